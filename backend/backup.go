@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/watchtower/web/database"
+	"github.com/watchtower/web/services"
+)
+
+// runBackup writes a snapshot of the SQLite database, which may be in use by
+// a running server
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", "", "file to write to (default watchtower-<time>.db in the current directory)")
+	flags.Parse(args)
+
+	// A backup only reads its source: it must not migrate a database an
+	// older server may be using, nor create one that isn't there
+	if cfg.Database.URL != "" {
+		return database.ErrBackupUnsupported
+	}
+	if _, err := os.Stat(cfg.Database.Path); err != nil {
+		return fmt.Errorf("no database to back up: %w", err)
+	}
+	if err := openDatabase(); err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer database.Close()
+
+	path := *output
+	if path == "" {
+		path = services.BackupFileName(time.Now())
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	if err := database.Backup(path); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up database to %s\n", path)
+	return nil
+}
+
+// runRestore replaces the SQLite database with a backup. The server must be
+// stopped.
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: watchtower restore <backup file>")
+		fmt.Fprintln(flags.Output(), "Stop the server first. The current database is kept with a .pre-restore suffix.")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if cfg.Database.URL != "" {
+		return errors.New("restore is only supported for SQLite; restore PostgreSQL with pg_restore or psql")
+	}
+	dbPath := cfg.Database.Path
+	version, err := database.Restore(flags.Arg(0), dbPath)
+	if err != nil {
+		return err
+	}
+
+	latest, err := database.LatestMigrationVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s from %s (schema version %d)\n", dbPath, flags.Arg(0), version)
+	if version < latest {
+		fmt.Printf("It will be migrated to version %d when the server starts\n", latest)
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+// Package config loads the server configuration: built-in defaults, then an
+// optional YAML file, then environment variables, which win.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is read when no file is given, if it exists
+const DefaultFile = "watchtower.yaml"
+
+// Config is the effective server configuration. Every setting can be
+// overridden by the environment variable in its env tag.
+type Config struct {
+	File string `yaml:"-" json:"file,omitempty"` // file it was loaded from, if any
+
+	Server    ServerConfig    `yaml:"server" json:"server"`
+	TLS       TLSConfig       `yaml:"tls" json:"tls"`
+	Database  DatabaseConfig  `yaml:"database" json:"database"`
+	Sessions  SessionsConfig  `yaml:"sessions" json:"sessions"`
+	Devices   DevicesConfig   `yaml:"devices" json:"devices"`
+	Push      PushConfig      `yaml:"push" json:"push"`
+	WebSocket WebSocketConfig `yaml:"websocket" json:"websocket"`
+	Backup    BackupConfig    `yaml:"backup" json:"backup"`
+	Metrics   MetricsConfig   `yaml:"metrics" json:"metrics"`
+	Log       LogConfig       `yaml:"log" json:"log"`
+}
+
+type ServerConfig struct {
+	Port      int    `yaml:"port" json:"port" env:"PORT"`
+	StaticDir string `yaml:"static_dir" json:"static_dir" env:"STATIC_DIR"` // admin UI served by serve -dev instead of the embedded one
+
+	// Addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is believed
+	TrustedProxies []string `yaml:"trusted_proxies" json:"trusted_proxies,omitempty" env:"TRUSTED_PROXIES"`
+}
+
+// TLSConfig turns on HTTPS, from certificate files or a local CA. Without
+// either the server speaks plain HTTP, for running behind a proxy.
+type TLSConfig struct {
+	CertFile string   `yaml:"cert_file" json:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile  string   `yaml:"key_file" json:"key_file" env:"TLS_KEY_FILE"`
+	LocalCA  bool     `yaml:"local_ca" json:"local_ca" env:"TLS_LOCAL_CA"`  // generate a CA and a server certificate it signs
+	Dir      string   `yaml:"dir" json:"dir" env:"TLS_DIR"`                 // where the local CA keeps its files
+	Hosts    []string `yaml:"hosts" json:"hosts,omitempty" env:"TLS_HOSTS"` // extra names and addresses for the local CA's server certificate
+}
+
+type DatabaseConfig struct {
+	Path string `yaml:"path" json:"path" env:"DB_PATH"`              // SQLite file
+	URL  string `yaml:"url" json:"url,omitempty" env:"DATABASE_URL"` // PostgreSQL, used instead of Path when set
+}
+
+type SessionsConfig struct {
+	Lifetime Duration `yaml:"lifetime" json:"lifetime" env:"SESSION_LIFETIME"`
+}
+
+type DevicesConfig struct {
+	// Devices without a heartbeat for this long are marked inactive
+	InactiveAfter Duration `yaml:"inactive_after" json:"inactive_after" env:"DEVICE_INACTIVE_AFTER"`
+}
+
+type PushConfig struct {
+	Subscriber string `yaml:"subscriber" json:"subscriber" env:"PUSH_SUBSCRIBER"` // VAPID contact, an email address or https URL
+	TTL        int    `yaml:"ttl" json:"ttl" env:"PUSH_TTL"`                      // seconds a push service keeps an undelivered notification
+}
+
+type WebSocketConfig struct {
+	Broker string `yaml:"broker" json:"broker" env:"WS_BROKER"` // "local" or "database"
+}
+
+type BackupConfig struct {
+	Dir      string   `yaml:"dir" json:"dir" env:"BACKUP_DIR"` // scheduled backups are off while empty
+	Interval Duration `yaml:"interval" json:"interval" env:"BACKUP_INTERVAL"`
+	Keep     int      `yaml:"keep" json:"keep" env:"BACKUP_KEEP"`
+}
+
+type MetricsConfig struct {
+	Token string `yaml:"token" json:"token,omitempty" env:"METRICS_TOKEN"` // bearer token /metrics requires; open when empty
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" json:"level" env:"LOG_LEVEL"`    // "debug", "info", "warn" or "error"
+	Format string `yaml:"format" json:"format" env:"LOG_FORMAT"` // "text" or "json"
+}
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		Server:    ServerConfig{Port: 8080, StaticDir: "./static"},
+		TLS:       TLSConfig{Dir: "./tls"},
+		Database:  DatabaseConfig{Path: "./watchtower.db"},
+		Sessions:  SessionsConfig{Lifetime: Duration(24 * time.Hour)},
+		Devices:   DevicesConfig{InactiveAfter: Duration(2 * time.Minute)},
+		Push:      PushConfig{Subscriber: "admin@watchtower.local", TTL: 60},
+		WebSocket: WebSocketConfig{Broker: "local"},
+		Backup:    BackupConfig{Interval: Duration(24 * time.Hour), Keep: 7},
+		Log:       LogConfig{Level: "info", Format: "text"},
+	}
+}
+
+// Load reads the configuration from a YAML file, or DefaultFile if path is
+// empty and it exists, applies environment overrides and validates the
+// result
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path == "" {
+		if _, err := os.Stat(DefaultFile); err == nil {
+			path = DefaultFile
+		}
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	// Misspelled settings are errors rather than silently ignored
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	c.File = path
+	return nil
+}
+
+// applyEnv sets every field whose env tag names a set variable
+func applyEnv(v reflect.Value) error {
+	var errs []error
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		// Empty variables count as unset, as they always have
+		name := t.Field(i).Tag.Get("env")
+		value := os.Getenv(name)
+		if name == "" || value == "" {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s=%q: %w", name, value, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func setField(field reflect.Value, value string) error {
+	if d, ok := field.Addr().Interface().(*Duration); ok {
+		return d.UnmarshalText([]byte(value))
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("not a whole number")
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("not true or false")
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		// Lists are comma-separated
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// Validate checks every setting and reports all problems at once
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(key, format string, args ...interface{}) {
+		problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		invalid("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if c.Server.StaticDir == "" {
+		invalid("server.static_dir", "must not be empty")
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, err := ParseProxy(proxy); err != nil {
+			invalid("server.trusted_proxies", "must be IP addresses or CIDR ranges, got %q", proxy)
+		}
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		invalid("tls.cert_file", "tls.cert_file and tls.key_file must be set together")
+	}
+	if c.TLS.LocalCA {
+		if c.TLS.CertFile != "" {
+			invalid("tls.local_ca", "can't be used with tls.cert_file; use one or the other")
+		}
+		if c.TLS.Dir == "" {
+			invalid("tls.dir", "must not be empty when tls.local_ca is on")
+		}
+	}
+
+	if c.Database.URL != "" {
+		u, err := url.Parse(c.Database.URL)
+		if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+			invalid("database.url", "must be a postgres:// URL")
+		}
+	} else if c.Database.Path == "" {
+		invalid("database.path", "must not be empty when database.url is not set")
+	}
+
+	if c.Sessions.Lifetime.Std() < time.Minute {
+		invalid("sessions.lifetime", "must be at least 1m, got %s", c.Sessions.Lifetime)
+	}
+	// Extensions ping about once a minute and the check runs every minute
+	if c.Devices.InactiveAfter.Std() < time.Minute {
+		invalid("devices.inactive_after", "must be at least 1m, got %s", c.Devices.InactiveAfter)
+	}
+
+	if s := c.Push.Subscriber; !strings.HasPrefix(s, "https://") && !strings.Contains(s, "@") {
+		invalid("push.subscriber", "must be an email address or https:// URL, got %q", s)
+	}
+	if c.Push.TTL < 0 || c.Push.TTL > 4*7*24*60*60 {
+		invalid("push.ttl", "must be between 0 and 2419200 seconds (4 weeks), got %d", c.Push.TTL)
+	}
+
+	if c.WebSocket.Broker != "local" && c.WebSocket.Broker != "database" {
+		invalid("websocket.broker", "must be \"local\" or \"database\", got %q", c.WebSocket.Broker)
+	}
+
+	if c.Backup.Dir != "" && c.Database.URL != "" {
+		invalid("backup.dir", "scheduled backups are only supported with SQLite; back up PostgreSQL with pg_dump")
+	}
+	if c.Backup.Interval.Std() < time.Minute {
+		invalid("backup.interval", "must be at least 1m, got %s", c.Backup.Interval)
+	}
+	if c.Backup.Keep < 1 {
+		invalid("backup.keep", "must be at least 1, got %d", c.Backup.Keep)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		invalid("log.level", "must be \"debug\", \"info\", \"warn\" or \"error\", got %q", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		invalid("log.format", "must be \"text\" or \"json\", got %q", c.Log.Format)
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// ParseProxy parses a trusted proxy, an IP address or a CIDR range
+func ParseProxy(proxy string) (netip.Prefix, error) {
+	if strings.Contains(proxy, "/") {
+		prefix, err := netip.ParsePrefix(proxy)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Redacted returns a copy that is safe to show: passwords in the database URL
+// and tokens are masked
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.Database.URL != "" {
+		redacted.Database.URL = redactURL(redacted.Database.URL)
+	}
+	if redacted.Metrics.Token != "" {
+		redacted.Metrics.Token = redactedValue
+	}
+	return &redacted
+}
+
+// redactedValue replaces secrets, like url.URL.Redacted does passwords
+const redactedValue = "xxxxx"
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "REDACTED"
+	}
+	query := u.Query()
+	if query.Has("password") {
+		query.Set("password", redactedValue)
+		u.RawQuery = query.Encode()
+	}
+	return u.Redacted()
+}
+
+// Duration is a time.Duration written like "24h" or "90s"
+type Duration time.Duration
+
+// Std returns d as a time.Duration
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalYAML points at the line of a bad duration in the config file
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	if err := d.UnmarshalText([]byte(node.Value)); err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	return nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("not a duration like 24h or 90s: %q", text)
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "watchtower.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFileAndEnv(t *testing.T) {
+	path := writeFile(t, `
+server:
+  port: 9090
+sessions:
+  lifetime: 8h
+push:
+  ttl: 120
+`)
+	t.Setenv("PUSH_TTL", "30")
+	t.Setenv("DEVICE_INACTIVE_AFTER", "5m")
+	t.Setenv("TLS_LOCAL_CA", "true")
+	t.Setenv("TLS_HOSTS", "watchtower.home, 192.168.1.10")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.File != path || cfg.Server.Port != 9090 || cfg.Sessions.Lifetime.Std() != 8*time.Hour {
+		t.Fatalf("file settings not applied: %+v", cfg)
+	}
+	// The environment wins over the file
+	if cfg.Push.TTL != 30 || cfg.Devices.InactiveAfter.Std() != 5*time.Minute {
+		t.Fatalf("env overrides not applied: %+v", cfg)
+	}
+	if !cfg.TLS.LocalCA || len(cfg.TLS.Hosts) != 2 || cfg.TLS.Hosts[1] != "192.168.1.10" {
+		t.Fatalf("TLS env overrides not applied: %+v", cfg.TLS)
+	}
+	// Everything else keeps its default
+	if cfg.Server.StaticDir != "./static" || cfg.Push.Subscriber != "admin@watchtower.local" {
+		t.Fatalf("defaults lost: %+v", cfg)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		wantErr []string
+	}{
+		{"unknown key", "server:\n  prot: 80\n", nil, []string{"prot"}},
+		{"bad duration", "sessions:\n  lifetime: 24\n", nil, []string{"line 2", "24h"}},
+		{"bad env", "", map[string]string{"PORT": "http"}, []string{"PORT"}},
+		{"half a key pair", "tls:\n  cert_file: server.crt\n", nil, []string{"tls.key_file"}},
+		{"bad trusted proxy", "", map[string]string{"TRUSTED_PROXIES": "10.0.0.1, proxy.lan"}, []string{"server.trusted_proxies", "proxy.lan"}},
+		{"bad log level", "log:\n  level: verbose\n", nil, []string{"log.level"}},
+		{
+			"every problem at once",
+			"server:\n  port: 70000\nwebsocket:\n  broker: redis\n",
+			map[string]string{"DATABASE_URL": "postgres://db/watchtower", "BACKUP_DIR": "/backups"},
+			[]string{"server.port", "websocket.broker", "backup.dir"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			_, err := Load(writeFile(t, tt.file))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %s", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := Default()
+	cfg.Database.URL = "postgres://db/watchtower?user=wt&password=s3cret"
+	if url := cfg.Redacted().Database.URL; strings.Contains(url, "s3cret") {
+		t.Fatalf("password not redacted: %s", url)
+	}
+
+	cfg.Metrics.Token = "scrape-secret"
+	if token := cfg.Redacted().Metrics.Token; token == "scrape-secret" {
+		t.Fatalf("metrics token not redacted")
+	}
+}
@@ -0,0 +1,236 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Backups are SQLite files copied with SQLite's online backup API, so they
+// are consistent snapshots even while the server is writing. PostgreSQL
+// databases are backed up with pg_dump instead.
+
+// ErrBackupUnsupported is returned for databases other than SQLite
+var ErrBackupUnsupported = errors.New("backups are only supported for SQLite; use pg_dump for PostgreSQL")
+
+// backupTimeout bounds how long a backup waits for writers to let go of
+// the database
+const backupTimeout = 30 * time.Second
+
+// Backup writes a snapshot of DB to destPath. The file only appears once the
+// snapshot is complete.
+func Backup(destPath string) error {
+	if Driver != SQLite {
+		return ErrBackupUnsupported
+	}
+
+	tmpPath := destPath + ".tmp"
+	os.Remove(tmpPath)
+	if err := backupTo(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// Backups hold password hashes and signing keys
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, destPath)
+}
+
+func backupTo(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	srcConn, err := DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			backup, err := destDriverConn.(*sqlite3.SQLiteConn).Backup("main", srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+
+			// Copy every page in one step so the snapshot is consistent.
+			// Step reports not done while another connection holds a
+			// lock, so retry until the writer is finished.
+			for {
+				done, err := backup.Step(-1)
+				if err != nil {
+					backup.Finish()
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				select {
+				case <-ctx.Done():
+					backup.Finish()
+					return fmt.Errorf("database stayed locked: %w", ctx.Err())
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+		})
+	})
+}
+
+// ValidateBackup checks that a file is an intact SQLite database at a schema
+// version this build has a migration for, and returns the version. Older
+// versions are migrated up when the server starts.
+func ValidateBackup(path string) (uint, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var integrity string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&integrity); err != nil {
+		return 0, fmt.Errorf("not a SQLite database: %w", err)
+	}
+	if integrity != "ok" {
+		return 0, fmt.Errorf("integrity check failed: %s", integrity)
+	}
+
+	var version uint
+	var dirty bool
+	if err := db.QueryRow("SELECT version, dirty FROM schema_migrations").Scan(&version, &dirty); err != nil {
+		return 0, fmt.Errorf("not a Watchtower database (no schema version): %w", err)
+	}
+	if dirty {
+		return 0, fmt.Errorf("schema version %d is dirty", version)
+	}
+
+	latest, err := LatestMigrationVersion()
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 || version > latest {
+		return 0, fmt.Errorf("schema version %d is not one this build knows (latest is %d)", version, latest)
+	}
+	return version, nil
+}
+
+// Restore replaces the SQLite database at dbPath with a validated backup.
+// The server must not be running. The replaced database and any journal
+// files are kept next to it with a .pre-restore suffix.
+func Restore(backupPath, dbPath string) (uint, error) {
+	version, err := ValidateBackup(backupPath)
+	if err != nil {
+		return 0, err
+	}
+
+	// Copy first so a failure leaves the current database alone
+	tmpPath := dbPath + ".restore"
+	if err := copyFile(backupPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	oldPath := dbPath + ".pre-restore"
+	if _, err := os.Stat(dbPath); err == nil {
+		// A server still using the database would go on writing to the
+		// replaced file, so hold it locked until the new one is in place
+		unlock, err := lockDatabase(dbPath)
+		if err != nil {
+			os.Remove(tmpPath)
+			return 0, fmt.Errorf("database is in use; stop the server before restoring: %w", err)
+		}
+		defer unlock()
+
+		if err := os.Rename(dbPath, oldPath); err != nil {
+			os.Remove(tmpPath)
+			return 0, err
+		}
+	}
+	// A journal left by the old database would be applied to the new one,
+	// so it moves along with the old database. One left from an earlier
+	// restore would be applied to the wrong file.
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if err := os.Remove(oldPath + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			os.Remove(tmpPath)
+			return 0, err
+		}
+		if err := os.Rename(dbPath+suffix, oldPath+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			os.Remove(tmpPath)
+			return 0, err
+		}
+	}
+
+	return version, os.Rename(tmpPath, dbPath)
+}
+
+// lockDatabase takes an exclusive lock on the SQLite database at path and
+// returns a function that releases it
+func lockDatabase(path string) (func(), error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=rw&_busy_timeout=1000")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN EXCLUSIVE"); err != nil {
+		conn.Close()
+		db.Close()
+		return nil, err
+	}
+
+	return func() {
+		conn.ExecContext(ctx, "ROLLBACK")
+		conn.Close()
+		db.Close()
+	}, nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
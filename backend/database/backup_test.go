@@ -0,0 +1,123 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newDatabase creates a migrated SQLite database at path holding one config
+// value, and leaves it open as DB
+func newDatabase(t *testing.T, path, value string) {
+	t.Helper()
+
+	if err := Initialize(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(Close)
+	if _, err := DB.Exec("INSERT INTO app_config (key, value) VALUES ('test', ?)", value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// configValue reads the config value newDatabase stored in the database at path
+func configValue(t *testing.T, path string) string {
+	t.Helper()
+
+	if err := Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	var value string
+	if err := DB.QueryRow("SELECT value FROM app_config WHERE key = 'test'").Scan(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "watchtower.db")
+	backupPath := filepath.Join(dir, "backup.db")
+
+	newDatabase(t, backupPath, "backup")
+	Close()
+	newDatabase(t, dbPath, "current")
+
+	// The database can't be replaced while someone is using it
+	tx, err := DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE app_config SET value = 'writing' WHERE key = 'test'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(backupPath, dbPath); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("restored a database in use: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	Close()
+	if _, err := os.Stat(dbPath + ".pre-restore"); !os.IsNotExist(err) {
+		t.Fatalf("database was moved aside: %v", err)
+	}
+
+	// A journal left by the old database moves along with it
+	if err := os.WriteFile(dbPath+"-wal", []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := LatestMigrationVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := Restore(backupPath, dbPath)
+	if err != nil || version != latest {
+		t.Fatalf("got version %d, %v", version, err)
+	}
+
+	if _, err := os.Stat(dbPath + "-wal"); !os.IsNotExist(err) {
+		t.Fatalf("journal left next to the restored database: %v", err)
+	}
+	if data, err := os.ReadFile(dbPath + ".pre-restore-wal"); err != nil || string(data) != "old" {
+		t.Fatalf("journal not kept with the old database: %q, %v", data, err)
+	}
+	if value := configValue(t, dbPath); value != "backup" {
+		t.Fatalf("restored database holds %q", value)
+	}
+	if value := configValue(t, dbPath+".pre-restore"); value != "current" {
+		t.Fatalf("old database holds %q", value)
+	}
+}
+
+func TestValidateBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.db")
+	newDatabase(t, path, "backup")
+
+	latest, err := LatestMigrationVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := ValidateBackup(path); err != nil || version != latest {
+		t.Fatalf("got version %d, %v", version, err)
+	}
+
+	// A backup from a newer build can't be migrated
+	if _, err := DB.Exec("UPDATE schema_migrations SET version = ?", latest+1); err != nil {
+		t.Fatal(err)
+	}
+	Close()
+	if _, err := ValidateBackup(path); err == nil || !strings.Contains(err.Error(), "not one this build knows") {
+		t.Fatalf("accepted a newer schema version: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("not a database"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateBackup(path); err == nil {
+		t.Fatal("accepted a file that isn't a database")
+	}
+}
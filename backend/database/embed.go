@@ -2,6 +2,9 @@ package database
 
 import "embed"
 
-//go:embed migrations/*.sql
+// Migrations holds one migration set per backend, in migrations/sqlite and
+// migrations/postgres. The sets are numbered alike so a schema version means
+// the same thing on both.
+//
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
 var Migrations embed.FS
-
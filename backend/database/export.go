@@ -0,0 +1,252 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An export is a JSON document with the schema version and the rows of every
+// table, which moves a server's data to another database, SQLite or
+// PostgreSQL. Sessions and the broker outbox are short-lived and left out.
+
+// exportTables are the exported tables, parents before children
+var exportTables = []string{
+	"users",
+	"devices",
+	"patterns",
+	"requests",
+	"push_subscriptions",
+	"app_config",
+	"device_enrollments",
+	"device_events",
+	"device_status_history",
+	"device_inventory_history",
+	"device_commands",
+	"pattern_changes",
+	"policy_bundles",
+}
+
+// Export is the document written by ExportJSON
+type Export struct {
+	SchemaVersion uint                                `json:"schema_version"`
+	ExportedAt    time.Time                           `json:"exported_at"`
+	Tables        map[string][]map[string]interface{} `json:"tables"`
+}
+
+// ExportJSON writes every exported table of DB to w
+func ExportJSON(w io.Writer) error {
+	version, dirty, err := GetMigrationVersion()
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("schema version %d is dirty", version)
+	}
+
+	export := Export{
+		SchemaVersion: version,
+		ExportedAt:    time.Now().UTC(),
+		Tables:        make(map[string][]map[string]interface{}),
+	}
+	for _, table := range exportTables {
+		rows, err := exportTable(table)
+		if err != nil {
+			return fmt.Errorf("export %s: %w", table, err)
+		}
+		export.Tables[table] = rows
+	}
+
+	return json.NewEncoder(w).Encode(export)
+}
+
+func exportTable(table string) ([]map[string]interface{}, error) {
+	rows, err := DB.Query("SELECT * FROM " + table + " ORDER BY 1")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		targets := make([]interface{}, len(columns))
+		for i := range values {
+			targets[i] = &values[i]
+		}
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[column] = values[i]
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// ImportJSON loads an export into DB, which must be empty and migrated to the
+// export's schema version. Rows keep their IDs.
+func ImportJSON(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var export Export
+	if err := decoder.Decode(&export); err != nil {
+		return fmt.Errorf("invalid export: %w", err)
+	}
+
+	version, dirty, err := GetMigrationVersion()
+	if err != nil {
+		return err
+	}
+	if dirty || version != export.SchemaVersion {
+		return fmt.Errorf("export is from schema version %d but the database is at version %d", export.SchemaVersion, version)
+	}
+
+	known := make(map[string]bool, len(exportTables))
+	for _, table := range exportTables {
+		known[table] = true
+	}
+	for table := range export.Tables {
+		if !known[table] {
+			return fmt.Errorf("export has unknown table %q", table)
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range exportTables {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return errors.New("database is not empty (table " + table + " has rows)")
+		}
+	}
+
+	for _, table := range exportTables {
+		if err := importTable(tx, table, export.Tables[table]); err != nil {
+			return fmt.Errorf("import %s: %w", table, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func importTable(tx *sql.Tx, table string, rows []map[string]interface{}) error {
+	columnTypes, err := tableColumnTypes(tx, table)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		columns := make([]string, 0, len(row))
+		for column := range row {
+			if _, ok := columnTypes[column]; !ok {
+				return fmt.Errorf("unknown column %q", column)
+			}
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+
+		placeholders := make([]string, len(columns))
+		args := make([]interface{}, len(columns))
+		for i, column := range columns {
+			placeholders[i] = placeholder(i + 1)
+			args[i], err = importValue(row[column], columnTypes[column])
+			if err != nil {
+				return fmt.Errorf("column %s: %w", column, err)
+			}
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO "+table+" ("+strings.Join(columns, ", ")+") VALUES ("+strings.Join(placeholders, ", ")+")",
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Carry on numbering after the imported IDs. SQLite does this by itself.
+	if Driver == Postgres {
+		if _, ok := columnTypes["id"]; ok {
+			_, err := tx.Exec("SELECT setval(pg_get_serial_sequence('" + table + "', 'id'), (SELECT COALESCE(MAX(id), 0) + 1 FROM " + table + "), false)")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tableColumnTypes returns the database type of every column of a table
+func tableColumnTypes(tx *sql.Tx, table string) (map[string]string, error) {
+	rows, err := tx.Query("SELECT * FROM " + table + " WHERE 1 = 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	columnTypes := make(map[string]string, len(types))
+	for _, t := range types {
+		columnTypes[t.Name()] = strings.ToUpper(t.DatabaseTypeName())
+	}
+	return columnTypes, nil
+}
+
+// importValue converts a decoded JSON value for a column of the given type
+func importValue(value interface{}, columnType string) (interface{}, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case string:
+		// Timestamps were exported in RFC 3339
+		if strings.Contains(columnType, "DATE") || strings.Contains(columnType, "TIME") {
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return t, nil
+			}
+		}
+		return v, nil
+	case nil, bool:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// placeholder returns the nth query placeholder for Driver
+func placeholder(n int) string {
+	if Driver == Postgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
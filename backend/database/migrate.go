@@ -0,0 +1,108 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+
+	"github.com/golang-migrate/migrate/v4"
+	migratedb "github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/database/sqlite3"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// newMigrate returns a migrate instance for DB with the migration set of
+// its driver
+func newMigrate() (*migrate.Migrate, error) {
+	var dir string
+	var dbDriver migratedb.Driver
+	var err error
+	switch Driver {
+	case SQLite:
+		dir = "migrations/sqlite"
+		dbDriver, err = sqlite3.WithInstance(DB, &sqlite3.Config{})
+	case Postgres:
+		dir = "migrations/postgres"
+		dbDriver, err = postgres.WithInstance(DB, &postgres.Config{})
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", Driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Create source driver from embedded migrations
+	sourceDriver, err := iofs.New(Migrations, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return migrate.NewWithInstance("iofs", sourceDriver, Driver, dbDriver)
+}
+
+func RunMigrations() error {
+	m, err := newMigrate()
+	if err != nil {
+		return err
+	}
+
+	// Run migrations
+	if err = m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	version, dirty, _ := m.Version()
+	slog.Info("Database migrations complete", "version", version, "dirty", dirty)
+
+	return nil
+}
+
+func MigrateDown() error {
+	m, err := newMigrate()
+	if err != nil {
+		return err
+	}
+
+	// Rollback one migration
+	return m.Steps(-1)
+}
+
+// GetMigrationVersion returns the schema version of DB and whether the last
+// migration failed halfway. The version is 0 before the first migration.
+func GetMigrationVersion() (uint, bool, error) {
+	m, err := newMigrate()
+	if err != nil {
+		return 0, false, err
+	}
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+// LatestMigrationVersion returns the schema version this build migrates to
+func LatestMigrationVersion() (uint, error) {
+	source, err := iofs.New(Migrations, "migrations/sqlite")
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	version, err := source.First()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		next, err := source.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version = next
+	}
+}
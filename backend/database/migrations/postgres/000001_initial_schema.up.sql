@@ -0,0 +1,51 @@
+-- Initial schema for Watchtower
+-- Creates all core tables
+
+-- SQLite's julianday(), so the models package can compare timestamps with
+-- the same queries on both backends
+CREATE OR REPLACE FUNCTION julianday(ts TIMESTAMPTZ) RETURNS DOUBLE PRECISION
+    LANGUAGE SQL IMMUTABLE
+    AS $$ SELECT EXTRACT(EPOCH FROM ts) / 86400.0 + 2440587.5 $$;
+
+CREATE TABLE IF NOT EXISTS users (
+    id BIGSERIAL PRIMARY KEY,
+    username TEXT UNIQUE NOT NULL,
+    password_hash TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS devices (
+    id BIGSERIAL PRIMARY KEY,
+    token TEXT UNIQUE NOT NULL,
+    name TEXT NOT NULL,
+    status TEXT CHECK(status IN ('active', 'inactive', 'uninstalled')) DEFAULT 'active',
+    last_seen TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS patterns (
+    id BIGSERIAL PRIMARY KEY,
+    device_id BIGINT NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    pattern TEXT NOT NULL,
+    type TEXT CHECK(type IN ('allow', 'deny')) NOT NULL,
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS requests (
+    id BIGSERIAL PRIMARY KEY,
+    device_id BIGINT NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    suggested_pattern TEXT,
+    status TEXT CHECK(status IN ('pending', 'approved', 'denied')) DEFAULT 'pending',
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
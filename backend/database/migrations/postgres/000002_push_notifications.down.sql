@@ -0,0 +1,7 @@
+-- Rollback push notification support
+
+DROP TABLE IF EXISTS push_subscriptions;
+DROP TABLE IF EXISTS app_config;
+
+ALTER TABLE users DROP COLUMN IF EXISTS notify_device_status;
+ALTER TABLE users DROP COLUMN IF EXISTS notify_new_requests;
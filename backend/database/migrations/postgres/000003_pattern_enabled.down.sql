@@ -0,0 +1 @@
+ALTER TABLE patterns DROP COLUMN IF EXISTS enabled;
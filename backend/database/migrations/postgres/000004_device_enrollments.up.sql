@@ -0,0 +1,11 @@
+-- Add one-time device enrollment codes
+
+-- Short-lived codes an extension can exchange for its device token
+CREATE TABLE IF NOT EXISTS device_enrollments (
+    id BIGSERIAL PRIMARY KEY,
+    device_id BIGINT NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    code TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,10 @@
+-- Rollback hashed device tokens
+-- Hashed tokens cannot be recovered; devices must be paired again.
+
+DROP INDEX IF EXISTS idx_devices_previous_token_prefix;
+DROP INDEX IF EXISTS idx_devices_token_prefix;
+
+ALTER TABLE devices DROP COLUMN IF EXISTS previous_token_expires_at;
+ALTER TABLE devices DROP COLUMN IF EXISTS previous_token_prefix;
+ALTER TABLE devices DROP COLUMN IF EXISTS previous_token;
+ALTER TABLE devices DROP COLUMN IF EXISTS token_prefix;
@@ -0,0 +1,6 @@
+-- Rollback device security events
+
+DROP INDEX IF EXISTS idx_device_events_device;
+DROP TABLE IF EXISTS device_events;
+
+ALTER TABLE users DROP COLUMN IF EXISTS notify_security_events;
@@ -0,0 +1,16 @@
+-- Add device status history for uptime reporting
+
+CREATE TABLE IF NOT EXISTS device_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    device_id BIGINT NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    status TEXT CHECK(status IN ('active', 'inactive', 'uninstalled')) NOT NULL,
+    previous_status TEXT,
+    reason TEXT,
+    changed_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_status_history_device ON device_status_history(device_id, changed_at);
+
+-- Seed the history with each device's current status
+INSERT INTO device_status_history (device_id, status, reason, changed_at)
+SELECT id, COALESCE(status, 'active'), 'initial', COALESCE(last_seen, created_at) FROM devices;
@@ -0,0 +1,12 @@
+-- Rollback device inventory metadata
+
+DROP INDEX IF EXISTS idx_device_inventory_history_device;
+DROP TABLE IF EXISTS device_inventory_history;
+
+ALTER TABLE devices DROP COLUMN IF EXISTS inventory_updated_at;
+ALTER TABLE devices DROP COLUMN IF EXISTS timezone;
+ALTER TABLE devices DROP COLUMN IF EXISTS profile_email;
+ALTER TABLE devices DROP COLUMN IF EXISTS os;
+ALTER TABLE devices DROP COLUMN IF EXISTS browser_version;
+ALTER TABLE devices DROP COLUMN IF EXISTS browser_name;
+ALTER TABLE devices DROP COLUMN IF EXISTS extension_version;
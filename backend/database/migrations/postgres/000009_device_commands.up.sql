@@ -0,0 +1,17 @@
+-- Add remote commands sent from admins to devices
+
+CREATE TABLE IF NOT EXISTS device_commands (
+    id BIGSERIAL PRIMARY KEY,
+    device_id BIGINT NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    type TEXT NOT NULL,
+    params TEXT, -- JSON object
+    status TEXT CHECK(status IN ('pending', 'delivered', 'acknowledged', 'failed', 'expired')) NOT NULL DEFAULT 'pending',
+    error TEXT,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    delivered_at TIMESTAMPTZ,
+    acknowledged_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_commands_device ON device_commands(device_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_device_commands_pending ON device_commands(device_id, status);
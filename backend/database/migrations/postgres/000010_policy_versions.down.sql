@@ -0,0 +1,6 @@
+-- Rollback policy versions
+
+DROP TABLE IF EXISTS pattern_changes;
+
+ALTER TABLE patterns DROP COLUMN IF EXISTS expiry_recorded;
+ALTER TABLE devices DROP COLUMN IF EXISTS policy_version;
@@ -0,0 +1,19 @@
+-- Add per-device policy versions and a pattern change log for incremental sync
+
+ALTER TABLE devices ADD COLUMN policy_version INTEGER NOT NULL DEFAULT 0;
+
+-- Set once the removal of an expired pattern has been logged
+ALTER TABLE patterns ADD COLUMN expiry_recorded INTEGER NOT NULL DEFAULT 0;
+UPDATE patterns SET expiry_recorded = 1 WHERE expires_at IS NOT NULL AND expires_at <= now();
+
+-- Changes to the set of patterns a device enforces, one per policy version
+CREATE TABLE IF NOT EXISTS pattern_changes (
+    id BIGSERIAL PRIMARY KEY,
+    device_id BIGINT NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    op TEXT CHECK(op IN ('add', 'update', 'remove')) NOT NULL,
+    pattern_id BIGINT NOT NULL,
+    pattern TEXT, -- JSON snapshot, NULL for removals
+    created_at TIMESTAMPTZ NOT NULL,
+    UNIQUE(device_id, version)
+);
@@ -0,0 +1,5 @@
+-- Rollback signed policy bundles
+
+DROP TABLE IF EXISTS policy_bundles;
+
+ALTER TABLE devices DROP COLUMN IF EXISTS reported_policy_hash;
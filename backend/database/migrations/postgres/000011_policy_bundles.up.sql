@@ -0,0 +1,15 @@
+-- Record signed policy bundles so devices reporting an unknown policy can be detected
+
+-- Policy hash from the device's last heartbeat
+ALTER TABLE devices ADD COLUMN reported_policy_hash TEXT;
+
+-- Policy hashes signed for each device
+CREATE TABLE IF NOT EXISTS policy_bundles (
+    id BIGSERIAL PRIMARY KEY,
+    device_id BIGINT NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    policy_hash TEXT NOT NULL,
+    issued_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    UNIQUE(device_id, policy_hash)
+);
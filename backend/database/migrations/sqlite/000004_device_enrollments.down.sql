@@ -0,0 +1,3 @@
+-- Rollback device enrollment codes
+
+DROP TABLE IF EXISTS device_enrollments;
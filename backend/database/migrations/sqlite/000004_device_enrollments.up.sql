@@ -0,0 +1,11 @@
+-- Add one-time device enrollment codes
+
+-- Short-lived codes an extension can exchange for its device token
+CREATE TABLE IF NOT EXISTS device_enrollments (
+    id INTEGER PRIMARY KEY,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    code TEXT UNIQUE NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
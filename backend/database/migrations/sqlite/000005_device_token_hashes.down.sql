@@ -0,0 +1,8 @@
+-- Rollback hashed device tokens
+
+DROP INDEX IF EXISTS idx_devices_previous_token_prefix;
+DROP INDEX IF EXISTS idx_devices_token_prefix;
+
+-- Note: SQLite doesn't support DROP COLUMN easily
+-- These columns will remain but be unused if rolled back.
+-- Hashed tokens cannot be recovered; devices must be paired again.
@@ -0,0 +1,13 @@
+-- Store device tokens hashed at rest
+-- devices.token now holds the SHA-256 hash of the token. Existing plaintext
+-- tokens (rows without a token_prefix) are hashed on startup.
+
+ALTER TABLE devices ADD COLUMN token_prefix TEXT;
+
+-- Previous token kept valid for a grace period after rotation
+ALTER TABLE devices ADD COLUMN previous_token TEXT;
+ALTER TABLE devices ADD COLUMN previous_token_prefix TEXT;
+ALTER TABLE devices ADD COLUMN previous_token_expires_at DATETIME;
+
+CREATE INDEX IF NOT EXISTS idx_devices_token_prefix ON devices(token_prefix);
+CREATE INDEX IF NOT EXISTS idx_devices_previous_token_prefix ON devices(previous_token_prefix);
@@ -0,0 +1,7 @@
+-- Rollback device security events
+
+DROP INDEX IF EXISTS idx_device_events_device;
+DROP TABLE IF EXISTS device_events;
+
+-- Note: SQLite doesn't support DROP COLUMN easily
+-- The notify_security_events column will remain but be unused if rolled back
@@ -0,0 +1,17 @@
+-- Add device security events (tamper and bypass reporting)
+
+CREATE TABLE IF NOT EXISTS device_events (
+    id INTEGER PRIMARY KEY,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    type TEXT NOT NULL,
+    severity TEXT CHECK(severity IN ('info', 'warning', 'critical')) DEFAULT 'info',
+    source TEXT CHECK(source IN ('device', 'server')) DEFAULT 'device',
+    details TEXT,
+    occurred_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_events_device ON device_events(device_id, created_at);
+
+-- Add security event notification preference to users
+ALTER TABLE users ADD COLUMN notify_security_events INTEGER DEFAULT 1;
@@ -0,0 +1,4 @@
+-- Rollback device status history
+
+DROP INDEX IF EXISTS idx_device_status_history_device;
+DROP TABLE IF EXISTS device_status_history;
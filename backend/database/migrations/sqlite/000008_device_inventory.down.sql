@@ -0,0 +1,7 @@
+-- Rollback device inventory metadata
+
+DROP INDEX IF EXISTS idx_device_inventory_history_device;
+DROP TABLE IF EXISTS device_inventory_history;
+
+-- Note: SQLite doesn't support DROP COLUMN easily
+-- The inventory columns on devices will remain but be unused if rolled back
@@ -0,0 +1,21 @@
+-- Add device inventory metadata reported by the extension
+
+ALTER TABLE devices ADD COLUMN extension_version TEXT;
+ALTER TABLE devices ADD COLUMN browser_name TEXT;
+ALTER TABLE devices ADD COLUMN browser_version TEXT;
+ALTER TABLE devices ADD COLUMN os TEXT;
+ALTER TABLE devices ADD COLUMN profile_email TEXT;
+ALTER TABLE devices ADD COLUMN timezone TEXT;
+ALTER TABLE devices ADD COLUMN inventory_updated_at DATETIME;
+
+-- Every change of an inventory field
+CREATE TABLE IF NOT EXISTS device_inventory_history (
+    id INTEGER PRIMARY KEY,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    field TEXT NOT NULL,
+    old_value TEXT,
+    new_value TEXT,
+    changed_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_inventory_history_device ON device_inventory_history(device_id, changed_at);
@@ -0,0 +1,5 @@
+-- Rollback remote device commands
+
+DROP INDEX IF EXISTS idx_device_commands_pending;
+DROP INDEX IF EXISTS idx_device_commands_device;
+DROP TABLE IF EXISTS device_commands;
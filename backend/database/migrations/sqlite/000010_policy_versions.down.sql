@@ -0,0 +1,6 @@
+-- Rollback policy versions
+
+DROP TABLE IF EXISTS pattern_changes;
+
+-- Note: SQLite doesn't support DROP COLUMN easily
+-- devices.policy_version and patterns.expiry_recorded will remain but be unused if rolled back
@@ -0,0 +1,6 @@
+-- Rollback signed policy bundles
+
+DROP TABLE IF EXISTS policy_bundles;
+
+-- Note: SQLite doesn't support DROP COLUMN easily
+-- devices.reported_policy_hash will remain but be unused if rolled back
@@ -0,0 +1,4 @@
+-- Rollback the broker outbox
+
+DROP INDEX IF EXISTS idx_broker_events_created_at;
+DROP TABLE IF EXISTS broker_events;
@@ -0,0 +1,15 @@
+-- Outbox for WebSocket messages shared between server instances
+
+-- Each instance appends the messages it sends and polls for the ones other
+-- instances appended, so devices get them whichever instance they are
+-- connected to. Rows are pruned after a few minutes.
+CREATE TABLE IF NOT EXISTS broker_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    instance_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    device_id INTEGER NOT NULL DEFAULT 0,
+    data TEXT,
+    created_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_broker_events_created_at ON broker_events(created_at);
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"database/sql"
+	"log/slog"
+
+	_ "github.com/lib/pq"
+)
+
+// InitializePostgres connects to the PostgreSQL database at a
+// postgres:// URL and migrates it
+func InitializePostgres(databaseURL string) error {
+	if err := OpenPostgres(databaseURL); err != nil {
+		return err
+	}
+
+	if err := RunMigrations(); err != nil {
+		return err
+	}
+
+	slog.Info("Database initialized", "driver", "postgres")
+	return nil
+}
+
+// OpenPostgres connects to the PostgreSQL database at databaseURL without
+// migrating it
+func OpenPostgres(databaseURL string) error {
+	var err error
+	DB, err = sql.Open("postgres", databaseURL)
+	if err != nil {
+		return err
+	}
+	Driver = Postgres
+
+	return DB.Ping()
+}
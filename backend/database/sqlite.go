@@ -2,109 +2,45 @@ package database
 
 import (
 	"database/sql"
-	"errors"
-	"io/fs"
-	"log"
+	"log/slog"
 
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/sqlite3"
-	"github.com/golang-migrate/migrate/v4/source/iofs"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var DB *sql.DB
-
-func Initialize(dbPath string) error {
-	var err error
-	DB, err = sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
-	if err != nil {
-		return err
-	}
-
-	if err = DB.Ping(); err != nil {
-		return err
-	}
-
-	if err = RunMigrations(); err != nil {
-		return err
-	}
-
-	log.Println("Database initialized successfully")
-	return nil
-}
-
-func RunMigrations() error {
-	// Create source driver from embedded migrations
-	sourceDriver, err := iofs.New(Migrations, "migrations")
-	if err != nil {
-		return err
-	}
+// Supported values of Driver
+const (
+	SQLite   = "sqlite3"
+	Postgres = "postgres"
+)
 
-	// Create database driver
-	dbDriver, err := sqlite3.WithInstance(DB, &sqlite3.Config{})
-	if err != nil {
-		return err
-	}
+var (
+	DB     *sql.DB
+	Driver string
+)
 
-	// Create migrate instance
-	m, err := migrate.NewWithInstance("iofs", sourceDriver, "sqlite3", dbDriver)
-	if err != nil {
+func Initialize(dbPath string) error {
+	if err := Open(dbPath); err != nil {
 		return err
 	}
 
-	// Run migrations
-	if err = m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+	if err := RunMigrations(); err != nil {
 		return err
 	}
 
-	version, dirty, _ := m.Version()
-	log.Printf("Database migrations complete (version: %d, dirty: %v)", version, dirty)
-
+	slog.Info("Database initialized", "driver", "sqlite")
 	return nil
 }
 
-func MigrateDown() error {
-	// Create source driver from embedded migrations
-	sourceDriver, err := iofs.New(Migrations, "migrations")
-	if err != nil {
-		return err
-	}
-
-	// Create database driver
-	dbDriver, err := sqlite3.WithInstance(DB, &sqlite3.Config{})
-	if err != nil {
-		return err
-	}
-
-	// Create migrate instance
-	m, err := migrate.NewWithInstance("iofs", sourceDriver, "sqlite3", dbDriver)
+// Open connects to the SQLite database at dbPath without migrating it
+func Open(dbPath string) error {
+	var err error
+	DB, err = sql.Open("sqlite3", dbPath+"?_foreign_keys=on&_txlock=immediate")
 	if err != nil {
 		return err
 	}
+	Driver = SQLite
 
-	// Rollback one migration
-	return m.Steps(-1)
-}
-
-func GetMigrationVersion() (uint, bool, error) {
-	// Helper to check current migration state
-	var migrationsFS fs.FS = Migrations
-	sourceDriver, err := iofs.New(migrationsFS, "migrations")
-	if err != nil {
-		return 0, false, err
-	}
-
-	dbDriver, err := sqlite3.WithInstance(DB, &sqlite3.Config{})
-	if err != nil {
-		return 0, false, err
-	}
-
-	m, err := migrate.NewWithInstance("iofs", sourceDriver, "sqlite3", dbDriver)
-	if err != nil {
-		return 0, false, err
-	}
-
-	return m.Version()
+	return DB.Ping()
 }
 
 func Close() {
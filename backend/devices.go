@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/watchtower/web/database"
+)
+
+// runDevice creates devices, lists them and rotates their tokens
+func runDevice(args []string) error {
+	action, args, err := subcommand(args, "device create|list|rotate-token")
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("device "+action, flag.ExitOnError)
+	grace := flags.Duration("grace", 0, "rotate-token: how long the old token keeps working")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: watchtower device create <name>")
+		fmt.Fprintln(flags.Output(), "       watchtower device list")
+		fmt.Fprintln(flags.Output(), "       watchtower device rotate-token [-grace 24h] <id>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	switch action {
+	case "create":
+		if flags.NArg() != 1 || flags.Arg(0) == "" {
+			flags.Usage()
+			os.Exit(2)
+		}
+		device, err := store.Devices.Create(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created device %s (ID %d)\nToken: %s\n", device.Name, device.ID, device.Token)
+		return nil
+
+	case "list":
+		devices, err := store.Devices.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSTATUS\tLAST SEEN\tTOKEN PREFIX")
+		for _, d := range devices {
+			lastSeen := "never"
+			if d.LastSeen != nil {
+				lastSeen = d.LastSeen.Local().Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", d.ID, d.Name, d.Status, lastSeen, d.TokenPrefix)
+		}
+		return w.Flush()
+
+	case "rotate-token":
+		if flags.NArg() != 1 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		id, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid device ID %q", flags.Arg(0))
+		}
+		if _, err := store.Devices.GetByID(id); err != nil {
+			return fmt.Errorf("device %d not found", id)
+		}
+
+		device, err := store.Devices.RegenerateToken(id, *grace)
+		if err != nil {
+			return err
+		}
+		// The server isn't told, so connected extensions don't get the new
+		// token pushed; enter it in the extension or pair it again
+		fmt.Printf("New token for %s (ID %d): %s\n", device.Name, device.ID, device.Token)
+		if *grace > 0 {
+			fmt.Printf("The old token keeps working until %s\n", time.Now().Add(*grace).Format(time.RFC3339))
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown action %q (expected create, list or rotate-token)", action)
+	}
+}
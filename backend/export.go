@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/watchtower/web/database"
+)
+
+// runExport writes all data in the database as JSON
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("o", "", "file to write to (default stdout)")
+	flags.Parse(args)
+
+	if _, err := openStore(); err != nil {
+		return err
+	}
+	defer database.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return database.ExportJSON(w)
+}
+
+// runImport loads an export into an empty database
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: watchtower import [file]")
+		fmt.Fprintln(flags.Output(), "Reads the export from stdin without a file. The database must be empty.")
+	}
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var r io.Reader = os.Stdin
+	if flags.NArg() == 1 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if _, err := openStore(); err != nil {
+		return err
+	}
+	defer database.Close()
+
+	if err := database.ImportJSON(r); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Import complete")
+	return nil
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	"github.com/watchtower/web/logging"
+	"github.com/watchtower/web/middleware"
+	"github.com/watchtower/web/websocket"
+)
+
+// Admin dashboards only receive events, so their messages are kept small
+const maxAdminMessageSize = 512
+
+// The admin stream authenticates with the session cookie, so unlike the
+// device socket it only accepts connections from the dashboard's own origin
+var adminUpgrader = ws.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// HandleAdminWebSocket streams admin events (new and resolved requests,
+// device status changes and pattern changes) to the dashboard (admin API)
+func HandleAdminWebSocket(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r)
+	session := middleware.GetSessionFromContext(r)
+	if user == nil || session == nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	if websocket.DefaultHub == nil {
+		http.Error(w, "Event stream not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := adminUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Admin WebSocket upgrade failed", "err", err)
+		return
+	}
+
+	client := &websocket.Client{
+		Hub:          websocket.DefaultHub,
+		Conn:         conn,
+		Send:         make(chan []byte, websocket.SendBufferSize),
+		ConnectedAt:  time.Now().UTC(),
+		RemoteAddr:   middleware.ClientAddr(r),
+		RequestID:    logging.RequestID(r.Context()),
+		UserID:       user.ID,
+		SessionToken: session.Token,
+	}
+
+	websocket.DefaultHub.Register(client)
+
+	go writePump(client)
+	go adminReadPump(client)
+}
+
+// adminReadPump discards messages from the dashboard and closes the
+// connection once its session has ended
+func adminReadPump(client *websocket.Client) {
+	defer func() {
+		websocket.DefaultHub.Unregister(client)
+		client.Conn.Close()
+	}()
+
+	ctx := client.Context()
+	client.Conn.SetReadLimit(maxAdminMessageSize)
+	client.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	client.Conn.SetPongHandler(func(string) error {
+		// A logged out or expired session ends the stream
+		if _, err := store.WithContext(ctx).Sessions.GetByToken(client.SessionToken); err != nil {
+			return err
+		}
+		client.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		if _, _, err := client.Conn.ReadMessage(); err != nil {
+			if ws.IsUnexpectedCloseError(err, ws.CloseGoingAway, ws.CloseAbnormalClosure) {
+				slog.WarnContext(ctx, "Admin WebSocket error", "user_id", client.UserID, "err", err)
+			}
+			break
+		}
+	}
+}
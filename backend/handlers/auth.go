@@ -6,7 +6,6 @@ import (
 	"time"
 
 	"github.com/watchtower/web/middleware"
-	"github.com/watchtower/web/models"
 )
 
 type LoginRequest struct {
@@ -26,7 +25,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := models.GetUserByUsername(req.Username)
+	user, err := store.WithContext(r.Context()).Users.GetByUsername(req.Username)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
@@ -41,7 +40,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, err := models.CreateSession(user.ID)
+	session, err := store.WithContext(r.Context()).Sessions.Create(user.ID)
 	if err != nil {
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
@@ -53,6 +52,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		Path:     "/",
 		Expires:  session.ExpiresAt,
 		HttpOnly: true,
+		Secure:   r.TLS != nil,
 		SameSite: http.SameSiteLaxMode,
 	})
 
@@ -63,7 +63,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 func Logout(w http.ResponseWriter, r *http.Request) {
 	session := middleware.GetSessionFromContext(r)
 	if session != nil {
-		models.DeleteSession(session.Token)
+		store.WithContext(r.Context()).Sessions.Delete(session.Token)
 	}
 
 	http.SetCookie(w, &http.Cookie{
@@ -80,7 +80,7 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 
 // CheckSetupNeeded returns whether first-time setup is needed
 func CheckSetupNeeded(w http.ResponseWriter, r *http.Request) {
-	needsSetup, err := models.NeedsSetup()
+	needsSetup, err := store.WithContext(r.Context()).NeedsSetup()
 	if err != nil {
 		http.Error(w, "Failed to check setup status", http.StatusInternalServerError)
 		return
@@ -99,7 +99,7 @@ type SetupRequest struct {
 // SetupFirstUser creates the first admin user (only works when no users exist)
 func SetupFirstUser(w http.ResponseWriter, r *http.Request) {
 	// Check if setup is still needed
-	needsSetup, err := models.NeedsSetup()
+	needsSetup, err := store.WithContext(r.Context()).NeedsSetup()
 	if err != nil {
 		http.Error(w, "Failed to check setup status", http.StatusInternalServerError)
 		return
@@ -141,7 +141,7 @@ func SetupFirstUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create the first user
-	_, err = models.CreateUser(req.Username, req.Password)
+	_, err = store.WithContext(r.Context()).Users.Create(req.Username, req.Password)
 	if err != nil {
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
@@ -187,7 +187,7 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get current user
-	user, err := models.GetUserByID(session.UserID)
+	user, err := store.WithContext(r.Context()).Users.GetByID(session.UserID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -202,7 +202,7 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update password
-	if err := models.UpdateUserPassword(session.UserID, req.NewPassword); err != nil {
+	if err := store.WithContext(r.Context()).Users.UpdatePassword(session.UserID, req.NewPassword); err != nil {
 		http.Error(w, "Failed to update password", http.StatusInternalServerError)
 		return
 	}
@@ -210,4 +210,3 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
-
@@ -0,0 +1,74 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSetupOnlyOnce(t *testing.T) {
+	ts := newTestServer(t)
+
+	var status map[string]bool
+	ts.expect("GET", "/api/setup/status", nil, http.StatusOK, &status)
+	if !status["setup_needed"] {
+		t.Fatalf("setup not needed on an empty store")
+	}
+
+	ts.expect("POST", "/api/setup/create-user", map[string]string{
+		"username": "admin", "password": "short", "confirm_password": "short",
+	}, http.StatusBadRequest, nil)
+	ts.expect("POST", "/api/setup/create-user", map[string]string{
+		"username": "admin", "password": "password1", "confirm_password": "password2",
+	}, http.StatusBadRequest, nil)
+	ts.expect("POST", "/api/setup/create-user", map[string]string{
+		"username": "admin", "password": "password1", "confirm_password": "password1",
+	}, http.StatusOK, nil)
+
+	ts.expect("GET", "/api/setup/status", nil, http.StatusOK, &status)
+	if status["setup_needed"] {
+		t.Fatalf("setup still needed after the first user was created")
+	}
+
+	ts.expect("POST", "/api/setup/create-user", map[string]string{
+		"username": "other", "password": "password1", "confirm_password": "password1",
+	}, http.StatusForbidden, nil)
+}
+
+func TestLogin(t *testing.T) {
+	ts := newAdminServer(t)
+
+	ts.expect("POST", "/api/auth/login", map[string]string{"username": testUsername, "password": "wrong"}, http.StatusUnauthorized, nil)
+	ts.expect("POST", "/api/auth/login", map[string]string{"username": "nobody", "password": testPassword}, http.StatusUnauthorized, nil)
+
+	// The session from newAdminServer is still valid
+	ts.expect("GET", "/api/admin/users", nil, http.StatusOK, nil)
+}
+
+func TestAdminRoutesRequireSession(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+	ts.expect("GET", "/api/admin/devices", nil, http.StatusOK, nil)
+
+	ts.expect("POST", "/api/auth/logout", nil, http.StatusOK, nil)
+	ts.expect("GET", "/api/admin/devices", nil, http.StatusUnauthorized, nil)
+
+	// A device token is no admin credential
+	ts.expectWithHeader("GET", "/api/admin/devices", nil, bearer(device.Token), http.StatusUnauthorized, nil)
+}
+
+func TestChangePassword(t *testing.T) {
+	ts := newAdminServer(t)
+
+	ts.expect("POST", "/api/auth/change-password", map[string]string{
+		"current_password": "wrong", "new_password": "password2", "confirm_password": "password2",
+	}, http.StatusUnauthorized, nil)
+	ts.expect("POST", "/api/auth/change-password", map[string]string{
+		"current_password": testPassword, "new_password": "short", "confirm_password": "short",
+	}, http.StatusBadRequest, nil)
+	ts.expect("POST", "/api/auth/change-password", map[string]string{
+		"current_password": testPassword, "new_password": "password2", "confirm_password": "password2",
+	}, http.StatusOK, nil)
+
+	ts.expect("POST", "/api/auth/login", map[string]string{"username": testUsername, "password": testPassword}, http.StatusUnauthorized, nil)
+	ts.login(testUsername, "password2")
+}
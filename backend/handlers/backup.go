@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/watchtower/web/database"
+	"github.com/watchtower/web/services"
+)
+
+// DownloadBackup sends a consistent snapshot of the SQLite database as a
+// file download (admin API)
+func DownloadBackup(w http.ResponseWriter, r *http.Request) {
+	dir, err := os.MkdirTemp("", "watchtower-backup-")
+	if err != nil {
+		http.Error(w, "Failed to create backup", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	name := services.BackupFileName(time.Now())
+	path := filepath.Join(dir, name)
+	if err := database.Backup(path); err != nil {
+		if errors.Is(err, database.ErrBackupUnsupported) {
+			http.Error(w, "Backups are only supported for SQLite", http.StatusNotImplemented)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to back up database", "err", err)
+		http.Error(w, "Failed to create backup", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Failed to create backup", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, name, time.Now(), f)
+}
@@ -0,0 +1,49 @@
+package handlers_test
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/watchtower/web/database"
+)
+
+func TestDownloadBackup(t *testing.T) {
+	ts := newAdminServer(t)
+	ts.createDevice("laptop")
+
+	// Only SQLite has an online backup
+	if database.Driver != database.SQLite {
+		ts.expect("GET", "/api/admin/backup", nil, http.StatusNotImplemented, nil)
+		return
+	}
+
+	resp := ts.request("GET", "/api/admin/backup", nil, nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+	if disposition := resp.Header.Get("Content-Disposition"); !strings.Contains(disposition, "watchtower-") {
+		t.Fatalf("unexpected Content-Disposition %q", disposition)
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := database.ValidateBackup(path)
+	if err != nil {
+		t.Fatalf("downloaded backup is invalid: %v", err)
+	}
+	if latest, _ := database.LatestMigrationVersion(); version != latest {
+		t.Fatalf("backup is at schema version %d, want %d", version, latest)
+	}
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/websocket"
+)
+
+const (
+	// Commands not delivered and answered within this time expire
+	defaultCommandTTL = time.Hour
+	maxCommandTTL     = 24 * time.Hour
+
+	maxCommandMessageLength = 500
+	maxLockMinutes          = 24 * 60
+)
+
+// CommandParams holds the parameters of all command types
+type CommandParams struct {
+	Title   string `json:"title,omitempty"`   // show_message
+	Message string `json:"message,omitempty"` // show_message
+	Pattern string `json:"pattern,omitempty"` // close_tabs
+	Minutes int    `json:"minutes,omitempty"` // lock
+}
+
+type SendCommandRequest struct {
+	Type       string        `json:"type"` // "resync", "show_message", "close_tabs", "lock"
+	Params     CommandParams `json:"params"`
+	TTLMinutes int           `json:"ttl_minutes,omitempty"`
+}
+
+type DeviceCommandsResponse struct {
+	Commands []models.DeviceCommand `json:"commands"`
+}
+
+// CommandAck is sent by the extension after it ran a command
+type CommandAck struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"` // "ok" or "error"
+	Error  string `json:"error,omitempty"`
+}
+
+// validateCommand checks the parameters of a command and drops the ones its type doesn't use
+func validateCommand(commandType string, params CommandParams) (CommandParams, string) {
+	switch commandType {
+	case "resync":
+		return CommandParams{}, ""
+	case "show_message":
+		params.Title = strings.TrimSpace(params.Title)
+		params.Message = strings.TrimSpace(params.Message)
+		if params.Message == "" {
+			return params, "Message is required"
+		}
+		if len(params.Title) > maxCommandMessageLength || len(params.Message) > maxCommandMessageLength {
+			return params, "Message too long"
+		}
+		return CommandParams{Title: params.Title, Message: params.Message}, ""
+	case "close_tabs":
+		params.Pattern = strings.TrimSpace(params.Pattern)
+		if params.Pattern == "" {
+			return params, "Pattern is required"
+		}
+		return CommandParams{Pattern: params.Pattern}, ""
+	case "lock":
+		if params.Minutes <= 0 || params.Minutes > maxLockMinutes {
+			return params, "Minutes must be between 1 and 1440"
+		}
+		return CommandParams{Minutes: params.Minutes}, ""
+	default:
+		return params, "Unknown command type"
+	}
+}
+
+// SendDeviceCommand queues a command for a device and delivers it right away
+// if the device is connected (admin API)
+func SendDeviceCommand(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	var req SendCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	params, problem := validateCommand(req.Type, req.Params)
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	ttl := defaultCommandTTL
+	if req.TTLMinutes != 0 {
+		ttl = time.Duration(req.TTLMinutes) * time.Minute
+		if ttl <= 0 || ttl > maxCommandTTL {
+			http.Error(w, "Invalid TTL", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := store.WithContext(r.Context()).Devices.GetByID(id); err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var encodedParams json.RawMessage
+	if params != (CommandParams{}) {
+		encodedParams, _ = json.Marshal(params)
+	}
+
+	command, err := store.WithContext(r.Context()).Commands.Create(id, req.Type, encodedParams, ttl)
+	if err != nil {
+		http.Error(w, "Failed to create command", http.StatusInternalServerError)
+		return
+	}
+
+	// A device connected to another instance gets it from there
+	if !deliverCommand(r.Context(), command) && websocket.DefaultHub != nil {
+		websocket.DefaultHub.PublishPendingCommands(id)
+	}
+
+	if updated, err := store.WithContext(r.Context()).Commands.GetByID(command.ID); err == nil {
+		command = updated
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(command)
+}
+
+// ListDeviceCommands returns the recent commands of a device with their status (admin API)
+func ListDeviceCommands(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultEventsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxEventsLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	commands, err := store.WithContext(r.Context()).Commands.List(id, limit)
+	if err != nil {
+		http.Error(w, "Failed to get commands", http.StatusInternalServerError)
+		return
+	}
+
+	if commands == nil {
+		commands = []models.DeviceCommand{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeviceCommandsResponse{Commands: commands})
+}
+
+// GetDeviceCommand returns a single command with its delivery and ack status (admin API)
+func GetDeviceCommand(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid command ID", http.StatusBadRequest)
+		return
+	}
+
+	command, err := store.WithContext(r.Context()).Commands.GetByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Command not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to get command", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(command)
+}
+
+// deliverCommand sends a command to the device's connections on this
+// instance and marks it delivered if at least one connection took it
+func deliverCommand(ctx context.Context, command *models.DeviceCommand) bool {
+	if websocket.DefaultHub == nil {
+		return false
+	}
+
+	message := websocket.Message{
+		Type: "command",
+		Data: map[string]interface{}{
+			"id":     command.ID,
+			"type":   command.Type,
+			"params": command.Params,
+		},
+	}
+
+	if websocket.DefaultHub.SendToLocalDevice(command.DeviceID, message) == 0 {
+		return false
+	}
+
+	if err := store.WithContext(ctx).Commands.MarkDelivered(command.ID); err != nil {
+		slog.ErrorContext(ctx, "Failed to mark command delivered", "command_id", command.ID, "err", err)
+	}
+	return true
+}
+
+// deliverPendingCommands sends a newly connected device the commands queued
+// while it was offline, and again the ones it never acknowledged: they may
+// have been lost with the previous connection before they were written. The
+// extension remembers the commands it ran and only acknowledges those again.
+func deliverPendingCommands(ctx context.Context, deviceID int64) {
+	commands, err := store.WithContext(ctx).Commands.ListUnacknowledged(deviceID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get pending commands", "device_id", deviceID, "err", err)
+		return
+	}
+
+	for i := range commands {
+		deliverCommand(ctx, &commands[i])
+	}
+}
+
+// DeliverQueuedCommands sends a device's connections on this instance the
+// commands another instance queued for it
+func DeliverQueuedCommands(ctx context.Context, deviceID int64) {
+	commands, err := store.WithContext(ctx).Commands.ListPending(deviceID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get pending commands", "device_id", deviceID, "err", err)
+		return
+	}
+
+	for i := range commands {
+		deliverCommand(ctx, &commands[i])
+	}
+}
+
+// acknowledgeCommand records a command acknowledgement received over WebSocket
+func acknowledgeCommand(ctx context.Context, deviceID int64, ack CommandAck) error {
+	if ack.Status != "ok" && ack.Status != "error" {
+		return badRequest("invalid_status", "Status must be ok or error")
+	}
+
+	if len(ack.Error) > maxCommandMessageLength {
+		ack.Error = ack.Error[:maxCommandMessageLength]
+	}
+
+	err := store.WithContext(ctx).Commands.Acknowledge(ack.ID, deviceID, ack.Status == "ok", ack.Error)
+	if err == sql.ErrNoRows {
+		return &apiError{Status: http.StatusNotFound, Code: "command_not_found", Message: "Unknown or finished command"}
+	}
+	return err
+}
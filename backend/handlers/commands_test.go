@@ -0,0 +1,76 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/watchtower/web/handlers"
+	"github.com/watchtower/web/models"
+)
+
+func TestSendDeviceCommand(t *testing.T) {
+	ts := newAdminServer(t)
+	ts.createDevice("laptop")
+
+	for _, req := range []handlers.SendCommandRequest{
+		{Type: "reboot"},
+		{Type: "show_message"},
+		{Type: "lock", Params: handlers.CommandParams{Minutes: 0}},
+		{Type: "resync", TTLMinutes: -1},
+	} {
+		ts.expect("POST", "/api/admin/devices/1/commands", req, http.StatusBadRequest, nil)
+	}
+	ts.expect("POST", "/api/admin/devices/2/commands", handlers.SendCommandRequest{Type: "resync"}, http.StatusNotFound, nil)
+
+	// The device is offline, so the command waits
+	var command models.DeviceCommand
+	ts.expect("POST", "/api/admin/devices/1/commands", handlers.SendCommandRequest{
+		Type:   "show_message",
+		Params: handlers.CommandParams{Message: "Time for dinner", Pattern: "dropped"},
+	}, http.StatusCreated, &command)
+	if command.Status != "pending" || string(command.Params) != `{"message":"Time for dinner"}` {
+		t.Fatalf("unexpected command %+v", command)
+	}
+
+	var fetched models.DeviceCommand
+	ts.expect("GET", "/api/admin/commands/1", nil, http.StatusOK, &fetched)
+	if fetched.ID != command.ID || fetched.Type != "show_message" {
+		t.Fatalf("unexpected command %+v", fetched)
+	}
+	ts.expect("GET", "/api/admin/commands/2", nil, http.StatusNotFound, nil)
+
+	ts.expect("POST", "/api/admin/devices/1/commands", handlers.SendCommandRequest{Type: "resync"}, http.StatusCreated, nil)
+
+	var commands handlers.DeviceCommandsResponse
+	ts.expect("GET", "/api/admin/devices/1/commands", nil, http.StatusOK, &commands)
+	if len(commands.Commands) != 2 || commands.Commands[0].Type != "resync" {
+		t.Fatalf("unexpected command list %+v", commands.Commands)
+	}
+}
+
+func TestUnacknowledgedCommands(t *testing.T) {
+	ts := newAdminServer(t)
+	ts.createDevice("laptop")
+
+	ts.expect("POST", "/api/admin/devices/1/commands", handlers.SendCommandRequest{Type: "resync"}, http.StatusCreated, nil)
+	ts.expect("POST", "/api/admin/devices/1/commands", handlers.SendCommandRequest{Type: "resync"}, http.StatusCreated, nil)
+	ts.expect("POST", "/api/admin/devices/1/commands", handlers.SendCommandRequest{Type: "resync"}, http.StatusCreated, nil)
+
+	// A delivered command may not have been written before the connection
+	// dropped, so it is sent again until the device answers it
+	if err := ts.store.Commands.MarkDelivered(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.store.Commands.Acknowledge(3, 1, true, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := ts.store.Commands.ListPending(1)
+	if err != nil || len(pending) != 1 || pending[0].ID != 2 {
+		t.Fatalf("got pending commands %+v, %v", pending, err)
+	}
+	unacknowledged, err := ts.store.Commands.ListUnacknowledged(1)
+	if err != nil || len(unacknowledged) != 2 || unacknowledged[0].ID != 1 || unacknowledged[1].ID != 2 {
+		t.Fatalf("got unacknowledged commands %+v, %v", unacknowledged, err)
+	}
+}
@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/watchtower/web/config"
+)
+
+// serverConfig is the configuration the server was started with
+var serverConfig = config.Default()
+
+// SetConfig sets the configuration shown by GetConfig
+func SetConfig(c *config.Config) {
+	serverConfig = c
+}
+
+// GetConfig returns the effective configuration with secrets redacted
+// (admin API)
+func GetConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serverConfig.Redacted())
+}
@@ -0,0 +1,45 @@
+package handlers_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/watchtower/web/config"
+	"github.com/watchtower/web/handlers"
+)
+
+func TestGetConfig(t *testing.T) {
+	ts := newAdminServer(t)
+
+	cfg := config.Default()
+	cfg.Database.URL = "postgres://watchtower:s3cret@db:5432/watchtower?sslmode=disable"
+	cfg.Push.TTL = 300
+	handlers.SetConfig(cfg)
+	t.Cleanup(func() { handlers.SetConfig(config.Default()) })
+
+	resp := ts.request("GET", "/api/admin/config", nil, nil)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+	if strings.Contains(string(body), "s3cret") {
+		t.Fatalf("config leaks the database password: %s", body)
+	}
+
+	var shown config.Config
+	ts.expect("GET", "/api/admin/config", nil, http.StatusOK, &shown)
+	if shown.Database.URL != "postgres://watchtower:xxxxx@db:5432/watchtower?sslmode=disable" {
+		t.Fatalf("unexpected database URL %q", shown.Database.URL)
+	}
+	if shown.Push.TTL != 300 || shown.Sessions.Lifetime != cfg.Sessions.Lifetime {
+		t.Fatalf("unexpected config %+v", shown)
+	}
+
+	// Showing the config doesn't touch the one in use
+	if cfg.Database.URL != "postgres://watchtower:s3cret@db:5432/watchtower?sslmode=disable" {
+		t.Fatalf("redacting changed the config: %q", cfg.Database.URL)
+	}
+}
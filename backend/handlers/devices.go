@@ -1,25 +1,64 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/watchtower/web/middleware"
 	"github.com/watchtower/web/models"
 	"github.com/watchtower/web/services"
-	"github.com/gorilla/mux"
+	"github.com/watchtower/web/websocket"
 )
 
 type CreateDeviceRequest struct {
 	Name string `json:"name"`
 }
 
+// DeviceListing is a device with its live WebSocket connection state
+type DeviceListing struct {
+	models.Device
+	Presence websocket.DevicePresence `json:"presence"`
+}
+
 type DevicesResponse struct {
-	Devices []models.Device `json:"devices"`
+	Devices []DeviceListing `json:"devices"`
 }
 
+type RegenerateTokenRequest struct {
+	Immediate bool `json:"immediate,omitempty"` // revoke the old token without a grace period
+}
+
+// HeartbeatRequest is the optional body of a heartbeat
+type HeartbeatRequest struct {
+	Inventory *models.DeviceInventory `json:"inventory,omitempty"`
+	Policy    *ReportedPolicy         `json:"policy,omitempty"`
+}
+
+// ReportedPolicy is the policy an extension is enforcing, hashed the same way
+// as the signed policy bundles
+type ReportedPolicy struct {
+	Version int64  `json:"version"`
+	Hash    string `json:"hash"`
+}
+
+type InventoryHistoryResponse struct {
+	Changes []models.InventoryChange `json:"changes"`
+}
+
+// maxInventoryFieldLength limits each reported inventory value
+const maxInventoryFieldLength = 256
+
 type HeartbeatResponse struct {
 	Success bool   `json:"success"`
 	Status  string `json:"status"`
@@ -27,18 +66,22 @@ type HeartbeatResponse struct {
 
 // ListDevices returns all registered devices (admin API)
 func ListDevices(w http.ResponseWriter, r *http.Request) {
-	devices, err := models.ListDevices()
+	devices, err := store.WithContext(r.Context()).Devices.List()
 	if err != nil {
 		http.Error(w, "Failed to get devices", http.StatusInternalServerError)
 		return
 	}
 
-	if devices == nil {
-		devices = []models.Device{}
+	listings := make([]DeviceListing, len(devices))
+	for i, device := range devices {
+		listings[i].Device = device
+		if websocket.DefaultHub != nil {
+			listings[i].Presence = websocket.DefaultHub.GetDevicePresence(device.ID)
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(DevicesResponse{Devices: devices})
+	json.NewEncoder(w).Encode(DevicesResponse{Devices: listings})
 }
 
 // CreateDevice registers a new device and returns its token (admin API)
@@ -54,7 +97,7 @@ func CreateDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	device, err := models.CreateDevice(req.Name)
+	device, err := store.WithContext(r.Context()).Devices.Create(req.Name)
 	if err != nil {
 		http.Error(w, "Failed to create device", http.StatusInternalServerError)
 		return
@@ -74,7 +117,7 @@ func DeleteDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := models.DeleteDevice(id); err != nil {
+	if err := store.WithContext(r.Context()).Devices.Delete(id); err != nil {
 		http.Error(w, "Failed to delete device", http.StatusInternalServerError)
 		return
 	}
@@ -84,6 +127,9 @@ func DeleteDevice(w http.ResponseWriter, r *http.Request) {
 }
 
 // RegenerateDeviceToken generates a new token for a device (admin API)
+// By default the old token keeps working for models.TokenRotationGrace and
+// connected extensions receive the new token over WebSocket. With "immediate"
+// the old token is revoked and connected extensions are disconnected.
 func RegenerateDeviceToken(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
@@ -92,16 +138,124 @@ func RegenerateDeviceToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	device, err := models.RegenerateDeviceToken(id)
+	// Body is optional
+	var req RegenerateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	grace := models.TokenRotationGrace
+	if req.Immediate {
+		grace = 0
+	}
+
+	device, err := store.WithContext(r.Context()).Devices.RegenerateToken(id, grace)
 	if err != nil {
 		http.Error(w, "Failed to regenerate token", http.StatusInternalServerError)
 		return
 	}
 
+	if req.Immediate {
+		DisconnectDevice(device.ID)
+	} else {
+		NotifyDeviceTokenRotated(device)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(device)
 }
 
+// parseTimeRange reads the "from" and "to" query parameters (RFC 3339)
+// Defaults to the last 24 hours
+func parseTimeRange(r *http.Request) (time.Time, time.Time, bool) {
+	// Ranges end before "to" and the SQL stores compare to the millisecond, so
+	// the default end is a millisecond ahead to include changes made just now
+	to := time.Now().UTC().Add(time.Millisecond)
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+		to = t
+	}
+
+	from := to.Add(-24 * time.Hour)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+// GetDeviceStatusHistory returns a device's status transitions in a date range (admin API)
+func GetDeviceStatusHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	from, to, ok := parseTimeRange(r)
+	if !ok {
+		http.Error(w, "Invalid time range", http.StatusBadRequest)
+		return
+	}
+
+	changes, err := store.WithContext(r.Context()).Devices.ListStatusHistory(id, from, to)
+	if err != nil {
+		http.Error(w, "Failed to get status history", http.StatusInternalServerError)
+		return
+	}
+
+	if changes == nil {
+		changes = []models.DeviceStatusChange{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"history": changes,
+	})
+}
+
+// GetDeviceUptime returns a device's uptime and offline intervals in a date range (admin API)
+func GetDeviceUptime(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	from, to, ok := parseTimeRange(r)
+	if !ok {
+		http.Error(w, "Invalid time range", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := store.WithContext(r.Context()).Devices.GetByID(id); err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	uptime, err := models.GetDeviceUptime(store.WithContext(r.Context()).Devices, id, from, to)
+	if err != nil {
+		http.Error(w, "Failed to compute uptime", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uptime)
+}
+
 // DeviceHeartbeat receives heartbeat pings from extensions (extension API)
 func DeviceHeartbeat(w http.ResponseWriter, r *http.Request) {
 	device := middleware.GetDeviceFromContext(r)
@@ -110,9 +264,15 @@ func DeviceHeartbeat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := models.UpdateDeviceHeartbeat(device.ID); err != nil {
-		log.Printf("Failed to update heartbeat for device %d: %v", device.ID, err)
-		http.Error(w, "Failed to update heartbeat", http.StatusInternalServerError)
+	// Older extensions send no body
+	var req HeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := recordHeartbeat(r.Context(), device, req, "heartbeat"); err != nil {
+		writeAPIError(w, err, "Failed to update heartbeat")
 		return
 	}
 
@@ -123,43 +283,109 @@ func DeviceHeartbeat(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// DeviceUninstall marks a device as uninstalled (extension API - called via uninstall URL)
-func DeviceUninstall(w http.ResponseWriter, r *http.Request) {
-	// This endpoint can be called via GET (from setUninstallURL) or POST
-	// Token can come from query param for GET requests
-	token := r.URL.Query().Get("token")
-	
-	if token == "" {
-		// Try to get from Authorization header (POST requests)
-		device := middleware.GetDeviceFromContext(r)
-		if device != nil {
-			if err := models.UpdateDeviceStatus(device.ID, "uninstalled"); err != nil {
-				log.Printf("Failed to mark device %d as uninstalled: %v", device.ID, err)
-			} else {
-				log.Printf("Device %d (%s) marked as uninstalled", device.ID, device.Name)
-				// Send push notification
-				if services.Push != nil {
-					go services.Push.NotifyDeviceStatus(device.Name, "uninstalled")
-				}
+// recordHeartbeat marks a device as alive and stores the inventory it
+// reported. It is shared by the HTTP and WebSocket APIs.
+func recordHeartbeat(ctx context.Context, device *models.Device, req HeartbeatRequest, reason string) error {
+	if req.Inventory != nil {
+		inv := req.Inventory
+		for _, value := range []string{inv.ExtensionVersion, inv.BrowserName, inv.BrowserVersion, inv.OS, inv.ProfileEmail, inv.Timezone} {
+			if len(value) > maxInventoryFieldLength {
+				return badRequest("inventory_too_long", "Inventory value too long")
 			}
 		}
-	} else {
-		// Get device by token from query param
-		device, err := models.GetDeviceByToken(token)
-		if err == nil && device != nil {
-			if err := models.UpdateDeviceStatus(device.ID, "uninstalled"); err != nil {
-				log.Printf("Failed to mark device %d as uninstalled: %v", device.ID, err)
-			} else {
-				log.Printf("Device %d (%s) marked as uninstalled", device.ID, device.Name)
-				// Send push notification
-				if services.Push != nil {
-					go services.Push.NotifyDeviceStatus(device.Name, "uninstalled")
+	}
+
+	if req.Policy != nil {
+		if hash, err := hex.DecodeString(req.Policy.Hash); err != nil || len(hash) != sha256.Size {
+			return badRequest("invalid_policy_hash", "Invalid policy hash")
+		}
+	}
+
+	store := store.WithContext(ctx)
+	change, err := store.Devices.UpdateHeartbeat(device.ID, reason)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to update heartbeat", "device_id", device.ID, "err", err)
+		return err
+	}
+	services.PublishDeviceStatusChange(ctx, change)
+
+	if req.Inventory != nil {
+		changes, err := store.Devices.UpdateInventory(device.ID, req.Inventory)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to update inventory", "device_id", device.ID, "err", err)
+		} else {
+			services.ProcessInventoryChanges(ctx, device, changes)
+
+			// A new extension version may lift or impose the fallback policy
+			for _, change := range changes {
+				if change.Field == "extension_version" {
+					services.RunBackground(func() { NotifyDevicePatternUpdate(ctx, device.ID) })
+					break
 				}
 			}
 		}
 	}
 
-	// Always return success (don't leak information about valid tokens)
+	if req.Policy != nil {
+		services.CheckReportedPolicy(ctx, device, strings.ToLower(req.Policy.Hash))
+	}
+
+	return nil
+}
+
+// GetUninstallURL returns the URL the extension registers with
+// chrome.runtime.setUninstallURL (extension API). The URL carries a signed
+// nonce that can only mark this device as uninstalled, never the device token.
+func GetUninstallURL(w http.ResponseWriter, r *http.Request) {
+	device := middleware.GetDeviceFromContext(r)
+	if device == nil {
+		http.Error(w, "Device not found", http.StatusUnauthorized)
+		return
+	}
+
+	nonce, err := services.CreateUninstallNonce(r.Context(), device.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create uninstall nonce", "device_id", device.ID, "err", err)
+		http.Error(w, "Failed to create uninstall URL", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"url": requestBaseURL(r) + "/api/uninstall?nonce=" + url.QueryEscape(nonce),
+	})
+}
+
+// DeviceUninstall marks a device as uninstalled (extension API - called via uninstall URL)
+func DeviceUninstall(w http.ResponseWriter, r *http.Request) {
+	// This endpoint can be called via GET (from setUninstallURL) with a signed
+	// nonce, or via POST with either the nonce or the device token
+	ctx := r.Context()
+	store := store.WithContext(ctx)
+	var device *models.Device
+	if nonce := r.URL.Query().Get("nonce"); nonce != "" {
+		if deviceID, err := services.VerifyUninstallNonce(ctx, nonce); err == nil {
+			device, _ = store.Devices.GetByID(deviceID)
+		}
+	} else if token := middleware.BearerToken(r); token != "" && r.Method == "POST" {
+		device, _ = store.Devices.GetByToken(token)
+	}
+
+	if device != nil {
+		if change, err := store.Devices.UpdateStatus(device.ID, "uninstalled", "uninstall_url"); err != nil {
+			slog.ErrorContext(ctx, "Failed to mark device as uninstalled", "device_id", device.ID, "err", err)
+		} else {
+			services.PublishDeviceStatusChange(ctx, change)
+			slog.InfoContext(ctx, "Device marked as uninstalled", "device_id", device.ID, "device_name", device.Name)
+			services.RecordServerEvent(ctx, device.ID, "uninstalled", nil)
+			// Send push notification
+			if services.Push != nil {
+				services.RunBackground(func() { services.Push.NotifyDeviceStatus(ctx, device.Name, "uninstalled") })
+			}
+		}
+	}
+
+	// Always return success (don't leak information about valid nonces)
 	// For GET requests, we can show a simple page
 	if r.Method == "GET" {
 		w.Header().Set("Content-Type", "text/html")
@@ -178,3 +404,34 @@ func DeviceUninstall(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
+// GetDeviceInventoryHistory returns the inventory changes of a device, newest first (admin API)
+func GetDeviceInventoryHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultEventsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxEventsLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, err := store.WithContext(r.Context()).Devices.ListInventoryHistory(id, limit)
+	if err != nil {
+		http.Error(w, "Failed to get inventory history", http.StatusInternalServerError)
+		return
+	}
+
+	if changes == nil {
+		changes = []models.InventoryChange{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(InventoryHistoryResponse{Changes: changes})
+}
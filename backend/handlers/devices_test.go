@@ -0,0 +1,182 @@
+package handlers_test
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/watchtower/web/handlers"
+	"github.com/watchtower/web/models"
+)
+
+func TestCreateAndDeleteDevice(t *testing.T) {
+	ts := newAdminServer(t)
+
+	ts.expect("POST", "/api/admin/devices", map[string]string{"name": ""}, http.StatusBadRequest, nil)
+	device := ts.createDevice("laptop")
+	ts.createPattern(device.ID, "example.com", "allow")
+
+	var devices handlers.DevicesResponse
+	ts.expect("GET", "/api/admin/devices", nil, http.StatusOK, &devices)
+	if len(devices.Devices) != 1 || devices.Devices[0].Name != "laptop" || devices.Devices[0].Token != "" {
+		t.Fatalf("unexpected device listing %+v", devices.Devices)
+	}
+
+	ts.expect("DELETE", "/api/admin/devices/1", nil, http.StatusOK, nil)
+	ts.asDevice(device.Token, "GET", "/api/patterns", nil, http.StatusUnauthorized, nil)
+
+	// The device's patterns went with it
+	var patterns handlers.PatternResponse
+	ts.expect("GET", "/api/admin/patterns", nil, http.StatusOK, &patterns)
+	if len(patterns.Patterns) != 0 {
+		t.Fatalf("patterns of a deleted device are still listed: %+v", patterns.Patterns)
+	}
+}
+
+func TestRegenerateDeviceToken(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+
+	// The old token keeps working during the grace period
+	var rotated models.Device
+	ts.expect("POST", "/api/admin/devices/1/regenerate-token", nil, http.StatusOK, &rotated)
+	if rotated.Token == "" || rotated.Token == device.Token || rotated.PreviousTokenExpiresAt == nil {
+		t.Fatalf("unexpected rotated device %+v", rotated)
+	}
+	ts.asDevice(device.Token, "GET", "/api/patterns", nil, http.StatusOK, nil)
+	ts.asDevice(rotated.Token, "GET", "/api/patterns", nil, http.StatusOK, nil)
+
+	// An immediate rotation revokes both
+	var revoked models.Device
+	ts.expect("POST", "/api/admin/devices/1/regenerate-token", map[string]bool{"immediate": true}, http.StatusOK, &revoked)
+	ts.asDevice(device.Token, "GET", "/api/patterns", nil, http.StatusUnauthorized, nil)
+	ts.asDevice(rotated.Token, "GET", "/api/patterns", nil, http.StatusUnauthorized, nil)
+	ts.asDevice(revoked.Token, "GET", "/api/patterns", nil, http.StatusOK, nil)
+}
+
+func TestReissueDeviceToken(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+
+	var rotated models.Device
+	ts.expect("POST", "/api/admin/devices/1/regenerate-token", nil, http.StatusOK, &rotated)
+
+	// Two connections arrive with the old token; only the first gets a new one
+	first, err := ts.store.Devices.GetByToken(device.Token)
+	if err != nil || !first.UsedPreviousToken {
+		t.Fatalf("old token not accepted as previous: %+v, %v", first, err)
+	}
+	second, _ := ts.store.Devices.GetByToken(device.Token)
+
+	reissued, err := ts.store.Devices.ReissueToken(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.store.Devices.ReissueToken(second); err != sql.ErrNoRows {
+		t.Fatalf("concurrent reissue got %v, want sql.ErrNoRows", err)
+	}
+
+	// The token the admin was shown stays valid next to the reissued one
+	ts.asDevice(reissued.Token, "GET", "/api/patterns", nil, http.StatusOK, nil)
+	ts.asDevice(rotated.Token, "GET", "/api/patterns", nil, http.StatusOK, nil)
+	ts.asDevice(device.Token, "GET", "/api/patterns", nil, http.StatusUnauthorized, nil)
+}
+
+func TestHeartbeatInventory(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+
+	// Older extensions send no body
+	ts.asDevice(device.Token, "POST", "/api/heartbeat", nil, http.StatusOK, nil)
+
+	heartbeat := map[string]interface{}{
+		"inventory": map[string]string{"extension_version": "1.2.0", "browser_name": "Chrome"},
+	}
+	var resp handlers.HeartbeatResponse
+	ts.asDevice(device.Token, "POST", "/api/heartbeat", heartbeat, http.StatusOK, &resp)
+	if !resp.Success || resp.Status != "active" {
+		t.Fatalf("unexpected heartbeat response %+v", resp)
+	}
+
+	// Unchanged values are not recorded again
+	ts.asDevice(device.Token, "POST", "/api/heartbeat", heartbeat, http.StatusOK, nil)
+
+	var history handlers.InventoryHistoryResponse
+	ts.expect("GET", "/api/admin/devices/1/inventory-history", nil, http.StatusOK, &history)
+	if len(history.Changes) != 2 {
+		t.Fatalf("got %d inventory changes, want 2: %+v", len(history.Changes), history.Changes)
+	}
+
+	ts.asDevice(device.Token, "POST", "/api/heartbeat", map[string]interface{}{
+		"policy": map[string]interface{}{"version": 1, "hash": "not-a-hash"},
+	}, http.StatusBadRequest, nil)
+}
+
+func TestDeviceStatusHistoryAndUptime(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+
+	if _, err := ts.store.Devices.UpdateStatus(device.ID, "inactive", "heartbeat_timeout"); err != nil {
+		t.Fatal(err)
+	}
+	ts.asDevice(device.Token, "POST", "/api/heartbeat", nil, http.StatusOK, nil)
+
+	var history struct {
+		History []models.DeviceStatusChange `json:"history"`
+	}
+	ts.expect("GET", "/api/admin/devices/1/status-history", nil, http.StatusOK, &history)
+	if len(history.History) != 3 {
+		t.Fatalf("got %d status changes, want 3: %+v", len(history.History), history.History)
+	}
+	if last := history.History[2]; last.Status != "active" || last.PreviousStatus != "inactive" || last.Reason != "heartbeat" {
+		t.Fatalf("unexpected last status change %+v", last)
+	}
+
+	var uptime models.DeviceUptime
+	ts.expect("GET", "/api/admin/devices/1/uptime", nil, http.StatusOK, &uptime)
+	if uptime.DeviceID != device.ID || uptime.OfflineIntervals == nil {
+		t.Fatalf("unexpected uptime %+v", uptime)
+	}
+
+	ts.expect("GET", "/api/admin/devices/2/uptime", nil, http.StatusNotFound, nil)
+	ts.expect("GET", "/api/admin/devices/1/status-history?from="+url.QueryEscape(time.Now().Format(time.RFC3339))+"&to="+url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339)), nil, http.StatusBadRequest, nil)
+}
+
+func TestUninstallURL(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+
+	var resp map[string]string
+	ts.asDevice(device.Token, "GET", "/api/uninstall-url", nil, http.StatusOK, &resp)
+	uninstallURL, err := url.Parse(resp["url"])
+	if err != nil || uninstallURL.Query().Get("nonce") == "" {
+		t.Fatalf("unexpected uninstall URL %q", resp["url"])
+	}
+
+	// A forged nonce is ignored
+	ts.expect("GET", "/api/uninstall?nonce=forged.nonce", nil, http.StatusOK, nil)
+	if d, _ := ts.store.Devices.GetByID(device.ID); d.Status != "active" {
+		t.Fatalf("forged nonce changed the status to %q", d.Status)
+	}
+
+	// Regenerating the token revokes the URL
+	var revoked models.Device
+	ts.expect("POST", "/api/admin/devices/1/regenerate-token", map[string]bool{"immediate": true}, http.StatusOK, &revoked)
+	ts.expect("GET", "/api/uninstall?"+uninstallURL.RawQuery, nil, http.StatusOK, nil)
+	if d, _ := ts.store.Devices.GetByID(device.ID); d.Status != "active" {
+		t.Fatalf("revoked nonce changed the status to %q", d.Status)
+	}
+
+	// but a rotation with a grace period leaves it working until it ends
+	ts.asDevice(revoked.Token, "GET", "/api/uninstall-url", nil, http.StatusOK, &resp)
+	if uninstallURL, err = url.Parse(resp["url"]); err != nil {
+		t.Fatal(err)
+	}
+	ts.expect("POST", "/api/admin/devices/1/regenerate-token", nil, http.StatusOK, nil)
+	ts.expect("GET", "/api/uninstall?"+uninstallURL.RawQuery, nil, http.StatusOK, nil)
+	if d, _ := ts.store.Devices.GetByID(device.ID); d.Status != "uninstalled" {
+		t.Fatalf("device status is %q after uninstall", d.Status)
+	}
+}
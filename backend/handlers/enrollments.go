@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/watchtower/web/models"
+)
+
+const (
+	// Default lifetime of an enrollment code when the admin doesn't pick one
+	defaultEnrollmentTTL = 15 * time.Minute
+
+	// Upper bound for enrollment code lifetime
+	maxEnrollmentTTL = 24 * time.Hour
+)
+
+type CreateEnrollmentRequest struct {
+	TTLMinutes int `json:"ttl_minutes,omitempty"`
+}
+
+type EnrollmentResponse struct {
+	models.DeviceEnrollment
+	QRPayload string `json:"qr_payload"`
+}
+
+type EnrollmentsResponse struct {
+	Enrollments []models.DeviceEnrollment `json:"enrollments"`
+}
+
+type RedeemEnrollmentRequest struct {
+	Code string `json:"code"`
+}
+
+type RedeemEnrollmentResponse struct {
+	DeviceID   int64  `json:"device_id"`
+	DeviceName string `json:"device_name"`
+	Token      string `json:"token"`
+}
+
+// requestBaseURL reconstructs the externally visible base URL of the server
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// CreateEnrollment creates a one-time enrollment code for a device (admin API)
+func CreateEnrollment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	// Body is optional; an empty body uses the default TTL
+	var req CreateEnrollmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ttl := defaultEnrollmentTTL
+	if req.TTLMinutes != 0 {
+		ttl = time.Duration(req.TTLMinutes) * time.Minute
+		if ttl <= 0 || ttl > maxEnrollmentTTL {
+			http.Error(w, "Invalid TTL", http.StatusBadRequest)
+			return
+		}
+	}
+
+	device, err := store.WithContext(r.Context()).Devices.GetByID(id)
+	if err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	enrollment, err := store.WithContext(r.Context()).Enrollments.Create(device.ID, ttl)
+	if err != nil {
+		http.Error(w, "Failed to create enrollment", http.StatusInternalServerError)
+		return
+	}
+	enrollment.DeviceName = device.Name
+
+	// The QR payload carries everything the extension needs to pair itself
+	qrPayload, _ := json.Marshal(map[string]string{
+		"api_url": requestBaseURL(r),
+		"code":    enrollment.Code,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(EnrollmentResponse{
+		DeviceEnrollment: *enrollment,
+		QRPayload:        string(qrPayload),
+	})
+}
+
+// ListEnrollments returns all pending enrollment codes (admin API)
+func ListEnrollments(w http.ResponseWriter, r *http.Request) {
+	enrollments, err := store.WithContext(r.Context()).Enrollments.ListPending()
+	if err != nil {
+		http.Error(w, "Failed to get enrollments", http.StatusInternalServerError)
+		return
+	}
+
+	if enrollments == nil {
+		enrollments = []models.DeviceEnrollment{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EnrollmentsResponse{Enrollments: enrollments})
+}
+
+// RevokeEnrollment deletes a pending enrollment code (admin API)
+func RevokeEnrollment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid enrollment ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := store.WithContext(r.Context()).Enrollments.Delete(id); err != nil {
+		http.Error(w, "Failed to revoke enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// RedeemEnrollment exchanges an enrollment code for a device token (extension API)
+func RedeemEnrollment(w http.ResponseWriter, r *http.Request) {
+	var req RedeemEnrollmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	code := models.NormalizeEnrollmentCode(req.Code)
+	if code == "" {
+		http.Error(w, "Enrollment code is required", http.StatusBadRequest)
+		return
+	}
+
+	device, err := store.WithContext(r.Context()).Enrollments.Redeem(code)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Invalid or expired enrollment code", http.StatusNotFound)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to redeem enrollment code", "err", err)
+		http.Error(w, "Failed to redeem enrollment code", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Device enrolled via enrollment code", "device_id", device.ID, "device_name", device.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RedeemEnrollmentResponse{
+		DeviceID:   device.ID,
+		DeviceName: device.Name,
+		Token:      device.Token,
+	})
+}
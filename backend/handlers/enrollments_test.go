@@ -0,0 +1,59 @@
+package handlers_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/watchtower/web/handlers"
+)
+
+func TestRedeemEnrollment(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+
+	ts.expect("POST", "/api/admin/devices/2/enrollments", nil, http.StatusNotFound, nil)
+	ts.expect("POST", "/api/admin/devices/1/enrollments", handlers.CreateEnrollmentRequest{TTLMinutes: 24*60 + 1}, http.StatusBadRequest, nil)
+
+	var enrollment handlers.EnrollmentResponse
+	ts.expect("POST", "/api/admin/devices/1/enrollments", nil, http.StatusCreated, &enrollment)
+	if len(enrollment.Code) != 8 || enrollment.DeviceName != "laptop" || !strings.Contains(enrollment.QRPayload, enrollment.Code) {
+		t.Fatalf("unexpected enrollment %+v", enrollment)
+	}
+
+	var pending handlers.EnrollmentsResponse
+	ts.expect("GET", "/api/admin/enrollments", nil, http.StatusOK, &pending)
+	if len(pending.Enrollments) != 1 {
+		t.Fatalf("got %d pending enrollments, want 1", len(pending.Enrollments))
+	}
+
+	// Codes are typed by hand, so case and separators don't matter
+	typed := strings.ToLower(enrollment.Code[:4] + "-" + enrollment.Code[4:])
+	var redeemed handlers.RedeemEnrollmentResponse
+	ts.expect("POST", "/api/enroll", handlers.RedeemEnrollmentRequest{Code: typed}, http.StatusOK, &redeemed)
+	if redeemed.DeviceID != device.ID || redeemed.Token == "" {
+		t.Fatalf("unexpected redemption %+v", redeemed)
+	}
+
+	// Pairing replaces the old token, and codes work once
+	ts.asDevice(device.Token, "GET", "/api/patterns", nil, http.StatusUnauthorized, nil)
+	ts.asDevice(redeemed.Token, "GET", "/api/patterns", nil, http.StatusOK, nil)
+	ts.expect("POST", "/api/enroll", handlers.RedeemEnrollmentRequest{Code: enrollment.Code}, http.StatusNotFound, nil)
+
+	ts.expect("GET", "/api/admin/enrollments", nil, http.StatusOK, &pending)
+	if len(pending.Enrollments) != 0 {
+		t.Fatalf("redeemed enrollment is still pending")
+	}
+}
+
+func TestRevokeEnrollment(t *testing.T) {
+	ts := newAdminServer(t)
+	ts.createDevice("laptop")
+
+	var enrollment handlers.EnrollmentResponse
+	ts.expect("POST", "/api/admin/devices/1/enrollments", nil, http.StatusCreated, &enrollment)
+	ts.expect("DELETE", "/api/admin/enrollments/1", nil, http.StatusOK, nil)
+
+	ts.expect("POST", "/api/enroll", handlers.RedeemEnrollmentRequest{Code: enrollment.Code}, http.StatusNotFound, nil)
+	ts.expect("POST", "/api/enroll", handlers.RedeemEnrollmentRequest{Code: " - "}, http.StatusBadRequest, nil)
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/watchtower/web/middleware"
+	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/services"
+)
+
+const (
+	// Largest details object accepted with a device event
+	maxEventDetailsSize = 4096
+
+	defaultEventsLimit = 100
+	maxEventsLimit     = 500
+)
+
+type DeviceEventRequest struct {
+	Type       string          `json:"type"`
+	Details    json.RawMessage `json:"details,omitempty"`
+	OccurredAt *time.Time      `json:"occurred_at,omitempty"`
+	ClientTime *time.Time      `json:"client_time,omitempty"` // extension's clock when sending, for skew detection
+}
+
+type DeviceEventsResponse struct {
+	Events []models.DeviceEvent `json:"events"`
+}
+
+// ReportDeviceEvent records a tamper or bypass event reported by an extension (extension API)
+func ReportDeviceEvent(w http.ResponseWriter, r *http.Request) {
+	device := middleware.GetDeviceFromContext(r)
+	if device == nil {
+		http.Error(w, "Device not found", http.StatusUnauthorized)
+		return
+	}
+
+	var req DeviceEventRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	response, err := reportDeviceEvent(r.Context(), device, req)
+	if err != nil {
+		writeAPIError(w, err, "Failed to record event")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// reportDeviceEvent validates and records an event reported by a device. It
+// is shared by the HTTP and WebSocket APIs.
+func reportDeviceEvent(ctx context.Context, device *models.Device, req DeviceEventRequest) (*DeviceEventsResponse, error) {
+	if !services.IsKnownDeviceEvent(req.Type) {
+		return nil, badRequest("unknown_event_type", "Unknown event type")
+	}
+
+	if len(req.Details) > maxEventDetailsSize {
+		return nil, badRequest("details_too_large", "Event details too large")
+	}
+	if string(req.Details) == "null" {
+		req.Details = nil
+	}
+
+	events, err := services.ProcessDeviceEvent(ctx, device, req.Type, req.Details, req.OccurredAt, req.ClientTime)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record device event", "device_id", device.ID, "type", req.Type, "err", err)
+		return nil, err
+	}
+
+	response := &DeviceEventsResponse{Events: []models.DeviceEvent{}}
+	for _, e := range events {
+		response.Events = append(response.Events, *e)
+	}
+	return response, nil
+}
+
+// ListDeviceEvents returns the security timeline of a device (admin API)
+func ListDeviceEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultEventsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxEventsLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := store.WithContext(r.Context()).Events.List(id, limit)
+	if err != nil {
+		http.Error(w, "Failed to get events", http.StatusInternalServerError)
+		return
+	}
+
+	if events == nil {
+		events = []models.DeviceEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeviceEventsResponse{Events: events})
+}
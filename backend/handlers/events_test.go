@@ -0,0 +1,44 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/watchtower/web/handlers"
+)
+
+func TestReportDeviceEvent(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+
+	ts.asDevice(device.Token, "POST", "/api/events", handlers.DeviceEventRequest{Type: "made_up"}, http.StatusBadRequest, nil)
+	ts.asDevice(device.Token, "POST", "/api/events", handlers.DeviceEventRequest{
+		Type:    "config_changed",
+		Details: json.RawMessage(`{"padding":"` + strings.Repeat("x", 5000) + `"}`),
+	}, http.StatusBadRequest, nil)
+
+	var reported handlers.DeviceEventsResponse
+	ts.asDevice(device.Token, "POST", "/api/events", handlers.DeviceEventRequest{
+		Type:    "extension_disabled",
+		Details: json.RawMessage(`{"reason":"user"}`),
+	}, http.StatusCreated, &reported)
+	if len(reported.Events) != 1 || reported.Events[0].Severity != "critical" || reported.Events[0].Source != "device" {
+		t.Fatalf("unexpected reported events %+v", reported.Events)
+	}
+
+	ts.asDevice(device.Token, "POST", "/api/events", handlers.DeviceEventRequest{Type: "incognito_access_granted"}, http.StatusCreated, nil)
+
+	var timeline handlers.DeviceEventsResponse
+	ts.expect("GET", "/api/admin/devices/1/events", nil, http.StatusOK, &timeline)
+	if len(timeline.Events) != 2 || timeline.Events[0].Type != "incognito_access_granted" {
+		t.Fatalf("unexpected timeline %+v", timeline.Events)
+	}
+
+	ts.expect("GET", "/api/admin/devices/1/events?limit=1", nil, http.StatusOK, &timeline)
+	if len(timeline.Events) != 1 {
+		t.Fatalf("got %d events with limit 1", len(timeline.Events))
+	}
+	ts.expect("GET", "/api/admin/devices/1/events?limit=0", nil, http.StatusBadRequest, nil)
+}
@@ -0,0 +1,89 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/watchtower/web/logging"
+	"github.com/watchtower/web/middleware"
+)
+
+func TestRequestID(t *testing.T) {
+	ts := newTestServer(t)
+
+	var logs bytes.Buffer
+	previous := slog.Default()
+	if err := logging.Setup(&logs, "info", "json"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	resp := ts.request("GET", "/api/setup/status", nil, nil)
+	resp.Body.Close()
+	id := resp.Header.Get(middleware.RequestIDHeader)
+	if id == "" {
+		t.Fatal("response has no request ID")
+	}
+
+	// The request is logged with its ID and route
+	var entry struct {
+		RequestID string `json:"request_id"`
+		Route     string `json:"route"`
+		Status    int    `json:"status"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("request not logged as JSON: %v\n%s", err, logs.String())
+	}
+	if entry.RequestID != id || entry.Route != "/api/setup/status" || entry.Status != http.StatusOK {
+		t.Fatalf("got log entry %+v, want request_id %s", entry, id)
+	}
+
+	// An ID set by a proxy is kept, a malformed one replaced
+	resp = ts.request("GET", "/api/setup/status", nil, http.Header{middleware.RequestIDHeader: {"proxy-42"}})
+	resp.Body.Close()
+	if got := resp.Header.Get(middleware.RequestIDHeader); got != "proxy-42" {
+		t.Fatalf("got request ID %q, want the proxy's", got)
+	}
+
+	resp = ts.request("GET", "/api/setup/status", nil, http.Header{middleware.RequestIDHeader: {"bad id; drop"}})
+	resp.Body.Close()
+	if got := resp.Header.Get(middleware.RequestIDHeader); got == "" || got == "bad id; drop" {
+		t.Fatalf("got request ID %q, want a generated one", got)
+	}
+
+	// Requests no route answers are logged as well
+	logs.Reset()
+	resp = ts.request("GET", "/no-such-page", nil, nil)
+	resp.Body.Close()
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("request not logged as JSON: %v\n%s", err, logs.String())
+	}
+	if entry.RequestID != resp.Header.Get(middleware.RequestIDHeader) || entry.Route != "unmatched" || entry.Status != http.StatusNotFound {
+		t.Fatalf("got log entry %+v for an unknown path", entry)
+	}
+
+	// Behind a trusted proxy the client's address is logged, as it is for
+	// WebSocket connections
+	middleware.SetTrustedProxies([]string{"127.0.0.1"})
+	t.Cleanup(func() { middleware.SetTrustedProxies(nil) })
+	var addr struct {
+		RemoteAddr string `json:"remote_addr"`
+	}
+	for forwarded, want := range map[string]string{
+		"203.0.113.7":            "203.0.113.7",
+		"198.51.100.1, 10.0.0.9": "10.0.0.9",
+	} {
+		logs.Reset()
+		resp = ts.request("GET", "/api/setup/status", nil, http.Header{"X-Forwarded-For": {forwarded}})
+		resp.Body.Close()
+		if err := json.Unmarshal(logs.Bytes(), &addr); err != nil {
+			t.Fatalf("request not logged as JSON: %v\n%s", err, logs.String())
+		}
+		if addr.RemoteAddr != want {
+			t.Fatalf("logged remote_addr %q for X-Forwarded-For %q, want %q", addr.RemoteAddr, forwarded, want)
+		}
+	}
+}
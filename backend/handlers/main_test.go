@@ -0,0 +1,262 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/watchtower/web/database"
+	"github.com/watchtower/web/handlers"
+	"github.com/watchtower/web/middleware"
+	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/services"
+	"github.com/watchtower/web/websocket"
+)
+
+// The tests run the real router against an in-memory store. The WebSocket
+// hub is only started by the tests that connect to it (startHub); the push
+// service is left uninitialized, as the handlers allow.
+//
+// TEST_STORE=sqlite runs them against a SQLite database instead, and
+// TEST_STORE=postgres against the PostgreSQL database at TEST_DATABASE_URL,
+// which is emptied before every test.
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+
+	services.SetStore(models.NewMemoryStore())
+	if err := services.InitPolicySigner(); err != nil {
+		log.Fatalf("Failed to initialize policy signing: %v", err)
+	}
+
+	os.Exit(m.Run())
+}
+
+const (
+	testUsername = "admin"
+	testPassword = "password1"
+)
+
+// testServer is a server with its own empty store, and a client that keeps
+// the session cookie
+type testServer struct {
+	t      *testing.T
+	store  *models.Store
+	server *httptest.Server
+	client *http.Client
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	store := newStore(t)
+	handlers.SetStore(store)
+	middleware.SetStore(store)
+	services.SetStore(store)
+
+	server := httptest.NewServer(handlers.NewRouter(http.NotFoundHandler()))
+	jar, _ := cookiejar.New(nil)
+	t.Cleanup(func() {
+		server.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		services.WaitBackground(ctx)
+	})
+
+	return &testServer{t: t, store: store, server: server, client: &http.Client{Jar: jar}}
+}
+
+// startHub runs a WebSocket hub for the server until the test ends
+func (ts *testServer) startHub() {
+	ts.t.Helper()
+
+	hub := websocket.NewHub()
+	go hub.Run()
+	websocket.DefaultHub = hub
+	ts.t.Cleanup(func() {
+		// Work started by the handlers still uses the hub
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		services.WaitBackground(ctx)
+		if err := hub.Shutdown(ctx, websocket.Message{Type: "server_restarting"}); err != nil {
+			ts.t.Errorf("shut down hub: %v", err)
+		}
+		websocket.DefaultHub = nil
+	})
+}
+
+// newStore returns an empty store of the kind TEST_STORE selects
+func newStore(t *testing.T) *models.Store {
+	t.Helper()
+
+	switch kind := os.Getenv("TEST_STORE"); kind {
+	case "", "memory":
+		return models.NewMemoryStore()
+	case "sqlite":
+		if err := database.Initialize(filepath.Join(t.TempDir(), "watchtower.db")); err != nil {
+			t.Fatalf("Failed to initialize SQLite: %v", err)
+		}
+		t.Cleanup(database.Close)
+		return models.NewSQLiteStore(database.DB)
+	case "postgres":
+		if database.DB == nil {
+			databaseURL := os.Getenv("TEST_DATABASE_URL")
+			if databaseURL == "" {
+				t.Fatal("TEST_STORE=postgres needs TEST_DATABASE_URL")
+			}
+			if err := database.InitializePostgres(databaseURL); err != nil {
+				t.Fatalf("Failed to initialize PostgreSQL: %v", err)
+			}
+		}
+		truncateTables(t)
+		return models.NewPostgresStore(database.DB)
+	default:
+		t.Fatalf("Unknown TEST_STORE %q", kind)
+		return nil
+	}
+}
+
+// truncateTables empties every table but the migration state, and restarts
+// IDs at 1
+func truncateTables(t *testing.T) {
+	t.Helper()
+
+	rows, err := database.DB.Query(`
+		SELECT tablename FROM pg_tables
+		WHERE schemaname = current_schema() AND tablename != 'schema_migrations'
+	`)
+	if err != nil {
+		t.Fatalf("Failed to list tables: %v", err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatalf("Failed to list tables: %v", err)
+		}
+		tables = append(tables, table)
+	}
+	if _, err := database.DB.Exec("TRUNCATE " + strings.Join(tables, ", ") + " RESTART IDENTITY CASCADE"); err != nil {
+		t.Fatalf("Failed to truncate tables: %v", err)
+	}
+}
+
+// newAdminServer returns a test server with the first admin set up and logged in
+func newAdminServer(t *testing.T) *testServer {
+	t.Helper()
+
+	ts := newTestServer(t)
+	ts.expect("POST", "/api/setup/create-user", map[string]string{
+		"username":         testUsername,
+		"password":         testPassword,
+		"confirm_password": testPassword,
+	}, http.StatusOK, nil)
+	ts.login(testUsername, testPassword)
+	return ts
+}
+
+func (ts *testServer) login(username, password string) {
+	ts.t.Helper()
+	ts.expect("POST", "/api/auth/login", map[string]string{"username": username, "password": password}, http.StatusOK, nil)
+}
+
+// request sends a JSON body, if any, with optional extra headers
+func (ts *testServer) request(method, path string, body interface{}, header http.Header) *http.Response {
+	ts.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			ts.t.Fatalf("encode body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, ts.server.URL+path, reader)
+	if err != nil {
+		ts.t.Fatalf("new request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		ts.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp
+}
+
+// expect sends a request, checks the status code and decodes the response into out
+func (ts *testServer) expect(method, path string, body interface{}, status int, out interface{}) {
+	ts.t.Helper()
+	ts.expectWithHeader(method, path, body, nil, status, out)
+}
+
+func (ts *testServer) expectWithHeader(method, path string, body interface{}, header http.Header, status int, out interface{}) {
+	ts.t.Helper()
+
+	resp := ts.request(method, path, body, header)
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != status {
+		ts.t.Fatalf("%s %s: status %d, want %d: %s", method, path, resp.StatusCode, status, data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			ts.t.Fatalf("%s %s: decode %q: %v", method, path, data, err)
+		}
+	}
+}
+
+// asDevice sends a request authenticated with a device token
+func (ts *testServer) asDevice(token, method, path string, body interface{}, status int, out interface{}) {
+	ts.t.Helper()
+	ts.expectWithHeader(method, path, body, bearer(token), status, out)
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+// createDevice registers a device through the admin API and returns it with its token
+func (ts *testServer) createDevice(name string) models.Device {
+	ts.t.Helper()
+
+	var device models.Device
+	ts.expect("POST", "/api/admin/devices", map[string]string{"name": name}, http.StatusCreated, &device)
+	if device.Token == "" {
+		ts.t.Fatalf("created device has no token")
+	}
+	return device
+}
+
+// createPattern adds a pattern for a device through the admin API
+func (ts *testServer) createPattern(deviceID int64, pattern, patternType string) models.Pattern {
+	ts.t.Helper()
+
+	var created models.Pattern
+	ts.expect("POST", "/api/admin/patterns", map[string]interface{}{
+		"device_id": deviceID,
+		"pattern":   pattern,
+		"type":      patternType,
+	}, http.StatusCreated, &created)
+	return created
+}
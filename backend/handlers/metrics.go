@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/watchtower/web/metrics"
+	"github.com/watchtower/web/middleware"
+)
+
+var metricsHandler = metrics.Handler()
+
+// GetMetrics serves the Prometheus metrics. With metrics.token configured,
+// scrapers have to send it as a bearer token.
+func GetMetrics(w http.ResponseWriter, r *http.Request) {
+	if token := serverConfig.Metrics.Token; token != "" {
+		if subtle.ConstantTimeCompare([]byte(middleware.BearerToken(r)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	metricsHandler.ServeHTTP(w, r)
+}
@@ -0,0 +1,71 @@
+package handlers_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/watchtower/web/config"
+	"github.com/watchtower/web/handlers"
+)
+
+func TestGetMetrics(t *testing.T) {
+	ts := newAdminServer(t)
+	ts.createDevice("Metrics Laptop")
+	ts.expect("GET", "/api/admin/devices/1/commands", nil, http.StatusOK, nil)
+	ts.expect("GET", "/no-such-page", nil, http.StatusNotFound, nil)
+	ts.expect("DELETE", "/metrics", nil, http.StatusMethodNotAllowed, nil)
+
+	resp := ts.request("GET", "/metrics", nil, nil)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+
+	// Requests are labelled with the route template, not the path
+	want := `watchtower_http_requests_total{code="200",method="GET",route="/api/admin/devices/{id}/commands"}`
+	if !strings.Contains(string(body), want) {
+		t.Fatalf("metrics missing %s:\n%s", want, body)
+	}
+	// Requests no route answers are counted too
+	for _, want := range []string{
+		`watchtower_http_requests_total{code="404",method="GET",route="unmatched"}`,
+		`watchtower_http_requests_total{code="405",method="DELETE",route="unmatched"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("metrics missing %s:\n%s", want, body)
+		}
+	}
+	if !strings.Contains(string(body), "watchtower_http_request_duration_seconds_bucket") {
+		t.Fatalf("metrics missing request durations:\n%s", body)
+	}
+}
+
+func TestGetMetricsToken(t *testing.T) {
+	ts := newTestServer(t)
+
+	cfg := config.Default()
+	cfg.Metrics.Token = "scrape-secret"
+	handlers.SetConfig(cfg)
+	t.Cleanup(func() { handlers.SetConfig(config.Default()) })
+
+	resp := ts.request("GET", "/metrics", nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %d without a token, want 401", resp.StatusCode)
+	}
+
+	resp = ts.request("GET", "/metrics", nil, bearer("wrong"))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %d with a wrong token, want 401", resp.StatusCode)
+	}
+
+	resp = ts.request("GET", "/metrics", nil, bearer("scrape-secret"))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d with the token, want 200", resp.StatusCode)
+	}
+}
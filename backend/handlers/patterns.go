@@ -4,15 +4,20 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/watchtower/web/middleware"
 	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/services"
 )
 
 type PatternResponse struct {
-	Patterns []models.Pattern `json:"patterns"`
+	Version         int64                  `json:"version,omitempty"` // policy version, only for a single device
+	Patterns        []models.Pattern       `json:"patterns"`
+	UpgradeRequired bool                   `json:"upgrade_required,omitempty"` // patterns are the restrictive fallback policy
+	Bundle          *services.PolicyBundle `json:"bundle,omitempty"`           // signed policy, only for a single device
 }
 
 type CreatePatternRequest struct {
@@ -58,7 +63,9 @@ func parseDuration(duration string, customMinutes int) (time.Duration, bool) {
 	}
 }
 
-// GetPatterns returns patterns for the authenticated device (extension API)
+// GetPatterns returns patterns for the authenticated device (extension API).
+// The response carries the policy version as an ETag, and requests with a
+// matching If-None-Match get 304 Not Modified.
 func GetPatterns(w http.ResponseWriter, r *http.Request) {
 	device := middleware.GetDeviceFromContext(r)
 	if device == nil {
@@ -66,23 +73,49 @@ func GetPatterns(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	patterns, err := models.GetPatternsByDevice(device.ID)
+	snapshot, err := getPolicySnapshot(r.Context(), device.ID)
 	if err != nil {
 		http.Error(w, "Failed to get patterns", http.StatusInternalServerError)
 		return
 	}
 
-	if patterns == nil {
-		patterns = []models.Pattern{}
+	etag := policyETag(snapshot.Version, snapshot.UpgradeRequired)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	bundle, err := signPolicy(r.Context(), device.ID, snapshot.Version, snapshot.Patterns, snapshot.UpgradeRequired)
+	if err != nil {
+		http.Error(w, "Failed to sign patterns", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(PatternResponse{Patterns: patterns})
+	json.NewEncoder(w).Encode(PatternResponse{
+		Version:         snapshot.Version,
+		Patterns:        snapshot.Patterns,
+		UpgradeRequired: snapshot.UpgradeRequired,
+		Bundle:          bundle,
+	})
+}
+
+// etagMatches reports whether an If-None-Match header lists the ETag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
 }
 
 // ListAllPatterns returns all patterns (admin API)
 func ListAllPatterns(w http.ResponseWriter, r *http.Request) {
-	patterns, err := models.ListAllPatterns()
+	patterns, err := store.WithContext(r.Context()).Patterns.ListAll()
 	if err != nil {
 		http.Error(w, "Failed to get patterns", http.StatusInternalServerError)
 		return
@@ -127,14 +160,15 @@ func CreatePattern(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	pattern, err := models.CreatePattern(req.DeviceID, req.Pattern, req.Type, expiresAt)
+	pattern, err := store.WithContext(r.Context()).Patterns.Create(req.DeviceID, req.Pattern, req.Type, expiresAt)
 	if err != nil {
 		http.Error(w, "Failed to create pattern", http.StatusInternalServerError)
 		return
 	}
 
 	// Notify device via WebSocket
-	go NotifyDevicePatternUpdate(req.DeviceID)
+	services.RunBackground(func() { NotifyDevicePatternUpdate(r.Context(), req.DeviceID) })
+	publishPatternChanged(r, "created", pattern.ID, pattern)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -151,7 +185,7 @@ func UpdatePattern(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get existing pattern to find device ID
-	existingPattern, err := models.GetPatternByID(id)
+	existingPattern, err := store.WithContext(r.Context()).Patterns.GetByID(id)
 	if err != nil {
 		http.Error(w, "Pattern not found", http.StatusNotFound)
 		return
@@ -186,14 +220,15 @@ func UpdatePattern(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	pattern, err := models.UpdatePattern(id, req.Pattern, req.Type, expiresAt)
+	pattern, err := store.WithContext(r.Context()).Patterns.Update(id, req.Pattern, req.Type, expiresAt)
 	if err != nil {
 		http.Error(w, "Failed to update pattern", http.StatusInternalServerError)
 		return
 	}
 
 	// Notify device via WebSocket
-	go NotifyDevicePatternUpdate(existingPattern.DeviceID)
+	services.RunBackground(func() { NotifyDevicePatternUpdate(r.Context(), existingPattern.DeviceID) })
+	publishPatternChanged(r, "updated", id, pattern)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(pattern)
@@ -209,20 +244,21 @@ func DeletePattern(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get pattern to find device ID before deletion
-	pattern, err := models.GetPatternByID(id)
+	pattern, err := store.WithContext(r.Context()).Patterns.GetByID(id)
 	if err != nil {
 		http.Error(w, "Pattern not found", http.StatusNotFound)
 		return
 	}
 	deviceID := pattern.DeviceID
 
-	if err := models.DeletePattern(id); err != nil {
+	if err := store.WithContext(r.Context()).Patterns.Delete(id); err != nil {
 		http.Error(w, "Failed to delete pattern", http.StatusInternalServerError)
 		return
 	}
 
 	// Notify device via WebSocket
-	go NotifyDevicePatternUpdate(deviceID)
+	services.RunBackground(func() { NotifyDevicePatternUpdate(r.Context(), deviceID) })
+	publishPatternChanged(r, "deleted", id, nil)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
@@ -245,20 +281,31 @@ func TogglePattern(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := models.TogglePatternEnabled(id, req.Enabled); err != nil {
+	if err := store.WithContext(r.Context()).Patterns.SetEnabled(id, req.Enabled); err != nil {
 		http.Error(w, "Failed to update pattern", http.StatusInternalServerError)
 		return
 	}
 
-	pattern, err := models.GetPatternByID(id)
+	pattern, err := store.WithContext(r.Context()).Patterns.GetByID(id)
 	if err != nil {
 		http.Error(w, "Failed to get pattern", http.StatusInternalServerError)
 		return
 	}
 
 	// Notify device via WebSocket
-	go NotifyDevicePatternUpdate(pattern.DeviceID)
+	services.RunBackground(func() { NotifyDevicePatternUpdate(r.Context(), pattern.DeviceID) })
+	publishPatternChanged(r, "toggled", id, pattern)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(pattern)
 }
+
+// publishPatternChanged tells admin dashboards that an admin changed a pattern
+func publishPatternChanged(r *http.Request, action string, id int64, pattern *models.Pattern) {
+	services.PublishAdminEvent(r.Context(), "pattern_changed", services.PatternEvent{
+		Action:    action,
+		PatternID: id,
+		Pattern:   pattern,
+		By:        adminName(r),
+	})
+}
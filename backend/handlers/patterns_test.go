@@ -0,0 +1,119 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/watchtower/web/handlers"
+	"github.com/watchtower/web/models"
+)
+
+func TestCreatePatternValidation(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+
+	for _, body := range []map[string]interface{}{
+		{"device_id": device.ID, "pattern": "", "type": "allow"},
+		{"device_id": device.ID, "pattern": "example.com", "type": "block"},
+		{"device_id": 0, "pattern": "example.com", "type": "allow"},
+		{"device_id": device.ID, "pattern": "example.com", "type": "allow", "duration": "2d"},
+		{"device_id": device.ID, "pattern": "example.com", "type": "allow", "duration": "custom"},
+	} {
+		ts.expect("POST", "/api/admin/patterns", body, http.StatusBadRequest, nil)
+	}
+
+	var pattern models.Pattern
+	ts.expect("POST", "/api/admin/patterns", map[string]interface{}{
+		"device_id": device.ID, "pattern": "example.com", "type": "allow", "duration": "1h",
+	}, http.StatusCreated, &pattern)
+	if pattern.ExpiresAt == nil || !pattern.Enabled {
+		t.Fatalf("unexpected pattern %+v", pattern)
+	}
+}
+
+func TestGetPatternsETag(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+	ts.createPattern(device.ID, "example.com", "allow")
+
+	resp := ts.request("GET", "/api/patterns", nil, bearer(device.Token))
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag != `"v1"` {
+		t.Fatalf("got status %d and ETag %s, want 200 and \"v1\"", resp.StatusCode, etag)
+	}
+
+	header := bearer(device.Token)
+	header.Set("If-None-Match", etag)
+	ts.expectWithHeader("GET", "/api/patterns", nil, header, http.StatusNotModified, nil)
+
+	// A change to the policy invalidates the cached copy
+	ts.createPattern(device.ID, "example.org", "deny")
+	var patterns handlers.PatternResponse
+	ts.expectWithHeader("GET", "/api/patterns", nil, header, http.StatusOK, &patterns)
+	if patterns.Version != 2 || len(patterns.Patterns) != 2 || patterns.Bundle == nil {
+		t.Fatalf("unexpected policy %+v", patterns)
+	}
+}
+
+func TestPatternsArePerDevice(t *testing.T) {
+	ts := newAdminServer(t)
+	laptop := ts.createDevice("laptop")
+	phone := ts.createDevice("phone")
+	ts.createPattern(laptop.ID, "example.com", "allow")
+
+	var patterns handlers.PatternResponse
+	ts.asDevice(phone.Token, "GET", "/api/patterns", nil, http.StatusOK, &patterns)
+	if len(patterns.Patterns) != 0 || patterns.Version != 0 {
+		t.Fatalf("phone got the laptop's patterns: %+v", patterns)
+	}
+
+	ts.asDevice("not-a-valid-token", "GET", "/api/patterns", nil, http.StatusUnauthorized, nil)
+	ts.expect("GET", "/api/patterns", nil, http.StatusUnauthorized, nil)
+}
+
+func TestUpdateTogglePattern(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+	pattern := ts.createPattern(device.ID, "example.com", "allow")
+
+	var updated models.Pattern
+	ts.expect("PUT", "/api/admin/patterns/1", map[string]string{"pattern": "*.example.com", "type": "deny"}, http.StatusOK, &updated)
+	if updated.ID != pattern.ID || updated.Pattern != "*.example.com" || updated.Type != "deny" {
+		t.Fatalf("unexpected updated pattern %+v", updated)
+	}
+	ts.expect("PUT", "/api/admin/patterns/99", map[string]string{"pattern": "x", "type": "deny"}, http.StatusNotFound, nil)
+
+	// Disabled patterns are not sent to the device
+	var toggled models.Pattern
+	ts.expect("POST", "/api/admin/patterns/1/toggle", map[string]bool{"enabled": false}, http.StatusOK, &toggled)
+	if toggled.Enabled {
+		t.Fatalf("pattern still enabled after toggling it off")
+	}
+
+	var patterns handlers.PatternResponse
+	ts.asDevice(device.Token, "GET", "/api/patterns", nil, http.StatusOK, &patterns)
+	if len(patterns.Patterns) != 0 || patterns.Version != 3 {
+		t.Fatalf("unexpected policy after disabling the pattern: %+v", patterns)
+	}
+
+	// The admin list still has it
+	ts.expect("GET", "/api/admin/patterns", nil, http.StatusOK, &patterns)
+	if len(patterns.Patterns) != 1 {
+		t.Fatalf("got %d patterns in the admin list, want 1", len(patterns.Patterns))
+	}
+}
+
+func TestDeletePattern(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+	ts.createPattern(device.ID, "example.com", "allow")
+
+	ts.expect("DELETE", "/api/admin/patterns/1", nil, http.StatusOK, nil)
+	ts.expect("DELETE", "/api/admin/patterns/1", nil, http.StatusNotFound, nil)
+
+	changes, version, complete, err := ts.store.Patterns.ListChangesSince(device.ID, 0)
+	if err != nil || !complete || version != 2 || len(changes) != 2 || changes[1].Op != "remove" {
+		t.Fatalf("unexpected change log %+v (version %d, complete %v, err %v)", changes, version, complete, err)
+	}
+}
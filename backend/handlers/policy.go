@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/services"
+	"github.com/watchtower/web/websocket"
+)
+
+// Devices are sent their patterns in full on connect and then only the
+// changes, as "patterns_delta" messages going from one policy version to the
+// next. An extension that missed a delta sends a "sync" message with its
+// version and gets the missing changes, or everything if they were pruned.
+// Out-of-date devices always get the full restrictive fallback policy.
+//
+// Each connection remembers the version it was last sent, and the scheduler
+// periodically pushes every connection up to the current version, so a
+// connection that missed a message still converges.
+//
+// Snapshots and deltas carry a bundle signed by services.Signer for the
+// resulting version, so extensions can check their cached copy.
+
+// PolicySnapshot is a device's complete policy at a version
+type PolicySnapshot struct {
+	Version         int64                  `json:"version"`
+	Patterns        []models.Pattern       `json:"patterns"`
+	UpgradeRequired bool                   `json:"upgrade_required,omitempty"` // patterns are the restrictive fallback policy
+	Bundle          *services.PolicyBundle `json:"bundle,omitempty"`
+}
+
+// PolicyDelta is the list of changes between two policy versions
+type PolicyDelta struct {
+	FromVersion int64                  `json:"from_version"`
+	Version     int64                  `json:"version"`
+	Changes     []models.PatternChange `json:"changes"`
+	Bundle      *services.PolicyBundle `json:"bundle,omitempty"`
+}
+
+// SyncRequest is sent by an extension that wants to catch up
+type SyncRequest struct {
+	Version int64 `json:"version"` // last version the extension applied, 0 if none
+}
+
+// SyncResponse is either a delta or a full snapshot, depending on Mode
+type SyncResponse struct {
+	Mode            string                 `json:"mode"` // "delta" or "full"
+	FromVersion     int64                  `json:"from_version,omitempty"`
+	Version         int64                  `json:"version"`
+	Changes         []models.PatternChange `json:"changes,omitempty"`
+	Patterns        []models.Pattern       `json:"patterns,omitempty"`
+	UpgradeRequired bool                   `json:"upgrade_required,omitempty"`
+	Bundle          *services.PolicyBundle `json:"bundle,omitempty"`
+}
+
+// PolicyKeyResponse is the public key extensions verify policy bundles with
+type PolicyKeyResponse struct {
+	KeyID     string `json:"key_id"`
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"` // base64 raw key
+}
+
+// policyMu serializes pushes so deltas reach each connection in order. It
+// also guards the Policy fields of websocket.Client.
+var policyMu sync.Mutex
+
+// getPolicySnapshot returns a device's current policy. The version is read
+// before the patterns so the patterns are never older than the version.
+func getPolicySnapshot(ctx context.Context, deviceID int64) (*PolicySnapshot, error) {
+	version, err := store.WithContext(ctx).Patterns.PolicyVersion(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns, restricted, err := services.GetDevicePolicy(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if patterns == nil {
+		patterns = []models.Pattern{}
+	}
+
+	return &PolicySnapshot{Version: version, Patterns: patterns, UpgradeRequired: restricted}, nil
+}
+
+// signPolicy signs a device's patterns at a version. It returns nil when
+// signing isn't set up.
+func signPolicy(ctx context.Context, deviceID, version int64, patterns []models.Pattern, restricted bool) (*services.PolicyBundle, error) {
+	if services.Signer == nil {
+		return nil, nil
+	}
+	return services.Signer.SignPolicy(ctx, deviceID, version, patterns, restricted)
+}
+
+// getSignedPolicySnapshot returns a device's current policy with its bundle
+func getSignedPolicySnapshot(ctx context.Context, deviceID int64) (*PolicySnapshot, error) {
+	snapshot, err := getPolicySnapshot(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot.Bundle, err = signPolicy(ctx, deviceID, snapshot.Version, snapshot.Patterns, snapshot.UpgradeRequired)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// policyETag identifies a policy for HTTP caching
+func policyETag(version int64, restricted bool) string {
+	if restricted {
+		return fmt.Sprintf(`"v%d-restricted"`, version)
+	}
+	return fmt.Sprintf(`"v%d"`, version)
+}
+
+// getPolicyDelta returns the changes after a version, or nil if the device
+// needs a full snapshot instead. The bundle is signed for the current
+// patterns; if they changed again in the meantime, the extension notices the
+// mismatch and resyncs.
+func getPolicyDelta(ctx context.Context, deviceID, since int64) (*PolicyDelta, error) {
+	changes, version, complete, err := store.WithContext(ctx).Patterns.ListChangesSince(deviceID, since)
+	if err != nil || !complete {
+		return nil, err
+	}
+	if changes == nil {
+		changes = []models.PatternChange{}
+	}
+
+	delta := &PolicyDelta{FromVersion: since, Version: version, Changes: changes}
+	if len(changes) > 0 {
+		patterns, _, err := services.GetDevicePolicy(ctx, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		if delta.Bundle, err = signPolicy(ctx, deviceID, version, patterns, false); err != nil {
+			return nil, err
+		}
+	}
+	return delta, nil
+}
+
+// NotifyDevicePatternUpdate sends a device the changes to its patterns since
+// its connections were last updated, on this and other instances
+func NotifyDevicePatternUpdate(ctx context.Context, deviceID int64) {
+	if websocket.DefaultHub != nil {
+		websocket.DefaultHub.PublishPolicyChange(deviceID)
+	}
+	pushDevicePolicy(ctx, deviceID, false)
+}
+
+// PushDevicePolicy brings a device's connections on this instance up to its
+// current policy
+func PushDevicePolicy(ctx context.Context, deviceID int64) {
+	pushDevicePolicy(ctx, deviceID, false)
+}
+
+// pushDevicePolicy brings each of a device's connections up to its current
+// policy, with a delta from the version the connection was last sent when
+// possible and the full policy otherwise. New connections, and all of them if
+// full is set, get the full policy. Out-of-date devices are told to upgrade
+// and receive the restrictive fallback policy instead of their patterns.
+func pushDevicePolicy(ctx context.Context, deviceID int64, full bool) {
+	if websocket.DefaultHub == nil {
+		return
+	}
+
+	policyMu.Lock()
+	defer policyMu.Unlock()
+
+	clients := websocket.DefaultHub.DeviceClients(deviceID)
+	if len(clients) == 0 {
+		return
+	}
+
+	store := store.WithContext(ctx)
+	device, err := store.Devices.GetByID(deviceID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get device", "device_id", deviceID, "err", err)
+		return
+	}
+	restricted := services.IsDeviceOutdated(ctx, device)
+
+	version, err := store.Patterns.PolicyVersion(deviceID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get policy version", "device_id", deviceID, "err", err)
+		return
+	}
+
+	// Connections are often at the same version, so the messages are shared
+	var snapshot *PolicySnapshot
+	deltas := make(map[int64]*PolicyDelta)
+
+	for _, client := range clients {
+		if !full && client.PolicySent && client.PolicyRestricted == restricted && client.PolicyVersion >= version {
+			continue
+		}
+
+		if !full && client.PolicySent && !restricted && !client.PolicyRestricted {
+			delta, ok := deltas[client.PolicyVersion]
+			if !ok {
+				if delta, err = getPolicyDelta(ctx, deviceID, client.PolicyVersion); err != nil {
+					slog.ErrorContext(ctx, "Failed to get pattern changes", "device_id", deviceID, "err", err)
+					return
+				}
+				deltas[client.PolicyVersion] = delta
+			}
+			if delta != nil {
+				if len(delta.Changes) > 0 && websocket.DefaultHub.SendToClient(client, websocket.Message{
+					Type: "patterns_delta",
+					Data: delta,
+				}) {
+					client.PolicyVersion = delta.Version
+				}
+				continue
+			}
+		}
+
+		if snapshot == nil {
+			if snapshot, err = getSignedPolicySnapshot(ctx, deviceID); err != nil {
+				slog.ErrorContext(ctx, "Failed to get patterns", "device_id", deviceID, "err", err)
+				return
+			}
+		}
+
+		if snapshot.UpgradeRequired {
+			websocket.DefaultHub.SendToClient(client, websocket.Message{
+				Type: "upgrade_required",
+				Data: map[string]interface{}{
+					"min_version": services.GetMinExtensionVersion(ctx),
+				},
+			})
+		}
+
+		if websocket.DefaultHub.SendToClient(client, websocket.Message{
+			Type: "patterns_updated",
+			Data: snapshot,
+		}) {
+			client.PolicySent = true
+			client.PolicyVersion = snapshot.Version
+			client.PolicyRestricted = snapshot.UpgradeRequired
+		}
+	}
+}
+
+// handleSyncMessage answers a sync with the changes since the version the
+// extension has, or the full policy. The connection is recorded as being at
+// the version sent, so later pushes continue from there.
+func handleSyncMessage(ctx context.Context, client *websocket.Client, device *models.Device, message clientMessage) (interface{}, error) {
+	var req SyncRequest
+	if err := decodeMessageData(message.Data, &req); err != nil {
+		return nil, err
+	}
+
+	policyMu.Lock()
+	defer policyMu.Unlock()
+
+	if req.Version > 0 && !services.IsDeviceOutdated(ctx, device) {
+		delta, err := getPolicyDelta(ctx, device.ID, req.Version)
+		if err != nil {
+			return nil, err
+		}
+		if delta != nil {
+			if sendResponse(client, message.ID, SyncResponse{
+				Mode:        "delta",
+				FromVersion: delta.FromVersion,
+				Version:     delta.Version,
+				Changes:     delta.Changes,
+				Bundle:      delta.Bundle,
+			}) {
+				client.PolicySent = true
+				client.PolicyVersion = delta.Version
+				client.PolicyRestricted = false
+			}
+			return queuedReply{}, nil
+		}
+	}
+
+	snapshot, err := getSignedPolicySnapshot(ctx, device.ID)
+	if err != nil {
+		return nil, err
+	}
+	if sendResponse(client, message.ID, SyncResponse{
+		Mode:            "full",
+		Version:         snapshot.Version,
+		Patterns:        snapshot.Patterns,
+		UpgradeRequired: snapshot.UpgradeRequired,
+		Bundle:          snapshot.Bundle,
+	}) {
+		client.PolicySent = true
+		client.PolicyVersion = snapshot.Version
+		client.PolicyRestricted = snapshot.UpgradeRequired
+	}
+	return queuedReply{}, nil
+}
+
+// GetPolicyKey returns the public key policy bundles are signed with (public API)
+func GetPolicyKey(w http.ResponseWriter, r *http.Request) {
+	if services.Signer == nil {
+		http.Error(w, "Policy signing not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PolicyKeyResponse{
+		KeyID:     services.Signer.KeyID(),
+		Algorithm: "Ed25519",
+		PublicKey: services.Signer.PublicKey(),
+	})
+}
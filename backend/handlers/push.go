@@ -20,6 +20,7 @@ type PushSubscriptionRequest struct {
 type NotificationPrefsRequest struct {
 	NotifyNewRequests  bool `json:"notify_new_requests"`
 	NotifyDeviceStatus bool `json:"notify_device_status"`
+	NotifySecurity     bool `json:"notify_security_events"`
 }
 
 // GetVAPIDPublicKey returns the VAPID public key for push subscription
@@ -54,7 +55,7 @@ func SubscribePush(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sub, err := models.CreatePushSubscription(user.ID, req.Endpoint, req.Keys.P256dh, req.Keys.Auth)
+	sub, err := store.WithContext(r.Context()).PushSubscriptions.Create(user.ID, req.Endpoint, req.Keys.P256dh, req.Keys.Auth)
 	if err != nil {
 		http.Error(w, "Failed to create subscription", http.StatusInternalServerError)
 		return
@@ -75,7 +76,7 @@ func UnsubscribePush(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := models.DeletePushSubscription(req.Endpoint); err != nil {
+	if err := store.WithContext(r.Context()).PushSubscriptions.Delete(req.Endpoint); err != nil {
 		http.Error(w, "Failed to delete subscription", http.StatusInternalServerError)
 		return
 	}
@@ -94,8 +95,9 @@ func GetNotificationPrefs(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{
-		"notify_new_requests":  user.NotifyNewRequests,
-		"notify_device_status": user.NotifyDeviceStatus,
+		"notify_new_requests":    user.NotifyNewRequests,
+		"notify_device_status":   user.NotifyDeviceStatus,
+		"notify_security_events": user.NotifySecurity,
 	})
 }
 
@@ -113,7 +115,7 @@ func UpdateNotificationPrefs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := models.UpdateUserNotificationPrefs(user.ID, req.NotifyNewRequests, req.NotifyDeviceStatus); err != nil {
+	if err := store.WithContext(r.Context()).Users.UpdateNotificationPrefs(user.ID, req.NotifyNewRequests, req.NotifyDeviceStatus, req.NotifySecurity); err != nil {
 		http.Error(w, "Failed to update preferences", http.StatusInternalServerError)
 		return
 	}
@@ -130,7 +132,7 @@ func GetPushSubscriptions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	subs, err := models.GetPushSubscriptionsByUser(user.ID)
+	subs, err := store.WithContext(r.Context()).PushSubscriptions.ListByUser(user.ID)
 	if err != nil {
 		http.Error(w, "Failed to get subscriptions", http.StatusInternalServerError)
 		return
@@ -145,4 +147,3 @@ func GetPushSubscriptions(w http.ResponseWriter, r *http.Request) {
 		"subscriptions": subs,
 	})
 }
-
@@ -0,0 +1,62 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/watchtower/web/handlers"
+	"github.com/watchtower/web/models"
+)
+
+func TestPushSubscriptions(t *testing.T) {
+	ts := newAdminServer(t)
+
+	// Push isn't initialized in tests
+	ts.expect("GET", "/api/admin/push/vapid-key", nil, http.StatusServiceUnavailable, nil)
+
+	subscribe := handlers.PushSubscriptionRequest{Endpoint: "https://push.example.com/1"}
+	ts.expect("POST", "/api/admin/push/subscribe", subscribe, http.StatusBadRequest, nil)
+
+	subscribe.Keys.P256dh = "key"
+	subscribe.Keys.Auth = "auth"
+	ts.expect("POST", "/api/admin/push/subscribe", subscribe, http.StatusCreated, nil)
+
+	// Subscribing the same endpoint again replaces it
+	subscribe.Keys.Auth = "auth2"
+	ts.expect("POST", "/api/admin/push/subscribe", subscribe, http.StatusCreated, nil)
+
+	var subs struct {
+		Subscriptions []models.PushSubscription `json:"subscriptions"`
+	}
+	ts.expect("GET", "/api/admin/push/subscriptions", nil, http.StatusOK, &subs)
+	if len(subs.Subscriptions) != 1 || subs.Subscriptions[0].Auth != "auth2" {
+		t.Fatalf("unexpected subscriptions %+v", subs.Subscriptions)
+	}
+
+	ts.expect("POST", "/api/admin/push/unsubscribe", map[string]string{"endpoint": subscribe.Endpoint}, http.StatusOK, nil)
+	ts.expect("GET", "/api/admin/push/subscriptions", nil, http.StatusOK, &subs)
+	if len(subs.Subscriptions) != 0 {
+		t.Fatalf("subscription still listed after unsubscribing")
+	}
+}
+
+func TestNotificationPrefs(t *testing.T) {
+	ts := newAdminServer(t)
+
+	var prefs map[string]bool
+	ts.expect("GET", "/api/admin/notifications/prefs", nil, http.StatusOK, &prefs)
+	if !prefs["notify_new_requests"] || !prefs["notify_device_status"] || !prefs["notify_security_events"] {
+		t.Fatalf("notifications not all on by default: %v", prefs)
+	}
+
+	ts.expect("PUT", "/api/admin/notifications/prefs", handlers.NotificationPrefsRequest{NotifySecurity: true}, http.StatusOK, nil)
+	ts.expect("GET", "/api/admin/notifications/prefs", nil, http.StatusOK, &prefs)
+	if prefs["notify_new_requests"] || prefs["notify_device_status"] || !prefs["notify_security_events"] {
+		t.Fatalf("unexpected preferences after update: %v", prefs)
+	}
+
+	users, err := ts.store.Users.ListForNotification("new_request")
+	if err != nil || len(users) != 0 {
+		t.Fatalf("admin still gets new request notifications: %v %v", users, err)
+	}
+}
@@ -1,15 +1,18 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/watchtower/web/metrics"
 	"github.com/watchtower/web/middleware"
 	"github.com/watchtower/web/models"
 	"github.com/watchtower/web/services"
-	"github.com/gorilla/mux"
 )
 
 type AccessRequest struct {
@@ -42,32 +45,45 @@ func CreateRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.URL == "" {
-		http.Error(w, "URL is required", http.StatusBadRequest)
+	accessReq, err := createAccessRequest(r.Context(), device, req)
+	if err != nil {
+		writeAPIError(w, err, "Failed to create request")
 		return
 	}
 
-	accessReq, err := models.CreateRequest(device.ID, req.URL, req.SuggestedPattern)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(accessReq)
+}
+
+// createAccessRequest stores an access request and notifies admins. It is
+// shared by the HTTP and WebSocket APIs.
+func createAccessRequest(ctx context.Context, device *models.Device, req AccessRequest) (*models.Request, error) {
+	if req.URL == "" {
+		return nil, badRequest("url_required", "URL is required")
+	}
+
+	accessReq, err := store.WithContext(ctx).Requests.Create(device.ID, req.URL, req.SuggestedPattern)
 	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	// Send push notification for new request
 	if services.Push != nil {
-		go services.Push.NotifyNewRequest(device.Name, req.URL)
+		services.RunBackground(func() { services.Push.NotifyNewRequest(ctx, device.Name, req.URL) })
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(accessReq)
+	accessReq.DeviceName = device.Name
+	services.PublishAdminEvent(ctx, "request_created", services.RequestEvent{Request: accessReq})
+
+	return accessReq, nil
 }
 
 // ListRequests returns all access requests (admin API)
 func ListRequests(w http.ResponseWriter, r *http.Request) {
 	status := r.URL.Query().Get("status")
 
-	requests, err := models.ListRequests(status)
+	requests, err := store.WithContext(r.Context()).Requests.List(status)
 	if err != nil {
 		http.Error(w, "Failed to get requests", http.StatusInternalServerError)
 		return
@@ -106,7 +122,7 @@ func ApproveRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the request to find device_id
-	accessReq, err := models.GetRequestByID(id)
+	accessReq, err := store.WithContext(r.Context()).Requests.GetByID(id)
 	if err != nil {
 		http.Error(w, "Request not found", http.StatusNotFound)
 		return
@@ -127,20 +143,23 @@ func ApproveRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create the pattern
-	pattern, err := models.CreatePattern(accessReq.DeviceID, body.Pattern, body.Type, expiresAt)
+	pattern, err := store.WithContext(r.Context()).Patterns.Create(accessReq.DeviceID, body.Pattern, body.Type, expiresAt)
 	if err != nil {
 		http.Error(w, "Failed to create pattern", http.StatusInternalServerError)
 		return
 	}
 
 	// Mark request as approved
-	if err := models.ApproveRequest(id); err != nil {
+	if err := store.WithContext(r.Context()).Requests.Approve(id); err != nil {
 		http.Error(w, "Failed to update request", http.StatusInternalServerError)
 		return
 	}
 
 	// Notify device via WebSocket
-	go NotifyDevicePatternUpdate(accessReq.DeviceID)
+	services.RunBackground(func() { NotifyDevicePatternUpdate(r.Context(), accessReq.DeviceID) })
+
+	publishRequestResolved(r, id)
+	publishPatternChanged(r, "created", pattern.ID, pattern)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -158,12 +177,36 @@ func DenyRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := models.DenyRequest(id); err != nil {
+	if err := store.WithContext(r.Context()).Requests.Deny(id); err != nil {
 		http.Error(w, "Failed to deny request", http.StatusInternalServerError)
 		return
 	}
 
+	publishRequestResolved(r, id)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
+// publishRequestResolved tells admin dashboards that a request was approved or
+// denied, and records how long it waited
+func publishRequestResolved(r *http.Request, id int64) {
+	accessReq, err := store.WithContext(r.Context()).Requests.GetByID(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get access request for admin event", "access_request_id", id, "err", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Access request resolved", "access_request_id", id, "status", accessReq.Status, "by", adminName(r))
+	if accessReq.ResolvedAt != nil {
+		metrics.ObserveRequestDecision(accessReq.Status, accessReq.ResolvedAt.Sub(accessReq.CreatedAt))
+	}
+	services.PublishAdminEvent(r.Context(), "request_resolved", services.RequestEvent{Request: accessReq, By: adminName(r)})
+}
+
+// adminName returns the username of the admin making a request
+func adminName(r *http.Request) string {
+	if user := middleware.GetUserFromContext(r); user != nil {
+		return user.Username
+	}
+	return ""
+}
@@ -0,0 +1,67 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/watchtower/web/handlers"
+	"github.com/watchtower/web/models"
+)
+
+func TestApproveRequest(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+
+	ts.asDevice(device.Token, "POST", "/api/requests", map[string]string{}, http.StatusBadRequest, nil)
+
+	var created models.Request
+	ts.asDevice(device.Token, "POST", "/api/requests", handlers.AccessRequest{
+		URL:              "https://example.com/page",
+		SuggestedPattern: "example.com",
+	}, http.StatusCreated, &created)
+	if created.Status != "pending" || created.DeviceName != "laptop" {
+		t.Fatalf("unexpected request %+v", created)
+	}
+
+	var pending handlers.RequestsResponse
+	ts.expect("GET", "/api/admin/requests?status=pending", nil, http.StatusOK, &pending)
+	if len(pending.Requests) != 1 || pending.Requests[0].URL != "https://example.com/page" {
+		t.Fatalf("unexpected pending requests %+v", pending.Requests)
+	}
+
+	ts.expect("POST", "/api/admin/requests/1/approve", handlers.ApproveRequestBody{}, http.StatusBadRequest, nil)
+	ts.expect("POST", "/api/admin/requests/2/approve", handlers.ApproveRequestBody{Pattern: "example.com"}, http.StatusNotFound, nil)
+	ts.expect("POST", "/api/admin/requests/1/approve", handlers.ApproveRequestBody{Pattern: "example.com", Duration: "30m"}, http.StatusOK, nil)
+
+	// The device gets the new pattern
+	var patterns handlers.PatternResponse
+	ts.asDevice(device.Token, "GET", "/api/patterns", nil, http.StatusOK, &patterns)
+	if len(patterns.Patterns) != 1 || patterns.Patterns[0].Type != "allow" || patterns.Patterns[0].ExpiresAt == nil {
+		t.Fatalf("unexpected patterns after approval %+v", patterns.Patterns)
+	}
+
+	ts.expect("GET", "/api/admin/requests?status=pending", nil, http.StatusOK, &pending)
+	if len(pending.Requests) != 0 {
+		t.Fatalf("approved request is still pending")
+	}
+}
+
+func TestDenyRequest(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+	ts.asDevice(device.Token, "POST", "/api/requests", handlers.AccessRequest{URL: "https://example.com"}, http.StatusCreated, nil)
+
+	ts.expect("POST", "/api/admin/requests/1/deny", nil, http.StatusOK, nil)
+
+	var all handlers.RequestsResponse
+	ts.expect("GET", "/api/admin/requests", nil, http.StatusOK, &all)
+	if len(all.Requests) != 1 || all.Requests[0].Status != "denied" || all.Requests[0].ResolvedAt == nil {
+		t.Fatalf("unexpected requests after denial %+v", all.Requests)
+	}
+
+	var patterns handlers.PatternResponse
+	ts.asDevice(device.Token, "GET", "/api/patterns", nil, http.StatusOK, &patterns)
+	if len(patterns.Patterns) != 0 {
+		t.Fatalf("denied request created patterns %+v", patterns.Patterns)
+	}
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/watchtower/web/middleware"
+	"github.com/watchtower/web/models"
+)
+
+// store is where handlers read and write their data, set once at startup
+var store *models.Store
+
+// SetStore sets the store used by the handlers
+func SetStore(s *models.Store) {
+	store = s
+}
+
+// NewRouter returns the routes of the device and admin APIs, with the admin
+// UI served by ui
+func NewRouter(ui http.Handler) *mux.Router {
+	r := mux.NewRouter()
+
+	// Request IDs and logging first, so everything after logs with the ID,
+	// then CORS and metrics
+	chain := []mux.MiddlewareFunc{middleware.RequestLog, middleware.CORS, middleware.Metrics}
+	r.Use(chain...)
+
+	// Middleware added with Use only runs for requests a route matches, so
+	// 404 and 405 answers go through the same chain to be logged and counted
+	r.NotFoundHandler = withMiddleware(http.NotFoundHandler(), chain)
+	r.MethodNotAllowedHandler = withMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}), chain)
+
+	// Prometheus metrics
+	r.HandleFunc("/metrics", GetMetrics).Methods("GET")
+
+	// Public API routes (token auth for extension)
+	api := r.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/patterns", middleware.TokenAuth(GetPatterns)).Methods("GET", "OPTIONS")
+	api.HandleFunc("/requests", middleware.TokenAuth(CreateRequest)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/heartbeat", middleware.TokenAuth(DeviceHeartbeat)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/events", middleware.TokenAuth(ReportDeviceEvent)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/uninstall-url", middleware.TokenAuth(GetUninstallURL)).Methods("GET", "OPTIONS")
+	api.HandleFunc("/uninstall", DeviceUninstall).Methods("GET", "POST", "OPTIONS")
+	api.HandleFunc("/ws", HandleWebSocket).Methods("GET")
+	api.HandleFunc("/enroll", RedeemEnrollment).Methods("POST", "OPTIONS")
+	api.HandleFunc("/policy-key", GetPolicyKey).Methods("GET", "OPTIONS")
+
+	// Local CA certificate, public so family devices can install it
+	api.HandleFunc("/tls/ca.crt", DownloadCACertificate).Methods("GET", "OPTIONS")
+
+	// Auth routes
+	api.HandleFunc("/auth/login", Login).Methods("POST", "OPTIONS")
+	api.HandleFunc("/auth/logout", middleware.SessionAuth(Logout)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/auth/change-password", middleware.SessionAuth(ChangePassword)).Methods("POST", "OPTIONS")
+
+	// Setup routes (public, only work when no users exist)
+	api.HandleFunc("/setup/status", CheckSetupNeeded).Methods("GET", "OPTIONS")
+	api.HandleFunc("/setup/create-user", SetupFirstUser).Methods("POST", "OPTIONS")
+
+	// Admin routes (session auth)
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(middleware.SessionAuthMiddleware)
+
+	// Requests management
+	admin.HandleFunc("/requests", ListRequests).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/requests/{id}/approve", ApproveRequest).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/requests/{id}/deny", DenyRequest).Methods("POST", "OPTIONS")
+
+	// Patterns management
+	admin.HandleFunc("/patterns", ListAllPatterns).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/patterns", CreatePattern).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/patterns/{id}", UpdatePattern).Methods("PUT", "OPTIONS")
+	admin.HandleFunc("/patterns/{id}", DeletePattern).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/patterns/{id}/toggle", TogglePattern).Methods("POST", "OPTIONS")
+
+	// Devices management
+	admin.HandleFunc("/devices", ListDevices).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/devices", CreateDevice).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/devices/{id}", DeleteDevice).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/devices/{id}/regenerate-token", RegenerateDeviceToken).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/devices/{id}/enrollments", CreateEnrollment).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/devices/{id}/events", ListDeviceEvents).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/devices/{id}/status-history", GetDeviceStatusHistory).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/devices/{id}/uptime", GetDeviceUptime).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/devices/{id}/inventory-history", GetDeviceInventoryHistory).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/devices/{id}/commands", ListDeviceCommands).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/devices/{id}/commands", SendDeviceCommand).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/commands/{id}", GetDeviceCommand).Methods("GET", "OPTIONS")
+
+	// Device enrollment codes
+	admin.HandleFunc("/enrollments", ListEnrollments).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/enrollments/{id}", RevokeEnrollment).Methods("DELETE", "OPTIONS")
+
+	// WebSocket connections and the admin event stream
+	admin.HandleFunc("/ws", HandleAdminWebSocket).Methods("GET")
+	admin.HandleFunc("/ws/stats", GetWebSocketStats).Methods("GET", "OPTIONS")
+
+	// Extension version policy
+	admin.HandleFunc("/extension-version", GetExtensionVersionPolicy).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/extension-version", UpdateExtensionVersionPolicy).Methods("PUT", "OPTIONS")
+
+	// Users management
+	admin.HandleFunc("/users", ListUsers).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/users", CreateUser).Methods("POST", "OPTIONS")
+
+	// Database backup
+	admin.HandleFunc("/backup", DownloadBackup).Methods("GET", "OPTIONS")
+
+	// Effective configuration
+	admin.HandleFunc("/config", GetConfig).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/tls", GetTLSInfo).Methods("GET", "OPTIONS")
+
+	// Push notifications
+	admin.HandleFunc("/push/vapid-key", GetVAPIDPublicKey).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/push/subscribe", SubscribePush).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/push/unsubscribe", UnsubscribePush).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/push/subscriptions", GetPushSubscriptions).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/notifications/prefs", GetNotificationPrefs).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/notifications/prefs", UpdateNotificationPrefs).Methods("PUT", "OPTIONS")
+
+	// Serve static files for admin UI
+	r.Handle("/admin", http.RedirectHandler("/admin/", http.StatusMovedPermanently))
+	r.PathPrefix("/admin/").Handler(http.StripPrefix("/admin", ui))
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/admin/", http.StatusFound)
+	})
+
+	return r
+}
+
+// withMiddleware wraps h in chain, the first middleware outermost
+func withMiddleware(h http.Handler, chain []mux.MiddlewareFunc) http.Handler {
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	return h
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The admin UI is served with its asset references in index.html rewritten
+// to carry a hash of the asset's content (app.js?v=1a2b3c...). Browsers keep
+// a hashed asset for a year and fetch it again only once index.html points at
+// a new hash. Everything else, index.html and the service worker included, is
+// revalidated on every load by its ETag.
+
+const (
+	immutableCacheControl  = "public, max-age=31536000, immutable"
+	revalidateCacheControl = "no-cache"
+	assetVersionParam      = "v"
+	staticIndexFile        = "index.html"
+)
+
+// assetRefPattern matches the local scripts and stylesheets index.html links to
+var assetRefPattern = regexp.MustCompile(`(?:src|href)="([^":?#]+\.(?:js|css))"`)
+
+// staticAsset is a file of the admin UI
+type staticAsset struct {
+	content []byte
+	hash    string
+}
+
+type staticAssets map[string]*staticAsset
+
+// staticHandler serves the admin UI from files
+type staticHandler struct {
+	files  fs.FS
+	live   bool
+	assets staticAssets
+}
+
+// NewStaticHandler serves the admin UI in files. Unless live is set, the
+// files are read once; with live set they are read again on every request,
+// so edits show up on reload.
+func NewStaticHandler(files fs.FS, live bool) (http.Handler, error) {
+	h := &staticHandler{files: files, live: live}
+	if !live {
+		assets, err := loadStaticAssets(files)
+		if err != nil {
+			return nil, err
+		}
+		h.assets = assets
+	}
+	return h, nil
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	assets := h.assets
+	if h.live {
+		var err error
+		if assets, err = loadStaticAssets(h.files); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to read admin UI files", "err", err)
+			http.Error(w, "Failed to read admin UI", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = staticIndexFile
+	}
+	asset, ok := assets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Only a request for the current hash may be cached for good; an old
+	// index.html asking for an old hash gets today's file, revalidated
+	if v := r.URL.Query().Get(assetVersionParam); v != "" && v == asset.hash {
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", revalidateCacheControl)
+	}
+	w.Header().Set("ETag", `"`+asset.hash+`"`)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(asset.content))
+}
+
+// loadStaticAssets reads and hashes every file, then points index.html at
+// the hashed asset URLs
+func loadStaticAssets(files fs.FS) (staticAssets, error) {
+	assets := make(staticAssets)
+	err := fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		assets[name] = &staticAsset{content: content, hash: contentHash(content)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if index, ok := assets[staticIndexFile]; ok {
+		content := assetRefPattern.ReplaceAllFunc(index.content, func(ref []byte) []byte {
+			name := string(assetRefPattern.FindSubmatch(ref)[1])
+			asset, ok := assets[path.Clean(name)]
+			if !ok {
+				return ref
+			}
+			return bytes.Replace(ref, []byte(`"`+name+`"`), []byte(`"`+name+"?"+assetVersionParam+"="+asset.hash+`"`), 1)
+		})
+		assets[staticIndexFile] = &staticAsset{content: content, hash: contentHash(content)}
+	}
+	return assets, nil
+}
+
+// contentHash is a short hash of an asset's content, for URLs and ETags
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:8])
+}
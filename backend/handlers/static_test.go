@@ -0,0 +1,111 @@
+package handlers_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"testing/fstest"
+
+	"github.com/watchtower/web/handlers"
+	"github.com/watchtower/web/static"
+)
+
+func serveStatic(t *testing.T, h http.Handler, path string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req := httptest.NewRequest("GET", path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body, _ := io.ReadAll(rec.Result().Body)
+	return rec.Result(), string(body)
+}
+
+var hashedRef = regexp.MustCompile(`src="app\.js\?v=([0-9a-f]+)"`)
+
+func TestStaticCaching(t *testing.T) {
+	files := fstest.MapFS{
+		"index.html": {Data: []byte(`<link rel="stylesheet" href="styles.css"><script src="app.js"></script><a href="https://example.com/x.js">`)},
+		"app.js":     {Data: []byte(`console.log(1)`)},
+		"styles.css": {Data: []byte(`body {}`)},
+		"sw.js":      {Data: []byte(`self.skipWaiting()`)},
+	}
+	h, err := handlers.NewStaticHandler(files, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, index := serveStatic(t, h, "/", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("index: status %d, Cache-Control %q", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+	match := hashedRef.FindStringSubmatch(index)
+	if match == nil || !regexp.MustCompile(`href="styles\.css\?v=[0-9a-f]+"`).MatchString(index) {
+		t.Fatalf("asset references not hashed: %s", index)
+	}
+	if !regexp.MustCompile(`href="https://example\.com/x\.js"`).MatchString(index) {
+		t.Fatalf("external reference rewritten: %s", index)
+	}
+
+	// The hashed URL is cached for good, the plain one revalidated
+	resp, body := serveStatic(t, h, "/app.js?v="+match[1], nil)
+	if body != "console.log(1)" || resp.Header.Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Fatalf("hashed asset: Cache-Control %q, body %q", resp.Header.Get("Cache-Control"), body)
+	}
+	if resp, _ := serveStatic(t, h, "/app.js?v=stale", nil); resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("stale hash cached: %q", resp.Header.Get("Cache-Control"))
+	}
+	if resp, _ := serveStatic(t, h, "/sw.js", nil); resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("service worker cached: %q", resp.Header.Get("Cache-Control"))
+	}
+
+	// Revalidation is answered from the ETag
+	etag := resp.Header.Get("ETag")
+	if resp, _ := serveStatic(t, h, "/app.js", http.Header{"If-None-Match": {etag}}); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("got status %d for a matching ETag, want 304", resp.StatusCode)
+	}
+
+	if resp, _ := serveStatic(t, h, "/missing.js", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %d for a missing file, want 404", resp.StatusCode)
+	}
+}
+
+func TestStaticLive(t *testing.T) {
+	files := fstest.MapFS{
+		"index.html": {Data: []byte(`<script src="app.js"></script>`)},
+		"app.js":     {Data: []byte(`console.log(1)`)},
+	}
+	h, err := handlers.NewStaticHandler(files, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, before := serveStatic(t, h, "/", nil)
+	files["app.js"] = &fstest.MapFile{Data: []byte(`console.log(2)`)}
+	_, after := serveStatic(t, h, "/", nil)
+	if hashedRef.FindStringSubmatch(before)[1] == hashedRef.FindStringSubmatch(after)[1] {
+		t.Fatal("edited asset kept its hash")
+	}
+	if _, body := serveStatic(t, h, "/app.js", nil); body != "console.log(2)" {
+		t.Fatalf("got %q, want the edited file", body)
+	}
+}
+
+func TestEmbeddedAdminUI(t *testing.T) {
+	h, err := handlers.NewStaticHandler(static.Files, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, index := serveStatic(t, h, "/", nil)
+	match := hashedRef.FindStringSubmatch(index)
+	if match == nil {
+		t.Fatal("embedded index.html doesn't load a hashed app.js")
+	}
+	if resp, _ := serveStatic(t, h, "/app.js?v="+match[1], nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d for the embedded app.js", resp.StatusCode)
+	}
+}
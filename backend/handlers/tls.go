@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/watchtower/web/services"
+)
+
+// TLSInfo describes how the server is serving HTTPS
+type TLSInfo struct {
+	Enabled     bool             `json:"enabled"`
+	Certificate *CertificateInfo `json:"certificate,omitempty"`
+	LocalCA     *CertificateInfo `json:"local_ca,omitempty"`
+	CAURL       string           `json:"ca_url,omitempty"`
+}
+
+// CertificateInfo is what an admin needs to check a certificate
+type CertificateInfo struct {
+	Subject           string    `json:"subject"`
+	Issuer            string    `json:"issuer"`
+	DNSNames          []string  `json:"dns_names,omitempty"`
+	IPAddresses       []string  `json:"ip_addresses,omitempty"`
+	PermittedNames    []string  `json:"permitted_names,omitempty"` // names a CA may issue certificates for
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+	FingerprintSHA256 string    `json:"fingerprint_sha256"`
+}
+
+func describeCertificate(cert *x509.Certificate) *CertificateInfo {
+	info := &CertificateInfo{
+		Subject:           cert.Subject.CommonName,
+		Issuer:            cert.Issuer.CommonName,
+		DNSNames:          cert.DNSNames,
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		FingerprintSHA256: services.CertFingerprint(cert),
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	info.PermittedNames = append(info.PermittedNames, cert.PermittedDNSDomains...)
+	for _, r := range cert.PermittedIPRanges {
+		if ones, bits := r.Mask.Size(); ones == bits {
+			info.PermittedNames = append(info.PermittedNames, r.IP.String())
+		} else {
+			info.PermittedNames = append(info.PermittedNames, r.String())
+		}
+	}
+	return info
+}
+
+// GetTLSInfo returns the certificate being served and the local CA, if
+// there is one (admin API)
+func GetTLSInfo(w http.ResponseWriter, r *http.Request) {
+	var info TLSInfo
+	if services.TLSCert != nil {
+		info.Enabled = true
+		info.Certificate = describeCertificate(services.TLSCert.Leaf())
+	}
+	if services.CA != nil {
+		info.LocalCA = describeCertificate(services.CA.Certificate())
+		info.CAURL = "/api/tls/ca.crt"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// DownloadCACertificate sends the local CA certificate for devices to trust.
+// It is public: a CA certificate holds no secret, and the devices installing
+// it have no admin login. Admins compare its fingerprint with the one shown
+// in the admin panel.
+func DownloadCACertificate(w http.ResponseWriter, r *http.Request) {
+	if services.CA == nil {
+		http.Error(w, "No local CA", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="watchtower-ca.crt"`)
+	w.Write(services.CA.CertificatePEM())
+}
@@ -0,0 +1,113 @@
+package handlers_test
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/watchtower/web/handlers"
+	"github.com/watchtower/web/services"
+)
+
+func TestTLSWithoutLocalCA(t *testing.T) {
+	ts := newAdminServer(t)
+
+	var info handlers.TLSInfo
+	ts.expect("GET", "/api/admin/tls", nil, http.StatusOK, &info)
+	if info.Enabled || info.LocalCA != nil {
+		t.Fatalf("unexpected TLS info %+v", info)
+	}
+	ts.expect("GET", "/api/tls/ca.crt", nil, http.StatusNotFound, nil)
+}
+
+func TestLocalCA(t *testing.T) {
+	ts := newAdminServer(t)
+
+	dir := t.TempDir()
+	if err := services.InitLocalCA(dir, []string{"watchtower.home", "192.168.1.10"}); err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := services.NewCertReloader(services.CA.ServerCertFiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	services.TLSCert = reloader
+	t.Cleanup(func() { services.CA, services.TLSCert = nil, nil })
+
+	var info handlers.TLSInfo
+	ts.expect("GET", "/api/admin/tls", nil, http.StatusOK, &info)
+	if !info.Enabled || info.LocalCA == nil || info.Certificate == nil || info.CAURL != "/api/tls/ca.crt" {
+		t.Fatalf("unexpected TLS info %+v", info)
+	}
+
+	// The CA can be downloaded without logging in
+	resp, err := http.Get(ts.server.URL + info.CAURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	block, _ := pem.Decode(data)
+	if resp.StatusCode != http.StatusOK || block == nil {
+		t.Fatalf("got status %d and no certificate", resp.StatusCode)
+	}
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := services.CertFingerprint(caCert); got != info.LocalCA.FingerprintSHA256 {
+		t.Fatalf("downloaded CA has fingerprint %s, admin panel shows %s", got, info.LocalCA.FingerprintSHA256)
+	}
+
+	// A device trusting the CA accepts the server certificate for every
+	// configured name
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	for _, name := range []string{"localhost", "watchtower.home", "192.168.1.10"} {
+		if _, err := reloader.Leaf().Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("server certificate not valid for %s: %v", name, err)
+		}
+	}
+
+	// The CA is limited to the server's names, so its key can't vouch for
+	// other sites
+	permitted := strings.Join(info.LocalCA.PermittedNames, " ")
+	if !strings.Contains(permitted, "watchtower.home") || !strings.Contains(permitted, "192.168.1.10") {
+		t.Fatalf("CA permits %v", info.LocalCA.PermittedNames)
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	caKey, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, other := range []*x509.Certificate{
+		{SerialNumber: big.NewInt(2), DNSNames: []string{"bank.example"}},
+		{SerialNumber: big.NewInt(3), IPAddresses: []net.IP{net.ParseIP("203.0.113.5")}},
+	} {
+		other.NotBefore, other.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(rand.Reader, other, caCert, caCert.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forged, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := forged.Verify(x509.VerifyOptions{Roots: roots}); err == nil {
+			t.Errorf("CA vouches for %v %v", other.DNSNames, other.IPAddresses)
+		}
+	}
+}
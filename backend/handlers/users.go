@@ -18,7 +18,7 @@ type UsersResponse struct {
 
 // ListUsers returns all admin users (admin API)
 func ListUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := models.ListUsers()
+	users, err := store.WithContext(r.Context()).Users.List()
 	if err != nil {
 		http.Error(w, "Failed to get users", http.StatusInternalServerError)
 		return
@@ -45,7 +45,7 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := models.CreateUser(req.Username, req.Password)
+	user, err := store.WithContext(r.Context()).Users.Create(req.Username, req.Password)
 	if err != nil {
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
@@ -55,4 +55,3 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(user)
 }
-
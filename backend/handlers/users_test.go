@@ -0,0 +1,24 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/watchtower/web/handlers"
+)
+
+func TestUsers(t *testing.T) {
+	ts := newAdminServer(t)
+
+	ts.expect("POST", "/api/admin/users", map[string]string{"username": "second"}, http.StatusBadRequest, nil)
+	ts.expect("POST", "/api/admin/users", map[string]string{"username": "second", "password": "password2"}, http.StatusCreated, nil)
+	ts.expect("POST", "/api/admin/users", map[string]string{"username": "second", "password": "password3"}, http.StatusInternalServerError, nil)
+
+	var users handlers.UsersResponse
+	ts.expect("GET", "/api/admin/users", nil, http.StatusOK, &users)
+	if len(users.Users) != 2 {
+		t.Fatalf("got %d users, want 2", len(users.Users))
+	}
+
+	ts.login("second", "password2")
+}
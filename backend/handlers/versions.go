@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/services"
+)
+
+type ExtensionVersionPolicy struct {
+	MinVersion      string          `json:"min_version"` // "" when not enforced
+	OutdatedDevices []models.Device `json:"outdated_devices"`
+}
+
+type UpdateExtensionVersionRequest struct {
+	MinVersion string `json:"min_version"`
+}
+
+// GetExtensionVersionPolicy returns the minimum extension version and the
+// devices below it (admin API)
+func GetExtensionVersionPolicy(w http.ResponseWriter, r *http.Request) {
+	outdated, err := services.ListOutdatedDevices(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to get devices", http.StatusInternalServerError)
+		return
+	}
+
+	if outdated == nil {
+		outdated = []models.Device{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ExtensionVersionPolicy{
+		MinVersion:      services.GetMinExtensionVersion(r.Context()),
+		OutdatedDevices: outdated,
+	})
+}
+
+// UpdateExtensionVersionPolicy sets the minimum extension version (admin API).
+// Connected devices get their policy re-sent and admins are notified about
+// the devices that are now out of date.
+func UpdateExtensionVersionPolicy(w http.ResponseWriter, r *http.Request) {
+	var req UpdateExtensionVersionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	minVersion := strings.TrimSpace(req.MinVersion)
+	if err := services.SetMinExtensionVersion(r.Context(), minVersion); err != nil {
+		if err == services.ErrInvalidVersion {
+			http.Error(w, "Invalid version, expected a dotted version like 1.2.0", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to update minimum version", http.StatusInternalServerError)
+		return
+	}
+
+	outdated, err := services.ListOutdatedDevices(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to get devices", http.StatusInternalServerError)
+		return
+	}
+
+	if outdated == nil {
+		outdated = []models.Device{}
+	}
+
+	var names []string
+	for _, device := range outdated {
+		names = append(names, device.Name)
+	}
+
+	// Lift or impose the fallback policy on every device
+	if devices, err := store.WithContext(r.Context()).Devices.List(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list devices after minimum version change", "err", err)
+	} else {
+		for _, device := range devices {
+			services.RunBackground(func() { NotifyDevicePatternUpdate(r.Context(), device.ID) })
+		}
+	}
+
+	if services.Push != nil {
+		services.RunBackground(func() { services.Push.NotifyOutdatedDevices(r.Context(), names, minVersion) })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ExtensionVersionPolicy{
+		MinVersion:      minVersion,
+		OutdatedDevices: outdated,
+	})
+}
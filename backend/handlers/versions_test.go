@@ -0,0 +1,44 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/watchtower/web/handlers"
+)
+
+func TestExtensionVersionPolicy(t *testing.T) {
+	ts := newAdminServer(t)
+	device := ts.createDevice("laptop")
+	ts.createPattern(device.ID, "example.com", "allow")
+	ts.asDevice(device.Token, "POST", "/api/heartbeat", map[string]interface{}{
+		"inventory": map[string]string{"extension_version": "1.0.0"},
+	}, http.StatusOK, nil)
+
+	ts.expect("PUT", "/api/admin/extension-version", handlers.UpdateExtensionVersionRequest{MinVersion: "1.x"}, http.StatusBadRequest, nil)
+
+	var policy handlers.ExtensionVersionPolicy
+	ts.expect("PUT", "/api/admin/extension-version", handlers.UpdateExtensionVersionRequest{MinVersion: "1.1"}, http.StatusOK, &policy)
+	if policy.MinVersion != "1.1" || len(policy.OutdatedDevices) != 1 {
+		t.Fatalf("unexpected version policy %+v", policy)
+	}
+
+	// Out-of-date devices get the restrictive fallback policy
+	var patterns handlers.PatternResponse
+	ts.asDevice(device.Token, "GET", "/api/patterns", nil, http.StatusOK, &patterns)
+	if !patterns.UpgradeRequired {
+		t.Fatalf("outdated device got its regular policy %+v", patterns)
+	}
+
+	// Turning enforcement off lifts it
+	ts.expect("PUT", "/api/admin/extension-version", handlers.UpdateExtensionVersionRequest{}, http.StatusOK, nil)
+	ts.expect("GET", "/api/admin/extension-version", nil, http.StatusOK, &policy)
+	if policy.MinVersion != "" || len(policy.OutdatedDevices) != 0 {
+		t.Fatalf("unexpected version policy %+v", policy)
+	}
+	var lifted handlers.PatternResponse
+	ts.asDevice(device.Token, "GET", "/api/patterns", nil, http.StatusOK, &lifted)
+	if lifted.UpgradeRequired || len(lifted.Patterns) != 1 {
+		t.Fatalf("unexpected policy after lifting the minimum %+v", lifted)
+	}
+}
@@ -1,24 +1,51 @@
 package handlers
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	ws "github.com/gorilla/websocket"
+	"github.com/watchtower/web/logging"
+	"github.com/watchtower/web/middleware"
 	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/services"
 	"github.com/watchtower/web/websocket"
-	ws "github.com/gorilla/websocket"
+)
+
+// Browsers can't set an Authorization header on WebSocket connections, so the
+// extension offers two subprotocols: wsProtocol, which the server selects, and
+// wsTokenProtocolPrefix followed by the device token, which carries the credential.
+const (
+	wsProtocol            = "watchtower.v1"
+	wsTokenProtocolPrefix = "watchtower.token."
 )
 
 var upgrader = ws.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{wsProtocol},
 	CheckOrigin: func(r *http.Request) bool {
 		// Allow connections from browser extensions
 		return true
 	},
 }
 
+// tokenFromSubprotocols extracts the device token offered in Sec-WebSocket-Protocol
+func tokenFromSubprotocols(r *http.Request) string {
+	for _, protocol := range ws.Subprotocols(r) {
+		if strings.HasPrefix(protocol, wsTokenProtocolPrefix) {
+			return strings.TrimPrefix(protocol, wsTokenProtocolPrefix)
+		}
+	}
+	return ""
+}
+
 const (
 	// Time allowed to write a message to the peer
 	writeWait = 10 * time.Second
@@ -29,21 +56,24 @@ const (
 	// Send pings to peer with this period (must be less than pongWait)
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer
-	maxMessageSize = 512
+	// Maximum message size allowed from peer; large enough for access
+	// requests with long URLs and event reports with details
+	maxMessageSize = 16 * 1024
 )
 
 // HandleWebSocket handles WebSocket connections from browser extensions
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Get token from query parameter
-	token := r.URL.Query().Get("token")
+	// Get token from the Sec-WebSocket-Protocol header
+	token := tokenFromSubprotocols(r)
 	if token == "" {
 		http.Error(w, "Missing token", http.StatusUnauthorized)
 		return
 	}
 
 	// Validate token and get device
-	device, err := models.GetDeviceByToken(token)
+	ctx := r.Context()
+	store := store.WithContext(ctx)
+	device, err := store.Devices.GetByToken(token)
 	if err != nil {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
@@ -52,7 +82,7 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Upgrade connection to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		slog.WarnContext(ctx, "WebSocket upgrade failed", "device_id", device.ID, "err", err)
 		return
 	}
 
@@ -62,47 +92,36 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		Conn:        conn,
 		DeviceID:    device.ID,
 		DeviceToken: token,
-		Send:        make(chan []byte, 256),
+		Send:        make(chan []byte, websocket.SendBufferSize),
+		ConnectedAt: time.Now().UTC(),
+		RemoteAddr:  middleware.ClientAddr(r),
+		RequestID:   logging.RequestID(ctx),
 	}
 
 	// Register client with hub
 	websocket.DefaultHub.Register(client)
 
 	// Update device heartbeat on connection
-	if err := models.UpdateDeviceHeartbeat(device.ID); err != nil {
-		log.Printf("Failed to update heartbeat on WS connect for device %d: %v", device.ID, err)
+	if change, err := store.Devices.UpdateHeartbeat(device.ID, "websocket_connect"); err != nil {
+		slog.ErrorContext(ctx, "Failed to update heartbeat on WebSocket connect", "device_id", device.ID, "err", err)
+	} else {
+		services.PublishDeviceStatusChange(ctx, change)
+	}
+
+	// An extension still using its rotated-out token gets a fresh one
+	if device.UsedPreviousToken {
+		services.RunBackground(func() { reissueDeviceToken(ctx, device) })
 	}
 
-	// Send initial patterns
-	go sendInitialPatterns(client, device.ID)
+	// Send the full policy and the commands queued while offline
+	services.RunBackground(func() { pushDevicePolicy(ctx, device.ID, false) })
+	services.RunBackground(func() { deliverPendingCommands(ctx, device.ID) })
 
 	// Start read and write pumps
 	go writePump(client)
 	go readPump(client)
 }
 
-// sendInitialPatterns sends the current patterns to a newly connected client
-func sendInitialPatterns(client *websocket.Client, deviceID int64) {
-	patterns, err := models.GetPatternsByDevice(deviceID)
-	if err != nil {
-		log.Printf("Failed to get patterns for device %d: %v", deviceID, err)
-		return
-	}
-
-	if patterns == nil {
-		patterns = []models.Pattern{}
-	}
-
-	message := websocket.Message{
-		Type: "patterns_updated",
-		Data: map[string]interface{}{
-			"patterns": patterns,
-		},
-	}
-
-	websocket.DefaultHub.SendToDevice(deviceID, message)
-}
-
 // readPump pumps messages from the WebSocket connection to the hub
 func readPump(client *websocket.Client) {
 	defer func() {
@@ -110,27 +129,30 @@ func readPump(client *websocket.Client) {
 		client.Conn.Close()
 	}()
 
+	ctx := client.Context()
 	client.Conn.SetReadLimit(maxMessageSize)
 	client.Conn.SetReadDeadline(time.Now().Add(pongWait))
 	client.Conn.SetPongHandler(func(string) error {
 		client.Conn.SetReadDeadline(time.Now().Add(pongWait))
 		// Update device heartbeat on each pong (device is still connected)
-		if err := models.UpdateDeviceHeartbeat(client.DeviceID); err != nil {
-			log.Printf("Failed to update heartbeat on pong for device %d: %v", client.DeviceID, err)
+		if change, err := store.WithContext(ctx).Devices.UpdateHeartbeat(client.DeviceID, "websocket_pong"); err != nil {
+			slog.ErrorContext(ctx, "Failed to update heartbeat on pong", "device_id", client.DeviceID, "err", err)
+		} else {
+			services.PublishDeviceStatusChange(ctx, change)
 		}
 		return nil
 	})
 
 	for {
-		_, _, err := client.Conn.ReadMessage()
+		_, data, err := client.Conn.ReadMessage()
 		if err != nil {
 			if ws.IsUnexpectedCloseError(err, ws.CloseGoingAway, ws.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				slog.WarnContext(ctx, "WebSocket error", "device_id", client.DeviceID, "err", err)
 			}
 			break
 		}
-		// We don't process incoming messages from clients for now
-		// This could be extended to handle sync requests, etc.
+
+		handleClientMessage(ctx, client, data)
 	}
 }
 
@@ -178,29 +200,122 @@ func writePump(client *websocket.Client) {
 	}
 }
 
-// NotifyDevicePatternUpdate sends a pattern update notification to a device
-func NotifyDevicePatternUpdate(deviceID int64) {
+// tokenMu guards the DeviceToken of websocket.Client, which is updated when
+// a connection is sent a new token
+var tokenMu sync.Mutex
+
+// NotifyDeviceTokenRotated sends a newly issued token to a device's
+// connections on this instance. Tokens don't go through the broker, so the
+// other instances are asked to issue their connections tokens of their own.
+func NotifyDeviceTokenRotated(device *models.Device) {
 	if websocket.DefaultHub == nil {
 		return
 	}
 
-	patterns, err := models.GetPatternsByDevice(deviceID)
-	if err != nil {
-		log.Printf("Failed to get patterns for device %d: %v", deviceID, err)
+	sendDeviceToken(device)
+	websocket.DefaultHub.PublishTokenRotation(device.ID)
+}
+
+// sendDeviceToken sends a newly issued token to a device's connections on
+// this instance
+func sendDeviceToken(device *models.Device) {
+	message := websocket.Message{
+		Type: "token_rotated",
+		Data: map[string]interface{}{
+			"token":                     device.Token,
+			"previous_token_expires_at": device.PreviousTokenExpiresAt,
+		},
+	}
+
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	for _, client := range websocket.DefaultHub.DeviceClients(device.ID) {
+		if websocket.DefaultHub.SendToClient(client, message) {
+			client.DeviceToken = device.Token
+		}
+	}
+}
+
+// ReissueDeviceTokens issues a device's connections on this instance a new
+// token after another instance regenerated it. The connections still hold
+// the token that is now the previous one, which lets them be reissued one as
+// if they had just connected with it.
+func ReissueDeviceTokens(ctx context.Context, deviceID int64) {
+	tokenMu.Lock()
+	var tokens []string
+	for _, client := range websocket.DefaultHub.DeviceClients(deviceID) {
+		tokens = append(tokens, client.DeviceToken)
+	}
+	tokenMu.Unlock()
+
+	for _, token := range tokens {
+		device, err := store.WithContext(ctx).Devices.GetByToken(token)
+		if err == nil && device.ID == deviceID && device.UsedPreviousToken {
+			reissueDeviceToken(ctx, device)
+			return
+		}
+	}
+}
+
+// DisconnectDevice closes all WebSocket connections for a device
+func DisconnectDevice(deviceID int64) {
+	if websocket.DefaultHub == nil {
 		return
 	}
 
-	if patterns == nil {
-		patterns = []models.Pattern{}
+	websocket.DefaultHub.DisconnectDevice(deviceID)
+}
+
+// Devices told the server is restarting wait reconnectDelay plus a random
+// share of reconnectJitter, so they don't all reconnect at once
+const (
+	reconnectDelay  = 2 * time.Second
+	reconnectJitter = 10 * time.Second
+)
+
+// ShutdownWebSockets tells connected devices the server is restarting and
+// when to reconnect, then closes all connections once their queued messages
+// are written
+func ShutdownWebSockets(ctx context.Context) error {
+	if websocket.DefaultHub == nil {
+		return nil
 	}
 
-	message := websocket.Message{
-		Type: "patterns_updated",
+	return websocket.DefaultHub.Shutdown(ctx, websocket.Message{
+		Type: "server_restarting",
 		Data: map[string]interface{}{
-			"patterns": patterns,
+			"reconnect_after_ms":  reconnectDelay.Milliseconds(),
+			"reconnect_jitter_ms": reconnectJitter.Milliseconds(),
 		},
+	})
+}
+
+// reissueDeviceToken hands a fresh token to a device's connections on this
+// instance when they use its previous token during the rotation grace
+// period. When another connection got there first, the device was already
+// sent that connection's token.
+func reissueDeviceToken(ctx context.Context, device *models.Device) {
+	reissued, err := store.WithContext(ctx).Devices.ReissueToken(device)
+	if err == sql.ErrNoRows {
+		slog.DebugContext(ctx, "Device token already replaced, not reissuing", "device_id", device.ID)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to reissue device token", "device_id", device.ID, "err", err)
+		return
 	}
 
-	websocket.DefaultHub.SendToDevice(deviceID, message)
+	slog.InfoContext(ctx, "Device used its previous token, sent a new one", "device_id", device.ID)
+	sendDeviceToken(reissued)
 }
 
+// GetWebSocketStats returns hub-wide connection statistics (admin API)
+func GetWebSocketStats(w http.ResponseWriter, r *http.Request) {
+	stats := websocket.HubStats{}
+	if websocket.DefaultHub != nil {
+		stats = websocket.DefaultHub.Stats()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
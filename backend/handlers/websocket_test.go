@@ -0,0 +1,433 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	"github.com/watchtower/web/handlers"
+	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/services"
+	"github.com/watchtower/web/websocket"
+)
+
+// wsMessage is a message from the server as a device receives it
+type wsMessage struct {
+	Version int              `json:"v"`
+	Type    string           `json:"type"`
+	ReplyTo string           `json:"reply_to"`
+	Data    json.RawMessage  `json:"data"`
+	Error   *websocket.Error `json:"error"`
+}
+
+// wsClient is a device connection that keeps the messages it hasn't been
+// asked for yet
+type wsClient struct {
+	t        *testing.T
+	conn     *ws.Conn
+	received []wsMessage
+}
+
+// dialWebSocket connects to the device WebSocket API, authenticating with
+// the token subprotocol if a token is given
+func (ts *testServer) dialWebSocket(token string) (*wsClient, *http.Response, error) {
+	ts.t.Helper()
+
+	protocols := []string{"watchtower.v1"}
+	if token != "" {
+		protocols = append(protocols, "watchtower.token."+token)
+	}
+	dialer := ws.Dialer{Subprotocols: protocols, HandshakeTimeout: 5 * time.Second}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(ts.server.URL, "http")+"/api/ws", nil)
+	if err != nil {
+		return nil, resp, err
+	}
+	ts.t.Cleanup(func() { conn.Close() })
+	return &wsClient{t: ts.t, conn: conn}, resp, nil
+}
+
+// connect opens a device connection and waits for the work the server
+// starts on connect, the policy push and the delivery of pending commands
+func (ts *testServer) connect(token string) *wsClient {
+	ts.t.Helper()
+
+	c, _, err := ts.dialWebSocket(token)
+	if err != nil {
+		ts.t.Fatalf("dial: %v", err)
+	}
+	c.receiveType("patterns_updated")
+	waitBackground(ts.t)
+	return c
+}
+
+func waitBackground(t *testing.T) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := services.WaitBackground(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// send writes a client message
+func (c *wsClient) send(id, messageType string, data interface{}) {
+	c.t.Helper()
+
+	message := map[string]interface{}{"v": 1, "id": id, "type": messageType, "data": data}
+	if err := c.conn.WriteJSON(message); err != nil {
+		c.t.Fatalf("send %s: %v", messageType, err)
+	}
+}
+
+// request sends a client message and returns the response or error reply to it
+func (c *wsClient) request(id, messageType string, data interface{}) wsMessage {
+	c.t.Helper()
+
+	c.send(id, messageType, data)
+	return c.receive("reply to "+id, func(m wsMessage) bool {
+		return m.ReplyTo == id && (m.Type == "response" || m.Type == "error")
+	})
+}
+
+// receiveType returns the first message of the given type
+func (c *wsClient) receiveType(messageType string) wsMessage {
+	c.t.Helper()
+	return c.receive(messageType, func(m wsMessage) bool { return m.Type == messageType })
+}
+
+// receive returns the first message, already received or not, that match
+// accepts. The messages it passes over are kept for later.
+func (c *wsClient) receive(what string, match func(wsMessage) bool) wsMessage {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		for i, m := range c.received {
+			if match(m) {
+				c.received = append(c.received[:i:i], c.received[i+1:]...)
+				return m
+			}
+		}
+
+		// Messages queued together arrive in one frame, a line each
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.t.Fatalf("waiting for %s: %v", what, err)
+		}
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			var m wsMessage
+			if err := json.Unmarshal(line, &m); err != nil {
+				c.t.Fatalf("decode %q: %v", line, err)
+			}
+			c.received = append(c.received, m)
+		}
+	}
+}
+
+// expectNone checks that no message of the given type was sent before a
+// heartbeat answered now
+func (c *wsClient) expectNone(messageType string) {
+	c.t.Helper()
+
+	c.request("flush", "heartbeat", nil)
+	for _, m := range c.received {
+		if m.Type == messageType {
+			c.t.Fatalf("unexpected %s message: %s", messageType, m.Data)
+		}
+	}
+}
+
+func decodeData(t *testing.T, m wsMessage, out interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(m.Data, out); err != nil {
+		t.Fatalf("decode %s data %q: %v", m.Type, m.Data, err)
+	}
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	ts := newAdminServer(t)
+	ts.startHub()
+	device := ts.createDevice("laptop")
+	ts.createPattern(device.ID, "example.com", "allow")
+
+	for _, token := range []string{"", "not-a-token"} {
+		_, resp, err := ts.dialWebSocket(token)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("token %q: connected or wrong status: %v", token, err)
+		}
+	}
+
+	c, _, err := ts.dialWebSocket(device.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protocol := c.conn.Subprotocol(); protocol != "watchtower.v1" {
+		t.Fatalf("selected subprotocol %q", protocol)
+	}
+
+	// The device is sent its policy when it connects
+	var snapshot handlers.PolicySnapshot
+	decodeData(t, c.receiveType("patterns_updated"), &snapshot)
+	if len(snapshot.Patterns) != 1 || snapshot.Patterns[0].Pattern != "example.com" || snapshot.Bundle == nil {
+		t.Fatalf("got policy %+v", snapshot)
+	}
+
+	var stats websocket.HubStats
+	ts.expect("GET", "/api/admin/ws/stats", nil, http.StatusOK, &stats)
+	if stats.ConnectedDevices != 1 || stats.Connections != 1 {
+		t.Fatalf("got stats %+v", stats)
+	}
+}
+
+func TestWebSocketRequests(t *testing.T) {
+	ts := newAdminServer(t)
+	ts.startHub()
+	device := ts.createDevice("laptop")
+	c := ts.connect(device.Token)
+
+	reply := c.request("1", "heartbeat", map[string]string{"extension_version": "1.0.0"})
+	var heartbeat handlers.HeartbeatResponse
+	decodeData(t, reply, &heartbeat)
+	if reply.Type != "response" || !heartbeat.Success || heartbeat.Status != "active" {
+		t.Fatalf("got reply %+v", reply)
+	}
+
+	reply = c.request("2", "access_request", handlers.AccessRequest{URL: "https://news.example/"})
+	var request models.Request
+	decodeData(t, reply, &request)
+	if reply.Type != "response" || request.DeviceID != device.ID || request.Status != "pending" {
+		t.Fatalf("got reply %+v", reply)
+	}
+
+	for _, tc := range []struct {
+		id, messageType string
+		version         int
+		data            interface{}
+		code            string
+	}{
+		{"3", "teleport", 1, nil, "unknown_type"},
+		{"4", "heartbeat", 2, nil, "unsupported_version"},
+		{"5", "access_request", 1, "not an object", "invalid_data"},
+		{"6", "command_ack", 1, handlers.CommandAck{ID: 12345, Status: "ok"}, "command_not_found"},
+	} {
+		message := map[string]interface{}{"v": tc.version, "id": tc.id, "type": tc.messageType, "data": tc.data}
+		if err := c.conn.WriteJSON(message); err != nil {
+			t.Fatal(err)
+		}
+		reply := c.receive("reply to "+tc.id, func(m wsMessage) bool { return m.ReplyTo == tc.id })
+		if reply.Type != "error" || reply.Error == nil || reply.Error.Code != tc.code {
+			t.Fatalf("%s: got reply %+v, want error %s", tc.messageType, reply, tc.code)
+		}
+	}
+
+	// A message that can't be read is answered without an ID
+	if err := c.conn.WriteMessage(ws.TextMessage, []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	reply = c.receiveType("error")
+	if reply.ReplyTo != "" || reply.Error.Code != "invalid_message" {
+		t.Fatalf("got reply %+v", reply)
+	}
+
+	// Messages without an ID get no response
+	c.send("", "heartbeat", nil)
+	c.expectNone("response")
+}
+
+func TestWebSocketPatternDelta(t *testing.T) {
+	ts := newAdminServer(t)
+	ts.startHub()
+	device := ts.createDevice("laptop")
+
+	c, _, err := ts.dialWebSocket(device.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot handlers.PolicySnapshot
+	decodeData(t, c.receiveType("patterns_updated"), &snapshot)
+	waitBackground(t)
+
+	pattern := ts.createPattern(device.ID, "example.com", "allow")
+	var delta handlers.PolicyDelta
+	decodeData(t, c.receiveType("patterns_delta"), &delta)
+	if delta.FromVersion != snapshot.Version || delta.Version <= snapshot.Version || delta.Bundle == nil {
+		t.Fatalf("got delta %+v after version %d", delta, snapshot.Version)
+	}
+	if len(delta.Changes) != 1 || delta.Changes[0].Op != "add" || delta.Changes[0].PatternID != pattern.ID {
+		t.Fatalf("got changes %+v", delta.Changes)
+	}
+
+	ts.expect("DELETE", fmt.Sprintf("/api/admin/patterns/%d", pattern.ID), nil, http.StatusOK, nil)
+	var removed handlers.PolicyDelta
+	decodeData(t, c.receiveType("patterns_delta"), &removed)
+	if removed.FromVersion != delta.Version || len(removed.Changes) != 1 || removed.Changes[0].Op != "remove" {
+		t.Fatalf("got delta %+v after version %d", removed, delta.Version)
+	}
+}
+
+func TestWebSocketSync(t *testing.T) {
+	ts := newAdminServer(t)
+	ts.startHub()
+	device := ts.createDevice("laptop")
+	ts.createPattern(device.ID, "example.com", "allow")
+
+	c, _, err := ts.dialWebSocket(device.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot handlers.PolicySnapshot
+	decodeData(t, c.receiveType("patterns_updated"), &snapshot)
+	waitBackground(t)
+
+	// A change the device wasn't told about, as if another instance made it
+	if _, err := ts.store.Patterns.Create(device.ID, "quiet.example", "allow", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// An extension that applied an older version catches up with the changes
+	var sync handlers.SyncResponse
+	decodeData(t, c.request("1", "sync", handlers.SyncRequest{Version: snapshot.Version}), &sync)
+	if sync.Mode != "delta" || sync.FromVersion != snapshot.Version || len(sync.Changes) != 1 || sync.Changes[0].Pattern.Pattern != "quiet.example" {
+		t.Fatalf("got sync %+v", sync)
+	}
+
+	// The connection is up to date after the reply, so a push sends nothing
+	handlers.PushDevicePolicy(context.Background(), device.ID)
+	c.expectNone("patterns_delta")
+	c.expectNone("patterns_updated")
+
+	// A version the server doesn't know gets the whole policy
+	for _, version := range []int64{0, sync.Version + 10} {
+		var full handlers.SyncResponse
+		decodeData(t, c.request("stale", "sync", handlers.SyncRequest{Version: version}), &full)
+		if full.Mode != "full" || full.Version != sync.Version || len(full.Patterns) != 2 || full.Bundle == nil {
+			t.Fatalf("version %d: got sync %+v", version, full)
+		}
+	}
+}
+
+// commandMessage is the data of a command message
+type commandMessage struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+func TestWebSocketCommandRedelivery(t *testing.T) {
+	ts := newAdminServer(t)
+	ts.startHub()
+	device := ts.createDevice("laptop")
+	path := fmt.Sprintf("/api/admin/devices/%d/commands", device.ID)
+
+	// A command for an offline device waits for it to connect
+	var queued models.DeviceCommand
+	ts.expect("POST", path, map[string]string{"type": "resync"}, http.StatusCreated, &queued)
+	if queued.Status != "pending" {
+		t.Fatalf("command for an offline device is %q", queued.Status)
+	}
+
+	c, _, err := ts.dialWebSocket(device.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var command commandMessage
+	decodeData(t, c.receiveType("command"), &command)
+	if command.ID != queued.ID || command.Type != "resync" {
+		t.Fatalf("got command %+v", command)
+	}
+	waitBackground(t)
+
+	var delivered models.DeviceCommand
+	ts.expect("GET", fmt.Sprintf("/api/admin/commands/%d", queued.ID), nil, http.StatusOK, &delivered)
+	if delivered.Status != "delivered" {
+		t.Fatalf("command is %q after delivery", delivered.Status)
+	}
+
+	// A command that wasn't acknowledged is sent again on the next connection
+	c.conn.Close()
+	c = ts.connect(device.Token)
+	decodeData(t, c.receiveType("command"), &command)
+	if command.ID != queued.ID {
+		t.Fatalf("got command %+v", command)
+	}
+
+	reply := c.request("ack", "command_ack", handlers.CommandAck{ID: queued.ID, Status: "ok"})
+	if reply.Type != "response" {
+		t.Fatalf("got reply %+v", reply)
+	}
+	var acknowledged models.DeviceCommand
+	ts.expect("GET", fmt.Sprintf("/api/admin/commands/%d", queued.ID), nil, http.StatusOK, &acknowledged)
+	if acknowledged.Status != "acknowledged" {
+		t.Fatalf("command is %q after ack", acknowledged.Status)
+	}
+
+	c.conn.Close()
+	c = ts.connect(device.Token)
+	c.expectNone("command")
+
+	// A connected device gets a command right away
+	var sent models.DeviceCommand
+	ts.expect("POST", path, map[string]string{"type": "resync"}, http.StatusCreated, &sent)
+	if sent.Status != "delivered" {
+		t.Fatalf("command for a connected device is %q", sent.Status)
+	}
+	decodeData(t, c.receiveType("command"), &command)
+	if command.ID != sent.ID {
+		t.Fatalf("got command %+v", command)
+	}
+}
+
+// tokenRotated is the data of a token_rotated message
+type tokenRotated struct {
+	Token                  string     `json:"token"`
+	PreviousTokenExpiresAt *time.Time `json:"previous_token_expires_at"`
+}
+
+func TestWebSocketTokenRotation(t *testing.T) {
+	ts := newAdminServer(t)
+	ts.startHub()
+	device := ts.createDevice("laptop")
+	c := ts.connect(device.Token)
+
+	var regenerated models.Device
+	ts.expect("POST", fmt.Sprintf("/api/admin/devices/%d/regenerate-token", device.ID), nil, http.StatusOK, &regenerated)
+	var rotated tokenRotated
+	decodeData(t, c.receiveType("token_rotated"), &rotated)
+	if rotated.Token != regenerated.Token || rotated.PreviousTokenExpiresAt == nil {
+		t.Fatalf("got %+v, want token %q", rotated, regenerated.Token)
+	}
+
+	// Another instance regenerating the token leaves this connection holding
+	// the previous one, which is reissued a token of its own
+	if _, err := ts.store.Devices.RegenerateToken(device.ID, models.TokenRotationGrace); err != nil {
+		t.Fatal(err)
+	}
+	handlers.ReissueDeviceTokens(context.Background(), device.ID)
+	var reissued tokenRotated
+	decodeData(t, c.receiveType("token_rotated"), &reissued)
+	if reissued.Token == "" || reissued.Token == rotated.Token {
+		t.Fatalf("got reissued token %+v", reissued)
+	}
+	ts.asDevice(reissued.Token, "GET", "/api/patterns", nil, http.StatusOK, nil)
+
+	// Connecting with the previous token gets the connection a new one too
+	if _, err := ts.store.Devices.RegenerateToken(device.ID, models.TokenRotationGrace); err != nil {
+		t.Fatal(err)
+	}
+	late, _, err := ts.dialWebSocket(reissued.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var onConnect tokenRotated
+	decodeData(t, late.receiveType("token_rotated"), &onConnect)
+	if onConnect.Token == "" || onConnect.Token == reissued.Token {
+		t.Fatalf("got token %+v on connect", onConnect)
+	}
+	ts.asDevice(onConnect.Token, "GET", "/api/patterns", nil, http.StatusOK, nil)
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/websocket"
+)
+
+// Extensions send messages over the WebSocket as
+//
+//	{"v": 1, "id": "<correlation id>", "type": "<type>", "data": {...}}
+//
+// The server answers a message that carries an ID with a "response" whose
+// reply_to is that ID, or with an "error" carrying a code and message.
+// Messages without an ID only get error replies. A missing "v" means version 1.
+
+// clientMessage is a message sent by the extension
+type clientMessage struct {
+	Version int             `json:"v"`
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Longest correlation ID echoed back to the client
+const maxCorrelationIDLength = 64
+
+// apiError is a client error shared by the HTTP and WebSocket APIs
+type apiError struct {
+	Status  int    // HTTP status
+	Code    string // machine-readable code for WebSocket error replies
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func badRequest(code, message string) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: code, Message: message}
+}
+
+// writeAPIError writes err as an HTTP error. Errors that aren't apiErrors are
+// internal and reported with the fallback message.
+func writeAPIError(w http.ResponseWriter, err error, fallback string) {
+	if e, ok := err.(*apiError); ok {
+		http.Error(w, e.Message, e.Status)
+		return
+	}
+	http.Error(w, fallback, http.StatusInternalServerError)
+}
+
+// clientMessageHandler processes one message type and returns the response
+// data, or queuedReply if it sent the response itself
+type clientMessageHandler func(ctx context.Context, client *websocket.Client, device *models.Device, message clientMessage) (interface{}, error)
+
+// queuedReply is returned by handlers that queued their response themselves
+type queuedReply struct{}
+
+var clientMessageHandlers = map[string]clientMessageHandler{
+	"heartbeat":      handleHeartbeatMessage,
+	"access_request": handleAccessRequestMessage,
+	"event":          handleEventMessage,
+	"command_ack":    handleCommandAckMessage,
+	"sync":           handleSyncMessage,
+}
+
+// handleClientMessage decodes a message from the extension, runs its handler
+// and sends the reply
+func handleClientMessage(ctx context.Context, client *websocket.Client, raw []byte) {
+	var message clientMessage
+	if err := json.Unmarshal(raw, &message); err != nil {
+		replyError(client, "", badRequest("invalid_message", "Message is not valid JSON"))
+		return
+	}
+
+	if len(message.ID) > maxCorrelationIDLength {
+		replyError(client, "", badRequest("invalid_message", "Message ID too long"))
+		return
+	}
+
+	if message.Version == 0 {
+		message.Version = 1
+	}
+	if message.Version > websocket.ProtocolVersion {
+		replyError(client, message.ID, badRequest("unsupported_version", "Unsupported protocol version"))
+		return
+	}
+
+	handler, ok := clientMessageHandlers[message.Type]
+	if !ok {
+		replyError(client, message.ID, badRequest("unknown_type", "Unknown message type"))
+		return
+	}
+
+	device, err := store.WithContext(ctx).Devices.GetByID(client.DeviceID)
+	if err != nil {
+		replyError(client, message.ID, &apiError{Status: http.StatusUnauthorized, Code: "device_not_found", Message: "Device not found"})
+		return
+	}
+
+	data, err := handler(ctx, client, device, message)
+	if err != nil {
+		if _, ok := err.(*apiError); !ok {
+			slog.ErrorContext(ctx, "Failed to handle WebSocket message", "device_id", device.ID, "type", message.Type, "err", err)
+		}
+		replyError(client, message.ID, err)
+		return
+	}
+
+	if _, ok := data.(queuedReply); !ok {
+		sendResponse(client, message.ID, data)
+	}
+}
+
+// sendResponse queues the response to the message with the given ID and
+// reports whether it was queued. Messages without an ID get no response.
+func sendResponse(client *websocket.Client, replyTo string, data interface{}) bool {
+	if replyTo == "" {
+		return false
+	}
+	return websocket.DefaultHub.SendToClient(client, websocket.Message{
+		Type:    "response",
+		ReplyTo: replyTo,
+		Data:    data,
+	})
+}
+
+// replyError sends an error reply. Errors that aren't apiErrors are reported
+// as internal errors without details.
+func replyError(client *websocket.Client, replyTo string, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		e = &apiError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "Internal error"}
+	}
+
+	websocket.DefaultHub.SendToClient(client, websocket.Message{
+		Type:    "error",
+		ReplyTo: replyTo,
+		Error:   &websocket.Error{Code: e.Code, Message: e.Message},
+	})
+}
+
+// decodeMessageData decodes the data of a message into v. Missing data
+// decodes as an empty object.
+func decodeMessageData(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return badRequest("invalid_data", "Invalid message data")
+	}
+	return nil
+}
+
+func handleHeartbeatMessage(ctx context.Context, client *websocket.Client, device *models.Device, message clientMessage) (interface{}, error) {
+	var req HeartbeatRequest
+	if err := decodeMessageData(message.Data, &req); err != nil {
+		return nil, err
+	}
+
+	if err := recordHeartbeat(ctx, device, req, "websocket_heartbeat"); err != nil {
+		return nil, err
+	}
+	return HeartbeatResponse{Success: true, Status: "active"}, nil
+}
+
+func handleAccessRequestMessage(ctx context.Context, client *websocket.Client, device *models.Device, message clientMessage) (interface{}, error) {
+	var req AccessRequest
+	if err := decodeMessageData(message.Data, &req); err != nil {
+		return nil, err
+	}
+	return createAccessRequest(ctx, device, req)
+}
+
+func handleEventMessage(ctx context.Context, client *websocket.Client, device *models.Device, message clientMessage) (interface{}, error) {
+	var req DeviceEventRequest
+	if err := decodeMessageData(message.Data, &req); err != nil {
+		return nil, err
+	}
+	return reportDeviceEvent(ctx, device, req)
+}
+
+func handleCommandAckMessage(ctx context.Context, client *websocket.Client, device *models.Device, message clientMessage) (interface{}, error) {
+	var ack CommandAck
+	if err := decodeMessageData(message.Data, &ack); err != nil {
+		return nil, err
+	}
+
+	if err := acknowledgeCommand(ctx, device.ID, ack); err != nil {
+		return nil, err
+	}
+	return map[string]bool{"success": true}, nil
+}
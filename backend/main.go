@@ -1,111 +1,123 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
+	"sort"
 
+	"github.com/watchtower/web/config"
 	"github.com/watchtower/web/database"
-	"github.com/watchtower/web/handlers"
-	"github.com/watchtower/web/middleware"
-	"github.com/watchtower/web/services"
-	"github.com/watchtower/web/websocket"
-	"github.com/gorilla/mux"
+	"github.com/watchtower/web/logging"
+	"github.com/watchtower/web/models"
 )
 
+// command is a subcommand of the watchtower binary
+type command struct {
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"serve":   {"serve [-dev]", "Run the server (default); -dev serves the admin UI from disk", runServe},
+	"migrate": {"migrate up|down|version", "Apply, roll back one or show schema migrations", runMigrate},
+	"user":    {"user create|reset-password|list", "Manage admin users", runUser},
+	"device":  {"device create|list|rotate-token", "Manage devices", runDevice},
+	"export":  {"export [-o file]", "Write all data as JSON", runExport},
+	"import":  {"import [file]", "Load an export into an empty database", runImport},
+	"backup":  {"backup [-o file]", "Snapshot the SQLite database, even while serving", runBackup},
+	"restore": {"restore <file>", "Replace the SQLite database with a backup", runRestore},
+}
+
+// cfg is the configuration every command runs with
+var cfg *config.Config
+
 func main() {
-	// Initialize database
-	dbPath := os.Getenv("DB_PATH")
-	if dbPath == "" {
-		dbPath = "./watchtower.db"
+	configFile := flag.String("config", os.Getenv("WATCHTOWER_CONFIG"), "YAML config file (default "+config.DefaultFile+" if it exists)")
+	flag.Usage = func() { usage(os.Stderr) }
+	flag.Parse()
+
+	// Without a subcommand the binary serves, as it always has
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
 	}
 
-	if err := database.Initialize(dbPath); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	name := args[0]
+	if name == "help" || name == "-h" || name == "--help" {
+		usage(os.Stdout)
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		usage(os.Stderr)
+		os.Exit(2)
 	}
-	defer database.Close()
 
-	// Initialize push notification service
-	if err := services.InitPushService(); err != nil {
-		log.Printf("Warning: Failed to initialize push service: %v", err)
+	var err error
+	if cfg, err = config.Load(*configFile); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if err := logging.Setup(os.Stderr, cfg.Log.Level, cfg.Log.Format); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
 	}
 
-	// Start background scheduler
-	services.StartScheduler()
-
-	// Initialize WebSocket hub
-	websocket.InitHub()
-
-	// Create router
-	r := mux.NewRouter()
-
-	// CORS middleware
-	r.Use(middleware.CORS)
-
-	// Public API routes (token auth for extension)
-	api := r.PathPrefix("/api").Subrouter()
-	api.HandleFunc("/patterns", middleware.TokenAuth(handlers.GetPatterns)).Methods("GET", "OPTIONS")
-	api.HandleFunc("/requests", middleware.TokenAuth(handlers.CreateRequest)).Methods("POST", "OPTIONS")
-	api.HandleFunc("/heartbeat", middleware.TokenAuth(handlers.DeviceHeartbeat)).Methods("POST", "OPTIONS")
-	api.HandleFunc("/uninstall", handlers.DeviceUninstall).Methods("GET", "POST", "OPTIONS")
-	api.HandleFunc("/ws", handlers.HandleWebSocket).Methods("GET")
-
-	// Auth routes
-	api.HandleFunc("/auth/login", handlers.Login).Methods("POST", "OPTIONS")
-	api.HandleFunc("/auth/logout", middleware.SessionAuth(handlers.Logout)).Methods("POST", "OPTIONS")
-	api.HandleFunc("/auth/change-password", middleware.SessionAuth(handlers.ChangePassword)).Methods("POST", "OPTIONS")
-
-	// Setup routes (public, only work when no users exist)
-	api.HandleFunc("/setup/status", handlers.CheckSetupNeeded).Methods("GET", "OPTIONS")
-	api.HandleFunc("/setup/create-user", handlers.SetupFirstUser).Methods("POST", "OPTIONS")
-
-	// Admin routes (session auth)
-	admin := api.PathPrefix("/admin").Subrouter()
-	admin.Use(middleware.SessionAuthMiddleware)
-
-	// Requests management
-	admin.HandleFunc("/requests", handlers.ListRequests).Methods("GET", "OPTIONS")
-	admin.HandleFunc("/requests/{id}/approve", handlers.ApproveRequest).Methods("POST", "OPTIONS")
-	admin.HandleFunc("/requests/{id}/deny", handlers.DenyRequest).Methods("POST", "OPTIONS")
-
-	// Patterns management
-	admin.HandleFunc("/patterns", handlers.ListAllPatterns).Methods("GET", "OPTIONS")
-	admin.HandleFunc("/patterns", handlers.CreatePattern).Methods("POST", "OPTIONS")
-	admin.HandleFunc("/patterns/{id}", handlers.UpdatePattern).Methods("PUT", "OPTIONS")
-	admin.HandleFunc("/patterns/{id}", handlers.DeletePattern).Methods("DELETE", "OPTIONS")
-	admin.HandleFunc("/patterns/{id}/toggle", handlers.TogglePattern).Methods("POST", "OPTIONS")
-
-	// Devices management
-	admin.HandleFunc("/devices", handlers.ListDevices).Methods("GET", "OPTIONS")
-	admin.HandleFunc("/devices", handlers.CreateDevice).Methods("POST", "OPTIONS")
-	admin.HandleFunc("/devices/{id}", handlers.DeleteDevice).Methods("DELETE", "OPTIONS")
-	admin.HandleFunc("/devices/{id}/regenerate-token", handlers.RegenerateDeviceToken).Methods("POST", "OPTIONS")
-
-	// Users management
-	admin.HandleFunc("/users", handlers.ListUsers).Methods("GET", "OPTIONS")
-	admin.HandleFunc("/users", handlers.CreateUser).Methods("POST", "OPTIONS")
-
-	// Push notifications
-	admin.HandleFunc("/push/vapid-key", handlers.GetVAPIDPublicKey).Methods("GET", "OPTIONS")
-	admin.HandleFunc("/push/subscribe", handlers.SubscribePush).Methods("POST", "OPTIONS")
-	admin.HandleFunc("/push/unsubscribe", handlers.UnsubscribePush).Methods("POST", "OPTIONS")
-	admin.HandleFunc("/push/subscriptions", handlers.GetPushSubscriptions).Methods("GET", "OPTIONS")
-	admin.HandleFunc("/notifications/prefs", handlers.GetNotificationPrefs).Methods("GET", "OPTIONS")
-	admin.HandleFunc("/notifications/prefs", handlers.UpdateNotificationPrefs).Methods("PUT", "OPTIONS")
-
-	// Serve static files for admin UI
-	staticDir := "./static"
-	r.PathPrefix("/admin").Handler(http.StripPrefix("/admin", http.FileServer(http.Dir(staticDir))))
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/admin/", http.StatusFound)
-	})
-
-	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if err := cmd.run(args[1:]); err != nil {
+		fatal(name+" failed", err)
 	}
+}
+
+// fatal logs an error that stops the program and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+func usage(w *os.File) {
+	fmt.Fprintln(w, "Usage: watchtower [-config file] <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
 
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-34s %s\n", commands[name].usage, commands[name].summary)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Settings come from the config file (or WATCHTOWER_CONFIG), overridden by environment")
+	fmt.Fprintln(w, "variables. Every command uses the database in database.url / DATABASE_URL (PostgreSQL)")
+	fmt.Fprintln(w, "or database.path / DB_PATH (SQLite).")
+}
+
+// openDatabase connects to the configured database without migrating it:
+// PostgreSQL if database.url is set, SQLite at database.path otherwise
+func openDatabase() error {
+	if cfg.Database.URL != "" {
+		return database.OpenPostgres(cfg.Database.URL)
+	}
+	return database.Open(cfg.Database.Path)
+}
+
+// openStore connects to the configured database, migrates it and returns
+// a store for it
+func openStore() (*models.Store, error) {
+	if err := openDatabase(); err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := database.RunMigrations(); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	if database.Driver == database.Postgres {
+		return models.NewPostgresStore(database.DB), nil
+	}
+	return models.NewSQLiteStore(database.DB), nil
 }
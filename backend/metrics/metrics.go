@@ -0,0 +1,119 @@
+// Package metrics defines the server's Prometheus metrics, served at
+// /metrics. Counters and histograms are updated where things happen; gauges
+// for state held elsewhere are read when Prometheus scrapes.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "watchtower"
+
+// Registry holds every metric, plus the Go runtime and process collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to answer HTTP requests by route and method. WebSocket connections are not included.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	requestDecisions = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_decision_seconds",
+		Help:      "Time from an access request to an admin approving or denying it.",
+		// 10 seconds to a day
+		Buckets: []float64{10, 30, 60, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600, 24 * 3600},
+	}, []string{"decision"})
+
+	pushNotifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_notifications_total",
+		Help:      "Web push notifications sent, by result: success, expired (subscription removed) or failure.",
+	}, []string{"result"})
+
+	schedulerJobs = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scheduler_job_duration_seconds",
+		Help:      "Time taken by each run of a background job.",
+		Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60},
+	}, []string{"job"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		requestDecisions,
+		pushNotifications,
+		schedulerJobs,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveHTTPRequest records a request to route, a path template such as
+// /api/admin/devices/{id}. A duration below zero leaves it out of the latency
+// histogram, for WebSocket connections.
+func ObserveHTTPRequest(route, method string, code int, duration time.Duration) {
+	httpRequests.WithLabelValues(route, method, strconv.Itoa(code)).Inc()
+	if duration >= 0 {
+		httpDuration.WithLabelValues(route, method).Observe(duration.Seconds())
+	}
+}
+
+// ObserveRequestDecision records how long an access request waited for its
+// decision, "approved" or "denied"
+func ObserveRequestDecision(decision string, waited time.Duration) {
+	requestDecisions.WithLabelValues(decision).Observe(waited.Seconds())
+}
+
+// PushNotificationSent records the result of sending a push notification
+func PushNotificationSent(result string) {
+	pushNotifications.WithLabelValues(result).Inc()
+}
+
+// ObserveSchedulerJob records one run of a background job
+func ObserveSchedulerJob(job string, duration time.Duration) {
+	schedulerJobs.WithLabelValues(job).Observe(duration.Seconds())
+}
+
+// RegisterGaugeFunc adds a gauge whose value is read from value on every
+// scrape
+func RegisterGaugeFunc(name, help string, labels prometheus.Labels, value func() float64) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        name,
+		Help:        help,
+		ConstLabels: labels,
+	}, value))
+}
+
+// RegisterCounterFunc adds a counter whose value is read from value on every
+// scrape
+func RegisterCounterFunc(name, help string, value func() float64) {
+	Registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, value))
+}
@@ -16,12 +16,21 @@ const (
 	UserContextKey    contextKey = "user"
 )
 
+// store holds the sessions, users and devices requests are authenticated against
+var store *models.Store
+
+// SetStore sets the store the middleware authenticates against
+func SetStore(s *models.Store) {
+	store = s
+}
+
 // CORS middleware to handle cross-origin requests
 func CORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if r.Method == "OPTIONS" {
@@ -41,20 +50,18 @@ func TokenAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
+		if r.Header.Get("Authorization") == "" {
 			http.Error(w, "Missing authorization header", http.StatusUnauthorized)
 			return
 		}
 
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		token := BearerToken(r)
+		if token == "" {
 			http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
 			return
 		}
 
-		token := parts[1]
-		device, err := models.GetDeviceByToken(token)
+		device, err := store.WithContext(r.Context()).Devices.GetByToken(token)
 		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
@@ -65,6 +72,16 @@ func TokenAuth(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// BearerToken extracts the token from an "Authorization: Bearer" header
+// Returns an empty string if the header is missing or malformed
+func BearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		return ""
+	}
+	return parts[1]
+}
+
 // SessionAuth validates session from cookie
 func SessionAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -79,13 +96,13 @@ func SessionAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		session, err := models.GetSessionByToken(cookie.Value)
+		session, err := store.WithContext(r.Context()).Sessions.GetByToken(cookie.Value)
 		if err != nil {
 			http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
 			return
 		}
 
-		user, err := models.GetUserByID(session.UserID)
+		user, err := store.WithContext(r.Context()).Users.GetByID(session.UserID)
 		if err != nil {
 			http.Error(w, "User not found", http.StatusUnauthorized)
 			return
@@ -111,13 +128,13 @@ func SessionAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		session, err := models.GetSessionByToken(cookie.Value)
+		session, err := store.WithContext(r.Context()).Sessions.GetByToken(cookie.Value)
 		if err != nil {
 			http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
 			return
 		}
 
-		user, err := models.GetUserByID(session.UserID)
+		user, err := store.WithContext(r.Context()).Users.GetByID(session.UserID)
 		if err != nil {
 			http.Error(w, "User not found", http.StatusUnauthorized)
 			return
@@ -155,4 +172,3 @@ func GetSessionFromContext(r *http.Request) *models.Session {
 	}
 	return session
 }
-
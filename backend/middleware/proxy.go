@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/watchtower/web/config"
+)
+
+// trustedProxies are the proxies whose X-Forwarded-For is believed
+var trustedProxies []netip.Prefix
+
+// SetTrustedProxies sets the proxies whose X-Forwarded-For is believed, as
+// IPs or CIDR ranges. Entries that don't parse are skipped; config
+// validation reports them.
+func SetTrustedProxies(proxies []string) {
+	var prefixes []netip.Prefix
+	for _, proxy := range proxies {
+		if prefix, err := config.ParseProxy(proxy); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	trustedProxies = prefixes
+}
+
+// ClientAddr returns the remote address of a request. Behind trusted
+// proxies it is the last address in X-Forwarded-For that isn't one of them;
+// anyone else could put whatever they like in the header.
+func ClientAddr(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		addr = host
+	}
+	if !trustedProxy(addr) {
+		return addr
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		addr = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// trustedProxy reports whether addr is one of the trusted proxies
+func trustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/watchtower/web/database"
+)
+
+// runMigrate applies or rolls back schema migrations, or shows the version
+func runMigrate(args []string) error {
+	action, _, err := subcommand(args, "migrate up|down|version")
+	if err != nil {
+		return err
+	}
+	if err := openDatabase(); err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer database.Close()
+
+	switch action {
+	case "up":
+		return database.RunMigrations()
+	case "down":
+		if err := database.MigrateDown(); err != nil {
+			return err
+		}
+		return printMigrationVersion()
+	case "version":
+		return printMigrationVersion()
+	default:
+		return fmt.Errorf("unknown action %q (expected up, down or version)", action)
+	}
+}
+
+func printMigrationVersion() error {
+	version, dirty, err := database.GetMigrationVersion()
+	if err != nil {
+		return err
+	}
+	latest, err := database.LatestMigrationVersion()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Schema version %d of %d", version, latest)
+	if dirty {
+		fmt.Print(" (dirty: the last migration failed halfway)")
+	}
+	fmt.Println()
+	return nil
+}
+
+// subcommand splits off the first argument of a command that has several
+// actions
+func subcommand(args []string, usage string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, errors.New("usage: watchtower " + usage)
+	}
+	return args[0], args[1:], nil
+}
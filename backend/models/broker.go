@@ -0,0 +1,69 @@
+package models
+
+import (
+	"time"
+)
+
+// BrokerEvent is a WebSocket message or signal published by one server
+// instance for the others
+type BrokerEvent struct {
+	ID         int64
+	InstanceID string
+	Kind       string
+	DeviceID   int64
+	Data       []byte
+	CreatedAt  time.Time
+}
+
+// ========== Broker Outbox Operations ==========
+
+// Insert appends an event to the outbox
+func (repo *sqlBroker) Insert(instanceID, kind string, deviceID int64, data []byte) error {
+	_, err := repo.db.Exec(
+		"INSERT INTO broker_events (instance_id, kind, device_id, data, created_at) VALUES (?, ?, ?, ?, ?)",
+		instanceID, kind, deviceID, string(data), time.Now().UTC(),
+	)
+	return err
+}
+
+// LatestID returns the ID of the newest event, 0 if there is none
+func (repo *sqlBroker) LatestID() (int64, error) {
+	var id int64
+	err := repo.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM broker_events").Scan(&id)
+	return id, err
+}
+
+// ListAfter returns the events after an ID that other instances
+// published, oldest first
+func (repo *sqlBroker) ListAfter(afterID int64, instanceID string, limit int) ([]BrokerEvent, error) {
+	rows, err := repo.db.Query(`
+		SELECT id, instance_id, kind, device_id, COALESCE(data, ''), created_at
+		FROM broker_events
+		WHERE id > ? AND instance_id != ?
+		ORDER BY id
+		LIMIT ?
+	`, afterID, instanceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []BrokerEvent
+	for rows.Next() {
+		var e BrokerEvent
+		var data string
+		if err := rows.Scan(&e.ID, &e.InstanceID, &e.Kind, &e.DeviceID, &data, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Data = []byte(data)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Prune removes events older than the given age
+func (repo *sqlBroker) Prune(olderThan time.Duration) error {
+	cutoff := time.Now().UTC().Add(-olderThan)
+	_, err := repo.db.Exec("DELETE FROM broker_events WHERE julianday(created_at) < julianday(?)", cutoff)
+	return err
+}
@@ -0,0 +1,181 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// DeviceCommand is a command sent from an admin to a device over WebSocket
+type DeviceCommand struct {
+	ID             int64           `json:"id"`
+	DeviceID       int64           `json:"device_id"`
+	Type           string          `json:"type"`
+	Params         json.RawMessage `json:"params,omitempty"`
+	Status         string          `json:"status"` // "pending", "delivered", "acknowledged", "failed", "expired"
+	Error          string          `json:"error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	ExpiresAt      time.Time       `json:"expires_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	AcknowledgedAt *time.Time      `json:"acknowledged_at,omitempty"`
+}
+
+const deviceCommandColumns = "id, device_id, type, params, status, COALESCE(error, ''), created_at, expires_at, delivered_at, acknowledged_at"
+
+func scanDeviceCommand(scanner interface{ Scan(...interface{}) error }) (*DeviceCommand, error) {
+	c := &DeviceCommand{}
+	var params *string
+	err := scanner.Scan(&c.ID, &c.DeviceID, &c.Type, &params, &c.Status, &c.Error, &c.CreatedAt, &c.ExpiresAt, &c.DeliveredAt, &c.AcknowledgedAt)
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		c.Params = json.RawMessage(*params)
+	}
+	return c, nil
+}
+
+// ========== Device Command Operations ==========
+
+func (repo *sqlCommands) Create(deviceID int64, commandType string, params json.RawMessage, ttl time.Duration) (*DeviceCommand, error) {
+	var paramsValue interface{}
+	if len(params) > 0 {
+		paramsValue = string(params)
+	}
+
+	now := time.Now().UTC()
+	var id int64
+	err := repo.db.QueryRow(
+		"INSERT INTO device_commands (device_id, type, params, status, created_at, expires_at) VALUES (?, ?, ?, 'pending', ?, ?) RETURNING id",
+		deviceID, commandType, paramsValue, now, now.Add(ttl),
+	).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeviceCommand{
+		ID:        id,
+		DeviceID:  deviceID,
+		Type:      commandType,
+		Params:    params,
+		Status:    "pending",
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}, nil
+}
+
+func (repo *sqlCommands) GetByID(id int64) (*DeviceCommand, error) {
+	if err := repo.expire(); err != nil {
+		return nil, err
+	}
+	return scanDeviceCommand(repo.db.QueryRow("SELECT "+deviceCommandColumns+" FROM device_commands WHERE id = ?", id))
+}
+
+// List returns the most recent commands for a device, newest first
+func (repo *sqlCommands) List(deviceID int64, limit int) ([]DeviceCommand, error) {
+	if err := repo.expire(); err != nil {
+		return nil, err
+	}
+
+	rows, err := repo.db.Query(
+		"SELECT "+deviceCommandColumns+" FROM device_commands WHERE device_id = ? ORDER BY created_at DESC, id DESC LIMIT ?",
+		deviceID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commands []DeviceCommand
+	for rows.Next() {
+		c, err := scanDeviceCommand(rows)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, *c)
+	}
+	return commands, nil
+}
+
+// ListPending returns the commands not yet delivered to a device, oldest first
+func (repo *sqlCommands) ListPending(deviceID int64) ([]DeviceCommand, error) {
+	return repo.listUnanswered(deviceID, "status = 'pending'")
+}
+
+// ListUnacknowledged returns the commands a device hasn't answered, oldest
+// first: the pending ones and the delivered ones, which may have been lost
+// with the connection before they were written
+func (repo *sqlCommands) ListUnacknowledged(deviceID int64) ([]DeviceCommand, error) {
+	return repo.listUnanswered(deviceID, "status IN ('pending', 'delivered')")
+}
+
+func (repo *sqlCommands) listUnanswered(deviceID int64, statusCondition string) ([]DeviceCommand, error) {
+	if err := repo.expire(); err != nil {
+		return nil, err
+	}
+
+	rows, err := repo.db.Query(
+		"SELECT "+deviceCommandColumns+" FROM device_commands WHERE device_id = ? AND "+statusCondition+" ORDER BY created_at, id",
+		deviceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commands []DeviceCommand
+	for rows.Next() {
+		c, err := scanDeviceCommand(rows)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, *c)
+	}
+	return commands, nil
+}
+
+// MarkDelivered records that a pending command was handed to a connection
+func (repo *sqlCommands) MarkDelivered(id int64) error {
+	_, err := repo.db.Exec(
+		"UPDATE device_commands SET status = 'delivered', delivered_at = ? WHERE id = ? AND status = 'pending'",
+		time.Now().UTC(), id,
+	)
+	return err
+}
+
+// Acknowledge records the device's answer to a command. A failed
+// command stores the error reported by the device. Commands of other devices
+// and commands that already completed or expired are left alone and reported
+// as sql.ErrNoRows.
+func (repo *sqlCommands) Acknowledge(id, deviceID int64, success bool, errorMessage string) error {
+	status := "acknowledged"
+	var errorValue interface{}
+	if !success {
+		status = "failed"
+		errorValue = errorMessage
+	}
+
+	now := time.Now().UTC()
+	result, err := repo.db.Exec(`
+		UPDATE device_commands SET status = ?, error = ?, acknowledged_at = ?, delivered_at = COALESCE(delivered_at, ?)
+		WHERE id = ? AND device_id = ? AND status IN ('pending', 'delivered')
+	`, status, errorValue, now, now, id, deviceID)
+	if err != nil {
+		return err
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// expire marks unanswered commands past their expiry as expired
+func (repo *sqlCommands) expire() error {
+	_, err := repo.db.Exec(
+		"UPDATE device_commands SET status = 'expired' WHERE status IN ('pending', 'delivered') AND julianday(expires_at) <= julianday(?)",
+		time.Now().UTC(),
+	)
+	return err
+}
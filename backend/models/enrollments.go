@@ -0,0 +1,163 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Enrollment codes avoid look-alike characters (0/O, 1/I) so they can be typed by hand.
+// The alphabet has 32 symbols, so mapping a random byte with % is unbiased.
+const (
+	enrollmentCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	enrollmentCodeLength   = 8
+)
+
+// DeviceEnrollment represents a one-time code that can be exchanged for a device token
+type DeviceEnrollment struct {
+	ID         int64      `json:"id"`
+	DeviceID   int64      `json:"device_id"`
+	DeviceName string     `json:"device_name,omitempty"`
+	Code       string     `json:"code"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UsedAt     *time.Time `json:"used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func generateEnrollmentCode() (string, error) {
+	bytes := make([]byte, enrollmentCodeLength)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	for i, b := range bytes {
+		bytes[i] = enrollmentCodeAlphabet[int(b)%len(enrollmentCodeAlphabet)]
+	}
+	return string(bytes), nil
+}
+
+// NormalizeEnrollmentCode uppercases a user-entered code and strips separators
+func NormalizeEnrollmentCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return code
+}
+
+// ========== Enrollment Operations ==========
+
+func (repo *sqlEnrollments) Create(deviceID int64, ttl time.Duration) (*DeviceEnrollment, error) {
+	code, err := generateEnrollmentCode()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(ttl)
+
+	var id int64
+	err = repo.db.QueryRow(
+		"INSERT INTO device_enrollments (device_id, code, expires_at) VALUES (?, ?, ?) RETURNING id",
+		deviceID, code, expiresAt,
+	).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeviceEnrollment{
+		ID:        id,
+		DeviceID:  deviceID,
+		Code:      code,
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	}, nil
+}
+
+// ListPending returns enrollments that are unused and not yet expired
+func (repo *sqlEnrollments) ListPending() ([]DeviceEnrollment, error) {
+	rows, err := repo.db.Query(`
+		SELECT e.id, e.device_id, d.name, e.code, e.expires_at, e.used_at, e.created_at
+		FROM device_enrollments e
+		JOIN devices d ON e.device_id = d.id
+		WHERE e.used_at IS NULL AND julianday(e.expires_at) > julianday(?)
+		ORDER BY e.created_at DESC
+	`, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var enrollments []DeviceEnrollment
+	for rows.Next() {
+		var e DeviceEnrollment
+		if err := rows.Scan(&e.ID, &e.DeviceID, &e.DeviceName, &e.Code, &e.ExpiresAt, &e.UsedAt, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		enrollments = append(enrollments, e)
+	}
+	return enrollments, nil
+}
+
+// Delete revokes an enrollment so its code can no longer be redeemed
+func (repo *sqlEnrollments) Delete(id int64) error {
+	_, err := repo.db.Exec("DELETE FROM device_enrollments WHERE id = ?", id)
+	return err
+}
+
+// Redeem burns a pending enrollment code and issues a fresh token
+// for its device. Any token previously issued to the device stops working.
+// Returns sql.ErrNoRows if the code is unknown, already used or expired.
+func (repo *sqlEnrollments) Redeem(code string) (*Device, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var enrollmentID, deviceID int64
+	err = tx.QueryRow(`
+		SELECT id, device_id FROM device_enrollments
+		WHERE code = ? AND used_at IS NULL AND julianday(expires_at) > julianday(?)
+	`, code, time.Now().UTC()).Scan(&enrollmentID, &deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Guard against a concurrent redemption of the same code
+	result, err := tx.Exec(
+		"UPDATE device_enrollments SET used_at = ? WHERE id = ? AND used_at IS NULL",
+		time.Now().UTC(), enrollmentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		return nil, sql.ErrNoRows
+	}
+
+	// Pairing replaces the device's credentials outright, so no grace period
+	_, err = tx.Exec(`
+		UPDATE devices SET token = ?, token_prefix = ?,
+			previous_token = NULL, previous_token_prefix = NULL, previous_token_expires_at = NULL
+		WHERE id = ?
+	`, hashToken(token), tokenPrefix(token), deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	device, err := (&sqlDevices{repo.db}).GetByID(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	device.Token = token
+	return device, nil
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// DeviceEvent represents an entry in a device's security timeline
+type DeviceEvent struct {
+	ID         int64           `json:"id"`
+	DeviceID   int64           `json:"device_id"`
+	Type       string          `json:"type"`
+	Severity   string          `json:"severity"` // "info", "warning", "critical"
+	Source     string          `json:"source"`   // "device" (reported by the extension) or "server"
+	Details    json.RawMessage `json:"details,omitempty"`
+	OccurredAt *time.Time      `json:"occurred_at,omitempty"` // Client-reported time, if any
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// ========== Device Event Operations ==========
+
+func (repo *sqlEvents) Create(deviceID int64, eventType, severity, source string, details json.RawMessage, occurredAt *time.Time) (*DeviceEvent, error) {
+	var detailsValue interface{}
+	if len(details) > 0 {
+		detailsValue = string(details)
+	}
+
+	now := time.Now().UTC()
+	var id int64
+	err := repo.db.QueryRow(
+		"INSERT INTO device_events (device_id, type, severity, source, details, occurred_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id",
+		deviceID, eventType, severity, source, detailsValue, occurredAt, now,
+	).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeviceEvent{
+		ID:         id,
+		DeviceID:   deviceID,
+		Type:       eventType,
+		Severity:   severity,
+		Source:     source,
+		Details:    details,
+		OccurredAt: occurredAt,
+		CreatedAt:  now,
+	}, nil
+}
+
+// List returns the most recent events for a device, newest first
+func (repo *sqlEvents) List(deviceID int64, limit int) ([]DeviceEvent, error) {
+	rows, err := repo.db.Query(`
+		SELECT id, device_id, type, COALESCE(severity, 'info'), COALESCE(source, 'device'), details, occurred_at, created_at
+		FROM device_events
+		WHERE device_id = ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?
+	`, deviceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []DeviceEvent
+	for rows.Next() {
+		var e DeviceEvent
+		var details *string
+		if err := rows.Scan(&e.ID, &e.DeviceID, &e.Type, &e.Severity, &e.Source, &details, &e.OccurredAt, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if details != nil {
+			e.Details = json.RawMessage(*details)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"time"
+)
+
+// DeviceInventory is the browser and environment metadata last reported by a device
+type DeviceInventory struct {
+	ExtensionVersion string     `json:"extension_version,omitempty"`
+	BrowserName      string     `json:"browser_name,omitempty"`
+	BrowserVersion   string     `json:"browser_version,omitempty"`
+	OS               string     `json:"os,omitempty"`
+	ProfileEmail     string     `json:"profile_email,omitempty"`
+	Timezone         string     `json:"timezone,omitempty"`
+	UpdatedAt        *time.Time `json:"updated_at,omitempty"`
+}
+
+// InventoryChange records a change of a single inventory field
+type InventoryChange struct {
+	ID        int64     `json:"id"`
+	DeviceID  int64     `json:"device_id"`
+	Field     string    `json:"field"`
+	OldValue  string    `json:"old_value"`
+	NewValue  string    `json:"new_value"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// deviceInventoryColumns selects the inventory in the order of scanTargets
+const deviceInventoryColumns = `COALESCE(extension_version, ''), COALESCE(browser_name, ''), COALESCE(browser_version, ''),
+	COALESCE(os, ''), COALESCE(profile_email, ''), COALESCE(timezone, ''), inventory_updated_at`
+
+// inventoryColumns lists the inventory fields in column order
+var inventoryColumns = []string{"extension_version", "browser_name", "browser_version", "os", "profile_email", "timezone"}
+
+func (inv *DeviceInventory) values() []string {
+	return []string{inv.ExtensionVersion, inv.BrowserName, inv.BrowserVersion, inv.OS, inv.ProfileEmail, inv.Timezone}
+}
+
+// setInventory attaches the inventory if the device has ever reported one
+func (d *Device) setInventory(inv *DeviceInventory) {
+	if inv.UpdatedAt != nil {
+		d.Inventory = inv
+	}
+}
+
+func (inv *DeviceInventory) scanTargets() []interface{} {
+	return []interface{}{&inv.ExtensionVersion, &inv.BrowserName, &inv.BrowserVersion, &inv.OS, &inv.ProfileEmail, &inv.Timezone, &inv.UpdatedAt}
+}
+
+// ========== Device Inventory Operations ==========
+
+// UpdateInventory stores the inventory reported by a device and records
+// every field whose value changed. Empty fields in the report are ignored so
+// a partial report doesn't wipe known values. It returns the changes made.
+func (repo *sqlDevices) UpdateInventory(deviceID int64, reported *DeviceInventory) ([]InventoryChange, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Take the write lock before reading the current values
+	now := time.Now().UTC()
+	if _, err := tx.Exec("UPDATE devices SET inventory_updated_at = ? WHERE id = ?", now, deviceID); err != nil {
+		return nil, err
+	}
+
+	current := &DeviceInventory{}
+	err = tx.QueryRow("SELECT "+deviceInventoryColumns+" FROM devices WHERE id = ?", deviceID).Scan(current.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []InventoryChange
+	oldValues := current.values()
+	for i, value := range reported.values() {
+		if value == "" || value == oldValues[i] {
+			continue
+		}
+
+		column := inventoryColumns[i]
+		if _, err := tx.Exec("UPDATE devices SET "+column+" = ? WHERE id = ?", value, deviceID); err != nil {
+			return nil, err
+		}
+
+		var id int64
+		err := tx.QueryRow(
+			"INSERT INTO device_inventory_history (device_id, field, old_value, new_value, changed_at) VALUES (?, ?, ?, ?, ?) RETURNING id",
+			deviceID, column, oldValues[i], value, now,
+		).Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, InventoryChange{
+			ID:        id,
+			DeviceID:  deviceID,
+			Field:     column,
+			OldValue:  oldValues[i],
+			NewValue:  value,
+			ChangedAt: now,
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// ListInventoryHistory returns the inventory changes of a device, newest first
+func (repo *sqlDevices) ListInventoryHistory(deviceID int64, limit int) ([]InventoryChange, error) {
+	rows, err := repo.db.Query(`
+		SELECT id, device_id, field, COALESCE(old_value, ''), COALESCE(new_value, ''), changed_at
+		FROM device_inventory_history
+		WHERE device_id = ?
+		ORDER BY changed_at DESC, id DESC
+		LIMIT ?
+	`, deviceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []InventoryChange
+	for rows.Next() {
+		var c InventoryChange
+		if err := rows.Scan(&c.ID, &c.DeviceID, &c.Field, &c.OldValue, &c.NewValue, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
@@ -0,0 +1,1521 @@
+package models
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The in-memory store keeps every table in maps and slices behind a single
+// mutex. It mirrors the SQLite repositories closely enough to run the
+// handlers against in tests, including cascading device deletes and the
+// policy change log, but nothing survives a restart.
+
+var (
+	errMemoryDuplicate  = errors.New("UNIQUE constraint failed")
+	errMemoryForeignKey = errors.New("FOREIGN KEY constraint failed")
+)
+
+type memoryDevice struct {
+	Device
+	tokenHash          string
+	previousHash       string
+	previousPrefix     string
+	policyVersion      int64
+	reportedPolicyHash string
+	inventory          DeviceInventory
+}
+
+type memoryPatternChange struct {
+	PatternChange
+	createdAt time.Time
+}
+
+type memoryPolicyBundle struct {
+	deviceID   int64
+	version    int64
+	policyHash string
+	expiresAt  time.Time
+}
+
+type memoryDB struct {
+	mu     sync.Mutex
+	lastID map[string]int64
+
+	users          map[int64]*User
+	sessions       map[string]*Session
+	devices        map[int64]*memoryDevice
+	statusHistory  []DeviceStatusChange
+	inventory      []InventoryChange
+	patterns       map[int64]*patternState
+	patternChanges []memoryPatternChange
+	policyBundles  []memoryPolicyBundle
+	requests       map[int64]*Request
+	subscriptions  map[int64]*PushSubscription
+	config         map[string]string
+	commands       map[int64]*DeviceCommand
+	enrollments    map[int64]*DeviceEnrollment
+	events         map[int64]*DeviceEvent
+	brokerEvents   []BrokerEvent
+}
+
+// nextID hands out row IDs per table the way AUTOINCREMENT does
+func (m *memoryDB) nextID(table string) int64 {
+	m.lastID[table]++
+	return m.lastID[table]
+}
+
+type (
+	memUsers             struct{ m *memoryDB }
+	memSessions          struct{ m *memoryDB }
+	memDevices           struct{ m *memoryDB }
+	memPatterns          struct{ m *memoryDB }
+	memRequests          struct{ m *memoryDB }
+	memPushSubscriptions struct{ m *memoryDB }
+	memConfig            struct{ m *memoryDB }
+	memCommands          struct{ m *memoryDB }
+	memEnrollments       struct{ m *memoryDB }
+	memEvents            struct{ m *memoryDB }
+	memBroker            struct{ m *memoryDB }
+)
+
+// NewMemoryStore returns an empty store that keeps everything in memory
+func NewMemoryStore() *Store {
+	m := &memoryDB{
+		lastID:        make(map[string]int64),
+		users:         make(map[int64]*User),
+		sessions:      make(map[string]*Session),
+		devices:       make(map[int64]*memoryDevice),
+		patterns:      make(map[int64]*patternState),
+		requests:      make(map[int64]*Request),
+		subscriptions: make(map[int64]*PushSubscription),
+		config:        make(map[string]string),
+		commands:      make(map[int64]*DeviceCommand),
+		enrollments:   make(map[int64]*DeviceEnrollment),
+		events:        make(map[int64]*DeviceEvent),
+	}
+	return &Store{
+		Users:             &memUsers{m},
+		Sessions:          &memSessions{m},
+		Devices:           &memDevices{m},
+		Patterns:          &memPatterns{m},
+		Requests:          &memRequests{m},
+		PushSubscriptions: &memPushSubscriptions{m},
+		Config:            &memConfig{m},
+		Commands:          &memCommands{m},
+		Enrollments:       &memEnrollments{m},
+		Events:            &memEvents{m},
+		Broker:            &memBroker{m},
+	}
+}
+
+// newestFirst orders rows by creation time and then ID, both descending
+func newestFirst(createdA, createdB time.Time, idA, idB int64) bool {
+	if !createdA.Equal(createdB) {
+		return createdA.After(createdB)
+	}
+	return idA > idB
+}
+
+// ========== User Operations ==========
+
+func (repo *memUsers) Create(username, password string) (*User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	for _, u := range repo.m.users {
+		if u.Username == username {
+			return nil, errMemoryDuplicate
+		}
+	}
+
+	user := &User{
+		ID:                 repo.m.nextID("users"),
+		Username:           username,
+		PasswordHash:       string(hash),
+		NotifyNewRequests:  true,
+		NotifyDeviceStatus: true,
+		NotifySecurity:     true,
+		CreatedAt:          time.Now(),
+	}
+	repo.m.users[user.ID] = user
+
+	created := *user
+	created.PasswordHash = ""
+	return &created, nil
+}
+
+func (repo *memUsers) GetByUsername(username string) (*User, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	for _, u := range repo.m.users {
+		if u.Username == username {
+			user := *u
+			return &user, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (repo *memUsers) GetByID(id int64) (*User, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	u, ok := repo.m.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	user := *u
+	return &user, nil
+}
+
+func (repo *memUsers) List() ([]User, error) {
+	return repo.filter(func(*User) bool { return true }), nil
+}
+
+// filter returns matching users without their password hashes, newest first
+func (repo *memUsers) filter(match func(*User) bool) []User {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	var users []User
+	for _, u := range repo.m.users {
+		if match(u) {
+			user := *u
+			user.PasswordHash = ""
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return newestFirst(users[i].CreatedAt, users[j].CreatedAt, users[i].ID, users[j].ID)
+	})
+	return users
+}
+
+func (repo *memUsers) Count() (int, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+	return len(repo.m.users), nil
+}
+
+func (repo *memUsers) UpdateNotificationPrefs(userID int64, notifyNewRequests, notifyDeviceStatus, notifySecurity bool) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if u, ok := repo.m.users[userID]; ok {
+		u.NotifyNewRequests = notifyNewRequests
+		u.NotifyDeviceStatus = notifyDeviceStatus
+		u.NotifySecurity = notifySecurity
+	}
+	return nil
+}
+
+func (repo *memUsers) UpdatePassword(userID int64, newPassword string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if u, ok := repo.m.users[userID]; ok {
+		u.PasswordHash = string(hash)
+	}
+	return nil
+}
+
+func (repo *memUsers) ListForNotification(notificationType string) ([]User, error) {
+	var match func(*User) bool
+	switch notificationType {
+	case "new_request":
+		match = func(u *User) bool { return u.NotifyNewRequests }
+	case "device_status":
+		match = func(u *User) bool { return u.NotifyDeviceStatus }
+	case "security_event":
+		match = func(u *User) bool { return u.NotifySecurity }
+	default:
+		return nil, nil
+	}
+	return repo.filter(match), nil
+}
+
+// ========== Session Operations ==========
+
+func (repo *memSessions) Create(userID int64) (*Session, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if _, ok := repo.m.users[userID]; !ok {
+		return nil, errMemoryForeignKey
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:        repo.m.nextID("sessions"),
+		UserID:    userID,
+		Token:     token,
+		ExpiresAt: now.Add(SessionLifetime),
+		CreatedAt: now,
+	}
+	repo.m.sessions[token] = session
+
+	created := *session
+	return &created, nil
+}
+
+func (repo *memSessions) GetByToken(token string) (*Session, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	s, ok := repo.m.sessions[token]
+	if !ok || !s.ExpiresAt.After(time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+	session := *s
+	return &session, nil
+}
+
+func (repo *memSessions) Delete(token string) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	delete(repo.m.sessions, token)
+	return nil
+}
+
+func (repo *memSessions) DeleteByUser(userID int64) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	for token, s := range repo.m.sessions {
+		if s.UserID == userID {
+			delete(repo.m.sessions, token)
+		}
+	}
+	return nil
+}
+
+func (repo *memSessions) DeleteExpired() error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	now := time.Now()
+	for token, s := range repo.m.sessions {
+		if !s.ExpiresAt.After(now) {
+			delete(repo.m.sessions, token)
+		}
+	}
+	return nil
+}
+
+// ========== Device Operations ==========
+
+// device returns a copy of a stored device as the SQLite repository would
+// load it, or nil if it doesn't exist. The caller holds the lock.
+func (m *memoryDB) device(id int64) *Device {
+	d, ok := m.devices[id]
+	if !ok {
+		return nil
+	}
+	device := d.Device
+	device.Token = ""
+	device.UsedPreviousToken = false
+	device.clearExpiredPreviousToken()
+	if d.inventory.UpdatedAt != nil {
+		inv := d.inventory
+		device.Inventory = &inv
+	}
+	return &device
+}
+
+// recordStatus appends to the status history. The caller holds the lock.
+func (m *memoryDB) recordStatus(change DeviceStatusChange) DeviceStatusChange {
+	change.ID = m.nextID("device_status_history")
+	m.statusHistory = append(m.statusHistory, change)
+	return change
+}
+
+func (repo *memDevices) Create(name string) (*Device, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	now := time.Now()
+	d := &memoryDevice{
+		Device: Device{
+			ID:          repo.m.nextID("devices"),
+			TokenPrefix: tokenPrefix(token),
+			Name:        name,
+			Status:      "active",
+			LastSeen:    &now,
+			CreatedAt:   now,
+		},
+		tokenHash: hashToken(token),
+	}
+	repo.m.devices[d.ID] = d
+	repo.m.recordStatus(DeviceStatusChange{DeviceID: d.ID, Status: "active", Reason: "created", ChangedAt: now.UTC()})
+
+	device := d.Device
+	device.Token = token
+	return &device, nil
+}
+
+func (repo *memDevices) GetByID(id int64) (*Device, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	device := repo.m.device(id)
+	if device == nil {
+		return nil, sql.ErrNoRows
+	}
+	return device, nil
+}
+
+func (repo *memDevices) GetByToken(token string) (*Device, error) {
+	if len(token) < tokenPrefixLength {
+		return nil, sql.ErrNoRows
+	}
+
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	prefix := tokenPrefix(token)
+	hash := []byte(hashToken(token))
+	for id, d := range repo.m.devices {
+		if d.TokenPrefix == prefix && subtle.ConstantTimeCompare(hash, []byte(d.tokenHash)) == 1 {
+			device := repo.m.device(id)
+			device.Inventory = nil
+			device.PreviousTokenExpiresAt = d.PreviousTokenExpiresAt
+			return device, nil
+		}
+		if d.previousPrefix == prefix && d.PreviousTokenExpiresAt != nil && d.PreviousTokenExpiresAt.After(time.Now()) &&
+			subtle.ConstantTimeCompare(hash, []byte(d.previousHash)) == 1 {
+			device := repo.m.device(id)
+			device.Inventory = nil
+			device.UsedPreviousToken = true
+			device.currentTokenHash = d.tokenHash
+			return device, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (repo *memDevices) List() ([]Device, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	var devices []Device
+	for id := range repo.m.devices {
+		devices = append(devices, *repo.m.device(id))
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return newestFirst(devices[i].CreatedAt, devices[j].CreatedAt, devices[i].ID, devices[j].ID)
+	})
+	return devices, nil
+}
+
+// Delete removes a device and, like the foreign keys do in SQLite, everything
+// that belongs to it
+func (repo *memDevices) Delete(id int64) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	m := repo.m
+	delete(m.devices, id)
+	for pid, p := range m.patterns {
+		if p.DeviceID == id {
+			delete(m.patterns, pid)
+		}
+	}
+	for rid, r := range m.requests {
+		if r.DeviceID == id {
+			delete(m.requests, rid)
+		}
+	}
+	for cid, c := range m.commands {
+		if c.DeviceID == id {
+			delete(m.commands, cid)
+		}
+	}
+	for eid, e := range m.enrollments {
+		if e.DeviceID == id {
+			delete(m.enrollments, eid)
+		}
+	}
+	for eid, e := range m.events {
+		if e.DeviceID == id {
+			delete(m.events, eid)
+		}
+	}
+
+	var history []DeviceStatusChange
+	for _, c := range m.statusHistory {
+		if c.DeviceID != id {
+			history = append(history, c)
+		}
+	}
+	m.statusHistory = history
+
+	var inventory []InventoryChange
+	for _, c := range m.inventory {
+		if c.DeviceID != id {
+			inventory = append(inventory, c)
+		}
+	}
+	m.inventory = inventory
+
+	var changes []memoryPatternChange
+	for _, c := range m.patternChanges {
+		if c.DeviceID != id {
+			changes = append(changes, c)
+		}
+	}
+	m.patternChanges = changes
+
+	var bundles []memoryPolicyBundle
+	for _, b := range m.policyBundles {
+		if b.deviceID != id {
+			bundles = append(bundles, b)
+		}
+	}
+	m.policyBundles = bundles
+	return nil
+}
+
+func (repo *memDevices) RegenerateToken(id int64, grace time.Duration) (*Device, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	d, ok := repo.m.devices[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if grace > 0 {
+		expiresAt := time.Now().UTC().Add(grace)
+		d.previousHash, d.previousPrefix, d.PreviousTokenExpiresAt = d.tokenHash, d.TokenPrefix, &expiresAt
+	} else {
+		d.previousHash, d.previousPrefix, d.PreviousTokenExpiresAt = "", "", nil
+	}
+	d.tokenHash, d.TokenPrefix = hashToken(token), tokenPrefix(token)
+
+	device := repo.m.device(id)
+	device.Token = token
+	return device, nil
+}
+
+func (repo *memDevices) ReissueToken(device *Device) (*Device, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	d, ok := repo.m.devices[device.ID]
+	if !ok || d.tokenHash != device.currentTokenHash {
+		return nil, sql.ErrNoRows
+	}
+	expiresAt := time.Now().UTC().Add(TokenRotationGrace)
+	d.previousHash, d.previousPrefix, d.PreviousTokenExpiresAt = d.tokenHash, d.TokenPrefix, &expiresAt
+	d.tokenHash, d.TokenPrefix = hashToken(token), tokenPrefix(token)
+
+	device = repo.m.device(device.ID)
+	device.Token = token
+	return device, nil
+}
+
+func (repo *memDevices) TokenHashes(id int64) ([]string, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	d, ok := repo.m.devices[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	hashes := []string{d.tokenHash}
+	if d.previousHash != "" && d.PreviousTokenExpiresAt != nil && d.PreviousTokenExpiresAt.After(time.Now()) {
+		hashes = append(hashes, d.previousHash)
+	}
+	return hashes, nil
+}
+
+// HashLegacyTokens has nothing to do, tokens are hashed from the start
+func (repo *memDevices) HashLegacyTokens() error {
+	return nil
+}
+
+func (repo *memDevices) UpdateHeartbeat(deviceID int64, reason string) (*DeviceStatusChange, error) {
+	now := time.Now()
+	return repo.setStatus(deviceID, "active", reason, &now)
+}
+
+func (repo *memDevices) UpdateStatus(deviceID int64, status, reason string) (*DeviceStatusChange, error) {
+	return repo.setStatus(deviceID, status, reason, nil)
+}
+
+func (repo *memDevices) setStatus(deviceID int64, status, reason string, lastSeen *time.Time) (*DeviceStatusChange, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	d, ok := repo.m.devices[deviceID]
+	if !ok {
+		return nil, nil
+	}
+
+	var change *DeviceStatusChange
+	if d.Status != status {
+		recorded := repo.m.recordStatus(DeviceStatusChange{
+			DeviceID:       deviceID,
+			Status:         status,
+			PreviousStatus: d.Status,
+			Reason:         reason,
+			ChangedAt:      time.Now().UTC(),
+		})
+		change = &recorded
+	}
+
+	d.Status = status
+	if lastSeen != nil {
+		seen := *lastSeen
+		d.LastSeen = &seen
+	}
+	return change, nil
+}
+
+func (repo *memDevices) MarkInactive(threshold time.Duration) ([]Device, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	cutoff := time.Now().Add(-threshold)
+	var devices []Device
+	for _, d := range repo.m.devices {
+		if d.Status != "active" || (d.LastSeen != nil && !d.LastSeen.Before(cutoff)) {
+			continue
+		}
+
+		changedAt := time.Now().UTC()
+		if d.LastSeen != nil {
+			changedAt = d.LastSeen.UTC()
+		}
+		repo.m.recordStatus(DeviceStatusChange{
+			DeviceID:       d.ID,
+			Status:         "inactive",
+			PreviousStatus: "active",
+			Reason:         "heartbeat_timeout",
+			ChangedAt:      changedAt,
+		})
+
+		d.Status = "inactive"
+		devices = append(devices, Device{ID: d.ID, Name: d.Name, LastSeen: d.LastSeen, Status: "inactive"})
+	}
+	return devices, nil
+}
+
+func (repo *memDevices) ListStatusHistory(deviceID int64, from, to time.Time) ([]DeviceStatusChange, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	var changes []DeviceStatusChange
+	for _, c := range repo.m.statusHistory {
+		if c.DeviceID == deviceID && !c.ChangedAt.Before(from) && c.ChangedAt.Before(to) {
+			changes = append(changes, c)
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].ChangedAt.Before(changes[j].ChangedAt) })
+	return changes, nil
+}
+
+func (repo *memDevices) StatusAt(deviceID int64, at time.Time) (*DeviceStatusChange, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	var last *DeviceStatusChange
+	for i, c := range repo.m.statusHistory {
+		if c.DeviceID == deviceID && c.ChangedAt.Before(at) && (last == nil || !c.ChangedAt.Before(last.ChangedAt)) {
+			last = &repo.m.statusHistory[i]
+		}
+	}
+	if last == nil {
+		return nil, sql.ErrNoRows
+	}
+	change := *last
+	return &change, nil
+}
+
+func (repo *memDevices) UpdateInventory(deviceID int64, reported *DeviceInventory) ([]InventoryChange, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	d, ok := repo.m.devices[deviceID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	now := time.Now().UTC()
+	d.inventory.UpdatedAt = &now
+
+	fields := []*string{&d.inventory.ExtensionVersion, &d.inventory.BrowserName, &d.inventory.BrowserVersion,
+		&d.inventory.OS, &d.inventory.ProfileEmail, &d.inventory.Timezone}
+	var changes []InventoryChange
+	for i, value := range reported.values() {
+		if value == "" || value == *fields[i] {
+			continue
+		}
+
+		change := InventoryChange{
+			ID:        repo.m.nextID("device_inventory_history"),
+			DeviceID:  deviceID,
+			Field:     inventoryColumns[i],
+			OldValue:  *fields[i],
+			NewValue:  value,
+			ChangedAt: now,
+		}
+		*fields[i] = value
+		repo.m.inventory = append(repo.m.inventory, change)
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+func (repo *memDevices) ListInventoryHistory(deviceID int64, limit int) ([]InventoryChange, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	var changes []InventoryChange
+	for _, c := range repo.m.inventory {
+		if c.DeviceID == deviceID {
+			changes = append(changes, c)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return newestFirst(changes[i].ChangedAt, changes[j].ChangedAt, changes[i].ID, changes[j].ID)
+	})
+	if len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return changes, nil
+}
+
+func (repo *memDevices) SetReportedPolicyHash(deviceID int64, policyHash string) (string, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	d, ok := repo.m.devices[deviceID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	previous := d.reportedPolicyHash
+	d.reportedPolicyHash = policyHash
+	return previous, nil
+}
+
+// ========== Pattern Operations ==========
+
+// patternState returns a copy of a stored pattern, or nil. The caller holds the lock.
+func (m *memoryDB) patternState(id int64) *patternState {
+	p, ok := m.patterns[id]
+	if !ok {
+		return nil
+	}
+	state := *p
+	return &state
+}
+
+// recordPatternChange is the in-memory counterpart of recordPatternChange.
+// The caller holds the lock.
+func (m *memoryDB) recordPatternChange(before, after *patternState) {
+	var op string
+	switch {
+	case before.active() && after.active():
+		op = "update"
+	case after.active():
+		op = "add"
+	case before.active():
+		op = "remove"
+	default:
+		return
+	}
+
+	current := after
+	if current == nil {
+		current = before
+	}
+
+	d, ok := m.devices[current.DeviceID]
+	if !ok {
+		return
+	}
+	d.policyVersion++
+
+	change := PatternChange{DeviceID: current.DeviceID, Version: d.policyVersion, Op: op, PatternID: current.ID}
+	if op != "remove" {
+		pattern := after.Pattern
+		change.Pattern = &pattern
+	}
+	m.patternChanges = append(m.patternChanges, memoryPatternChange{PatternChange: change, createdAt: time.Now().UTC()})
+}
+
+// update applies a write to a pattern and records the resulting change
+func (repo *memPatterns) update(id int64, write func(p *patternState)) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	before := repo.m.patternState(id)
+	if before != nil {
+		write(repo.m.patterns[id])
+	}
+	repo.m.recordPatternChange(before, repo.m.patternState(id))
+	return nil
+}
+
+func (repo *memPatterns) Create(deviceID int64, pattern, patternType string, expiresAt *time.Time) (*Pattern, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if _, ok := repo.m.devices[deviceID]; !ok {
+		return nil, errMemoryForeignKey
+	}
+
+	p := &patternState{Pattern: Pattern{
+		ID:        repo.m.nextID("patterns"),
+		DeviceID:  deviceID,
+		Pattern:   pattern,
+		Type:      patternType,
+		Enabled:   true,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now().UTC(),
+	}}
+	repo.m.patterns[p.ID] = p
+	repo.m.recordPatternChange(nil, repo.m.patternState(p.ID))
+
+	created := p.Pattern
+	return &created, nil
+}
+
+func (repo *memPatterns) GetByID(id int64) (*Pattern, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	p := repo.m.patternState(id)
+	if p == nil {
+		return nil, sql.ErrNoRows
+	}
+	return &p.Pattern, nil
+}
+
+func (repo *memPatterns) ListByDevice(deviceID int64) ([]Pattern, error) {
+	return repo.list(func(p *patternState) bool { return p.DeviceID == deviceID && p.active() }, false), nil
+}
+
+func (repo *memPatterns) ListAll() ([]Pattern, error) {
+	return repo.list(func(*patternState) bool { return true }, true), nil
+}
+
+// list returns matching patterns newest first, deny patterns ahead of allow
+// patterns if denyFirst is set
+func (repo *memPatterns) list(match func(p *patternState) bool, denyFirst bool) []Pattern {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	var patterns []Pattern
+	for _, p := range repo.m.patterns {
+		if match(p) {
+			patterns = append(patterns, p.Pattern)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if denyFirst && (patterns[i].Type == "deny") != (patterns[j].Type == "deny") {
+			return patterns[i].Type == "deny"
+		}
+		return newestFirst(patterns[i].CreatedAt, patterns[j].CreatedAt, patterns[i].ID, patterns[j].ID)
+	})
+	return patterns
+}
+
+func (repo *memPatterns) Update(id int64, pattern, patternType string, expiresAt *time.Time) (*Pattern, error) {
+	err := repo.update(id, func(p *patternState) {
+		p.Pattern.Pattern = pattern
+		p.Type = patternType
+		p.ExpiresAt = expiresAt
+		p.expiryRecorded = false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repo.GetByID(id)
+}
+
+func (repo *memPatterns) SetEnabled(id int64, enabled bool) error {
+	return repo.update(id, func(p *patternState) { p.Enabled = enabled })
+}
+
+func (repo *memPatterns) Delete(id int64) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	before := repo.m.patternState(id)
+	delete(repo.m.patterns, id)
+	repo.m.recordPatternChange(before, nil)
+	return nil
+}
+
+func (repo *memPatterns) PolicyVersion(deviceID int64) (int64, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	d, ok := repo.m.devices[deviceID]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	return d.policyVersion, nil
+}
+
+func (repo *memPatterns) ListChangesSince(deviceID, since int64) (changes []PatternChange, version int64, complete bool, err error) {
+	version, err = repo.PolicyVersion(deviceID)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if since > version || since < 0 {
+		return nil, version, false, nil
+	}
+	if since == version {
+		return nil, version, true, nil
+	}
+
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	for _, c := range repo.m.patternChanges {
+		if c.DeviceID == deviceID && c.Version > since && c.Version <= version {
+			changes = append(changes, c.PatternChange)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Version < changes[j].Version })
+	return changes, version, int64(len(changes)) == version-since, nil
+}
+
+func (repo *memPatterns) RecordExpired() ([]int64, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	var ids []int64
+	now := time.Now()
+	for id, p := range repo.m.patterns {
+		if !p.expiryRecorded && p.ExpiresAt != nil && !p.ExpiresAt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	changed := make(map[int64]bool)
+	var deviceIDs []int64
+	for _, id := range ids {
+		before := repo.m.patternState(id)
+		repo.m.patterns[id].expiryRecorded = true
+		repo.m.recordPatternChange(before, repo.m.patternState(id))
+		if before.active() && !changed[before.DeviceID] {
+			changed[before.DeviceID] = true
+			deviceIDs = append(deviceIDs, before.DeviceID)
+		}
+	}
+	return deviceIDs, nil
+}
+
+func (repo *memPatterns) PruneChanges() error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	cutoff := time.Now().UTC().Add(-PatternChangeRetention)
+	var changes []memoryPatternChange
+	for _, c := range repo.m.patternChanges {
+		if !c.createdAt.Before(cutoff) {
+			changes = append(changes, c)
+		}
+	}
+	repo.m.patternChanges = changes
+	return nil
+}
+
+func (repo *memPatterns) RecordPolicyBundle(deviceID, version int64, policyHash string, issuedAt, expiresAt time.Time) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if _, ok := repo.m.devices[deviceID]; !ok {
+		return errMemoryForeignKey
+	}
+	for i, b := range repo.m.policyBundles {
+		if b.deviceID == deviceID && b.policyHash == policyHash {
+			repo.m.policyBundles[i].version = version
+			repo.m.policyBundles[i].expiresAt = expiresAt
+			return nil
+		}
+	}
+	repo.m.policyBundles = append(repo.m.policyBundles, memoryPolicyBundle{deviceID, version, policyHash, expiresAt})
+	return nil
+}
+
+func (repo *memPatterns) IsKnownPolicyHash(deviceID int64, policyHash string) (bool, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	for _, b := range repo.m.policyBundles {
+		if b.deviceID == deviceID && b.policyHash == policyHash {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (repo *memPatterns) PrunePolicyBundles(olderThan time.Duration) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	cutoff := time.Now().UTC().Add(-olderThan)
+	var bundles []memoryPolicyBundle
+	for _, b := range repo.m.policyBundles {
+		if !b.expiresAt.Before(cutoff) {
+			bundles = append(bundles, b)
+		}
+	}
+	repo.m.policyBundles = bundles
+	return nil
+}
+
+// ========== Request Operations ==========
+
+func (repo *memRequests) Create(deviceID int64, url, suggestedPattern string) (*Request, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if _, ok := repo.m.devices[deviceID]; !ok {
+		return nil, errMemoryForeignKey
+	}
+
+	req := &Request{
+		ID:               repo.m.nextID("requests"),
+		DeviceID:         deviceID,
+		URL:              url,
+		SuggestedPattern: suggestedPattern,
+		Status:           "pending",
+		CreatedAt:        time.Now(),
+	}
+	repo.m.requests[req.ID] = req
+
+	created := *req
+	return &created, nil
+}
+
+// request returns a copy of a stored request with its device name. The
+// caller holds the lock.
+func (m *memoryDB) request(r *Request) Request {
+	req := *r
+	if d, ok := m.devices[r.DeviceID]; ok {
+		req.DeviceName = d.Name
+	}
+	return req
+}
+
+func (repo *memRequests) GetByID(id int64) (*Request, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	r, ok := repo.m.requests[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	req := repo.m.request(r)
+	return &req, nil
+}
+
+func (repo *memRequests) List(status string) ([]Request, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	var requests []Request
+	for _, r := range repo.m.requests {
+		if status == "" || r.Status == status {
+			requests = append(requests, repo.m.request(r))
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return newestFirst(requests[i].CreatedAt, requests[j].CreatedAt, requests[i].ID, requests[j].ID)
+	})
+	return requests, nil
+}
+
+func (repo *memRequests) Count(status string) (int, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	count := 0
+	for _, r := range repo.m.requests {
+		if r.Status == status {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (repo *memRequests) Approve(id int64) error {
+	return repo.resolve(id, "approved")
+}
+
+func (repo *memRequests) Deny(id int64) error {
+	return repo.resolve(id, "denied")
+}
+
+func (repo *memRequests) resolve(id int64, status string) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if r, ok := repo.m.requests[id]; ok {
+		now := time.Now()
+		r.Status = status
+		r.ResolvedAt = &now
+	}
+	return nil
+}
+
+// ========== Push Subscription Operations ==========
+
+func (repo *memPushSubscriptions) Create(userID int64, endpoint, p256dh, auth string) (*PushSubscription, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if _, ok := repo.m.users[userID]; !ok {
+		return nil, errMemoryForeignKey
+	}
+	for id, s := range repo.m.subscriptions {
+		if s.Endpoint == endpoint {
+			delete(repo.m.subscriptions, id)
+		}
+	}
+
+	sub := &PushSubscription{
+		ID:        repo.m.nextID("push_subscriptions"),
+		UserID:    userID,
+		Endpoint:  endpoint,
+		P256dh:    p256dh,
+		Auth:      auth,
+		CreatedAt: time.Now(),
+	}
+	repo.m.subscriptions[sub.ID] = sub
+
+	created := *sub
+	return &created, nil
+}
+
+func (repo *memPushSubscriptions) ListByUser(userID int64) ([]PushSubscription, error) {
+	return repo.filter(func(s *PushSubscription) bool { return s.UserID == userID }), nil
+}
+
+func (repo *memPushSubscriptions) ListAll() ([]PushSubscription, error) {
+	return repo.filter(func(*PushSubscription) bool { return true }), nil
+}
+
+func (repo *memPushSubscriptions) filter(match func(s *PushSubscription) bool) []PushSubscription {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	var subs []PushSubscription
+	for _, s := range repo.m.subscriptions {
+		if match(s) {
+			subs = append(subs, *s)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs
+}
+
+func (repo *memPushSubscriptions) Delete(endpoint string) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	for id, s := range repo.m.subscriptions {
+		if s.Endpoint == endpoint {
+			delete(repo.m.subscriptions, id)
+		}
+	}
+	return nil
+}
+
+func (repo *memPushSubscriptions) DeleteByID(id int64) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	delete(repo.m.subscriptions, id)
+	return nil
+}
+
+// ========== App Config Operations ==========
+
+func (repo *memConfig) Get(key string) (string, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	value, ok := repo.m.config[key]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return value, nil
+}
+
+func (repo *memConfig) Set(key, value string) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	repo.m.config[key] = value
+	return nil
+}
+
+func (repo *memConfig) SetDefault(key, value string) (string, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if stored, ok := repo.m.config[key]; ok {
+		return stored, nil
+	}
+	repo.m.config[key] = value
+	return value, nil
+}
+
+// ========== Device Command Operations ==========
+
+func (repo *memCommands) Create(deviceID int64, commandType string, params json.RawMessage, ttl time.Duration) (*DeviceCommand, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if _, ok := repo.m.devices[deviceID]; !ok {
+		return nil, errMemoryForeignKey
+	}
+
+	now := time.Now().UTC()
+	c := &DeviceCommand{
+		ID:        repo.m.nextID("device_commands"),
+		DeviceID:  deviceID,
+		Type:      commandType,
+		Params:    params,
+		Status:    "pending",
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	repo.m.commands[c.ID] = c
+
+	created := *c
+	return &created, nil
+}
+
+// expire marks unanswered commands past their expiry as expired. The caller
+// holds the lock.
+func (repo *memCommands) expire() {
+	now := time.Now()
+	for _, c := range repo.m.commands {
+		if (c.Status == "pending" || c.Status == "delivered") && !c.ExpiresAt.After(now) {
+			c.Status = "expired"
+		}
+	}
+}
+
+func (repo *memCommands) GetByID(id int64) (*DeviceCommand, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	repo.expire()
+	c, ok := repo.m.commands[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	command := *c
+	return &command, nil
+}
+
+func (repo *memCommands) List(deviceID int64, limit int) ([]DeviceCommand, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	repo.expire()
+	var commands []DeviceCommand
+	for _, c := range repo.m.commands {
+		if c.DeviceID == deviceID {
+			commands = append(commands, *c)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return newestFirst(commands[i].CreatedAt, commands[j].CreatedAt, commands[i].ID, commands[j].ID)
+	})
+	if len(commands) > limit {
+		commands = commands[:limit]
+	}
+	return commands, nil
+}
+
+func (repo *memCommands) ListPending(deviceID int64) ([]DeviceCommand, error) {
+	return repo.listUnanswered(deviceID, false)
+}
+
+func (repo *memCommands) ListUnacknowledged(deviceID int64) ([]DeviceCommand, error) {
+	return repo.listUnanswered(deviceID, true)
+}
+
+func (repo *memCommands) listUnanswered(deviceID int64, delivered bool) ([]DeviceCommand, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	repo.expire()
+	var commands []DeviceCommand
+	for _, c := range repo.m.commands {
+		if c.DeviceID == deviceID && (c.Status == "pending" || delivered && c.Status == "delivered") {
+			commands = append(commands, *c)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].ID < commands[j].ID })
+	return commands, nil
+}
+
+func (repo *memCommands) MarkDelivered(id int64) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if c, ok := repo.m.commands[id]; ok && c.Status == "pending" {
+		now := time.Now().UTC()
+		c.Status = "delivered"
+		c.DeliveredAt = &now
+	}
+	return nil
+}
+
+func (repo *memCommands) Acknowledge(id, deviceID int64, success bool, errorMessage string) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	c, ok := repo.m.commands[id]
+	if !ok || c.DeviceID != deviceID || (c.Status != "pending" && c.Status != "delivered") {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now().UTC()
+	c.Status = "acknowledged"
+	if !success {
+		c.Status = "failed"
+		c.Error = errorMessage
+	}
+	c.AcknowledgedAt = &now
+	if c.DeliveredAt == nil {
+		c.DeliveredAt = &now
+	}
+	return nil
+}
+
+// ========== Enrollment Operations ==========
+
+func (repo *memEnrollments) Create(deviceID int64, ttl time.Duration) (*DeviceEnrollment, error) {
+	code, err := generateEnrollmentCode()
+	if err != nil {
+		return nil, err
+	}
+
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if _, ok := repo.m.devices[deviceID]; !ok {
+		return nil, errMemoryForeignKey
+	}
+
+	now := time.Now().UTC()
+	e := &DeviceEnrollment{
+		ID:        repo.m.nextID("device_enrollments"),
+		DeviceID:  deviceID,
+		Code:      code,
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+	repo.m.enrollments[e.ID] = e
+
+	created := *e
+	return &created, nil
+}
+
+func (repo *memEnrollments) ListPending() ([]DeviceEnrollment, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	var enrollments []DeviceEnrollment
+	now := time.Now()
+	for _, e := range repo.m.enrollments {
+		if e.UsedAt == nil && e.ExpiresAt.After(now) {
+			enrollment := *e
+			enrollment.DeviceName = repo.m.devices[e.DeviceID].Name
+			enrollments = append(enrollments, enrollment)
+		}
+	}
+	sort.Slice(enrollments, func(i, j int) bool {
+		return newestFirst(enrollments[i].CreatedAt, enrollments[j].CreatedAt, enrollments[i].ID, enrollments[j].ID)
+	})
+	return enrollments, nil
+}
+
+func (repo *memEnrollments) Delete(id int64) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	delete(repo.m.enrollments, id)
+	return nil
+}
+
+func (repo *memEnrollments) Redeem(code string) (*Device, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, e := range repo.m.enrollments {
+		if e.Code != code || e.UsedAt != nil || !e.ExpiresAt.After(now) {
+			continue
+		}
+
+		e.UsedAt = &now
+		d := repo.m.devices[e.DeviceID]
+		d.tokenHash, d.TokenPrefix = hashToken(token), tokenPrefix(token)
+		d.previousHash, d.previousPrefix, d.PreviousTokenExpiresAt = "", "", nil
+
+		device := repo.m.device(d.ID)
+		device.Token = token
+		return device, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// ========== Device Event Operations ==========
+
+func (repo *memEvents) Create(deviceID int64, eventType, severity, source string, details json.RawMessage, occurredAt *time.Time) (*DeviceEvent, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if _, ok := repo.m.devices[deviceID]; !ok {
+		return nil, errMemoryForeignKey
+	}
+
+	e := &DeviceEvent{
+		ID:         repo.m.nextID("device_events"),
+		DeviceID:   deviceID,
+		Type:       eventType,
+		Severity:   severity,
+		Source:     source,
+		Details:    details,
+		OccurredAt: occurredAt,
+		CreatedAt:  time.Now().UTC(),
+	}
+	repo.m.events[e.ID] = e
+
+	created := *e
+	return &created, nil
+}
+
+func (repo *memEvents) List(deviceID int64, limit int) ([]DeviceEvent, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	var events []DeviceEvent
+	for _, e := range repo.m.events {
+		if e.DeviceID == deviceID {
+			events = append(events, *e)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return newestFirst(events[i].CreatedAt, events[j].CreatedAt, events[i].ID, events[j].ID)
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+// ========== Broker Operations ==========
+
+func (repo *memBroker) Insert(instanceID, kind string, deviceID int64, data []byte) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	repo.m.brokerEvents = append(repo.m.brokerEvents, BrokerEvent{
+		ID:         repo.m.nextID("broker_events"),
+		InstanceID: instanceID,
+		Kind:       kind,
+		DeviceID:   deviceID,
+		Data:       append([]byte(nil), data...),
+		CreatedAt:  time.Now().UTC(),
+	})
+	return nil
+}
+
+func (repo *memBroker) LatestID() (int64, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	if n := len(repo.m.brokerEvents); n > 0 {
+		return repo.m.brokerEvents[n-1].ID, nil
+	}
+	return 0, nil
+}
+
+func (repo *memBroker) ListAfter(afterID int64, instanceID string, limit int) ([]BrokerEvent, error) {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	var events []BrokerEvent
+	for _, e := range repo.m.brokerEvents {
+		if len(events) == limit {
+			break
+		}
+		if e.ID > afterID && e.InstanceID != instanceID {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (repo *memBroker) Prune(olderThan time.Duration) error {
+	repo.m.mu.Lock()
+	defer repo.m.mu.Unlock()
+
+	cutoff := time.Now().UTC().Add(-olderThan)
+	var events []BrokerEvent
+	for _, e := range repo.m.brokerEvents {
+		if !e.CreatedAt.Before(cutoff) {
+			events = append(events, e)
+		}
+	}
+	repo.m.brokerEvents = events
+	return nil
+}
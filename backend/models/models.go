@@ -2,11 +2,13 @@ package models
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/hex"
+	"log/slog"
 	"time"
 
-	"github.com/watchtower/web/database"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -17,6 +19,7 @@ type User struct {
 	PasswordHash       string    `json:"-"`
 	NotifyNewRequests  bool      `json:"notify_new_requests"`
 	NotifyDeviceStatus bool      `json:"notify_device_status"`
+	NotifySecurity     bool      `json:"notify_security_events"`
 	CreatedAt          time.Time `json:"created_at"`
 }
 
@@ -32,12 +35,27 @@ type PushSubscription struct {
 
 // Device represents a registered browser extension
 type Device struct {
-	ID        int64      `json:"id"`
-	Token     string     `json:"token,omitempty"`
-	Name      string     `json:"name"`
-	Status    string     `json:"status"`    // "active", "inactive", "uninstalled"
-	LastSeen  *time.Time `json:"last_seen"` // Last heartbeat time
-	CreatedAt time.Time  `json:"created_at"`
+	ID          int64      `json:"id"`
+	Token       string     `json:"token,omitempty"` // Only set right after a token is issued
+	TokenPrefix string     `json:"token_prefix,omitempty"`
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`    // "active", "inactive", "uninstalled"
+	LastSeen    *time.Time `json:"last_seen"` // Last heartbeat time
+	CreatedAt   time.Time  `json:"created_at"`
+
+	// PreviousTokenExpiresAt is set while a rotated-out token is still accepted
+	PreviousTokenExpiresAt *time.Time `json:"previous_token_expires_at,omitempty"`
+
+	// Inventory is the browser metadata last reported by the extension
+	Inventory *DeviceInventory `json:"inventory,omitempty"`
+
+	// UsedPreviousToken is set by GetDeviceByToken when the caller authenticated
+	// with a rotated-out token that is still within its grace period
+	UsedPreviousToken bool `json:"-"`
+
+	// currentTokenHash is the current token hash GetByToken saw, so
+	// ReissueToken only replaces the token the caller knows about
+	currentTokenHash string
 }
 
 // Pattern represents an allow/deny URL pattern
@@ -81,58 +99,81 @@ func generateToken(length int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+// Device tokens are stored as a SHA-256 hash plus a short plaintext prefix
+// that is used to find candidate rows without scanning the whole table
+const tokenPrefixLength = 8
+
+// SessionLifetime is how long an admin session lasts after login
+var SessionLifetime = 24 * time.Hour
+
+// TokenRotationGrace is how long a rotated-out device token keeps working
+const TokenRotationGrace = 24 * time.Hour
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func tokenPrefix(token string) string {
+	if len(token) < tokenPrefixLength {
+		return token
+	}
+	return token[:tokenPrefixLength]
+}
+
 // ========== User Operations ==========
 
-func CreateUser(username, password string) (*User, error) {
+func (repo *sqlUsers) Create(username, password string) (*User, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, err
 	}
 
-	result, err := database.DB.Exec(
-		"INSERT INTO users (username, password_hash, notify_new_requests, notify_device_status) VALUES (?, ?, 1, 1)",
+	var id int64
+	err = repo.db.QueryRow(
+		"INSERT INTO users (username, password_hash, notify_new_requests, notify_device_status, notify_security_events) VALUES (?, ?, 1, 1, 1) RETURNING id",
 		username, string(hash),
-	)
+	).Scan(&id)
 	if err != nil {
 		return nil, err
 	}
 
-	id, _ := result.LastInsertId()
 	return &User{
 		ID:                 id,
 		Username:           username,
 		NotifyNewRequests:  true,
 		NotifyDeviceStatus: true,
+		NotifySecurity:     true,
 		CreatedAt:          time.Now(),
 	}, nil
 }
 
-func GetUserByUsername(username string) (*User, error) {
+func (repo *sqlUsers) GetByUsername(username string) (*User, error) {
 	user := &User{}
-	err := database.DB.QueryRow(
-		"SELECT id, username, password_hash, COALESCE(notify_new_requests, 1), COALESCE(notify_device_status, 1), created_at FROM users WHERE username = ?",
+	err := repo.db.QueryRow(
+		"SELECT id, username, password_hash, COALESCE(notify_new_requests, 1), COALESCE(notify_device_status, 1), COALESCE(notify_security_events, 1), created_at FROM users WHERE username = ?",
 		username,
-	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.NotifyNewRequests, &user.NotifyDeviceStatus, &user.CreatedAt)
+	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.NotifyNewRequests, &user.NotifyDeviceStatus, &user.NotifySecurity, &user.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
-func GetUserByID(id int64) (*User, error) {
+func (repo *sqlUsers) GetByID(id int64) (*User, error) {
 	user := &User{}
-	err := database.DB.QueryRow(
-		"SELECT id, username, password_hash, COALESCE(notify_new_requests, 1), COALESCE(notify_device_status, 1), created_at FROM users WHERE id = ?",
+	err := repo.db.QueryRow(
+		"SELECT id, username, password_hash, COALESCE(notify_new_requests, 1), COALESCE(notify_device_status, 1), COALESCE(notify_security_events, 1), created_at FROM users WHERE id = ?",
 		id,
-	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.NotifyNewRequests, &user.NotifyDeviceStatus, &user.CreatedAt)
+	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.NotifyNewRequests, &user.NotifyDeviceStatus, &user.NotifySecurity, &user.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
-func ListUsers() ([]User, error) {
-	rows, err := database.DB.Query("SELECT id, username, COALESCE(notify_new_requests, 1), COALESCE(notify_device_status, 1), created_at FROM users ORDER BY created_at DESC")
+func (repo *sqlUsers) List() ([]User, error) {
+	rows, err := repo.db.Query("SELECT id, username, COALESCE(notify_new_requests, 1), COALESCE(notify_device_status, 1), COALESCE(notify_security_events, 1), created_at FROM users ORDER BY created_at DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -141,7 +182,7 @@ func ListUsers() ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Username, &u.NotifyNewRequests, &u.NotifyDeviceStatus, &u.CreatedAt); err != nil {
+		if err := rows.Scan(&u.ID, &u.Username, &u.NotifyNewRequests, &u.NotifyDeviceStatus, &u.NotifySecurity, &u.CreatedAt); err != nil {
 			return nil, err
 		}
 		users = append(users, u)
@@ -149,10 +190,10 @@ func ListUsers() ([]User, error) {
 	return users, nil
 }
 
-func UpdateUserNotificationPrefs(userID int64, notifyNewRequests, notifyDeviceStatus bool) error {
-	_, err := database.DB.Exec(
-		"UPDATE users SET notify_new_requests = ?, notify_device_status = ? WHERE id = ?",
-		notifyNewRequests, notifyDeviceStatus, userID,
+func (repo *sqlUsers) UpdateNotificationPrefs(userID int64, notifyNewRequests, notifyDeviceStatus, notifySecurity bool) error {
+	_, err := repo.db.Exec(
+		"UPDATE users SET notify_new_requests = ?, notify_device_status = ?, notify_security_events = ? WHERE id = ?",
+		boolInt(notifyNewRequests), boolInt(notifyDeviceStatus), boolInt(notifySecurity), userID,
 	)
 	return err
 }
@@ -162,13 +203,13 @@ func (u *User) CheckPassword(password string) bool {
 	return err == nil
 }
 
-func UpdateUserPassword(userID int64, newPassword string) error {
+func (repo *sqlUsers) UpdatePassword(userID int64, newPassword string) error {
 	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 
-	_, err = database.DB.Exec(
+	_, err = repo.db.Exec(
 		"UPDATE users SET password_hash = ? WHERE id = ?",
 		string(hash), userID,
 	)
@@ -177,72 +218,229 @@ func UpdateUserPassword(userID int64, newPassword string) error {
 
 // ========== Device Operations ==========
 
-func CreateDevice(name string) (*Device, error) {
+func (repo *sqlDevices) Create(name string) (*Device, error) {
 	token, err := generateToken(32)
 	if err != nil {
 		return nil, err
 	}
 
 	now := time.Now()
-	result, err := database.DB.Exec(
-		"INSERT INTO devices (token, name, status, last_seen) VALUES (?, ?, 'active', ?)",
-		token, name, now,
-	)
+	var id int64
+	err = repo.db.QueryRow(
+		"INSERT INTO devices (token, token_prefix, name, status, last_seen) VALUES (?, ?, ?, 'active', ?) RETURNING id",
+		hashToken(token), tokenPrefix(token), name, now,
+	).Scan(&id)
 	if err != nil {
 		return nil, err
 	}
 
-	id, _ := result.LastInsertId()
+	if err := repo.recordInitialStatus(id, "active", now); err != nil {
+		return nil, err
+	}
+
 	return &Device{
-		ID:        id,
-		Token:     token,
-		Name:      name,
-		Status:    "active",
-		LastSeen:  &now,
-		CreatedAt: now,
+		ID:          id,
+		Token:       token,
+		TokenPrefix: tokenPrefix(token),
+		Name:        name,
+		Status:      "active",
+		LastSeen:    &now,
+		CreatedAt:   now,
 	}, nil
 }
 
-func GetDeviceByToken(token string) (*Device, error) {
-	device := &Device{}
-	err := database.DB.QueryRow(
-		"SELECT id, token, name, COALESCE(status, 'active'), last_seen, created_at FROM devices WHERE token = ?",
-		token,
-	).Scan(&device.ID, &device.Token, &device.Name, &device.Status, &device.LastSeen, &device.CreatedAt)
+// GetByToken looks up a device by its current token, or by its previous
+// token while the rotation grace period is still running
+func (repo *sqlDevices) GetByToken(token string) (*Device, error) {
+	if len(token) < tokenPrefixLength {
+		return nil, sql.ErrNoRows
+	}
+
+	prefix := tokenPrefix(token)
+	rows, err := repo.db.Query(`
+		SELECT id, token_prefix, name, COALESCE(status, 'active'), last_seen, created_at, previous_token_expires_at,
+			token, token_prefix = ?,
+			COALESCE(previous_token, ''), previous_token_prefix = ? AND julianday(previous_token_expires_at) > julianday(?)
+		FROM devices
+		WHERE token_prefix = ? OR previous_token_prefix = ?
+	`, prefix, prefix, time.Now().UTC(), prefix, prefix)
 	if err != nil {
 		return nil, err
 	}
-	return device, nil
+	defer rows.Close()
+
+	hash := []byte(hashToken(token))
+	for rows.Next() {
+		device := &Device{}
+		var currentHash, previousHash string
+		var currentMatch, previousMatch sql.NullBool
+		if err := rows.Scan(&device.ID, &device.TokenPrefix, &device.Name, &device.Status, &device.LastSeen, &device.CreatedAt, &device.PreviousTokenExpiresAt,
+			&currentHash, &currentMatch, &previousHash, &previousMatch); err != nil {
+			return nil, err
+		}
+
+		if currentMatch.Bool && subtle.ConstantTimeCompare(hash, []byte(currentHash)) == 1 {
+			return device, nil
+		}
+		if previousMatch.Bool && subtle.ConstantTimeCompare(hash, []byte(previousHash)) == 1 {
+			device.UsedPreviousToken = true
+			device.currentTokenHash = currentHash
+			return device, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nil, sql.ErrNoRows
 }
 
-func GetDeviceByID(id int64) (*Device, error) {
+func (repo *sqlDevices) GetByID(id int64) (*Device, error) {
 	device := &Device{}
-	err := database.DB.QueryRow(
-		"SELECT id, token, name, COALESCE(status, 'active'), last_seen, created_at FROM devices WHERE id = ?",
+	inv := &DeviceInventory{}
+	err := repo.db.QueryRow(
+		"SELECT id, COALESCE(token_prefix, ''), name, COALESCE(status, 'active'), last_seen, created_at, previous_token_expires_at, "+deviceInventoryColumns+" FROM devices WHERE id = ?",
 		id,
-	).Scan(&device.ID, &device.Token, &device.Name, &device.Status, &device.LastSeen, &device.CreatedAt)
+	).Scan(append([]interface{}{&device.ID, &device.TokenPrefix, &device.Name, &device.Status, &device.LastSeen, &device.CreatedAt, &device.PreviousTokenExpiresAt}, inv.scanTargets()...)...)
 	if err != nil {
 		return nil, err
 	}
+	device.clearExpiredPreviousToken()
+	device.setInventory(inv)
 	return device, nil
 }
 
-func RegenerateDeviceToken(id int64) (*Device, error) {
+// clearExpiredPreviousToken hides a previous token whose grace period is over
+func (d *Device) clearExpiredPreviousToken() {
+	if d.PreviousTokenExpiresAt != nil && !d.PreviousTokenExpiresAt.After(time.Now()) {
+		d.PreviousTokenExpiresAt = nil
+	}
+}
+
+// RegenerateToken issues a new token for a device. With a positive grace
+// period the old token keeps working until it expires; otherwise it is revoked
+// immediately.
+func (repo *sqlDevices) RegenerateToken(id int64, grace time.Duration) (*Device, error) {
 	token, err := generateToken(32)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = database.DB.Exec("UPDATE devices SET token = ? WHERE id = ?", token, id)
+	if grace > 0 {
+		// The right-hand side sees the pre-update row, so the current token moves to previous
+		_, err = repo.db.Exec(`
+			UPDATE devices SET previous_token = token, previous_token_prefix = token_prefix, previous_token_expires_at = ?,
+				token = ?, token_prefix = ?
+			WHERE id = ?
+		`, time.Now().UTC().Add(grace), hashToken(token), tokenPrefix(token), id)
+	} else {
+		_, err = repo.db.Exec(`
+			UPDATE devices SET previous_token = NULL, previous_token_prefix = NULL, previous_token_expires_at = NULL,
+				token = ?, token_prefix = ?
+			WHERE id = ?
+		`, hashToken(token), tokenPrefix(token), id)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return GetDeviceByID(id)
+	device, err := repo.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	device.Token = token
+	return device, nil
+}
+
+// ReissueToken hands a fresh token to an extension that authenticated with
+// its previous token during the grace period. The current token, which an
+// admin may have just been shown, becomes the previous one for another
+// TokenRotationGrace. The device must come from GetByToken; if its current
+// token changed since, e.g. because a concurrent connection already got a
+// new one, nothing changes and sql.ErrNoRows is returned.
+func (repo *sqlDevices) ReissueToken(device *Device) (*Device, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := repo.db.Exec(`
+		UPDATE devices SET previous_token = token, previous_token_prefix = token_prefix, previous_token_expires_at = ?,
+			token = ?, token_prefix = ?
+		WHERE id = ? AND token = ?
+	`, time.Now().UTC().Add(TokenRotationGrace), hashToken(token), tokenPrefix(token), device.ID, device.currentTokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		return nil, sql.ErrNoRows
+	}
+
+	device, err = repo.GetByID(device.ID)
+	if err != nil {
+		return nil, err
+	}
+	device.Token = token
+	return device, nil
+}
+
+// TokenHashes returns the hashes of the tokens a device is accepted with,
+// the current one first, then the previous one during its grace period
+func (repo *sqlDevices) TokenHashes(id int64) ([]string, error) {
+	var current, previous string
+	var previousValid sql.NullBool
+	err := repo.db.QueryRow(`
+		SELECT token, COALESCE(previous_token, ''), julianday(previous_token_expires_at) > julianday(?)
+		FROM devices WHERE id = ?
+	`, time.Now().UTC(), id).Scan(&current, &previous, &previousValid)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := []string{current}
+	if previousValid.Bool && previous != "" {
+		hashes = append(hashes, previous)
+	}
+	return hashes, nil
 }
 
-func ListDevices() ([]Device, error) {
-	rows, err := database.DB.Query("SELECT id, name, COALESCE(status, 'active'), last_seen, created_at FROM devices ORDER BY created_at DESC")
+// HashLegacyTokens converts device tokens stored in plaintext by older
+// versions into hashes. Rows without a token prefix have not been converted yet.
+func (repo *sqlDevices) HashLegacyTokens() error {
+	rows, err := repo.db.Query("SELECT id, token FROM devices WHERE token_prefix IS NULL")
+	if err != nil {
+		return err
+	}
+
+	tokens := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var token string
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[id] = token
+	}
+	rows.Close()
+
+	for id, token := range tokens {
+		_, err := repo.db.Exec(
+			"UPDATE devices SET token = ?, token_prefix = ? WHERE id = ? AND token_prefix IS NULL",
+			hashToken(token), tokenPrefix(token), id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(tokens) > 0 {
+		slog.InfoContext(repo.db.context(), "Hashed legacy device tokens", "count", len(tokens))
+	}
+	return nil
+}
+
+func (repo *sqlDevices) List() ([]Device, error) {
+	rows, err := repo.db.Query("SELECT id, COALESCE(token_prefix, ''), name, COALESCE(status, 'active'), last_seen, created_at, previous_token_expires_at, " + deviceInventoryColumns + " FROM devices ORDER BY created_at DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -251,63 +449,81 @@ func ListDevices() ([]Device, error) {
 	var devices []Device
 	for rows.Next() {
 		var d Device
-		if err := rows.Scan(&d.ID, &d.Name, &d.Status, &d.LastSeen, &d.CreatedAt); err != nil {
+		inv := &DeviceInventory{}
+		if err := rows.Scan(append([]interface{}{&d.ID, &d.TokenPrefix, &d.Name, &d.Status, &d.LastSeen, &d.CreatedAt, &d.PreviousTokenExpiresAt}, inv.scanTargets()...)...); err != nil {
 			return nil, err
 		}
+		d.clearExpiredPreviousToken()
+		d.setInventory(inv)
 		devices = append(devices, d)
 	}
 	return devices, nil
 }
 
-func DeleteDevice(id int64) error {
-	_, err := database.DB.Exec("DELETE FROM devices WHERE id = ?", id)
+func (repo *sqlDevices) Delete(id int64) error {
+	_, err := repo.db.Exec("DELETE FROM devices WHERE id = ?", id)
 	return err
 }
 
-// UpdateDeviceHeartbeat updates the last_seen timestamp and sets status to active
-func UpdateDeviceHeartbeat(deviceID int64) error {
-	_, err := database.DB.Exec(
-		"UPDATE devices SET last_seen = ?, status = 'active' WHERE id = ?",
-		time.Now(), deviceID,
-	)
-	return err
+// UpdateHeartbeat updates the last_seen timestamp and sets status to active
+// The reason is recorded in the status history if the device was not active,
+// and the recorded transition is returned
+func (repo *sqlDevices) UpdateHeartbeat(deviceID int64, reason string) (*DeviceStatusChange, error) {
+	now := time.Now()
+	return repo.setStatus(deviceID, "active", reason, &now)
 }
 
-// UpdateDeviceStatus updates the device status (active, inactive, uninstalled)
-func UpdateDeviceStatus(deviceID int64, status string) error {
-	_, err := database.DB.Exec(
-		"UPDATE devices SET status = ? WHERE id = ?",
-		status, deviceID,
-	)
-	return err
+// UpdateStatus updates the device status (active, inactive, uninstalled)
+// The reason is recorded in the status history if the status changed, and
+// the recorded transition is returned
+func (repo *sqlDevices) UpdateStatus(deviceID int64, status, reason string) (*DeviceStatusChange, error) {
+	return repo.setStatus(deviceID, status, reason, nil)
 }
 
-// MarkInactiveDevices marks devices as inactive if they haven't been seen recently
-// Returns the names of devices that were marked inactive
-func MarkInactiveDevices(threshold time.Duration) ([]string, error) {
+// MarkInactive marks devices as inactive if they haven't been seen recently
+// Returns the devices that were marked inactive
+func (repo *sqlDevices) MarkInactive(threshold time.Duration) ([]Device, error) {
 	cutoff := time.Now().Add(-threshold)
 
-	// First get the names of devices that will be marked inactive
-	rows, err := database.DB.Query(
-		"SELECT name FROM devices WHERE status = 'active' AND (last_seen IS NULL OR last_seen < ?)",
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Record the transitions first; the device went silent at its last heartbeat
+	_, err = tx.Exec(`
+		INSERT INTO device_status_history (device_id, status, previous_status, reason, changed_at)
+		SELECT id, 'inactive', 'active', 'heartbeat_timeout', COALESCE(last_seen, ?)
+		FROM devices WHERE status = 'active' AND (last_seen IS NULL OR last_seen < ?)
+	`, time.Now().UTC(), cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	// Then get the devices that will be marked inactive
+	rows, err := tx.Query(
+		"SELECT id, name, last_seen FROM devices WHERE status = 'active' AND (last_seen IS NULL OR last_seen < ?)",
 		cutoff,
 	)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var deviceNames []string
+	var devices []Device
 	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err != nil {
+		var d Device
+		if err := rows.Scan(&d.ID, &d.Name, &d.LastSeen); err != nil {
+			rows.Close()
 			return nil, err
 		}
-		deviceNames = append(deviceNames, name)
+		d.Status = "inactive"
+		devices = append(devices, d)
 	}
+	rows.Close()
 
 	// Now update them
-	_, err = database.DB.Exec(
+	_, err = tx.Exec(
 		"UPDATE devices SET status = 'inactive' WHERE status = 'active' AND (last_seen IS NULL OR last_seen < ?)",
 		cutoff,
 	)
@@ -315,50 +531,61 @@ func MarkInactiveDevices(threshold time.Duration) ([]string, error) {
 		return nil, err
 	}
 
-	return deviceNames, nil
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
 }
 
 // ========== Pattern Operations ==========
 
-func CreatePattern(deviceID int64, pattern, patternType string, expiresAt *time.Time) (*Pattern, error) {
-	var result sql.Result
-	var err error
+func (repo *sqlPatterns) Create(deviceID int64, pattern, patternType string, expiresAt *time.Time) (*Pattern, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
+	var id int64
 	if expiresAt != nil {
-		result, err = database.DB.Exec(
-			"INSERT INTO patterns (device_id, pattern, type, enabled, expires_at) VALUES (?, ?, ?, 1, ?)",
+		err = tx.QueryRow(
+			"INSERT INTO patterns (device_id, pattern, type, enabled, expires_at) VALUES (?, ?, ?, 1, ?) RETURNING id",
 			deviceID, pattern, patternType, expiresAt,
-		)
+		).Scan(&id)
 	} else {
-		result, err = database.DB.Exec(
-			"INSERT INTO patterns (device_id, pattern, type, enabled) VALUES (?, ?, ?, 1)",
+		err = tx.QueryRow(
+			"INSERT INTO patterns (device_id, pattern, type, enabled) VALUES (?, ?, ?, 1) RETURNING id",
 			deviceID, pattern, patternType,
-		)
+		).Scan(&id)
 	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	id, _ := result.LastInsertId()
-	return &Pattern{
-		ID:        id,
-		DeviceID:  deviceID,
-		Pattern:   pattern,
-		Type:      patternType,
-		Enabled:   true,
-		ExpiresAt: expiresAt,
-		CreatedAt: time.Now(),
-	}, nil
+	after, err := getPatternState(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordPatternChange(tx, nil, after); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &after.Pattern, nil
 }
 
-func GetPatternsByDevice(deviceID int64) ([]Pattern, error) {
-	// Compare using datetime() which normalizes the format for comparison
-	// Only return enabled patterns that haven't expired
-	rows, err := database.DB.Query(`
+func (repo *sqlPatterns) ListByDevice(deviceID int64) ([]Pattern, error) {
+	// Only return enabled patterns whose expiry hasn't been recorded, so the
+	// list always matches the device's policy version. Extensions also skip
+	// patterns that expired since they were sent.
+	rows, err := repo.db.Query(`
 		SELECT id, device_id, pattern, type, COALESCE(enabled, 1), expires_at, created_at 
 		FROM patterns 
-		WHERE device_id = ? AND COALESCE(enabled, 1) = 1 AND (expires_at IS NULL OR datetime(expires_at) > datetime('now'))
+		WHERE device_id = ? AND COALESCE(enabled, 1) = 1 AND expiry_recorded = 0
 		ORDER BY created_at DESC
 	`, deviceID)
 	if err != nil {
@@ -377,8 +604,8 @@ func GetPatternsByDevice(deviceID int64) ([]Pattern, error) {
 	return patterns, nil
 }
 
-func ListAllPatterns() ([]Pattern, error) {
-	rows, err := database.DB.Query(`
+func (repo *sqlPatterns) ListAll() ([]Pattern, error) {
+	rows, err := repo.db.Query(`
 		SELECT id, device_id, pattern, type, COALESCE(enabled, 1), expires_at, created_at 
 		FROM patterns 
 		ORDER BY CASE type WHEN 'deny' THEN 0 ELSE 1 END, created_at DESC
@@ -399,19 +626,49 @@ func ListAllPatterns() ([]Pattern, error) {
 	return patterns, nil
 }
 
-func DeletePattern(id int64) error {
-	_, err := database.DB.Exec("DELETE FROM patterns WHERE id = ?", id)
-	return err
+func (repo *sqlPatterns) Delete(id int64) error {
+	return repo.updateTx(id, func(tx *sqlTx) error {
+		_, err := tx.Exec("DELETE FROM patterns WHERE id = ?", id)
+		return err
+	})
 }
 
-func TogglePatternEnabled(id int64, enabled bool) error {
-	_, err := database.DB.Exec("UPDATE patterns SET enabled = ? WHERE id = ?", enabled, id)
-	return err
+func (repo *sqlPatterns) SetEnabled(id int64, enabled bool) error {
+	return repo.updateTx(id, func(tx *sqlTx) error {
+		_, err := tx.Exec("UPDATE patterns SET enabled = ? WHERE id = ?", boolInt(enabled), id)
+		return err
+	})
+}
+
+// updateTx runs a write to a pattern in a transaction and records the
+// resulting change to the device's policy
+func (repo *sqlPatterns) updateTx(id int64, write func(tx *sqlTx) error) error {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := getPatternState(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := write(tx); err != nil {
+		return err
+	}
+	after, err := getPatternState(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := recordPatternChange(tx, before, after); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func GetPatternByID(id int64) (*Pattern, error) {
+func (repo *sqlPatterns) GetByID(id int64) (*Pattern, error) {
 	pattern := &Pattern{}
-	err := database.DB.QueryRow(`
+	err := repo.db.QueryRow(`
 		SELECT id, device_id, pattern, type, COALESCE(enabled, 1), expires_at, created_at 
 		FROM patterns WHERE id = ?
 	`, id).Scan(&pattern.ID, &pattern.DeviceID, &pattern.Pattern, &pattern.Type, &pattern.Enabled, &pattern.ExpiresAt, &pattern.CreatedAt)
@@ -421,40 +678,44 @@ func GetPatternByID(id int64) (*Pattern, error) {
 	return pattern, nil
 }
 
-func UpdatePattern(id int64, pattern, patternType string, expiresAt *time.Time) (*Pattern, error) {
-	var err error
-
-	if expiresAt != nil {
-		_, err = database.DB.Exec(
-			"UPDATE patterns SET pattern = ?, type = ?, expires_at = ? WHERE id = ?",
-			pattern, patternType, expiresAt, id,
-		)
-	} else {
-		_, err = database.DB.Exec(
-			"UPDATE patterns SET pattern = ?, type = ?, expires_at = NULL WHERE id = ?",
-			pattern, patternType, id,
-		)
-	}
+// Update changes a pattern. A new expiry is tracked again even if the
+// old one had already passed.
+func (repo *sqlPatterns) Update(id int64, pattern, patternType string, expiresAt *time.Time) (*Pattern, error) {
+	err := repo.updateTx(id, func(tx *sqlTx) error {
+		var err error
+		if expiresAt != nil {
+			_, err = tx.Exec(
+				"UPDATE patterns SET pattern = ?, type = ?, expires_at = ?, expiry_recorded = 0 WHERE id = ?",
+				pattern, patternType, expiresAt, id,
+			)
+		} else {
+			_, err = tx.Exec(
+				"UPDATE patterns SET pattern = ?, type = ?, expires_at = NULL, expiry_recorded = 0 WHERE id = ?",
+				pattern, patternType, id,
+			)
+		}
+		return err
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return GetPatternByID(id)
+	return repo.GetByID(id)
 }
 
 // ========== Request Operations ==========
 
-func CreateRequest(deviceID int64, url, suggestedPattern string) (*Request, error) {
-	result, err := database.DB.Exec(
-		"INSERT INTO requests (device_id, url, suggested_pattern) VALUES (?, ?, ?)",
+func (repo *sqlRequests) Create(deviceID int64, url, suggestedPattern string) (*Request, error) {
+	var id int64
+	err := repo.db.QueryRow(
+		"INSERT INTO requests (device_id, url, suggested_pattern) VALUES (?, ?, ?) RETURNING id",
 		deviceID, url, suggestedPattern,
-	)
+	).Scan(&id)
 	if err != nil {
 		return nil, err
 	}
 
-	id, _ := result.LastInsertId()
 	return &Request{
 		ID:               id,
 		DeviceID:         deviceID,
@@ -465,9 +726,9 @@ func CreateRequest(deviceID int64, url, suggestedPattern string) (*Request, erro
 	}, nil
 }
 
-func GetRequestByID(id int64) (*Request, error) {
+func (repo *sqlRequests) GetByID(id int64) (*Request, error) {
 	req := &Request{}
-	err := database.DB.QueryRow(`
+	err := repo.db.QueryRow(`
 		SELECT r.id, r.device_id, d.name, r.url, r.suggested_pattern, r.status, r.created_at, r.resolved_at
 		FROM requests r
 		JOIN devices d ON r.device_id = d.id
@@ -479,12 +740,12 @@ func GetRequestByID(id int64) (*Request, error) {
 	return req, nil
 }
 
-func ListRequests(status string) ([]Request, error) {
+func (repo *sqlRequests) List(status string) ([]Request, error) {
 	var rows *sql.Rows
 	var err error
 
 	if status != "" {
-		rows, err = database.DB.Query(`
+		rows, err = repo.db.Query(`
 			SELECT r.id, r.device_id, d.name, r.url, r.suggested_pattern, r.status, r.created_at, r.resolved_at
 			FROM requests r
 			JOIN devices d ON r.device_id = d.id
@@ -492,7 +753,7 @@ func ListRequests(status string) ([]Request, error) {
 			ORDER BY r.created_at DESC
 		`, status)
 	} else {
-		rows, err = database.DB.Query(`
+		rows, err = repo.db.Query(`
 			SELECT r.id, r.device_id, d.name, r.url, r.suggested_pattern, r.status, r.created_at, r.resolved_at
 			FROM requests r
 			JOIN devices d ON r.device_id = d.id
@@ -516,18 +777,24 @@ func ListRequests(status string) ([]Request, error) {
 	return requests, nil
 }
 
-func ApproveRequest(id int64) error {
+func (repo *sqlRequests) Count(status string) (int, error) {
+	var count int
+	err := repo.db.QueryRow("SELECT COUNT(*) FROM requests WHERE status = ?", status).Scan(&count)
+	return count, err
+}
+
+func (repo *sqlRequests) Approve(id int64) error {
 	now := time.Now()
-	_, err := database.DB.Exec(
+	_, err := repo.db.Exec(
 		"UPDATE requests SET status = 'approved', resolved_at = ? WHERE id = ?",
 		now, id,
 	)
 	return err
 }
 
-func DenyRequest(id int64) error {
+func (repo *sqlRequests) Deny(id int64) error {
 	now := time.Now()
-	_, err := database.DB.Exec(
+	_, err := repo.db.Exec(
 		"UPDATE requests SET status = 'denied', resolved_at = ? WHERE id = ?",
 		now, id,
 	)
@@ -536,23 +803,23 @@ func DenyRequest(id int64) error {
 
 // ========== Session Operations ==========
 
-func CreateSession(userID int64) (*Session, error) {
+func (repo *sqlSessions) Create(userID int64) (*Session, error) {
 	token, err := generateToken(32)
 	if err != nil {
 		return nil, err
 	}
 
-	expiresAt := time.Now().Add(24 * time.Hour)
+	expiresAt := time.Now().Add(SessionLifetime)
 
-	result, err := database.DB.Exec(
-		"INSERT INTO sessions (user_id, token, expires_at) VALUES (?, ?, ?)",
+	var id int64
+	err = repo.db.QueryRow(
+		"INSERT INTO sessions (user_id, token, expires_at) VALUES (?, ?, ?) RETURNING id",
 		userID, token, expiresAt,
-	)
+	).Scan(&id)
 	if err != nil {
 		return nil, err
 	}
 
-	id, _ := result.LastInsertId()
 	return &Session{
 		ID:        id,
 		UserID:    userID,
@@ -562,11 +829,11 @@ func CreateSession(userID int64) (*Session, error) {
 	}, nil
 }
 
-func GetSessionByToken(token string) (*Session, error) {
+func (repo *sqlSessions) GetByToken(token string) (*Session, error) {
 	session := &Session{}
-	err := database.DB.QueryRow(
-		"SELECT id, user_id, token, expires_at, created_at FROM sessions WHERE token = ? AND expires_at > datetime('now')",
-		token,
+	err := repo.db.QueryRow(
+		"SELECT id, user_id, token, expires_at, created_at FROM sessions WHERE token = ? AND julianday(expires_at) > julianday(?)",
+		token, time.Now().UTC(),
 	).Scan(&session.ID, &session.UserID, &session.Token, &session.ExpiresAt, &session.CreatedAt)
 	if err != nil {
 		return nil, err
@@ -574,40 +841,36 @@ func GetSessionByToken(token string) (*Session, error) {
 	return session, nil
 }
 
-func DeleteSession(token string) error {
-	_, err := database.DB.Exec("DELETE FROM sessions WHERE token = ?", token)
+func (repo *sqlSessions) Delete(token string) error {
+	_, err := repo.db.Exec("DELETE FROM sessions WHERE token = ?", token)
+	return err
+}
+
+func (repo *sqlSessions) DeleteByUser(userID int64) error {
+	_, err := repo.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
 	return err
 }
 
-func CleanExpiredSessions() error {
-	_, err := database.DB.Exec("DELETE FROM sessions WHERE expires_at <= datetime('now')")
+func (repo *sqlSessions) DeleteExpired() error {
+	_, err := repo.db.Exec("DELETE FROM sessions WHERE julianday(expires_at) <= julianday(?)", time.Now().UTC())
 	return err
 }
 
-// GetUserCount returns the number of users in the database
-func GetUserCount() (int, error) {
+// Count returns the number of users in the database
+func (repo *sqlUsers) Count() (int, error) {
 	var count int
-	err := database.DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	err := repo.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
 	if err != nil {
 		return 0, err
 	}
 	return count, nil
 }
 
-// NeedsSetup returns true if no users exist (first-time setup needed)
-func NeedsSetup() (bool, error) {
-	count, err := GetUserCount()
-	if err != nil {
-		return false, err
-	}
-	return count == 0, nil
-}
-
 // ========== Push Subscription Operations ==========
 
-func CreatePushSubscription(userID int64, endpoint, p256dh, auth string) (*PushSubscription, error) {
+func (repo *sqlPushSubscriptions) Create(userID int64, endpoint, p256dh, auth string) (*PushSubscription, error) {
 	// Upsert - replace existing subscription for this endpoint
-	_, err := database.DB.Exec(
+	_, err := repo.db.Exec(
 		"DELETE FROM push_subscriptions WHERE endpoint = ?",
 		endpoint,
 	)
@@ -615,15 +878,15 @@ func CreatePushSubscription(userID int64, endpoint, p256dh, auth string) (*PushS
 		return nil, err
 	}
 
-	result, err := database.DB.Exec(
-		"INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth) VALUES (?, ?, ?, ?)",
+	var id int64
+	err = repo.db.QueryRow(
+		"INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth) VALUES (?, ?, ?, ?) RETURNING id",
 		userID, endpoint, p256dh, auth,
-	)
+	).Scan(&id)
 	if err != nil {
 		return nil, err
 	}
 
-	id, _ := result.LastInsertId()
 	return &PushSubscription{
 		ID:        id,
 		UserID:    userID,
@@ -634,8 +897,8 @@ func CreatePushSubscription(userID int64, endpoint, p256dh, auth string) (*PushS
 	}, nil
 }
 
-func GetPushSubscriptionsByUser(userID int64) ([]PushSubscription, error) {
-	rows, err := database.DB.Query(
+func (repo *sqlPushSubscriptions) ListByUser(userID int64) ([]PushSubscription, error) {
+	rows, err := repo.db.Query(
 		"SELECT id, user_id, endpoint, p256dh, auth, created_at FROM push_subscriptions WHERE user_id = ?",
 		userID,
 	)
@@ -655,8 +918,8 @@ func GetPushSubscriptionsByUser(userID int64) ([]PushSubscription, error) {
 	return subs, nil
 }
 
-func GetAllPushSubscriptions() ([]PushSubscription, error) {
-	rows, err := database.DB.Query(
+func (repo *sqlPushSubscriptions) ListAll() ([]PushSubscription, error) {
+	rows, err := repo.db.Query(
 		"SELECT id, user_id, endpoint, p256dh, auth, created_at FROM push_subscriptions",
 	)
 	if err != nil {
@@ -675,29 +938,31 @@ func GetAllPushSubscriptions() ([]PushSubscription, error) {
 	return subs, nil
 }
 
-func DeletePushSubscription(endpoint string) error {
-	_, err := database.DB.Exec("DELETE FROM push_subscriptions WHERE endpoint = ?", endpoint)
+func (repo *sqlPushSubscriptions) Delete(endpoint string) error {
+	_, err := repo.db.Exec("DELETE FROM push_subscriptions WHERE endpoint = ?", endpoint)
 	return err
 }
 
-func DeletePushSubscriptionByID(id int64) error {
-	_, err := database.DB.Exec("DELETE FROM push_subscriptions WHERE id = ?", id)
+func (repo *sqlPushSubscriptions) DeleteByID(id int64) error {
+	_, err := repo.db.Exec("DELETE FROM push_subscriptions WHERE id = ?", id)
 	return err
 }
 
-// GetUsersForNotification returns users who should receive a specific notification type
-func GetUsersForNotification(notificationType string) ([]User, error) {
+// ListForNotification returns users who should receive a specific notification type
+func (repo *sqlUsers) ListForNotification(notificationType string) ([]User, error) {
 	var query string
 	switch notificationType {
 	case "new_request":
-		query = "SELECT id, username, COALESCE(notify_new_requests, 1), COALESCE(notify_device_status, 1), created_at FROM users WHERE COALESCE(notify_new_requests, 1) = 1"
+		query = "SELECT id, username, COALESCE(notify_new_requests, 1), COALESCE(notify_device_status, 1), COALESCE(notify_security_events, 1), created_at FROM users WHERE COALESCE(notify_new_requests, 1) = 1"
 	case "device_status":
-		query = "SELECT id, username, COALESCE(notify_new_requests, 1), COALESCE(notify_device_status, 1), created_at FROM users WHERE COALESCE(notify_device_status, 1) = 1"
+		query = "SELECT id, username, COALESCE(notify_new_requests, 1), COALESCE(notify_device_status, 1), COALESCE(notify_security_events, 1), created_at FROM users WHERE COALESCE(notify_device_status, 1) = 1"
+	case "security_event":
+		query = "SELECT id, username, COALESCE(notify_new_requests, 1), COALESCE(notify_device_status, 1), COALESCE(notify_security_events, 1), created_at FROM users WHERE COALESCE(notify_security_events, 1) = 1"
 	default:
 		return nil, nil
 	}
 
-	rows, err := database.DB.Query(query)
+	rows, err := repo.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -706,7 +971,7 @@ func GetUsersForNotification(notificationType string) ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Username, &u.NotifyNewRequests, &u.NotifyDeviceStatus, &u.CreatedAt); err != nil {
+		if err := rows.Scan(&u.ID, &u.Username, &u.NotifyNewRequests, &u.NotifyDeviceStatus, &u.NotifySecurity, &u.CreatedAt); err != nil {
 			return nil, err
 		}
 		users = append(users, u)
@@ -716,19 +981,27 @@ func GetUsersForNotification(notificationType string) ([]User, error) {
 
 // ========== App Config Operations (for VAPID keys) ==========
 
-func GetAppConfig(key string) (string, error) {
+func (repo *sqlConfig) Get(key string) (string, error) {
 	var value string
-	err := database.DB.QueryRow("SELECT value FROM app_config WHERE key = ?", key).Scan(&value)
+	err := repo.db.QueryRow("SELECT value FROM app_config WHERE key = ?", key).Scan(&value)
 	if err != nil {
 		return "", err
 	}
 	return value, nil
 }
 
-func SetAppConfig(key, value string) error {
-	_, err := database.DB.Exec(
-		"INSERT OR REPLACE INTO app_config (key, value) VALUES (?, ?)",
+func (repo *sqlConfig) Set(key, value string) error {
+	_, err := repo.db.Exec(
+		"INSERT INTO app_config (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value",
 		key, value,
 	)
 	return err
 }
+
+func (repo *sqlConfig) SetDefault(key, value string) (string, error) {
+	_, err := repo.db.Exec("INSERT INTO app_config (key, value) VALUES (?, ?) ON CONFLICT(key) DO NOTHING", key, value)
+	if err != nil {
+		return "", err
+	}
+	return repo.Get(key)
+}
@@ -0,0 +1,266 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Each device has a policy version that goes up by one for every change to
+// the set of patterns it enforces. The change log lets extensions catch up
+// with deltas instead of downloading every pattern again.
+
+// PatternChange is an entry in a device's policy change log
+type PatternChange struct {
+	DeviceID  int64    `json:"-"`
+	Version   int64    `json:"version"`
+	Op        string   `json:"op"` // "add", "update", "remove"
+	PatternID int64    `json:"pattern_id"`
+	Pattern   *Pattern `json:"pattern,omitempty"` // nil for "remove"
+}
+
+// PatternChangeRetention is how long the change log is kept. Extensions that
+// are further behind get a full resync.
+const PatternChangeRetention = 7 * 24 * time.Hour
+
+// patternState is a pattern as seen by the change log
+type patternState struct {
+	Pattern
+	expiryRecorded bool
+}
+
+// active reports whether the change log considers the pattern enforced
+func (p *patternState) active() bool {
+	return p != nil && p.Enabled && !p.expiryRecorded
+}
+
+func getPatternState(tx *sqlTx, id int64) (*patternState, error) {
+	p := &patternState{}
+	err := tx.QueryRow(`
+		SELECT id, device_id, pattern, type, COALESCE(enabled, 1), expires_at, created_at, expiry_recorded
+		FROM patterns WHERE id = ?
+	`, id).Scan(&p.ID, &p.DeviceID, &p.Pattern.Pattern, &p.Type, &p.Enabled, &p.ExpiresAt, &p.CreatedAt, &p.expiryRecorded)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// recordPatternChange logs how a pattern write changed the device's policy
+// and bumps its version. Writes that don't change what the device enforces,
+// like editing a disabled pattern, are not logged.
+func recordPatternChange(tx *sqlTx, before, after *patternState) error {
+	var op string
+	switch {
+	case before.active() && after.active():
+		op = "update"
+	case after.active():
+		op = "add"
+	case before.active():
+		op = "remove"
+	default:
+		return nil
+	}
+
+	current := after
+	if current == nil {
+		current = before
+	}
+
+	if _, err := tx.Exec("UPDATE devices SET policy_version = policy_version + 1 WHERE id = ?", current.DeviceID); err != nil {
+		return err
+	}
+	var version int64
+	if err := tx.QueryRow("SELECT policy_version FROM devices WHERE id = ?", current.DeviceID).Scan(&version); err != nil {
+		return err
+	}
+
+	var snapshot interface{}
+	if op != "remove" {
+		data, err := json.Marshal(after.Pattern)
+		if err != nil {
+			return err
+		}
+		snapshot = string(data)
+	}
+
+	_, err := tx.Exec(
+		"INSERT INTO pattern_changes (device_id, version, op, pattern_id, pattern, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		current.DeviceID, version, op, current.ID, snapshot, time.Now().UTC(),
+	)
+	return err
+}
+
+// ========== Policy Version Operations ==========
+
+func (repo *sqlPatterns) PolicyVersion(deviceID int64) (int64, error) {
+	var version int64
+	err := repo.db.QueryRow("SELECT policy_version FROM devices WHERE id = ?", deviceID).Scan(&version)
+	return version, err
+}
+
+// ListChangesSince returns the changes after the given version, oldest
+// first, and the current version. complete is false if the log no longer has
+// every change since that version, in which case a full resync is needed.
+func (repo *sqlPatterns) ListChangesSince(deviceID, since int64) (changes []PatternChange, version int64, complete bool, err error) {
+	version, err = repo.PolicyVersion(deviceID)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if since > version || since < 0 {
+		return nil, version, false, nil
+	}
+	if since == version {
+		return nil, version, true, nil
+	}
+
+	rows, err := repo.db.Query(`
+		SELECT device_id, version, op, pattern_id, pattern
+		FROM pattern_changes
+		WHERE device_id = ? AND version > ? AND version <= ?
+		ORDER BY version
+	`, deviceID, since, version)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c PatternChange
+		var snapshot *string
+		if err := rows.Scan(&c.DeviceID, &c.Version, &c.Op, &c.PatternID, &snapshot); err != nil {
+			return nil, 0, false, err
+		}
+		if snapshot != nil {
+			c.Pattern = &Pattern{}
+			if err := json.Unmarshal([]byte(*snapshot), c.Pattern); err != nil {
+				return nil, 0, false, err
+			}
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, false, err
+	}
+
+	// Every version has exactly one change, so gaps mean the log was pruned
+	return changes, version, int64(len(changes)) == version-since, nil
+}
+
+// RecordExpired logs the removal of patterns that expired since the
+// last run and returns the IDs of the devices whose policy changed
+func (repo *sqlPatterns) RecordExpired() ([]int64, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id FROM patterns
+		WHERE expiry_recorded = 0 AND expires_at IS NOT NULL AND julianday(expires_at) <= julianday(?)
+	`, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	changed := make(map[int64]bool)
+	var deviceIDs []int64
+	for _, id := range ids {
+		before, err := getPatternState(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("UPDATE patterns SET expiry_recorded = 1 WHERE id = ?", id); err != nil {
+			return nil, err
+		}
+		after, err := getPatternState(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := recordPatternChange(tx, before, after); err != nil {
+			return nil, err
+		}
+		if before.active() && !changed[before.DeviceID] {
+			changed[before.DeviceID] = true
+			deviceIDs = append(deviceIDs, before.DeviceID)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return deviceIDs, nil
+}
+
+// PruneChanges deletes change log entries older than the retention period
+func (repo *sqlPatterns) PruneChanges() error {
+	_, err := repo.db.Exec(
+		"DELETE FROM pattern_changes WHERE julianday(created_at) < julianday(?)",
+		time.Now().UTC().Add(-PatternChangeRetention),
+	)
+	return err
+}
+
+// ========== Policy Bundle Operations ==========
+
+// RecordPolicyBundle remembers that a policy hash was signed for a device
+func (repo *sqlPatterns) RecordPolicyBundle(deviceID, version int64, policyHash string, issuedAt, expiresAt time.Time) error {
+	_, err := repo.db.Exec(`
+		INSERT INTO policy_bundles (device_id, version, policy_hash, issued_at, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(device_id, policy_hash) DO UPDATE SET version = excluded.version, issued_at = excluded.issued_at, expires_at = excluded.expires_at
+	`, deviceID, version, policyHash, issuedAt, expiresAt)
+	return err
+}
+
+// IsKnownPolicyHash reports whether a policy hash was ever signed for a device
+// and its bundle hasn't been pruned
+func (repo *sqlPatterns) IsKnownPolicyHash(deviceID int64, policyHash string) (bool, error) {
+	var count int
+	err := repo.db.QueryRow(
+		"SELECT COUNT(*) FROM policy_bundles WHERE device_id = ? AND policy_hash = ?",
+		deviceID, policyHash,
+	).Scan(&count)
+	return count > 0, err
+}
+
+// SetReportedPolicyHash stores the policy hash a device reported and returns
+// the one it reported before
+func (repo *sqlDevices) SetReportedPolicyHash(deviceID int64, policyHash string) (string, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	if err := tx.QueryRow("SELECT COALESCE(reported_policy_hash, '') FROM devices WHERE id = ?", deviceID).Scan(&previous); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("UPDATE devices SET reported_policy_hash = ? WHERE id = ?", policyHash, deviceID); err != nil {
+		return "", err
+	}
+	return previous, tx.Commit()
+}
+
+// PrunePolicyBundles deletes bundles that expired more than the given time ago
+func (repo *sqlPatterns) PrunePolicyBundles(olderThan time.Duration) error {
+	_, err := repo.db.Exec(
+		"DELETE FROM policy_bundles WHERE julianday(expires_at) < julianday(?)",
+		time.Now().UTC().Add(-olderThan),
+	)
+	return err
+}
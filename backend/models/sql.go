@@ -0,0 +1,175 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The SQL repositories, shared by the SQLite and PostgreSQL stores. Their
+// operations live next to the types they store, grouped under "Operations"
+// headers.
+//
+// Queries are written once, with ? placeholders, and rebound for the
+// backend they run on. Anything else that differs between the two is kept
+// out of the queries: timestamps are compared with julianday(), which the
+// PostgreSQL migrations define, and IDs come back through RETURNING.
+//
+// Queries are logged at debug level with the request ID of the context the
+// store was bound to with Store.WithContext.
+
+type (
+	sqlUsers             struct{ db *sqlDB }
+	sqlSessions          struct{ db *sqlDB }
+	sqlDevices           struct{ db *sqlDB }
+	sqlPatterns          struct{ db *sqlDB }
+	sqlRequests          struct{ db *sqlDB }
+	sqlPushSubscriptions struct{ db *sqlDB }
+	sqlConfig            struct{ db *sqlDB }
+	sqlCommands          struct{ db *sqlDB }
+	sqlEnrollments       struct{ db *sqlDB }
+	sqlEvents            struct{ db *sqlDB }
+	sqlBroker            struct{ db *sqlDB }
+)
+
+// NewSQLiteStore returns a store backed by an open and migrated SQLite database
+func NewSQLiteStore(db *sql.DB) *Store {
+	return newSQLStore(&sqlDB{DB: db})
+}
+
+// NewPostgresStore returns a store backed by an open and migrated PostgreSQL
+// database
+func NewPostgresStore(db *sql.DB) *Store {
+	return newSQLStore(&sqlDB{DB: db, postgres: true})
+}
+
+func newSQLStore(db *sqlDB) *Store {
+	return &Store{
+		Users:             &sqlUsers{db},
+		Sessions:          &sqlSessions{db},
+		Devices:           &sqlDevices{db},
+		Patterns:          &sqlPatterns{db},
+		Requests:          &sqlRequests{db},
+		PushSubscriptions: &sqlPushSubscriptions{db},
+		Config:            &sqlConfig{db},
+		Commands:          &sqlCommands{db},
+		Enrollments:       &sqlEnrollments{db},
+		Events:            &sqlEvents{db},
+		Broker:            &sqlBroker{db},
+		withContext: func(ctx context.Context) *Store {
+			bound := *db
+			bound.ctx = context.WithoutCancel(ctx)
+			return newSQLStore(&bound)
+		},
+	}
+}
+
+// sqlDB is a database whose queries are rebound for its backend
+type sqlDB struct {
+	*sql.DB
+	postgres bool
+
+	// Carries the request ID queries are logged with; never cancelled, so
+	// work a request started finishes after it was answered
+	ctx context.Context
+}
+
+func (db *sqlDB) context() context.Context {
+	if db.ctx == nil {
+		return context.Background()
+	}
+	return db.ctx
+}
+
+func (db *sqlDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer db.logQuery(query, time.Now())
+	return db.DB.ExecContext(db.context(), db.rebind(query), args...)
+}
+
+func (db *sqlDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	defer db.logQuery(query, time.Now())
+	return db.DB.QueryContext(db.context(), db.rebind(query), args...)
+}
+
+func (db *sqlDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	defer db.logQuery(query, time.Now())
+	return db.DB.QueryRowContext(db.context(), db.rebind(query), args...)
+}
+
+func (db *sqlDB) Begin() (*sqlTx, error) {
+	tx, err := db.DB.BeginTx(db.context(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{Tx: tx, db: db}, nil
+}
+
+// logQuery logs a query that started at start, on one line
+func (db *sqlDB) logQuery(query string, start time.Time) {
+	ctx := db.context()
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	slog.DebugContext(ctx, "SQL query",
+		"query", strings.Join(strings.Fields(query), " "),
+		"duration", time.Since(start),
+	)
+}
+
+// rebind replaces the ? placeholders in a query with PostgreSQL's $1, $2, ...
+func (db *sqlDB) rebind(query string) string {
+	if !db.postgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// sqlTx is a transaction on a sqlDB
+type sqlTx struct {
+	*sql.Tx
+	db *sqlDB
+}
+
+func (tx *sqlTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer tx.db.logQuery(query, time.Now())
+	return tx.Tx.ExecContext(tx.db.context(), tx.db.rebind(query), args...)
+}
+
+func (tx *sqlTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	defer tx.db.logQuery(query, time.Now())
+	return tx.Tx.QueryContext(tx.db.context(), tx.db.rebind(query), args...)
+}
+
+func (tx *sqlTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	defer tx.db.logQuery(query, time.Now())
+	return tx.Tx.QueryRowContext(tx.db.context(), tx.db.rebind(query), args...)
+}
+
+// boolInt converts a flag for the INTEGER columns both backends store
+// flags in
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,197 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// DeviceStatusChange represents a single device status transition
+type DeviceStatusChange struct {
+	ID             int64     `json:"id"`
+	DeviceID       int64     `json:"device_id"`
+	Status         string    `json:"status"`
+	PreviousStatus string    `json:"previous_status,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	ChangedAt      time.Time `json:"changed_at"`
+}
+
+// StatusInterval is a span of time a device spent in one status
+type StatusInterval struct {
+	Status          string    `json:"status"`
+	Reason          string    `json:"reason,omitempty"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds int64     `json:"duration_seconds"`
+}
+
+// DeviceUptime summarizes a device's availability over a time range
+type DeviceUptime struct {
+	DeviceID         int64            `json:"device_id"`
+	From             time.Time        `json:"from"`
+	To               time.Time        `json:"to"`
+	TrackedSeconds   int64            `json:"tracked_seconds"` // Part of the range covered by status history
+	OnlineSeconds    int64            `json:"online_seconds"`
+	OfflineSeconds   int64            `json:"offline_seconds"`
+	UptimePercent    *float64         `json:"uptime_percent"` // nil if nothing was tracked
+	OfflineIntervals []StatusInterval `json:"offline_intervals"`
+}
+
+// ========== Device Status History Operations ==========
+
+// setStatus updates a device's status and records the transition if it
+// changed. It returns the recorded transition, or nil if the status was unchanged.
+func (repo *sqlDevices) setStatus(deviceID int64, status, reason string, lastSeen *time.Time) (*DeviceStatusChange, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Write the history row first so the transaction takes the write lock
+	// up front instead of upgrading from a read
+	change := &DeviceStatusChange{DeviceID: deviceID, Status: status, Reason: reason, ChangedAt: time.Now().UTC()}
+	err = tx.QueryRow(`
+		INSERT INTO device_status_history (device_id, status, previous_status, reason, changed_at)
+		SELECT id, ?, COALESCE(status, 'active'), ?, ? FROM devices WHERE id = ? AND COALESCE(status, 'active') != ?
+		RETURNING id, previous_status
+	`, status, reason, change.ChangedAt, deviceID, status).Scan(&change.ID, &change.PreviousStatus)
+	if err == sql.ErrNoRows {
+		change = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if lastSeen != nil {
+		_, err = tx.Exec("UPDATE devices SET last_seen = ?, status = ? WHERE id = ?", *lastSeen, status, deviceID)
+	} else {
+		_, err = tx.Exec("UPDATE devices SET status = ? WHERE id = ?", status, deviceID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// recordInitialStatus starts the status history of a newly created device
+func (repo *sqlDevices) recordInitialStatus(deviceID int64, status string, at time.Time) error {
+	_, err := repo.db.Exec(
+		"INSERT INTO device_status_history (device_id, status, reason, changed_at) VALUES (?, ?, 'created', ?)",
+		deviceID, status, at.UTC(),
+	)
+	return err
+}
+
+// ListStatusHistory returns the status transitions of a device within [from, to), oldest first
+func (repo *sqlDevices) ListStatusHistory(deviceID int64, from, to time.Time) ([]DeviceStatusChange, error) {
+	rows, err := repo.db.Query(`
+		SELECT id, device_id, status, COALESCE(previous_status, ''), COALESCE(reason, ''), changed_at
+		FROM device_status_history
+		WHERE device_id = ? AND julianday(changed_at) >= julianday(?) AND julianday(changed_at) < julianday(?)
+		ORDER BY julianday(changed_at), id
+	`, deviceID, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []DeviceStatusChange
+	for rows.Next() {
+		var c DeviceStatusChange
+		if err := rows.Scan(&c.ID, &c.DeviceID, &c.Status, &c.PreviousStatus, &c.Reason, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// StatusAt returns the last status transition before the given time
+func (repo *sqlDevices) StatusAt(deviceID int64, at time.Time) (*DeviceStatusChange, error) {
+	c := &DeviceStatusChange{}
+	err := repo.db.QueryRow(`
+		SELECT id, device_id, status, COALESCE(previous_status, ''), COALESCE(reason, ''), changed_at
+		FROM device_status_history
+		WHERE device_id = ? AND julianday(changed_at) < julianday(?)
+		ORDER BY julianday(changed_at) DESC, id DESC
+		LIMIT 1
+	`, deviceID, at.UTC()).Scan(&c.ID, &c.DeviceID, &c.Status, &c.PreviousStatus, &c.Reason, &c.ChangedAt)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetDeviceUptime computes how long a device was online and its offline
+// intervals within [from, to). Time before the device's first recorded
+// status is not counted.
+func GetDeviceUptime(devices DeviceRepository, deviceID int64, from, to time.Time) (*DeviceUptime, error) {
+	if now := time.Now(); to.After(now) {
+		to = now
+	}
+
+	uptime := &DeviceUptime{
+		DeviceID:         deviceID,
+		From:             from.UTC(),
+		To:               to.UTC(),
+		OfflineIntervals: []StatusInterval{},
+	}
+	if !to.After(from) {
+		return uptime, nil
+	}
+
+	changes, err := devices.ListStatusHistory(deviceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// Status in effect when the range starts, if known
+	var current *StatusInterval
+	initial, err := devices.StatusAt(deviceID, from)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if initial != nil {
+		current = &StatusInterval{Status: initial.Status, Reason: initial.Reason, Start: from}
+	}
+
+	var intervals []StatusInterval
+	for _, c := range changes {
+		if current != nil {
+			current.End = c.ChangedAt
+			intervals = append(intervals, *current)
+		}
+		current = &StatusInterval{Status: c.Status, Reason: c.Reason, Start: c.ChangedAt}
+	}
+	if current != nil {
+		current.End = to
+		intervals = append(intervals, *current)
+	}
+
+	for _, interval := range intervals {
+		interval.Start = interval.Start.UTC()
+		interval.End = interval.End.UTC()
+		interval.DurationSeconds = int64(interval.End.Sub(interval.Start).Seconds())
+		if interval.DurationSeconds <= 0 {
+			continue
+		}
+
+		uptime.TrackedSeconds += interval.DurationSeconds
+		if interval.Status == "active" {
+			uptime.OnlineSeconds += interval.DurationSeconds
+		} else {
+			uptime.OfflineSeconds += interval.DurationSeconds
+			uptime.OfflineIntervals = append(uptime.OfflineIntervals, interval)
+		}
+	}
+
+	if uptime.TrackedSeconds > 0 {
+		percent := float64(uptime.OnlineSeconds) / float64(uptime.TrackedSeconds) * 100
+		uptime.UptimePercent = &percent
+	}
+
+	return uptime, nil
+}
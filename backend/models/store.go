@@ -0,0 +1,193 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Handlers and services reach the database through these repositories, so
+// they can run against SQLite in production and an in-memory store in tests.
+// Lookups of missing rows return sql.ErrNoRows with every implementation.
+
+// UserRepository stores admin users
+type UserRepository interface {
+	Create(username, password string) (*User, error)
+	GetByUsername(username string) (*User, error)
+	GetByID(id int64) (*User, error)
+	List() ([]User, error)
+	Count() (int, error)
+	UpdateNotificationPrefs(userID int64, notifyNewRequests, notifyDeviceStatus, notifySecurity bool) error
+	UpdatePassword(userID int64, newPassword string) error
+
+	// ListForNotification returns the users who receive a notification type:
+	// "new_request", "device_status" or "security_event"
+	ListForNotification(notificationType string) ([]User, error)
+}
+
+// SessionRepository stores admin login sessions
+type SessionRepository interface {
+	Create(userID int64) (*Session, error)
+
+	// GetByToken returns an unexpired session
+	GetByToken(token string) (*Session, error)
+	Delete(token string) error
+
+	// DeleteByUser signs a user out everywhere
+	DeleteByUser(userID int64) error
+	DeleteExpired() error
+}
+
+// DeviceRepository stores devices with their credentials, status history
+// and inventory
+type DeviceRepository interface {
+	Create(name string) (*Device, error)
+	GetByID(id int64) (*Device, error)
+	GetByToken(token string) (*Device, error)
+	List() ([]Device, error)
+	Delete(id int64) error
+
+	RegenerateToken(id int64, grace time.Duration) (*Device, error)
+	ReissueToken(device *Device) (*Device, error)
+	TokenHashes(id int64) ([]string, error)
+	HashLegacyTokens() error
+
+	UpdateHeartbeat(deviceID int64, reason string) (*DeviceStatusChange, error)
+	UpdateStatus(deviceID int64, status, reason string) (*DeviceStatusChange, error)
+	MarkInactive(threshold time.Duration) ([]Device, error)
+	ListStatusHistory(deviceID int64, from, to time.Time) ([]DeviceStatusChange, error)
+
+	// StatusAt returns the last status transition before the given time
+	StatusAt(deviceID int64, at time.Time) (*DeviceStatusChange, error)
+
+	UpdateInventory(deviceID int64, reported *DeviceInventory) ([]InventoryChange, error)
+	ListInventoryHistory(deviceID int64, limit int) ([]InventoryChange, error)
+	SetReportedPolicyHash(deviceID int64, policyHash string) (string, error)
+}
+
+// PatternRepository stores patterns together with each device's policy
+// version, change log and signed policy hashes
+type PatternRepository interface {
+	Create(deviceID int64, pattern, patternType string, expiresAt *time.Time) (*Pattern, error)
+	GetByID(id int64) (*Pattern, error)
+
+	// ListByDevice returns the patterns a device currently enforces
+	ListByDevice(deviceID int64) ([]Pattern, error)
+	ListAll() ([]Pattern, error)
+	Update(id int64, pattern, patternType string, expiresAt *time.Time) (*Pattern, error)
+	SetEnabled(id int64, enabled bool) error
+	Delete(id int64) error
+
+	PolicyVersion(deviceID int64) (int64, error)
+	ListChangesSince(deviceID, since int64) (changes []PatternChange, version int64, complete bool, err error)
+	RecordExpired() ([]int64, error)
+	PruneChanges() error
+
+	RecordPolicyBundle(deviceID, version int64, policyHash string, issuedAt, expiresAt time.Time) error
+	IsKnownPolicyHash(deviceID int64, policyHash string) (bool, error)
+	PrunePolicyBundles(olderThan time.Duration) error
+}
+
+// RequestRepository stores access requests
+type RequestRepository interface {
+	Create(deviceID int64, url, suggestedPattern string) (*Request, error)
+	GetByID(id int64) (*Request, error)
+
+	// List returns requests with the given status, or all of them if status
+	// is empty, newest first
+	List(status string) ([]Request, error)
+	// Count returns how many requests have the given status
+	Count(status string) (int, error)
+	Approve(id int64) error
+	Deny(id int64) error
+}
+
+// PushSubscriptionRepository stores web push subscriptions
+type PushSubscriptionRepository interface {
+	// Create replaces any subscription with the same endpoint
+	Create(userID int64, endpoint, p256dh, auth string) (*PushSubscription, error)
+	ListByUser(userID int64) ([]PushSubscription, error)
+	ListAll() ([]PushSubscription, error)
+	Delete(endpoint string) error
+	DeleteByID(id int64) error
+}
+
+// ConfigRepository stores server settings and keys as key/value pairs
+type ConfigRepository interface {
+	Get(key string) (string, error)
+	Set(key, value string) error
+
+	// SetDefault stores value unless the key is already set, and returns
+	// the stored value. Instances starting together use it so they agree on
+	// generated keys.
+	SetDefault(key, value string) (string, error)
+}
+
+// CommandRepository stores remote commands sent to devices
+type CommandRepository interface {
+	Create(deviceID int64, commandType string, params json.RawMessage, ttl time.Duration) (*DeviceCommand, error)
+	GetByID(id int64) (*DeviceCommand, error)
+	List(deviceID int64, limit int) ([]DeviceCommand, error)
+	ListPending(deviceID int64) ([]DeviceCommand, error)
+	ListUnacknowledged(deviceID int64) ([]DeviceCommand, error)
+	MarkDelivered(id int64) error
+	Acknowledge(id, deviceID int64, success bool, errorMessage string) error
+}
+
+// EnrollmentRepository stores one-time device enrollment codes
+type EnrollmentRepository interface {
+	Create(deviceID int64, ttl time.Duration) (*DeviceEnrollment, error)
+	ListPending() ([]DeviceEnrollment, error)
+	Delete(id int64) error
+	Redeem(code string) (*Device, error)
+}
+
+// EventRepository stores device security events
+type EventRepository interface {
+	Create(deviceID int64, eventType, severity, source string, details json.RawMessage, occurredAt *time.Time) (*DeviceEvent, error)
+	List(deviceID int64, limit int) ([]DeviceEvent, error)
+}
+
+// BrokerRepository is the outbox server instances share WebSocket events through
+type BrokerRepository interface {
+	Insert(instanceID, kind string, deviceID int64, data []byte) error
+	LatestID() (int64, error)
+	ListAfter(afterID int64, instanceID string, limit int) ([]BrokerEvent, error)
+	Prune(olderThan time.Duration) error
+}
+
+// Store bundles the repositories of one backend
+type Store struct {
+	Users             UserRepository
+	Sessions          SessionRepository
+	Devices           DeviceRepository
+	Patterns          PatternRepository
+	Requests          RequestRepository
+	PushSubscriptions PushSubscriptionRepository
+	Config            ConfigRepository
+	Commands          CommandRepository
+	Enrollments       EnrollmentRepository
+	Events            EventRepository
+	Broker            BrokerRepository
+
+	// Set by stores that log their queries
+	withContext func(ctx context.Context) *Store
+}
+
+// WithContext returns the store with its queries logged under the request ID
+// ctx carries. Stores that don't log return themselves.
+func (s *Store) WithContext(ctx context.Context) *Store {
+	if s.withContext == nil {
+		return s
+	}
+	return s.withContext(ctx)
+}
+
+// NeedsSetup returns true if no users exist (first-time setup needed)
+func (s *Store) NeedsSetup() (bool, error) {
+	count, err := s.Users.Count()
+	if err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/watchtower/web/database"
+	"github.com/watchtower/web/handlers"
+	"github.com/watchtower/web/middleware"
+	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/services"
+	"github.com/watchtower/web/static"
+	"github.com/watchtower/web/websocket"
+)
+
+// runServe runs the HTTP server until it gets SIGTERM or Ctrl-C
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	dev := flags.Bool("dev", false, "serve the admin UI from server.static_dir on disk, re-read on every request")
+	flags.Parse(args)
+
+	// The admin UI is built into the binary; -dev edits it in place
+	var uiFiles fs.FS = static.Files
+	if *dev {
+		uiFiles = os.DirFS(cfg.Server.StaticDir)
+		slog.Info("Serving the admin UI from disk", "dir", cfg.Server.StaticDir)
+	}
+	ui, err := handlers.NewStaticHandler(uiFiles, *dev)
+	if err != nil {
+		return err
+	}
+
+	models.SessionLifetime = cfg.Sessions.Lifetime.Std()
+	services.DeviceInactiveAfter = cfg.Devices.InactiveAfter.Std()
+	services.PushSubscriber = cfg.Push.Subscriber
+	services.PushTTL = cfg.Push.TTL
+	handlers.SetConfig(cfg)
+	middleware.SetTrustedProxies(cfg.Server.TrustedProxies)
+
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	// Handlers, middleware and services share one store
+	handlers.SetStore(store)
+	middleware.SetStore(store)
+	services.SetStore(store)
+
+	if err := store.Devices.HashLegacyTokens(); err != nil {
+		fatal("Failed to hash legacy device tokens", err)
+	}
+
+	// Initialize push notification service
+	if err := services.InitPushService(); err != nil {
+		slog.Warn("Failed to initialize push service", "err", err)
+	}
+
+	// Load the key policy bundles are signed with
+	if err := services.InitPolicySigner(); err != nil {
+		fatal("Failed to initialize policy signing", err)
+	}
+
+	// Initialize WebSocket hub
+	websocket.InitHub()
+	websocket.DefaultHub.PolicyChanged = handlers.PushDevicePolicy
+	websocket.DefaultHub.TokenRotated = handlers.ReissueDeviceTokens
+	websocket.DefaultHub.CommandsPending = handlers.DeliverQueuedCommands
+	services.RegisterMetrics()
+
+	// Instances sharing the database reach each other's devices through it
+	if cfg.WebSocket.Broker == "database" {
+		dbBroker, err := services.NewDBBroker(services.BrokerPollInterval)
+		if err != nil {
+			fatal("Failed to create WebSocket broker", err)
+		}
+		if err := websocket.DefaultHub.UseBroker(dbBroker); err != nil {
+			fatal("Failed to start WebSocket broker", err)
+		}
+	}
+
+	// Scheduled backups, SQLite only
+	services.BackupDir = cfg.Backup.Dir
+	services.BackupInterval = cfg.Backup.Interval.Std()
+	services.BackupKeep = cfg.Backup.Keep
+
+	// Before the scheduler, which renews the local CA's server certificate
+	tlsConfig, err := configureTLS()
+	if err != nil {
+		fatal("Failed to set up TLS", err)
+	}
+
+	// Start background scheduler, which pushes pattern expiry to devices
+	services.PatternChangeHook = handlers.NotifyDevicePatternUpdate
+	services.PolicyPushHook = handlers.PushDevicePolicy
+	services.StartScheduler()
+
+	r := handlers.NewRouter(ui)
+
+	// Start server
+	port := strconv.Itoa(cfg.Server.Port)
+
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: r,
+		// TLS handshake failures and the like
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	srv.TLSConfig = tlsConfig
+
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			slog.Info("Server starting", "port", port, "tls", true)
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("Server starting", "port", port, "tls", false)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server failed", err)
+		}
+	}()
+
+	// Wait for a container stop or Ctrl-C
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+	slog.Info("Shutting down", "signal", sig.String())
+
+	shutdown(srv)
+	return nil
+}
+
+// configureTLS returns the TLS config for serving HTTPS from the configured
+// certificate files, or from the local CA's server certificate if that is
+// turned on. Either is reloaded when its files change. Without either it
+// returns nil and the server speaks plain HTTP.
+func configureTLS() (*tls.Config, error) {
+	certFile, keyFile := cfg.TLS.CertFile, cfg.TLS.KeyFile
+	if cfg.TLS.LocalCA {
+		if err := services.InitLocalCA(cfg.TLS.Dir, cfg.TLS.Hosts); err != nil {
+			return nil, err
+		}
+		certFile, keyFile = services.CA.ServerCertFiles()
+	}
+	if certFile == "" {
+		return nil, nil
+	}
+
+	reloader, err := services.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	services.TLSCert = reloader
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
+
+// Time allowed for in-flight requests, WebSocket writes and notifications
+// to finish once the server is asked to stop
+const shutdownTimeout = 15 * time.Second
+
+// shutdown stops the server in order: no new connections, devices told to
+// reconnect later, WebSockets drained, scheduled jobs and background work
+// finished, then the database closed if they did. Each step gets what is
+// left of shutdownTimeout.
+func shutdown(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections and wait for in-flight HTTP requests
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("HTTP server shutdown", "err", err)
+	}
+
+	// Send server_restarting and close WebSockets once their queues are written
+	if err := handlers.ShutdownWebSockets(ctx); err != nil {
+		slog.Warn("WebSocket shutdown", "err", err)
+	}
+
+	// Stop the scheduler so it can't start new background work, then wait
+	// for push notifications and policy pushes still being sent
+	finished := true
+	if err := services.StopScheduler(ctx); err != nil {
+		slog.Warn("Scheduled jobs still running at shutdown", "err", err)
+		finished = false
+	}
+	if err := services.WaitBackground(ctx); err != nil {
+		slog.Warn("Background work still running at shutdown", "err", err)
+		finished = false
+	}
+
+	// Work still running would fail on a closed database; the process
+	// exits right after, which ends it anyway
+	if finished {
+		database.Close()
+	} else {
+		slog.Warn("Leaving the database open for work still running")
+	}
+	slog.Info("Server stopped")
+}
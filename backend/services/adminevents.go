@@ -0,0 +1,72 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/websocket"
+)
+
+// Admin dashboards keep a WebSocket open and receive these events, so every
+// admin sees new requests and other admins' actions without reloading.
+
+// DeviceStatusEvent is published when a device changes status
+type DeviceStatusEvent struct {
+	DeviceID       int64     `json:"device_id"`
+	DeviceName     string    `json:"device_name"`
+	Status         string    `json:"status"`
+	PreviousStatus string    `json:"previous_status,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	ChangedAt      time.Time `json:"changed_at"`
+}
+
+// RequestEvent is published when an access request is created or resolved
+type RequestEvent struct {
+	Request *models.Request `json:"request"`
+	By      string          `json:"by,omitempty"` // admin who resolved it
+}
+
+// PatternEvent is published when an admin changes a pattern
+type PatternEvent struct {
+	Action    string          `json:"action"` // "created", "updated", "toggled", "deleted"
+	PatternID int64           `json:"pattern_id"`
+	Pattern   *models.Pattern `json:"pattern,omitempty"` // nil for "deleted"
+	By        string          `json:"by,omitempty"`
+}
+
+// PublishAdminEvent sends an event to all connected admin dashboards
+func PublishAdminEvent(ctx context.Context, eventType string, data interface{}) {
+	if websocket.DefaultHub == nil {
+		return
+	}
+
+	websocket.DefaultHub.BroadcastToAdmins(websocket.Message{
+		Type: eventType,
+		Data: data,
+	})
+}
+
+// PublishDeviceStatusChange publishes a device_status event for a recorded
+// status transition. A nil change is ignored.
+func PublishDeviceStatusChange(ctx context.Context, change *models.DeviceStatusChange) {
+	if change == nil {
+		return
+	}
+
+	event := DeviceStatusEvent{
+		DeviceID:       change.DeviceID,
+		Status:         change.Status,
+		PreviousStatus: change.PreviousStatus,
+		Reason:         change.Reason,
+		ChangedAt:      change.ChangedAt,
+	}
+	if device, err := store.WithContext(ctx).Devices.GetByID(change.DeviceID); err == nil {
+		event.DeviceName = device.Name
+	} else {
+		slog.ErrorContext(ctx, "Failed to get device for status event", "device_id", change.DeviceID, "err", err)
+	}
+
+	PublishAdminEvent(ctx, "device_status", event)
+}
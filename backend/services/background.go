@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"sync"
+)
+
+// Work that outlives the request that started it, such as push
+// notifications and policy pushes, runs through RunBackground so shutdown
+// can wait for it before the database is closed.
+
+var (
+	background sync.WaitGroup
+
+	// Read pumps and handlers keep starting work while shutdown waits, but
+	// a WaitGroup must not grow from zero during Wait, so while anyone
+	// waits new work runs in the caller's goroutine instead
+	backgroundMu      sync.Mutex
+	backgroundWaiters int
+)
+
+// RunBackground runs fn in its own goroutine and tracks it until it returns.
+// While WaitBackground is waiting, fn runs before RunBackground returns.
+func RunBackground(fn func()) {
+	backgroundMu.Lock()
+	if backgroundWaiters > 0 {
+		backgroundMu.Unlock()
+		fn()
+		return
+	}
+	background.Add(1)
+	backgroundMu.Unlock()
+
+	go func() {
+		defer background.Done()
+		fn()
+	}()
+}
+
+// WaitBackground waits for the goroutines started with RunBackground to
+// finish. It returns the context's error if they are still running when the
+// context is done.
+func WaitBackground(ctx context.Context) error {
+	backgroundMu.Lock()
+	backgroundWaiters++
+	backgroundMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		backgroundMu.Lock()
+		backgroundWaiters--
+		backgroundMu.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
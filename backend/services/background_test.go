@@ -0,0 +1,50 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunBackgroundDuringWait(t *testing.T) {
+	release := make(chan struct{})
+	RunBackground(func() { <-release })
+
+	waited := make(chan error)
+	go func() { waited <- WaitBackground(context.Background()) }()
+
+	// Work started while shutdown waits runs right away instead of joining
+	// the wait group
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		backgroundMu.Lock()
+		waiting := backgroundWaiters > 0
+		backgroundMu.Unlock()
+		if waiting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("WaitBackground didn't start waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ran := false
+	RunBackground(func() { ran = true })
+	if !ran {
+		t.Fatal("work started during the wait didn't run inline")
+	}
+
+	close(release)
+	if err := <-waited; err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the wait is over, work runs in the background again
+	done := make(chan struct{})
+	RunBackground(func() { close(done) })
+	<-done
+	if err := WaitBackground(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
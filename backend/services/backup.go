@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/watchtower/web/database"
+)
+
+// Scheduled backups write a snapshot into BackupDir every BackupInterval
+// and keep the newest BackupKeep. They are off while BackupDir is empty.
+var (
+	BackupDir      string
+	BackupInterval = 24 * time.Hour
+	BackupKeep     = 7
+)
+
+const (
+	backupPrefix     = "watchtower-"
+	backupSuffix     = ".db"
+	backupTimeFormat = "20060102-150405"
+)
+
+// BackupFileName names a backup taken at t. Names sort by time.
+func BackupFileName(t time.Time) string {
+	return backupPrefix + t.UTC().Format(backupTimeFormat) + backupSuffix
+}
+
+// CreateBackup writes a snapshot into dir, then deletes all but the newest
+// keep backups there. It returns the new backup's path.
+func CreateBackup(dir string, keep int) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, BackupFileName(time.Now()))
+	if err := database.Backup(path); err != nil {
+		return "", err
+	}
+
+	if err := rotateBackups(dir, keep); err != nil {
+		slog.Error("Failed to rotate backups", "dir", dir, "err", err)
+	}
+	return path, nil
+}
+
+// rotateBackups deletes all but the newest keep backups in dir. Other files
+// are left alone.
+func rotateBackups(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, name)
+		}
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+
+	sort.Strings(backups)
+	for _, name := range backups[:len(backups)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scheduledBackup is the scheduler job for BackupDir
+func scheduledBackup(ctx context.Context) {
+	path, err := CreateBackup(BackupDir, BackupKeep)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to back up database", "err", err)
+		return
+	}
+	slog.InfoContext(ctx, "Backed up database", "path", path)
+}
@@ -0,0 +1,60 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRotateBackups(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2025, 1, 1, 3, 0, 0, 0, time.UTC)
+
+	var names []string
+	for day := range 4 {
+		names = append(names, BackupFileName(start.AddDate(0, 0, day)))
+	}
+	// Files that aren't backups are never deleted
+	others := []string{"notes.txt", "watchtower.db", backupPrefix + "manual.db.tmp"}
+	for _, name := range append(slices.Clone(names), others...) {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, BackupFileName(start.AddDate(0, 0, -1))), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	remaining := func() []string {
+		t.Helper()
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	if err := rotateBackups(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]string{BackupFileName(start.AddDate(0, 0, -1))}, names[2:]...)
+	want = append(want, others...)
+	slices.Sort(want)
+	if got := remaining(); !slices.Equal(got, want) {
+		t.Fatalf("kept %v, want %v", got, want)
+	}
+
+	// Nothing more goes while there are no more backups than to keep
+	if err := rotateBackups(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := remaining(); !slices.Equal(got, want) {
+		t.Fatalf("kept %v, want %v", got, want)
+	}
+}
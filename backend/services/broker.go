@@ -0,0 +1,157 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"github.com/watchtower/web/websocket"
+)
+
+// Server instances sharing a database use DBBroker to reach each other's
+// WebSocket connections: every instance appends its events to the
+// broker_events table and polls it for the events of the others.
+
+const (
+	// How often an instance checks the outbox for new events
+	BrokerPollInterval = 500 * time.Millisecond
+
+	// Events are only useful while they're fresh; older ones are pruned
+	brokerEventRetention = 5 * time.Minute
+
+	// Events fetched per query
+	brokerBatchSize = 500
+
+	// An event's ID is assigned when it is inserted but the event only
+	// shows up once its transaction commits, so on PostgreSQL a lower ID can
+	// appear after a higher one. Polls keep looking at events this long
+	// after they first saw them before moving past their IDs.
+	brokerSettleWindow = 5 * time.Second
+)
+
+// DBBroker is a websocket.Broker backed by the database outbox
+type DBBroker struct {
+	instanceID string
+	interval   time.Duration
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewDBBroker creates a broker for this instance with a random instance ID
+func NewDBBroker(interval time.Duration) (*DBBroker, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &DBBroker{
+		instanceID: hex.EncodeToString(id),
+		interval:   interval,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// InstanceID identifies this instance's events in the outbox
+func (b *DBBroker) InstanceID() string {
+	return b.instanceID
+}
+
+// Publish appends an event to the outbox
+func (b *DBBroker) Publish(event websocket.BrokerEvent) error {
+	return store.Broker.Insert(b.instanceID, event.Kind, event.DeviceID, event.Data)
+}
+
+// Start delivers the events other instances publish from now on
+func (b *DBBroker) Start(deliver func(websocket.BrokerEvent)) error {
+	lastID, err := store.Broker.LatestID()
+	if err != nil {
+		return err
+	}
+
+	go b.poll(lastID, deliver)
+	slog.Info("Database WebSocket broker started", "instance", b.instanceID)
+	return nil
+}
+
+// Close stops polling and waits for the current poll to finish
+func (b *DBBroker) Close() error {
+	select {
+	case <-b.stop:
+		return nil
+	default:
+	}
+
+	close(b.stop)
+	<-b.done
+	return nil
+}
+
+func (b *DBBroker) poll(lastID int64, deliver func(websocket.BrokerEvent)) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	lastPrune := time.Now()
+
+	// Events above lastID that were already delivered, and when they were
+	// first seen
+	seen := make(map[int64]time.Time)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+
+		now := time.Now()
+		afterID := lastID
+		for {
+			events, err := store.Broker.ListAfter(afterID, b.instanceID, brokerBatchSize)
+			if err != nil {
+				slog.Error("Failed to poll broker events", "err", err)
+				break
+			}
+
+			for _, event := range events {
+				if _, ok := seen[event.ID]; ok {
+					continue
+				}
+				deliver(websocket.BrokerEvent{
+					Kind:     event.Kind,
+					DeviceID: event.DeviceID,
+					Data:     event.Data,
+				})
+				seen[event.ID] = now
+			}
+
+			if len(events) < brokerBatchSize {
+				break
+			}
+			afterID = events[len(events)-1].ID
+		}
+
+		// Move past events once anything inserted before them has had
+		// time to commit
+		for id, firstSeen := range seen {
+			if id > lastID && now.Sub(firstSeen) >= brokerSettleWindow {
+				lastID = id
+			}
+		}
+		for id := range seen {
+			if id <= lastID {
+				delete(seen, id)
+			}
+		}
+
+		if time.Since(lastPrune) >= time.Minute {
+			if err := store.Broker.Prune(brokerEventRetention); err != nil {
+				slog.Error("Failed to prune broker events", "err", err)
+			}
+			lastPrune = time.Now()
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	"github.com/watchtower/web/database"
+	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/websocket"
+)
+
+const testPollInterval = 10 * time.Millisecond
+
+// newBrokerHub starts a hub with its own DBBroker, as a server instance would
+func newBrokerHub(t *testing.T) *websocket.Hub {
+	t.Helper()
+
+	broker, err := NewDBBroker(testPollInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := websocket.NewHub()
+	go hub.Run()
+	if err := hub.UseBroker(broker); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return hub
+}
+
+// connect registers a client on a hub over a real WebSocket connection and
+// returns the peer's end of it
+func connect(t *testing.T, hub *websocket.Hub, client *websocket.Client) *ws.Conn {
+	t.Helper()
+
+	conns := make(chan *ws.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&ws.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	peer, _, err := ws.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	client.Hub = hub
+	client.Conn = <-conns
+	client.Send = make(chan []byte, websocket.SendBufferSize)
+	hub.Register(client)
+	return peer
+}
+
+// receive returns the type of the next message queued on a client
+func receive(t *testing.T, client *websocket.Client) string {
+	t.Helper()
+
+	select {
+	case data := <-client.Send:
+		var message websocket.Message
+		if err := json.Unmarshal(data, &message); err != nil {
+			t.Fatal(err)
+		}
+		return message.Type
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message arrived")
+		return ""
+	}
+}
+
+func TestDBBrokerBetweenInstances(t *testing.T) {
+	if err := database.Initialize(filepath.Join(t.TempDir(), "watchtower.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+	SetStore(models.NewSQLiteStore(database.DB))
+
+	a, b := newBrokerHub(t), newBrokerHub(t)
+
+	hooks := make(chan string, 10)
+	hook := func(name string) func(context.Context, int64) {
+		return func(ctx context.Context, deviceID int64) { hooks <- name }
+	}
+	b.PolicyChanged = hook("policy")
+	b.TokenRotated = hook("token")
+	b.CommandsPending = hook("commands")
+
+	onA := &websocket.Client{DeviceID: 1}
+	connect(t, a, onA)
+	onB := &websocket.Client{DeviceID: 1}
+	peerOnB := connect(t, b, onB)
+	admin := &websocket.Client{UserID: 1}
+	connect(t, b, admin)
+
+	// Messages sent on A reach B's connections
+	if queued := a.SendToDevice(1, websocket.Message{Type: "to_device"}); queued != 1 {
+		t.Fatalf("queued on %d local connections, want 1", queued)
+	}
+	if got := receive(t, onB); got != "to_device" {
+		t.Fatalf("got %q on B", got)
+	}
+	a.BroadcastToAdmins(websocket.Message{Type: "to_admins"})
+	if got := receive(t, admin); got != "to_admins" {
+		t.Fatalf("got %q on B's admin connection", got)
+	}
+
+	// Signals run B's hooks for the device connected there
+	a.PublishPolicyChange(1)
+	a.PublishTokenRotation(1)
+	a.PublishPendingCommands(1)
+	for _, want := range []string{"policy", "token", "commands"} {
+		select {
+		case got := <-hooks:
+			if got != want {
+				t.Fatalf("got hook %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("hook %q didn't run", want)
+		}
+	}
+
+	// A doesn't deliver its own events a second time
+	if got := receive(t, onA); got != "to_device" {
+		t.Fatalf("got %q on A", got)
+	}
+	time.Sleep(10 * testPollInterval)
+	if len(onA.Send) != 0 {
+		t.Fatalf("A delivered its own message again")
+	}
+
+	// Disconnecting on A closes the connection on B
+	a.DisconnectDevice(1)
+	peerOnB.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := peerOnB.ReadMessage()
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Fatalf("connection on B still open: %v", err)
+	}
+}
+
+// lateCommitBroker is an outbox whose events show up when the test adds them,
+// whatever their IDs
+type lateCommitBroker struct {
+	mu     sync.Mutex
+	events []models.BrokerEvent
+}
+
+func (f *lateCommitBroker) commit(id int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, models.BrokerEvent{ID: id, InstanceID: "other", Kind: websocket.EventPolicyChanged, DeviceID: id})
+	sort.Slice(f.events, func(i, j int) bool { return f.events[i].ID < f.events[j].ID })
+}
+
+func (f *lateCommitBroker) Insert(instanceID, kind string, deviceID int64, data []byte) error {
+	return nil
+}
+
+func (f *lateCommitBroker) LatestID() (int64, error) {
+	return 0, nil
+}
+
+func (f *lateCommitBroker) ListAfter(afterID int64, instanceID string, limit int) ([]models.BrokerEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var events []models.BrokerEvent
+	for _, e := range f.events {
+		if e.ID > afterID && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (f *lateCommitBroker) Prune(olderThan time.Duration) error {
+	return nil
+}
+
+func TestDBBrokerLateCommit(t *testing.T) {
+	outbox := &lateCommitBroker{}
+	s := models.NewMemoryStore()
+	s.Broker = outbox
+	SetStore(s)
+
+	broker, err := NewDBBroker(testPollInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := make(chan int64, 10)
+	if err := broker.Start(func(event websocket.BrokerEvent) { delivered <- event.DeviceID }); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	next := func() int64 {
+		t.Helper()
+		select {
+		case id := <-delivered:
+			return id
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event delivered")
+			return 0
+		}
+	}
+
+	// Event 1's transaction commits after event 2's
+	outbox.commit(2)
+	if id := next(); id != 2 {
+		t.Fatalf("delivered event %d, want 2", id)
+	}
+	outbox.commit(1)
+	if id := next(); id != 1 {
+		t.Fatalf("delivered event %d, want 1", id)
+	}
+
+	time.Sleep(10 * testPollInterval)
+	if len(delivered) != 0 {
+		t.Fatalf("delivered event %d twice", <-delivered)
+	}
+}
@@ -0,0 +1,221 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/watchtower/web/models"
+)
+
+// EventRule describes how a device event type is classified and whether it
+// should alert admins
+type EventRule struct {
+	Severity string
+	Notify   bool
+	Title    string
+
+	// Describe renders the notification body
+	Describe func(deviceName string, details map[string]interface{}) string
+}
+
+const (
+	// Client clocks further off than this are reported as clock skew
+	clockSkewThreshold = 5 * time.Minute
+
+	// Minimum time between notifications for the same device and event type
+	eventNotifyCooldown = 15 * time.Minute
+)
+
+// DeviceEventRules maps event types to their rules. Events reported by the
+// extension must use one of these types.
+var DeviceEventRules = map[string]EventRule{
+	"extension_disabled": {
+		Severity: "critical",
+		Notify:   true,
+		Title:    "Extension Disabled",
+		Describe: func(name string, _ map[string]interface{}) string {
+			return "The extension on " + name + " was disabled"
+		},
+	},
+	"extension_enabled": {
+		Severity: "warning",
+		Notify:   true,
+		Title:    "Extension Re-enabled",
+		Describe: func(name string, details map[string]interface{}) string {
+			if minutes, ok := details["offline_minutes"].(float64); ok {
+				return fmt.Sprintf("The extension on %s was re-enabled after %.0f minutes", name, minutes)
+			}
+			return "The extension on " + name + " was re-enabled"
+		},
+	},
+	"incognito_access_revoked": {
+		Severity: "critical",
+		Notify:   true,
+		Title:    "Incognito Access Revoked",
+		Describe: func(name string, _ map[string]interface{}) string {
+			return name + " can browse in incognito windows without filtering"
+		},
+	},
+	"incognito_access_granted": {
+		Severity: "info",
+	},
+	"config_changed": {
+		Severity: "warning",
+		Notify:   true,
+		Title:    "Extension Configuration Changed",
+		Describe: func(name string, _ map[string]interface{}) string {
+			return "The extension configuration was changed on " + name
+		},
+	},
+	"clock_skew": {
+		Severity: "warning",
+		Notify:   true,
+		Title:    "Clock Skew Detected",
+		Describe: func(name string, details map[string]interface{}) string {
+			if seconds, ok := details["skew_seconds"].(float64); ok {
+				return fmt.Sprintf("The clock on %s is off by %s", name, (time.Duration(seconds) * time.Second).String())
+			}
+			return "The clock on " + name + " is out of sync"
+		},
+	},
+	"policy_tampered": {
+		Severity: "critical",
+		Notify:   true,
+		Title:    "Cached Policy Modified",
+		Describe: func(name string, _ map[string]interface{}) string {
+			return "The cached filtering policy on " + name + " failed its signature check"
+		},
+	},
+}
+
+// Server-generated events. Status events are recorded on the timeline only;
+// the matching status notifications are sent by NotifyDeviceStatus.
+var serverEventRules = map[string]EventRule{
+	"heartbeat_lost": {Severity: "warning"},
+	"uninstalled":    {Severity: "critical"},
+	"profile_changed": {
+		Severity: "warning",
+		Notify:   true,
+		Title:    "Browser Profile Changed",
+		Describe: func(name string, details map[string]interface{}) string {
+			if email, ok := details["new_value"].(string); ok {
+				return "The extension on " + name + " now reports the browser profile " + email
+			}
+			return "The browser profile on " + name + " changed"
+		},
+	},
+	"policy_unknown": {
+		Severity: "critical",
+		Notify:   true,
+		Title:    "Unknown Policy Reported",
+		Describe: func(name string, _ map[string]interface{}) string {
+			return name + " reports enforcing a policy the server never issued"
+		},
+	},
+}
+
+var (
+	lastEventNotify   = make(map[string]time.Time)
+	lastEventNotifyMu sync.Mutex
+)
+
+// IsKnownDeviceEvent reports whether the extension may report this event type
+func IsKnownDeviceEvent(eventType string) bool {
+	_, ok := DeviceEventRules[eventType]
+	return ok
+}
+
+// ProcessDeviceEvent records an event reported by a device, applies the rules
+// and alerts admins. If clientTime is set and too far from the server clock,
+// a clock_skew event is recorded as well.
+func ProcessDeviceEvent(ctx context.Context, device *models.Device, eventType string, details json.RawMessage, occurredAt, clientTime *time.Time) ([]*models.DeviceEvent, error) {
+	rule := DeviceEventRules[eventType]
+
+	event, err := store.WithContext(ctx).Events.Create(device.ID, eventType, rule.Severity, "device", details, occurredAt)
+	if err != nil {
+		return nil, err
+	}
+	events := []*models.DeviceEvent{event}
+	applyEventRule(ctx, device, event, rule)
+
+	if clientTime != nil && eventType != "clock_skew" {
+		skew := time.Since(*clientTime)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > clockSkewThreshold {
+			skewDetails, _ := json.Marshal(map[string]interface{}{
+				"skew_seconds": int64(skew.Seconds()),
+				"client_time":  clientTime,
+			})
+			skewRule := DeviceEventRules["clock_skew"]
+			skewEvent, err := store.WithContext(ctx).Events.Create(device.ID, "clock_skew", skewRule.Severity, "server", skewDetails, nil)
+			if err != nil {
+				return events, err
+			}
+			events = append(events, skewEvent)
+			applyEventRule(ctx, device, skewEvent, skewRule)
+		}
+	}
+
+	return events, nil
+}
+
+// RecordServerEvent adds a server-detected event to a device's timeline
+func RecordServerEvent(ctx context.Context, deviceID int64, eventType string, details json.RawMessage) {
+	rule := serverEventRules[eventType]
+	if _, err := store.WithContext(ctx).Events.Create(deviceID, eventType, rule.Severity, "server", details, nil); err != nil {
+		slog.ErrorContext(ctx, "Failed to record device event", "device_id", deviceID, "type", eventType, "err", err)
+	}
+}
+
+// ProcessInventoryChanges records a profile_changed event when a device that
+// already reported a profile email starts reporting a different one, which
+// usually means the extension was moved to another browser profile
+func ProcessInventoryChanges(ctx context.Context, device *models.Device, changes []models.InventoryChange) {
+	for _, change := range changes {
+		if change.Field != "profile_email" || change.OldValue == "" {
+			continue
+		}
+
+		details, _ := json.Marshal(map[string]string{
+			"old_value": change.OldValue,
+			"new_value": change.NewValue,
+		})
+		rule := serverEventRules["profile_changed"]
+		event, err := store.WithContext(ctx).Events.Create(device.ID, "profile_changed", rule.Severity, "server", details, nil)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to record device event", "device_id", device.ID, "type", "profile_changed", "err", err)
+			continue
+		}
+		applyEventRule(ctx, device, event, rule)
+	}
+}
+
+func applyEventRule(ctx context.Context, device *models.Device, event *models.DeviceEvent, rule EventRule) {
+	slog.InfoContext(ctx, "Device event", "device_id", device.ID, "device_name", device.Name, "type", event.Type, "severity", event.Severity)
+
+	if !rule.Notify || Push == nil {
+		return
+	}
+
+	key := fmt.Sprintf("%d:%s", device.ID, event.Type)
+	lastEventNotifyMu.Lock()
+	if last, ok := lastEventNotify[key]; ok && time.Since(last) < eventNotifyCooldown {
+		lastEventNotifyMu.Unlock()
+		return
+	}
+	lastEventNotify[key] = time.Now()
+	lastEventNotifyMu.Unlock()
+
+	var details map[string]interface{}
+	if len(event.Details) > 0 {
+		json.Unmarshal(event.Details, &details)
+	}
+
+	RunBackground(func() { Push.NotifySecurityEvent(ctx, device.Name, rule.Title, rule.Describe(device.Name, details)) })
+}
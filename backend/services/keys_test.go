@@ -0,0 +1,72 @@
+package services
+
+import (
+	"database/sql"
+	"testing"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+	"github.com/watchtower/web/models"
+)
+
+// racingConfig misses every key on Get, like an instance that looked before
+// another one starting at the same time stored its keys
+type racingConfig struct {
+	models.ConfigRepository
+}
+
+func (racingConfig) Get(key string) (string, error) {
+	return "", sql.ErrNoRows
+}
+
+func TestGeneratedKeysAgreeAcrossInstances(t *testing.T) {
+	s := models.NewMemoryStore()
+	SetStore(s)
+
+	if err := InitPolicySigner(); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitPushService(); err != nil {
+		t.Fatal(err)
+	}
+	uninstallKey = nil
+	firstUninstallKey, err := getUninstallKey(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, firstPush := Signer, Push
+
+	// The second instance generates keys of its own but keeps the stored ones
+	s.Config = racingConfig{s.Config}
+	if err := InitPolicySigner(); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitPushService(); err != nil {
+		t.Fatal(err)
+	}
+	uninstallKey = nil
+	secondUninstallKey, err := getUninstallKey(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if Signer.KeyID() != first.KeyID() {
+		t.Fatalf("policy signing keys differ: %s and %s", first.KeyID(), Signer.KeyID())
+	}
+	if string(secondUninstallKey) != string(firstUninstallKey) {
+		t.Fatal("uninstall keys differ")
+	}
+	if *Push != *firstPush {
+		t.Fatal("VAPID keys differ")
+	}
+}
+
+func TestVAPIDPublicKey(t *testing.T) {
+	privateKey, publicKey, err := webpush.GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived, err := vapidPublicKey(privateKey)
+	if err != nil || derived != publicKey {
+		t.Fatalf("got public key %q, %v, want %q", derived, err, publicKey)
+	}
+}
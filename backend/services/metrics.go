@@ -0,0 +1,41 @@
+package services
+
+import (
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/watchtower/web/metrics"
+	"github.com/watchtower/web/websocket"
+)
+
+// RegisterMetrics adds the gauges read from the store and the WebSocket hub
+// on every scrape. It is called once, after the hub is initialized.
+func RegisterMetrics() {
+	hubStat := func(stat func(websocket.HubStats) int64) func() float64 {
+		return func() float64 {
+			return float64(stat(websocket.DefaultHub.Stats()))
+		}
+	}
+
+	metrics.RegisterGaugeFunc("websocket_clients", "Open WebSocket connections by kind of client.", prometheus.Labels{"kind": "device"},
+		hubStat(func(s websocket.HubStats) int64 { return int64(s.Connections) }))
+	metrics.RegisterGaugeFunc("websocket_clients", "Open WebSocket connections by kind of client.", prometheus.Labels{"kind": "admin"},
+		hubStat(func(s websocket.HubStats) int64 { return int64(s.AdminConnections) }))
+	metrics.RegisterGaugeFunc("websocket_connected_devices", "Devices with at least one open WebSocket connection to this instance.", nil,
+		hubStat(func(s websocket.HubStats) int64 { return int64(s.ConnectedDevices) }))
+	metrics.RegisterGaugeFunc("websocket_queued_messages", "Messages waiting to be written to WebSocket connections.", nil,
+		hubStat(func(s websocket.HubStats) int64 { return int64(s.QueuedMessages) }))
+	metrics.RegisterCounterFunc("websocket_dropped_messages_total", "Messages dropped because a connection's send buffer was full.",
+		hubStat(func(s websocket.HubStats) int64 { return s.DroppedMessages }))
+	metrics.RegisterCounterFunc("websocket_slow_client_disconnects_total", "Connections closed for falling too far behind.",
+		hubStat(func(s websocket.HubStats) int64 { return s.SlowClientDisconnects }))
+
+	metrics.RegisterGaugeFunc("pending_requests", "Access requests waiting for an admin.", nil, func() float64 {
+		count, err := store.Requests.Count("pending")
+		if err != nil {
+			slog.Error("Failed to count pending requests for metrics", "err", err)
+			return 0
+		}
+		return float64(count)
+	})
+}
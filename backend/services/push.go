@@ -1,10 +1,16 @@
 package services
 
 import (
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
+	"strings"
 
 	webpush "github.com/SherClockHolmes/webpush-go"
+	"github.com/watchtower/web/metrics"
 	"github.com/watchtower/web/models"
 )
 
@@ -16,31 +22,43 @@ type PushService struct {
 
 // NotificationPayload represents the data sent in a push notification
 type NotificationPayload struct {
-	Title   string `json:"title"`
-	Body    string `json:"body"`
-	Icon    string `json:"icon,omitempty"`
-	URL     string `json:"url,omitempty"`
-	Tag     string `json:"tag,omitempty"`
-	Type    string `json:"type"` // "new_request" or "device_status"
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Icon  string `json:"icon,omitempty"`
+	URL   string `json:"url,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+	Type  string `json:"type"` // "new_request", "device_status" or "security_event"
 }
 
 var Push *PushService
 
+// PushSubscriber is the VAPID contact push services can reach the admin at,
+// and PushTTL how many seconds they keep a notification for an offline browser
+var (
+	PushSubscriber = "admin@watchtower.local"
+	PushTTL        = 60
+)
+
 // InitPushService initializes the push notification service
 func InitPushService() error {
 	// Try to load existing VAPID keys
-	publicKey, err := models.GetAppConfig("vapid_public_key")
+	publicKey, err := store.Config.Get("vapid_public_key")
 	if err != nil {
-		// Generate new keys
-		privateKey, publicKey, err := webpush.GenerateVAPIDKeys()
+		// Generate new keys. Instances starting together on a new database
+		// keep the private key stored first and the public key that goes
+		// with it.
+		generated, _, err := webpush.GenerateVAPIDKeys()
 		if err != nil {
 			return err
 		}
-
-		if err := models.SetAppConfig("vapid_public_key", publicKey); err != nil {
+		privateKey, err := store.Config.SetDefault("vapid_private_key", generated)
+		if err != nil {
+			return err
+		}
+		if publicKey, err = vapidPublicKey(privateKey); err != nil {
 			return err
 		}
-		if err := models.SetAppConfig("vapid_private_key", privateKey); err != nil {
+		if publicKey, err = store.Config.SetDefault("vapid_public_key", publicKey); err != nil {
 			return err
 		}
 
@@ -48,11 +66,11 @@ func InitPushService() error {
 			vapidPublicKey:  publicKey,
 			vapidPrivateKey: privateKey,
 		}
-		log.Println("Generated new VAPID keys for push notifications")
+		slog.Info("Generated new VAPID keys for push notifications")
 		return nil
 	}
 
-	privateKey, err := models.GetAppConfig("vapid_private_key")
+	privateKey, err := store.Config.Get("vapid_private_key")
 	if err != nil {
 		return err
 	}
@@ -61,17 +79,31 @@ func InitPushService() error {
 		vapidPublicKey:  publicKey,
 		vapidPrivateKey: privateKey,
 	}
-	log.Println("Push notification service initialized")
+	slog.Info("Push notification service initialized")
 	return nil
 }
 
+// vapidPublicKey returns the public key of a VAPID private key, both
+// encoded the way webpush.GenerateVAPIDKeys encodes them
+func vapidPublicKey(privateKey string) (string, error) {
+	d, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", err
+	}
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
 // GetVAPIDPublicKey returns the public VAPID key for client subscription
 func (p *PushService) GetVAPIDPublicKey() string {
 	return p.vapidPublicKey
 }
 
 // SendNotification sends a push notification to a specific subscription
-func (p *PushService) SendNotification(sub *models.PushSubscription, payload NotificationPayload) error {
+func (p *PushService) SendNotification(ctx context.Context, sub *models.PushSubscription, payload NotificationPayload) error {
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
 		return err
@@ -86,30 +118,37 @@ func (p *PushService) SendNotification(sub *models.PushSubscription, payload Not
 	}
 
 	resp, err := webpush.SendNotification(payloadBytes, subscription, &webpush.Options{
-		Subscriber:      "admin@watchtower.local",
+		Subscriber:      PushSubscriber,
 		VAPIDPublicKey:  p.vapidPublicKey,
 		VAPIDPrivateKey: p.vapidPrivateKey,
-		TTL:             60,
+		TTL:             PushTTL,
 	})
 	if err != nil {
+		metrics.PushNotificationSent("failure")
 		return err
 	}
 	defer resp.Body.Close()
 
 	// If subscription is expired or invalid, remove it
-	if resp.StatusCode == 404 || resp.StatusCode == 410 {
-		log.Printf("Removing invalid push subscription: %s", sub.Endpoint)
-		models.DeletePushSubscription(sub.Endpoint)
+	switch {
+	case resp.StatusCode == 404 || resp.StatusCode == 410:
+		metrics.PushNotificationSent("expired")
+		slog.InfoContext(ctx, "Removing invalid push subscription", "endpoint", sub.Endpoint, "status", resp.StatusCode)
+		store.WithContext(ctx).PushSubscriptions.Delete(sub.Endpoint)
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		metrics.PushNotificationSent("success")
+	default:
+		metrics.PushNotificationSent("failure")
 	}
 
 	return nil
 }
 
 // NotifyNewRequest sends notifications for a new access request
-func (p *PushService) NotifyNewRequest(deviceName, url string) {
-	users, err := models.GetUsersForNotification("new_request")
+func (p *PushService) NotifyNewRequest(ctx context.Context, deviceName, url string) {
+	users, err := store.WithContext(ctx).Users.ListForNotification("new_request")
 	if err != nil {
-		log.Printf("Error getting users for notification: %v", err)
+		slog.ErrorContext(ctx, "Failed to get users for notification", "err", err)
 		return
 	}
 
@@ -122,14 +161,14 @@ func (p *PushService) NotifyNewRequest(deviceName, url string) {
 		Type:  "new_request",
 	}
 
-	p.sendToUsers(users, payload)
+	p.sendToUsers(ctx, users, payload)
 }
 
 // NotifyDeviceStatus sends notifications for device status changes
-func (p *PushService) NotifyDeviceStatus(deviceName, status string) {
-	users, err := models.GetUsersForNotification("device_status")
+func (p *PushService) NotifyDeviceStatus(ctx context.Context, deviceName, status string) {
+	users, err := store.WithContext(ctx).Users.ListForNotification("device_status")
 	if err != nil {
-		log.Printf("Error getting users for notification: %v", err)
+		slog.ErrorContext(ctx, "Failed to get users for notification", "err", err)
 		return
 	}
 
@@ -152,23 +191,68 @@ func (p *PushService) NotifyDeviceStatus(deviceName, status string) {
 		Type:  "device_status",
 	}
 
-	p.sendToUsers(users, payload)
+	p.sendToUsers(ctx, users, payload)
 }
 
-func (p *PushService) sendToUsers(users []models.User, payload NotificationPayload) {
+// NotifySecurityEvent sends notifications for tamper and bypass events
+func (p *PushService) NotifySecurityEvent(ctx context.Context, deviceName, title, body string) {
+	users, err := store.WithContext(ctx).Users.ListForNotification("security_event")
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get users for notification", "err", err)
+		return
+	}
+
+	payload := NotificationPayload{
+		Title: title,
+		Body:  body,
+		Icon:  "/admin/icon-192.png",
+		URL:   "/admin/#devices",
+		Tag:   "security-event-" + deviceName,
+		Type:  "security_event",
+	}
+
+	p.sendToUsers(ctx, users, payload)
+}
+
+// NotifyOutdatedDevices sends a list of devices running an extension older
+// than the required minimum
+func (p *PushService) NotifyOutdatedDevices(ctx context.Context, deviceNames []string, minVersion string) {
+	if len(deviceNames) == 0 {
+		return
+	}
+
+	users, err := store.WithContext(ctx).Users.ListForNotification("device_status")
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get users for notification", "err", err)
+		return
+	}
+
+	payload := NotificationPayload{
+		Title: "Extension Update Required",
+		Body:  fmt.Sprintf("%d device(s) need extension %s or newer: %s", len(deviceNames), minVersion, strings.Join(deviceNames, ", ")),
+		Icon:  "/admin/icon-192.png",
+		URL:   "/admin/#devices",
+		Tag:   "outdated-devices",
+		Type:  "device_status",
+	}
+
+	p.sendToUsers(ctx, users, payload)
+}
+
+func (p *PushService) sendToUsers(ctx context.Context, users []models.User, payload NotificationPayload) {
 	for _, user := range users {
-		subs, err := models.GetPushSubscriptionsByUser(user.ID)
+		subs, err := store.WithContext(ctx).PushSubscriptions.ListByUser(user.ID)
 		if err != nil {
-			log.Printf("Error getting subscriptions for user %d: %v", user.ID, err)
+			slog.ErrorContext(ctx, "Failed to get push subscriptions", "user_id", user.ID, "err", err)
 			continue
 		}
 
 		for _, sub := range subs {
-			go func(s models.PushSubscription) {
-				if err := p.SendNotification(&s, payload); err != nil {
-					log.Printf("Error sending push notification: %v", err)
+			RunBackground(func() {
+				if err := p.SendNotification(ctx, &sub, payload); err != nil {
+					slog.ErrorContext(ctx, "Failed to send push notification", "user_id", user.ID, "type", payload.Type, "err", err)
 				}
-			}(sub)
+			})
 		}
 	}
 }
@@ -179,4 +263,3 @@ func truncateURL(url string) string {
 	}
 	return url
 }
-
@@ -1,48 +1,197 @@
 package services
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
 	"time"
 
-	"github.com/watchtower/web/models"
+	"github.com/watchtower/web/logging"
+	"github.com/watchtower/web/metrics"
+	"github.com/watchtower/web/websocket"
+)
+
+// PatternChangeHook is called with a device's ID when the scheduler changes
+// the patterns it enforces, so the device can be sent the update
+var PatternChangeHook func(ctx context.Context, deviceID int64)
+
+// PolicyPushHook brings a device's connections on this instance up to its
+// current policy
+var PolicyPushHook func(ctx context.Context, deviceID int64)
+
+var (
+	schedulerStop = make(chan struct{})
+	schedulerJobs sync.WaitGroup
 )
 
 // StartScheduler starts background tasks
 func StartScheduler() {
 	// Check for inactive devices every 1 minute for responsive status updates
+	// (runs immediately on startup)
+	schedule("check_inactive_devices", 1*time.Minute, true, checkInactiveDevices)
+
+	// Record pattern expiry every 30 seconds so devices get removal deltas
+	schedule("record_expired_patterns", 30*time.Second, true, recordExpiredPatterns)
+
+	// Push connected devices up to their current policy every 30 seconds, in
+	// case a connection missed an update
+	schedule("reconcile_device_policies", 30*time.Second, false, reconcileDevicePolicies)
+
+	// Prune the pattern change log and old policy bundles every hour
+	schedule("prune", 1*time.Hour, true, func(ctx context.Context) {
+		pruneOldPatternChanges(ctx)
+		pruneOldPolicyBundles(ctx)
+	})
+
+	// Back up the database, if configured
+	if BackupDir != "" {
+		schedule("backup", BackupInterval, false, scheduledBackup)
+	}
+
+	// Replace the local CA's server certificate before it expires
+	if CA != nil {
+		schedule("renew_server_cert", 24*time.Hour, false, renewServerCert)
+	}
+
+	slog.Info("Background scheduler started")
+}
+
+// StopScheduler stops all background tasks and waits for running ones to
+// finish. It returns the context's error if they are still running when the
+// context is done.
+func StopScheduler(ctx context.Context) error {
+	close(schedulerStop)
+
+	done := make(chan struct{})
+	go func() {
+		schedulerJobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("Background scheduler stopped")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// schedule runs job every interval until the scheduler is stopped, and once
+// right away if runNow is set. Each run's duration is recorded under name,
+// and each run gets its own request ID so what it sets off can be traced.
+func schedule(name string, interval time.Duration, runNow bool, job func(ctx context.Context)) {
+	run := func() {
+		ctx := logging.WithRequestID(context.Background(), logging.NewRequestID())
+		start := time.Now()
+		job(ctx)
+		duration := time.Since(start)
+		metrics.ObserveSchedulerJob(name, duration)
+		slog.DebugContext(ctx, "Scheduler job finished", "job", name, "duration", duration)
+	}
+
+	schedulerJobs.Add(1)
 	go func() {
-		// Run immediately on startup
-		checkInactiveDevices()
-		
-		ticker := time.NewTicker(1 * time.Minute)
+		defer schedulerJobs.Done()
+
+		if runNow {
+			run()
+		}
+
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			checkInactiveDevices()
+		for {
+			select {
+			case <-ticker.C:
+				run()
+			case <-schedulerStop:
+				return
+			}
 		}
 	}()
-
-	log.Println("Background scheduler started")
 }
 
-// checkInactiveDevices marks devices inactive if no heartbeat for 2 minutes
-// WebSocket ping/pong happens every ~54 seconds, so 2 minutes gives some buffer
-func checkInactiveDevices() {
-	deviceNames, err := models.MarkInactiveDevices(2 * time.Minute)
+// DeviceInactiveAfter is how long a device can go without a heartbeat before
+// it is marked inactive. WebSocket ping/pong happens every ~54 seconds, so the
+// 2 minute default gives some buffer.
+var DeviceInactiveAfter = 2 * time.Minute
+
+// checkInactiveDevices marks devices inactive if no heartbeat for DeviceInactiveAfter
+func checkInactiveDevices(ctx context.Context) {
+	devices, err := store.WithContext(ctx).Devices.MarkInactive(DeviceInactiveAfter)
 	if err != nil {
-		log.Printf("Error marking inactive devices: %v", err)
+		slog.ErrorContext(ctx, "Failed to mark inactive devices", "err", err)
 		return
 	}
 
+	for _, device := range devices {
+		details, _ := json.Marshal(map[string]interface{}{"last_seen": device.LastSeen})
+		RecordServerEvent(ctx, device.ID, "heartbeat_lost", details)
+
+		PublishAdminEvent(ctx, "device_status", DeviceStatusEvent{
+			DeviceID:       device.ID,
+			DeviceName:     device.Name,
+			Status:         "inactive",
+			PreviousStatus: "active",
+			Reason:         "heartbeat_timeout",
+			ChangedAt:      time.Now().UTC(),
+		})
+	}
+
 	// Send notifications for newly inactive devices
 	if Push != nil {
-		for _, name := range deviceNames {
-			go Push.NotifyDeviceStatus(name, "inactive")
+		for _, device := range devices {
+			RunBackground(func() { Push.NotifyDeviceStatus(ctx, device.Name, "inactive") })
 		}
 	}
 
-	if len(deviceNames) > 0 {
-		log.Printf("Marked %d devices as inactive", len(deviceNames))
+	if len(devices) > 0 {
+		slog.InfoContext(ctx, "Marked devices inactive", "count", len(devices))
 	}
 }
 
+// recordExpiredPatterns logs the removal of expired patterns and notifies the
+// affected devices
+func recordExpiredPatterns(ctx context.Context) {
+	deviceIDs, err := store.WithContext(ctx).Patterns.RecordExpired()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record expired patterns", "err", err)
+		return
+	}
+
+	if PatternChangeHook != nil {
+		for _, deviceID := range deviceIDs {
+			RunBackground(func() { PatternChangeHook(ctx, deviceID) })
+		}
+	}
+}
+
+// pruneOldPatternChanges removes change log entries past the retention period
+func pruneOldPatternChanges(ctx context.Context) {
+	if err := store.WithContext(ctx).Patterns.PruneChanges(); err != nil {
+		slog.ErrorContext(ctx, "Failed to prune pattern changes", "err", err)
+	}
+}
+
+// pruneOldPolicyBundles forgets policy hashes whose bundles expired a while
+// ago, so devices still reporting them are flagged
+func pruneOldPolicyBundles(ctx context.Context) {
+	if err := store.WithContext(ctx).Patterns.PrunePolicyBundles(PolicyBundleTTL); err != nil {
+		slog.ErrorContext(ctx, "Failed to prune policy bundles", "err", err)
+	}
+}
+
+// reconcileDevicePolicies runs PolicyPushHook for every device connected to
+// this instance. Connections already at the current version are not sent
+// anything.
+func reconcileDevicePolicies(ctx context.Context) {
+	if PolicyPushHook == nil || websocket.DefaultHub == nil {
+		return
+	}
+
+	for _, deviceID := range websocket.DefaultHub.ConnectedDeviceIDs() {
+		PolicyPushHook(ctx, deviceID)
+	}
+}
@@ -0,0 +1,28 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStopSchedulerDeadline(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	schedule("slow", time.Hour, true, func(ctx context.Context) {
+		close(started)
+		<-release
+	})
+	<-started
+
+	// A job still running when the deadline passes doesn't hold shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := StopScheduler(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline", err)
+	}
+
+	close(release)
+	schedulerJobs.Wait()
+}
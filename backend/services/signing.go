@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/watchtower/web/models"
+)
+
+// Policies sent to extensions are signed with a server Ed25519 key, so an
+// extension can tell when its cached copy was edited. The signed statement
+// covers a hash of the patterns rather than the patterns themselves, which
+// lets deltas carry a new bundle without resending every pattern.
+
+const policySigningKeyConfigKey = "policy_signing_key"
+
+// PolicyBundleTTL is how long a signed policy is valid. Extensions refresh
+// it before it runs out.
+const PolicyBundleTTL = 7 * 24 * time.Hour
+
+// PolicyStatement is the signed content of a policy bundle
+type PolicyStatement struct {
+	DeviceID        int64     `json:"device_id"`
+	Version         int64     `json:"version"`
+	PolicyHash      string    `json:"policy_hash"`
+	UpgradeRequired bool      `json:"upgrade_required"`
+	IssuedAt        time.Time `json:"issued_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+}
+
+// PolicyBundle is a signed policy statement. Payload is the base64 JSON
+// statement and Signature the base64 Ed25519 signature of the decoded payload.
+type PolicyBundle struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+	KeyID     string `json:"key_id"`
+}
+
+// PolicySigner signs device policies
+type PolicySigner struct {
+	privateKey ed25519.PrivateKey
+	keyID      string
+}
+
+var Signer *PolicySigner
+
+// InitPolicySigner loads the policy signing key, generating it on first run.
+// Instances starting together on a new database all use the key stored first.
+func InitPolicySigner() error {
+	message := "Policy signing key loaded"
+	encoded, err := store.Config.Get(policySigningKeyConfigKey)
+	if err != nil {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		generated := base64.StdEncoding.EncodeToString(privateKey.Seed())
+		if encoded, err = store.Config.SetDefault(policySigningKeyConfigKey, generated); err != nil {
+			return err
+		}
+		if encoded == generated {
+			message = "Generated new policy signing key"
+		}
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return errors.New("invalid policy signing key")
+	}
+
+	Signer = newPolicySigner(ed25519.NewKeyFromSeed(seed))
+	slog.Info(message, "key_id", Signer.keyID)
+	return nil
+}
+
+func newPolicySigner(privateKey ed25519.PrivateKey) *PolicySigner {
+	sum := sha256.Sum256(privateKey.Public().(ed25519.PublicKey))
+	return &PolicySigner{privateKey: privateKey, keyID: hex.EncodeToString(sum[:8])}
+}
+
+// PublicKey returns the base64 raw Ed25519 public key
+func (s *PolicySigner) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(s.privateKey.Public().(ed25519.PublicKey))
+}
+
+// KeyID identifies the signing key in bundles
+func (s *PolicySigner) KeyID() string {
+	return s.keyID
+}
+
+// SignPolicy signs the patterns a device enforces at a version and records
+// the policy hash as issued to that device
+func (s *PolicySigner) SignPolicy(ctx context.Context, deviceID, version int64, patterns []models.Pattern, upgradeRequired bool) (*PolicyBundle, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	statement := PolicyStatement{
+		DeviceID:        deviceID,
+		Version:         version,
+		PolicyHash:      PolicyHash(patterns),
+		UpgradeRequired: upgradeRequired,
+		IssuedAt:        now,
+		ExpiresAt:       now.Add(PolicyBundleTTL),
+	}
+
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.WithContext(ctx).Patterns.RecordPolicyBundle(deviceID, version, statement.PolicyHash, statement.IssuedAt, statement.ExpiresAt); err != nil {
+		return nil, err
+	}
+
+	return &PolicyBundle{
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(s.privateKey, payload)),
+		KeyID:     s.keyID,
+	}, nil
+}
+
+// PolicyHash is the hex SHA-256 of the patterns sorted by ID (then pattern),
+// one per line as ID, type, pattern and RFC 3339 expiry separated by tabs.
+// Extensions compute the same hash over their cached patterns.
+func PolicyHash(patterns []models.Pattern) string {
+	sorted := make([]models.Pattern, len(patterns))
+	copy(sorted, patterns)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ID != sorted[j].ID {
+			return sorted[i].ID < sorted[j].ID
+		}
+		return sorted[i].Pattern < sorted[j].Pattern
+	})
+
+	var b strings.Builder
+	for _, p := range sorted {
+		expiresAt := ""
+		if p.ExpiresAt != nil {
+			expiresAt = p.ExpiresAt.Format(time.RFC3339Nano)
+		}
+		b.WriteString(strconv.FormatInt(p.ID, 10) + "\t" + p.Type + "\t" + p.Pattern + "\t" + expiresAt + "\n")
+	}
+
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckReportedPolicy records a policy_unknown event when a device reports
+// enforcing a policy hash the server never signed for it. Repeated reports of
+// the same hash are recorded once.
+func CheckReportedPolicy(ctx context.Context, device *models.Device, policyHash string) {
+	store := store.WithContext(ctx)
+	previous, err := store.Devices.SetReportedPolicyHash(device.ID, policyHash)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to store reported policy", "device_id", device.ID, "err", err)
+		return
+	}
+	if previous == policyHash {
+		return
+	}
+
+	known, err := store.Patterns.IsKnownPolicyHash(device.ID, policyHash)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to check reported policy", "device_id", device.ID, "err", err)
+		return
+	}
+	if known {
+		return
+	}
+
+	details, _ := json.Marshal(map[string]string{"policy_hash": policyHash})
+	rule := serverEventRules["policy_unknown"]
+	event, err := store.Events.Create(device.ID, "policy_unknown", rule.Severity, "server", details, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record device event", "device_id", device.ID, "type", "policy_unknown", "err", err)
+		return
+	}
+	applyEventRule(ctx, device, event, rule)
+}
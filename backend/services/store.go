@@ -0,0 +1,11 @@
+package services
+
+import "github.com/watchtower/web/models"
+
+// store is where services read and write their data, set once at startup
+var store *models.Store
+
+// SetStore sets the store used by the services
+func SetStore(s *models.Store) {
+	store = s
+}
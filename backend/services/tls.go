@@ -0,0 +1,489 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPS is served from configured certificate files, or from a server
+// certificate issued by a local CA generated on first start. Either way the
+// files are checked for changes, so a renewed certificate is picked up by new
+// connections without a restart.
+
+// certCheckInterval is how often the certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// CertReloader serves the certificate in a pair of PEM files, reloading it
+// when either file changes
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// TLSCert is the certificate being served, nil without HTTPS
+var TLSCert *CertReloader
+
+// NewCertReloader loads the certificate in certFile and keyFile
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := c.modified()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTime); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate is the tls.Config callback
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		c.reloadIfChanged()
+	}
+	return c.cert, nil
+}
+
+// Leaf returns the parsed certificate being served
+func (c *CertReloader) Leaf() *x509.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert.Leaf
+}
+
+// reloadIfChanged loads the files again if either was modified. A pair that
+// doesn't load, such as one caught halfway through being replaced, is tried
+// again at the next check while the current certificate stays in use.
+func (c *CertReloader) reloadIfChanged() {
+	modTime, err := c.modified()
+	if err != nil {
+		slog.Error("Failed to check TLS certificate", "err", err)
+		return
+	}
+	if modTime.Equal(c.modTime) {
+		return
+	}
+
+	if err := c.load(modTime); err != nil {
+		slog.Error("Failed to reload TLS certificate, keeping the current one", "err", err)
+		return
+	}
+	slog.Info("Reloaded TLS certificate", "file", c.certFile, "expires", c.cert.Leaf.NotAfter.Format(time.RFC3339))
+}
+
+// load reads the pair, which was last modified at modTime. c.mu must be held
+// or c not yet shared.
+func (c *CertReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// modified returns the later modification time of the two files
+func (c *CertReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ========== Local CA ==========
+
+const (
+	caCertFileName     = "ca.crt"
+	caKeyFileName      = "ca.key"
+	serverCertFileName = "server.crt"
+	serverKeyFileName  = "server.key"
+
+	caValidity = 10 * 365 * 24 * time.Hour
+	// Browsers refuse server certificates valid for longer than 398 days
+	serverCertValidity = 397 * 24 * time.Hour
+	// serverCertRenewBefore is how long before it expires the server
+	// certificate is replaced
+	serverCertRenewBefore = 30 * 24 * time.Hour
+)
+
+// LocalCA is a certificate authority generated for this server. Devices that
+// trust its certificate accept the server certificates it issues.
+type LocalCA struct {
+	dir   string
+	hosts []string
+	cert  *x509.Certificate
+	key   crypto.Signer
+}
+
+// CA is the local CA, nil unless it is enabled
+var CA *LocalCA
+
+// InitLocalCA loads the CA in dir, generating it on first start, and makes
+// sure its server certificate is current and covers this machine's names and
+// addresses plus hosts
+func InitLocalCA(dir string, hosts []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	ca := &LocalCA{dir: dir, hosts: hosts}
+	certPath, keyPath := ca.path(caCertFileName), ca.path(caKeyFileName)
+	if _, err := os.Stat(certPath); errors.Is(err, os.ErrNotExist) {
+		if err := ca.generate(); err != nil {
+			return fmt.Errorf("failed to generate local CA: %w", err)
+		}
+		slog.Info("Generated local CA", "file", certPath, "sha256_fingerprint", CertFingerprint(ca.cert))
+	} else {
+		if ca.cert, ca.key, err = loadCertAndKey(certPath, keyPath); err != nil {
+			return fmt.Errorf("failed to load local CA: %w", err)
+		}
+		slog.Info("Local CA loaded", "file", certPath, "sha256_fingerprint", CertFingerprint(ca.cert))
+		if len(ca.cert.PermittedDNSDomains) == 0 && len(ca.cert.PermittedIPRanges) == 0 {
+			slog.Warn("Local CA is not limited to this server's names; devices trusting it accept any site it signs. Remove its files from the TLS directory to generate a limited one, then install it on devices again", "dir", dir)
+		}
+	}
+
+	if err := ca.RenewServerCert(); err != nil {
+		return err
+	}
+	CA = ca
+	return nil
+}
+
+// ServerCertFiles returns the paths of the server certificate and its key
+func (ca *LocalCA) ServerCertFiles() (string, string) {
+	return ca.path(serverCertFileName), ca.path(serverKeyFileName)
+}
+
+// Certificate returns the CA certificate
+func (ca *LocalCA) Certificate() *x509.Certificate {
+	return ca.cert
+}
+
+// CertificatePEM returns the CA certificate for devices to install
+func (ca *LocalCA) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// RenewServerCert issues a new server certificate if the current one is
+// missing, close to expiring, not from this CA or lacking a name or address
+// the server now has. A running server picks it up through its CertReloader.
+func (ca *LocalCA) RenewServerCert() error {
+	names, ips := ca.serverNames()
+
+	certPath, keyPath := ca.ServerCertFiles()
+	current, _, err := loadCertAndKey(certPath, keyPath)
+	if err == nil {
+		reason := ""
+		switch {
+		case time.Until(current.NotAfter) < serverCertRenewBefore:
+			reason = "it expires " + current.NotAfter.Format("2006-01-02")
+		case current.CheckSignatureFrom(ca.cert) != nil:
+			reason = "it was not issued by the local CA"
+		default:
+			reason = missingName(current, names, ips)
+		}
+		if reason == "" {
+			return nil
+		}
+		slog.Info("Renewing TLS server certificate", "reason", reason)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Replacing unreadable TLS server certificate", "err", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0], Organization: []string{"Watchtower"}},
+		DNSNames:     names,
+		IPAddresses:  ips,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(serverCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return err
+	}
+
+	// The key is written first: the reloader retries until the pair matches
+	if err := writeKey(keyPath, key); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	slog.Info("Issued TLS server certificate", "names", strings.Join(append(names, ipStrings(ips)...), ", "))
+	if outside := ca.unpermittedNames(names, ips); len(outside) > 0 {
+		slog.Warn("Devices will reject the TLS server certificate for names the local CA doesn't cover; remove the CA's files from the TLS directory to generate one that does, then install it on devices again", "names", strings.Join(outside, ", "))
+	}
+	return nil
+}
+
+// unpermittedNames returns the names and addresses outside the CA's name
+// constraints
+func (ca *LocalCA) unpermittedNames(names []string, ips []net.IP) []string {
+	var outside []string
+	if len(ca.cert.PermittedDNSDomains) > 0 {
+		for _, name := range names {
+			if !permittedDNSName(ca.cert.PermittedDNSDomains, name) {
+				outside = append(outside, name)
+			}
+		}
+	}
+	if len(ca.cert.PermittedIPRanges) > 0 {
+		for _, ip := range ips {
+			if !permittedIP(ca.cert.PermittedIPRanges, ip) {
+				outside = append(outside, ip.String())
+			}
+		}
+	}
+	return outside
+}
+
+// permittedDNSName reports whether name is one of domains or below one
+func permittedDNSName(domains []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func permittedIP(ranges []*net.IPNet, ip net.IP) bool {
+	for _, r := range ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// renewServerCert is the scheduler job for the local CA
+func renewServerCert(ctx context.Context) {
+	if err := CA.RenewServerCert(); err != nil {
+		slog.ErrorContext(ctx, "Failed to renew TLS server certificate", "err", err)
+	}
+}
+
+func (ca *LocalCA) generate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	// Devices trust the CA as a root, so it may only vouch for this server:
+	// anyone who got hold of its key could otherwise impersonate any site
+	names, ips := ca.serverNames()
+	var ranges []*net.IPNet
+	for _, ip := range ips {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:                serial,
+		Subject:                     pkix.Name{CommonName: "Watchtower Local CA " + hostname, Organization: []string{"Watchtower"}},
+		NotBefore:                   now.Add(-time.Hour),
+		NotAfter:                    now.Add(caValidity),
+		KeyUsage:                    x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid:       true,
+		IsCA:                        true,
+		MaxPathLenZero:              true,
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         names,
+		PermittedIPRanges:           ranges,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	if err := writeKey(ca.path(caKeyFileName), key); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(ca.path(caCertFileName), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	ca.cert, ca.key = cert, key
+	return nil
+}
+
+// serverNames returns the DNS names and IP addresses the server certificate
+// should cover: localhost, the hostname, this machine's addresses and the
+// configured hosts
+func (ca *LocalCA) serverNames() ([]string, []net.IP) {
+	names := []string{"localhost"}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		names = append(names, hostname)
+		// mDNS name, which is how home networks usually reach a machine
+		if !strings.Contains(hostname, ".") {
+			names = append(names, hostname+".local")
+		}
+	}
+
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+
+	for _, host := range ca.hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, host)
+		}
+	}
+	return names, ips
+}
+
+// missingName describes the first name or address cert doesn't cover, or
+// returns "" if it covers them all
+func missingName(cert *x509.Certificate, names []string, ips []net.IP) string {
+	for _, name := range names {
+		if cert.VerifyHostname(name) != nil {
+			return name + " is not in it"
+		}
+	}
+	for _, ip := range ips {
+		if cert.VerifyHostname(ip.String()) != nil {
+			return ip.String() + " is not in it"
+		}
+	}
+	return ""
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of a certificate, written
+// the way browsers and operating systems show it
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+func (ca *LocalCA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+func loadCertAndKey(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("unsupported private key type")
+	}
+	return cert, key, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// writeFileAtomic replaces path with data, so readers never see half a file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func ipStrings(ips []net.IP) []string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return s
+}
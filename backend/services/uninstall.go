@@ -0,0 +1,140 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uninstall nonces let the extension's uninstall URL mark its device as
+// uninstalled without putting the device token in the URL. A nonce is
+// "<payload>.<signature>" where the payload is the device ID, the issue time
+// and random bytes, and the signature is an HMAC over the "uninstall" purpose,
+// the payload and the hash of the device's token. Regenerating the token
+// revokes the nonce, as it did when the token was in the URL; a nonce stays
+// valid for a previous token during its grace period.
+const uninstallNoncePurpose = "uninstall"
+
+const uninstallPayloadLength = 8 + 8 + 16
+
+var ErrInvalidNonce = errors.New("invalid nonce")
+
+var (
+	uninstallKey   []byte
+	uninstallKeyMu sync.Mutex
+)
+
+// getUninstallKey loads the HMAC key from app config, generating it on first
+// use unless another instance stored one first
+func getUninstallKey(ctx context.Context) ([]byte, error) {
+	uninstallKeyMu.Lock()
+	defer uninstallKeyMu.Unlock()
+
+	if uninstallKey != nil {
+		return uninstallKey, nil
+	}
+
+	store := store.WithContext(ctx)
+	value, err := store.Config.Get("uninstall_signing_key")
+	if err != nil {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if value, err = store.Config.SetDefault("uninstall_signing_key", hex.EncodeToString(key)); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	uninstallKey = key
+	return uninstallKey, nil
+}
+
+func signUninstallPayload(key, payload []byte, tokenHash string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(uninstallNoncePurpose))
+	mac.Write(payload)
+	mac.Write([]byte(tokenHash))
+	return mac.Sum(nil)
+}
+
+// CreateUninstallNonce returns a signed nonce that can only be used to mark
+// the given device as uninstalled, until its token is regenerated
+func CreateUninstallNonce(ctx context.Context, deviceID int64) (string, error) {
+	key, err := getUninstallKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	hashes, err := store.WithContext(ctx).Devices.TokenHashes(deviceID)
+	if err != nil {
+		return "", err
+	}
+
+	payload := make([]byte, uninstallPayloadLength)
+	binary.BigEndian.PutUint64(payload, uint64(deviceID))
+	binary.BigEndian.PutUint64(payload[8:], uint64(time.Now().Unix()))
+	if _, err := rand.Read(payload[16:]); err != nil {
+		return "", err
+	}
+
+	signature := signUninstallPayload(key, payload, hashes[0])
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// VerifyUninstallNonce checks an uninstall nonce against the tokens its
+// device currently accepts and returns the device ID it was issued for. A
+// nonce issued before the device was created belongs to a deleted device
+// whose ID was reused.
+func VerifyUninstallNonce(ctx context.Context, nonce string) (int64, error) {
+	key, err := getUninstallKey(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	encodedPayload, encodedSignature, ok := strings.Cut(nonce, ".")
+	if !ok {
+		return 0, ErrInvalidNonce
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil || len(payload) != uninstallPayloadLength {
+		return 0, ErrInvalidNonce
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return 0, ErrInvalidNonce
+	}
+
+	deviceID := int64(binary.BigEndian.Uint64(payload))
+	issuedAt := time.Unix(int64(binary.BigEndian.Uint64(payload[8:])), 0)
+
+	store := store.WithContext(ctx)
+	device, err := store.Devices.GetByID(deviceID)
+	if err != nil || device.CreatedAt.Truncate(time.Second).After(issuedAt) {
+		return 0, ErrInvalidNonce
+	}
+	hashes, err := store.Devices.TokenHashes(deviceID)
+	if err != nil {
+		return 0, ErrInvalidNonce
+	}
+
+	for _, hash := range hashes {
+		if hmac.Equal(signature, signUninstallPayload(key, payload, hash)) {
+			return deviceID, nil
+		}
+	}
+	return 0, ErrInvalidNonce
+}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/watchtower/web/models"
+)
+
+const minExtensionVersionKey = "min_extension_version"
+
+// Hosts that stay reachable under the restrictive policy so an out-of-date
+// extension can still be updated
+var extensionUpdateHosts = []string{
+	"chromewebstore.google.com/*",
+	"chrome.google.com/webstore/*",
+	"clients2.google.com/*",
+}
+
+var ErrInvalidVersion = errors.New("invalid version")
+
+// ParseVersion splits a dotted version like "1.2.3" into its numeric parts
+func ParseVersion(version string) ([]int, error) {
+	if version == "" {
+		return nil, ErrInvalidVersion
+	}
+
+	fields := strings.Split(version, ".")
+	parts := make([]int, len(fields))
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return nil, ErrInvalidVersion
+		}
+		parts[i] = n
+	}
+	return parts, nil
+}
+
+// CompareVersions returns -1, 0 or 1 depending on whether a is older than,
+// equal to or newer than b. Missing parts count as zero.
+func CompareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+// GetMinExtensionVersion returns the configured minimum extension version, or
+// "" if none is enforced
+func GetMinExtensionVersion(ctx context.Context) string {
+	version, err := store.WithContext(ctx).Config.Get(minExtensionVersionKey)
+	if err != nil {
+		return ""
+	}
+	return version
+}
+
+// SetMinExtensionVersion changes the enforced minimum. An empty version turns
+// enforcement off.
+func SetMinExtensionVersion(ctx context.Context, version string) error {
+	if version != "" {
+		if _, err := ParseVersion(version); err != nil {
+			return err
+		}
+	}
+	return store.WithContext(ctx).Config.Set(minExtensionVersionKey, version)
+}
+
+// IsDeviceOutdated reports whether a device runs an extension older than the
+// configured minimum. Devices that haven't reported a version yet are not
+// considered outdated, and neither are unparseable versions.
+func IsDeviceOutdated(ctx context.Context, device *models.Device) bool {
+	if device.Inventory == nil || device.Inventory.ExtensionVersion == "" {
+		return false
+	}
+	return isVersionOutdated(device.Inventory.ExtensionVersion, GetMinExtensionVersion(ctx))
+}
+
+func isVersionOutdated(version, minVersion string) bool {
+	if minVersion == "" {
+		return false
+	}
+	min, err := ParseVersion(minVersion)
+	if err != nil {
+		return false
+	}
+	current, err := ParseVersion(version)
+	if err != nil {
+		return false
+	}
+	return CompareVersions(current, min) < 0
+}
+
+// ListOutdatedDevices returns the devices running an extension older than the
+// configured minimum
+func ListOutdatedDevices(ctx context.Context) ([]models.Device, error) {
+	devices, err := store.WithContext(ctx).Devices.List()
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion := GetMinExtensionVersion(ctx)
+	var outdated []models.Device
+	for _, device := range devices {
+		if device.Inventory != nil && isVersionOutdated(device.Inventory.ExtensionVersion, minVersion) {
+			outdated = append(outdated, device)
+		}
+	}
+	return outdated, nil
+}
+
+// GetDevicePolicy returns the patterns a device should enforce. Out-of-date
+// devices get a restrictive fallback: only their allow patterns and the
+// extension update hosts are reachable, everything else is blocked.
+func GetDevicePolicy(ctx context.Context, deviceID int64) ([]models.Pattern, bool, error) {
+	store := store.WithContext(ctx)
+	patterns, err := store.Patterns.ListByDevice(deviceID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	device, err := store.Devices.GetByID(deviceID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !IsDeviceOutdated(ctx, device) {
+		return patterns, false, nil
+	}
+
+	// Any allow pattern puts the extension in allow-list mode
+	for _, host := range extensionUpdateHosts {
+		patterns = append(patterns, models.Pattern{
+			DeviceID: deviceID,
+			Pattern:  host,
+			Type:     "allow",
+			Enabled:  true,
+		})
+	}
+	return patterns, true, nil
+}
@@ -15,7 +15,10 @@ let requests = [];
 let users = [];
 let pushSupported = false;
 let pushSubscription = null;
-let notificationPrefs = { notify_new_requests: true, notify_device_status: true };
+let notificationPrefs = { notify_new_requests: true, notify_device_status: true, notify_security_events: true };
+let eventSocket = null;
+let eventReconnectDelay = 1000;
+const pendingReloads = {};
 
 // ========================================
 // DOM Elements
@@ -102,6 +105,7 @@ function showSetupScreen() {
 }
 
 function showLoginScreen() {
+    disconnectEventStream();
     $('#setup-screen').classList.add('hidden');
     $('#login-screen').classList.remove('hidden');
     $('#dashboard').classList.add('hidden');
@@ -112,7 +116,9 @@ function showDashboard() {
     $('#login-screen').classList.add('hidden');
     $('#dashboard').classList.remove('hidden');
     loadAllData();
+    loadTLSInfo();
     initPushNotifications();
+    connectEventStream();
 }
 
 async function login(username, password) {
@@ -218,6 +224,87 @@ async function loadUsers() {
     }
 }
 
+// ========================================
+// Live Events
+// ========================================
+
+// The server pushes new and resolved requests, device status changes and
+// pattern changes, including those made by other admins
+function connectEventStream() {
+    if (eventSocket) {
+        return;
+    }
+    
+    const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    const socket = new WebSocket(`${protocol}//${location.host}${API_BASE}/admin/ws`);
+    eventSocket = socket;
+    
+    socket.onopen = () => {
+        eventReconnectDelay = 1000;
+        // Catch up on anything missed while disconnected
+        loadAllData();
+    };
+    
+    socket.onmessage = (event) => {
+        // Messages queued together arrive in one frame, one per line
+        for (const line of event.data.split('\n')) {
+            if (line) {
+                handleAdminEvent(JSON.parse(line));
+            }
+        }
+    };
+    
+    socket.onclose = () => {
+        if (eventSocket !== socket) {
+            return;
+        }
+        eventSocket = null;
+        
+        // Reconnect with backoff while the dashboard is open
+        if (!$('#dashboard').classList.contains('hidden')) {
+            setTimeout(connectEventStream, eventReconnectDelay);
+            eventReconnectDelay = Math.min(eventReconnectDelay * 2, 30000);
+        }
+    };
+}
+
+function disconnectEventStream() {
+    if (eventSocket) {
+        const socket = eventSocket;
+        eventSocket = null;
+        socket.close();
+    }
+}
+
+function handleAdminEvent(event) {
+    const data = event.data || {};
+    
+    switch (event.type) {
+        case 'request_created':
+            showToast(`New request from ${data.request.device_name || 'a device'}`);
+            scheduleReload('requests', loadRequests);
+            break;
+        case 'request_resolved':
+            scheduleReload('requests', loadRequests);
+            break;
+        case 'device_status':
+            scheduleReload('devices', loadDevices);
+            break;
+        case 'pattern_changed':
+            scheduleReload('patterns', loadPatterns);
+            break;
+    }
+}
+
+// Coalesce bursts of events into one reload per list
+function scheduleReload(name, load) {
+    clearTimeout(pendingReloads[name]);
+    pendingReloads[name] = setTimeout(() => {
+        delete pendingReloads[name];
+        load();
+    }, 300);
+}
+
 function updatePendingBadge() {
     const pendingCount = requests.filter(r => r.status === 'pending').length;
     const badge = $('#pending-badge');
@@ -376,7 +463,10 @@ function renderDevices() {
     container.innerHTML = devices.map(d => {
         const statusClass = d.status || 'active';
         const statusIcon = getDeviceStatusIcon(statusClass);
-        const lastSeenText = d.last_seen ? `Last seen ${formatDate(d.last_seen)}` : 'Never connected';
+        const presence = d.presence || {};
+        const lastSeenText = presence.connected
+            ? `Online, connected ${formatDate(presence.connected_since).toLowerCase()}${presence.connections > 1 ? ` (${presence.connections} connections)` : ''}${presence.remote_addrs?.length ? ` from ${presence.remote_addrs.join(', ')}` : ''}`
+            : (d.last_seen ? `Last seen ${formatDate(d.last_seen)}` : 'Never connected');
         
         return `
             <div class="card device-card" data-id="${d.id}">
@@ -396,10 +486,33 @@ function renderDevices() {
                             </span>
                         </h4>
                         <p>${lastSeenText}</p>
+                        ${d.token_prefix ? `<p style="font-size: 0.75rem; color: var(--text-muted);">Token <code style="font-family: var(--font-mono);">${escapeHtml(d.token_prefix)}…</code>${d.previous_token_expires_at ? ` (previous token valid until ${new Date(d.previous_token_expires_at).toLocaleString()})` : ''}</p>` : ''}
+                        ${d.inventory ? `<p style="font-size: 0.75rem; color: var(--text-muted);">${escapeHtml(formatInventory(d.inventory))}</p>` : ''}
                         <p style="font-size: 0.75rem; color: var(--text-muted);">Created ${formatDate(d.created_at)}</p>
                     </div>
                 </div>
                 <div class="card-actions">
+                    <button class="btn btn-secondary btn-small" onclick="createEnrollmentCode(${d.id}, '${escapeHtml(d.name)}')">
+                        <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                            <path d="M10 13a5 5 0 007.54.54l3-3a5 5 0 00-7.07-7.07l-1.72 1.71"/>
+                            <path d="M14 11a5 5 0 00-7.54-.54l-3 3a5 5 0 007.07 7.07l1.71-1.71"/>
+                        </svg>
+                        Pair
+                    </button>
+                    <button class="btn btn-secondary btn-small" onclick="showDeviceTimeline(${d.id}, '${escapeHtml(d.name)}')">
+                        <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                            <circle cx="12" cy="12" r="10"/>
+                            <polyline points="12 6 12 12 16 14"/>
+                        </svg>
+                        Timeline
+                    </button>
+                    <button class="btn btn-secondary btn-small" onclick="showDeviceCommands(${d.id}, '${escapeHtml(d.name)}')">
+                        <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                            <polyline points="4 17 10 11 4 5"/>
+                            <line x1="12" y1="19" x2="20" y2="19"/>
+                        </svg>
+                        Commands
+                    </button>
                     <button class="btn btn-secondary btn-small" onclick="regenerateDeviceToken(${d.id}, '${escapeHtml(d.name)}')">
                         <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
                             <path d="M23 4v6h-6M1 20v-6h6"/>
@@ -697,13 +810,14 @@ function showEditPatternModal(patternId) {
 }
 
 async function regenerateDeviceToken(deviceId, deviceName) {
-    if (!confirm(`Are you sure you want to regenerate the token for "${deviceName}"?\n\nThe old token will stop working immediately. You will need to update the extension configuration with the new token.`)) {
+    if (!confirm(`Are you sure you want to regenerate the token for "${deviceName}"?\n\nThe old token keeps working for 24 hours. A connected extension picks up the new token automatically; otherwise you will need to update the extension configuration with the new token.`)) {
         return;
     }
     
     try {
         const device = await api(`/admin/devices/${deviceId}/regenerate-token`, {
-            method: 'POST'
+            method: 'POST',
+            body: JSON.stringify({ immediate: false })
         });
         
         showModal('New Token Generated', `
@@ -731,6 +845,214 @@ async function regenerateDeviceToken(deviceId, deviceName) {
     }
 }
 
+async function showDeviceTimeline(deviceId, deviceName) {
+    try {
+        const data = await api(`/admin/devices/${deviceId}/events?limit=50`);
+        const events = data.events || [];
+        
+        const rows = events.length === 0
+            ? '<p style="color: var(--text-muted);">No security events recorded.</p>'
+            : events.map(e => `
+                <div style="display: flex; gap: 0.75rem; padding: 0.5rem 0; border-bottom: 1px solid var(--border-color);">
+                    ${getEventSeverityIcon(e.severity)}
+                    <div style="flex: 1;">
+                        <div>${escapeHtml(formatEventType(e.type))}</div>
+                        <div style="font-size: 0.75rem; color: var(--text-muted);">
+                            ${formatDate(e.created_at)} · ${e.source === 'server' ? 'detected by server' : 'reported by extension'}
+                        </div>
+                    </div>
+                </div>
+            `).join('');
+        
+        showModal(`Security Timeline: ${escapeHtml(deviceName)}`, `
+            <div style="max-height: 60vh; overflow-y: auto; margin-bottom: 1rem;">${rows}</div>
+            <div class="modal-actions">
+                <button type="button" class="btn btn-primary" onclick="hideModal()">Close</button>
+            </div>
+        `);
+    } catch (error) {
+        showToast('Failed to load timeline', 'error');
+    }
+}
+
+async function showDeviceCommands(deviceId, deviceName) {
+    let commands;
+    try {
+        const data = await api(`/admin/devices/${deviceId}/commands?limit=20`);
+        commands = data.commands || [];
+    } catch (error) {
+        showToast('Failed to load commands', 'error');
+        return;
+    }
+    
+    const rows = commands.length === 0
+        ? '<p style="color: var(--text-muted);">No commands sent yet.</p>'
+        : commands.map(c => `
+            <div style="display: flex; justify-content: space-between; gap: 0.75rem; padding: 0.5rem 0; border-bottom: 1px solid var(--border-color);">
+                <div>
+                    <div>${escapeHtml(formatCommand(c))}</div>
+                    <div style="font-size: 0.75rem; color: var(--text-muted);">${formatDate(c.created_at)}${c.error ? ` · ${escapeHtml(c.error)}` : ''}</div>
+                </div>
+                <span style="font-size: 0.75rem; color: var(--text-muted);">${escapeHtml(c.status)}</span>
+            </div>
+        `).join('');
+    
+    showModal(`Commands: ${escapeHtml(deviceName)}`, `
+        <form id="command-form">
+            <div class="form-group">
+                <label for="command-type">Command</label>
+                <select id="command-type" class="select" style="width: 100%;">
+                    <option value="resync">Force pattern resync</option>
+                    <option value="show_message">Show a message</option>
+                    <option value="close_tabs">Close tabs matching a pattern</option>
+                    <option value="lock">Lock the browser</option>
+                </select>
+            </div>
+            <div class="form-group hidden" id="command-message-group">
+                <label for="command-message">Message</label>
+                <input type="text" id="command-message" maxlength="500" placeholder="e.g., Time for dinner">
+            </div>
+            <div class="form-group hidden" id="command-pattern-group">
+                <label for="command-pattern">Pattern</label>
+                <input type="text" id="command-pattern" placeholder="e.g., youtube.com/*">
+            </div>
+            <div class="form-group hidden" id="command-minutes-group">
+                <label for="command-minutes">Minutes</label>
+                <input type="number" id="command-minutes" min="1" max="1440" value="30">
+            </div>
+            <div class="modal-actions">
+                <button type="button" class="btn btn-secondary" onclick="hideModal()">Close</button>
+                <button type="submit" class="btn btn-primary">Send</button>
+            </div>
+        </form>
+        <div style="max-height: 40vh; overflow-y: auto; margin-top: 1rem;">${rows}</div>
+    `);
+    
+    const updateFields = () => {
+        const type = $('#command-type').value;
+        $('#command-message-group').classList.toggle('hidden', type !== 'show_message');
+        $('#command-pattern-group').classList.toggle('hidden', type !== 'close_tabs');
+        $('#command-minutes-group').classList.toggle('hidden', type !== 'lock');
+    };
+    $('#command-type').onchange = updateFields;
+    
+    $('#command-form').onsubmit = async (e) => {
+        e.preventDefault();
+        const type = $('#command-type').value;
+        const params = {};
+        if (type === 'show_message') params.message = $('#command-message').value;
+        if (type === 'close_tabs') params.pattern = $('#command-pattern').value;
+        if (type === 'lock') params.minutes = parseInt($('#command-minutes').value, 10);
+        
+        try {
+            const command = await api(`/admin/devices/${deviceId}/commands`, {
+                method: 'POST',
+                body: JSON.stringify({ type, params })
+            });
+            showToast(command.status === 'pending' ? 'Device offline, command queued' : 'Command sent', 'success');
+            showDeviceCommands(deviceId, deviceName);
+        } catch (error) {
+            showToast('Failed to send command', 'error');
+        }
+    };
+}
+
+function formatCommand(command) {
+    const params = command.params || {};
+    switch (command.type) {
+        case 'resync':
+            return 'Force pattern resync';
+        case 'show_message':
+            return `Show message "${params.message}"`;
+        case 'close_tabs':
+            return `Close tabs matching ${params.pattern}`;
+        case 'lock':
+            return `Lock for ${params.minutes} minutes`;
+        default:
+            return command.type;
+    }
+}
+
+function formatInventory(inv) {
+    const parts = [];
+    if (inv.browser_name) parts.push(`${inv.browser_name} ${inv.browser_version || ''}`.trim());
+    if (inv.os) parts.push(inv.os);
+    if (inv.extension_version) parts.push(`extension ${inv.extension_version}`);
+    if (inv.profile_email) parts.push(inv.profile_email);
+    if (inv.timezone) parts.push(inv.timezone);
+    return parts.join(' · ');
+}
+
+function getEventSeverityIcon(severity) {
+    switch (severity) {
+        case 'critical':
+            return '<span style="color: var(--accent-danger);">●</span>';
+        case 'warning':
+            return '<span style="color: var(--accent-warning);">●</span>';
+        default:
+            return '<span style="color: var(--text-muted);">●</span>';
+    }
+}
+
+function formatEventType(type) {
+    const labels = {
+        extension_disabled: 'Extension disabled',
+        extension_enabled: 'Extension re-enabled',
+        incognito_access_revoked: 'Incognito access revoked',
+        incognito_access_granted: 'Incognito access granted',
+        config_changed: 'Configuration changed',
+        clock_skew: 'Clock skew detected',
+        policy_tampered: 'Cached policy modified',
+        heartbeat_lost: 'Heartbeat lost',
+        uninstalled: 'Extension uninstalled',
+        profile_changed: 'Browser profile changed',
+        policy_unknown: 'Unknown policy reported'
+    };
+    return labels[type] || type;
+}
+
+async function createEnrollmentCode(deviceId, deviceName) {
+    try {
+        const enrollment = await api(`/admin/devices/${deviceId}/enrollments`, {
+            method: 'POST',
+            body: JSON.stringify({ ttl_minutes: 15 })
+        });
+        
+        const code = enrollment.code.slice(0, 4) + '-' + enrollment.code.slice(4);
+        
+        showModal('Pair Device', `
+            <p style="margin-bottom: 1rem; color: var(--text-secondary);">
+                Enter this code in the extension popup on "${escapeHtml(deviceName)}" in place of the device token.
+            </p>
+            <div style="background: var(--bg-tertiary); padding: 1rem; border-radius: var(--radius-sm); margin-bottom: 1rem; text-align: center;">
+                <code style="font-family: var(--font-mono); font-size: 1.5rem; letter-spacing: 0.2em; color: var(--accent-primary);">
+                    ${escapeHtml(code)}
+                </code>
+            </div>
+            <p style="color: var(--text-muted); font-size: 0.85rem;">
+                The code can be used once and expires ${formatDate(enrollment.expires_at)}. Pairing replaces the device's current token.
+            </p>
+            <div class="modal-actions">
+                <button type="button" class="btn btn-danger" onclick="revokeEnrollment(${enrollment.id})">Revoke Code</button>
+                <button type="button" class="btn btn-secondary" onclick="copyToken('${code}')">Copy Code</button>
+                <button type="button" class="btn btn-primary" onclick="hideModal()">Done</button>
+            </div>
+        `);
+    } catch (error) {
+        showToast('Failed to create enrollment code', 'error');
+    }
+}
+
+async function revokeEnrollment(enrollmentId) {
+    try {
+        await api(`/admin/enrollments/${enrollmentId}`, { method: 'DELETE' });
+        hideModal();
+        showToast('Enrollment code revoked');
+    } catch (error) {
+        showToast('Failed to revoke enrollment code', 'error');
+    }
+}
+
 async function deleteDevice(deviceId) {
     if (!confirm('Are you sure you want to delete this device? All associated patterns will also be deleted.')) return;
     
@@ -744,6 +1066,53 @@ async function deleteDevice(deviceId) {
     }
 }
 
+async function showExtensionVersionModal() {
+    let policy;
+    try {
+        policy = await api('/admin/extension-version');
+    } catch (error) {
+        showToast('Failed to load extension version policy', 'error');
+        return;
+    }
+    
+    const outdated = policy.outdated_devices.map(d =>
+        `<li>${escapeHtml(d.name)} (${escapeHtml(d.inventory?.extension_version || 'unknown')})</li>`
+    ).join('');
+    
+    showModal('Minimum Extension Version', `
+        <form id="extension-version-form">
+            <div class="form-group">
+                <label for="min-extension-version">Minimum Version</label>
+                <input type="text" id="min-extension-version" placeholder="e.g., 1.2.0 (leave empty to disable)" value="${escapeHtml(policy.min_version)}">
+            </div>
+            <p style="margin-bottom: 1rem; color: var(--text-secondary); font-size: 0.85rem;">
+                Devices below this version only reach their allowed sites and the Chrome Web Store until they update.
+            </p>
+            ${outdated ? `<p style="margin-bottom: 0.5rem;">Out-of-date devices:</p><ul style="margin: 0 0 1rem 1.25rem; color: var(--text-secondary);">${outdated}</ul>` : ''}
+            <div class="modal-actions">
+                <button type="button" class="btn btn-secondary" onclick="hideModal()">Cancel</button>
+                <button type="submit" class="btn btn-primary">Save</button>
+            </div>
+        </form>
+    `);
+    
+    $('#extension-version-form').onsubmit = async (e) => {
+        e.preventDefault();
+        const minVersion = $('#min-extension-version').value.trim();
+        
+        try {
+            const result = await api('/admin/extension-version', {
+                method: 'PUT',
+                body: JSON.stringify({ min_version: minVersion })
+            });
+            hideModal();
+            showToast(minVersion ? `${result.outdated_devices.length} device(s) below ${minVersion}` : 'Minimum version disabled', 'success');
+        } catch (error) {
+            showToast('Failed to update minimum version', 'error');
+        }
+    };
+}
+
 function showAddDeviceModal() {
     showModal('Add Device', `
         <form id="add-device-form">
@@ -1141,17 +1510,22 @@ async function unsubscribePush() {
     }
 }
 
-async function updateNotificationPrefs(notifyNewRequests, notifyDeviceStatus) {
+async function updateNotificationPrefs(notifyNewRequests, notifyDeviceStatus, notifySecurityEvents) {
     try {
         await api('/admin/notifications/prefs', {
             method: 'PUT',
             body: JSON.stringify({
                 notify_new_requests: notifyNewRequests,
-                notify_device_status: notifyDeviceStatus
+                notify_device_status: notifyDeviceStatus,
+                notify_security_events: notifySecurityEvents
             })
         });
         
-        notificationPrefs = { notify_new_requests: notifyNewRequests, notify_device_status: notifyDeviceStatus };
+        notificationPrefs = {
+            notify_new_requests: notifyNewRequests,
+            notify_device_status: notifyDeviceStatus,
+            notify_security_events: notifySecurityEvents
+        };
         showToast('Notification preferences updated');
     } catch (error) {
         showToast('Failed to update preferences', 'error');
@@ -1225,6 +1599,58 @@ function showChangePasswordModal() {
     };
 }
 
+// ========================================
+// HTTPS Certificate
+// ========================================
+
+let tlsInfo = null;
+
+async function loadTLSInfo() {
+    try {
+        tlsInfo = await api('/admin/tls');
+    } catch (error) {
+        tlsInfo = null;
+    }
+    // Only a local CA needs installing on devices
+    $('#certificate-btn').classList.toggle('hidden', !tlsInfo?.local_ca);
+}
+
+function showCertificateModal() {
+    const ca = tlsInfo.local_ca;
+    const cert = tlsInfo.certificate;
+    const names = [...(cert?.dns_names || []), ...(cert?.ip_addresses || [])];
+    
+    showModal('HTTPS Certificate', `
+        <p style="margin-bottom: 1rem; color: var(--text-secondary); font-size: 0.85rem;">
+            This server uses its own certificate authority. Install the CA certificate on each family device
+            (as a trusted root in the system or browser certificate settings) so browsers and the extension
+            accept the connection without warnings.
+        </p>
+        <div class="form-group">
+            <label>CA SHA-256 Fingerprint</label>
+            <code style="display: block; word-break: break-all; font-family: var(--font-mono); font-size: 0.8rem;">${escapeHtml(ca.fingerprint_sha256)}</code>
+        </div>
+        <p style="margin-bottom: 1rem; color: var(--text-muted); font-size: 0.85rem;">
+            Check that the fingerprint a device shows for the downloaded certificate matches this one before trusting it.
+            ${escapeHtml(ca.subject)}, valid until ${formatDate(ca.not_after)}.
+        </p>
+        <p style="margin-bottom: 1rem; color: var(--text-muted); font-size: 0.85rem;">
+            ${ca.permitted_names?.length
+                ? `Devices only accept certificates from this CA for ${ca.permitted_names.map(escapeHtml).join(', ')}, so its key can't be used to impersonate other sites.`
+                : 'This CA is not limited to this server\'s names: anyone with its key can impersonate any site to devices that trust it. Remove its files from the TLS directory to generate a limited one.'}
+        </p>
+        ${cert ? `
+            <p style="margin-bottom: 1rem; color: var(--text-muted); font-size: 0.85rem;">
+                Server certificate for ${names.map(escapeHtml).join(', ')}, valid until ${formatDate(cert.not_after)} and renewed automatically.
+            </p>
+        ` : ''}
+        <div class="modal-actions">
+            <button type="button" class="btn btn-secondary" onclick="hideModal()">Close</button>
+            <a class="btn btn-primary" href="${escapeHtml(tlsInfo.ca_url)}" download>Download CA Certificate</a>
+        </div>
+    `);
+}
+
 function showNotificationSettingsModal() {
     const subscribed = !!pushSubscription;
     
@@ -1258,11 +1684,16 @@ function showNotificationSettingsModal() {
                            style="width: 18px; height: 18px;">
                     <span>New access requests</span>
                 </label>
-                <label style="display: flex; align-items: center; gap: 0.75rem; margin-bottom: 1rem; cursor: pointer;">
+                <label style="display: flex; align-items: center; gap: 0.75rem; margin-bottom: 0.75rem; cursor: pointer;">
                     <input type="checkbox" id="pref-device-status" ${notificationPrefs.notify_device_status ? 'checked' : ''} 
                            style="width: 18px; height: 18px;">
                     <span>Device status changes (inactive, uninstalled)</span>
                 </label>
+                <label style="display: flex; align-items: center; gap: 0.75rem; margin-bottom: 1rem; cursor: pointer;">
+                    <input type="checkbox" id="pref-security-events" ${notificationPrefs.notify_security_events ? 'checked' : ''} 
+                           style="width: 18px; height: 18px;">
+                    <span>Security events (extension disabled, incognito access, config changes)</span>
+                </label>
                 <div class="modal-actions" style="padding-top: 1rem;">
                     <button type="button" class="btn btn-secondary" onclick="hideModal()">Close</button>
                     <button type="submit" class="btn btn-primary">Save Preferences</button>
@@ -1275,7 +1706,8 @@ function showNotificationSettingsModal() {
         e.preventDefault();
         const notifyNewRequests = $('#pref-new-requests').checked;
         const notifyDeviceStatus = $('#pref-device-status').checked;
-        await updateNotificationPrefs(notifyNewRequests, notifyDeviceStatus);
+        const notifySecurityEvents = $('#pref-security-events').checked;
+        await updateNotificationPrefs(notifyNewRequests, notifyDeviceStatus, notifySecurityEvents);
         hideModal();
     };
 }
@@ -1364,6 +1796,9 @@ document.addEventListener('DOMContentLoaded', () => {
     const notifBtn = $('#notification-btn');
     if (notifBtn) notifBtn.onclick = showNotificationSettingsModal;
     
+    // HTTPS certificate
+    $('#certificate-btn').onclick = showCertificateModal;
+    
     // Change password
     const changePwBtn = $('#change-password-btn');
     if (changePwBtn) changePwBtn.onclick = showChangePasswordModal;
@@ -1411,6 +1846,7 @@ document.addEventListener('DOMContentLoaded', () => {
     
     // Add buttons
     $('#add-device-btn').onclick = showAddDeviceModal;
+    $('#extension-version-btn').onclick = showExtensionVersionModal;
     $('#add-pattern-btn').onclick = showAddPatternModal;
     $('#add-user-btn').onclick = showAddUserModal;
     
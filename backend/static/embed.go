@@ -0,0 +1,10 @@
+// Package static holds the admin UI, embedded so the binary serves it from
+// any working directory.
+package static
+
+import "embed"
+
+// Files are the admin UI's files
+//
+//go:embed *.html *.css *.js
+var Files embed.FS
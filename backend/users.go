@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/term"
+
+	"github.com/watchtower/web/database"
+)
+
+// minPasswordLength matches what the setup page requires
+const minPasswordLength = 8
+
+// runUser creates admin users, resets their passwords and lists them
+func runUser(args []string) error {
+	action, args, err := subcommand(args, "user create|reset-password|list")
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("user "+action, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: watchtower user create|reset-password <username>")
+		fmt.Fprintln(flags.Output(), "       watchtower user list")
+		fmt.Fprintln(flags.Output(), "The password is prompted for, or read from the first line of stdin if it isn't a terminal.")
+	}
+	flags.Parse(args)
+
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	switch action {
+	case "create":
+		if flags.NArg() != 1 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		username := flags.Arg(0)
+		if _, err := store.Users.GetByUsername(username); err == nil {
+			return fmt.Errorf("user %q already exists", username)
+		}
+
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		user, err := store.Users.Create(username, password)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created user %s (ID %d)\n", user.Username, user.ID)
+		return nil
+
+	case "reset-password":
+		if flags.NArg() != 1 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		user, err := store.Users.GetByUsername(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("user %q not found", flags.Arg(0))
+		}
+
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := store.Users.UpdatePassword(user.ID, password); err != nil {
+			return err
+		}
+		// Whoever knew the old password is signed out too
+		if err := store.Sessions.DeleteByUser(user.ID); err != nil {
+			return err
+		}
+		fmt.Printf("Reset the password of %s and signed them out everywhere\n", user.Username)
+		return nil
+
+	case "list":
+		users, err := store.Users.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSERNAME\tCREATED")
+		for _, u := range users {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", u.ID, u.Username, u.CreatedAt.Local().Format("2006-01-02 15:04"))
+		}
+		return w.Flush()
+
+	default:
+		return fmt.Errorf("unknown action %q (expected create, reset-password or list)", action)
+	}
+}
+
+// readPassword prompts for a new password twice, or reads it from the first
+// line of stdin when stdin is not a terminal
+func readPassword() (string, error) {
+	var password string
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		first, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprint(os.Stderr, "Confirm password: ")
+		second, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(first) != string(second) {
+			return "", errors.New("passwords do not match")
+		}
+		password = string(first)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("no password on stdin")
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	return password, nil
+}
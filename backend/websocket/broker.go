@@ -0,0 +1,45 @@
+package websocket
+
+// A Broker carries hub events between server instances, so a message for a
+// device reaches it whichever instance the device is connected to. Each hub
+// delivers events to its own connections; the broker only has to reach the
+// other instances.
+type Broker interface {
+	// Publish sends an event to the other instances
+	Publish(event BrokerEvent) error
+
+	// Start hands events published by other instances to deliver until
+	// Close is called
+	Start(deliver func(BrokerEvent)) error
+
+	// Close stops delivering events
+	Close() error
+}
+
+// Kinds of broker events. Events are stored in the database, so the ones
+// that need secrets or database state are only signals: the instance holding
+// the device's connections does the work.
+const (
+	EventDeviceMessage   = "device_message"   // Data is a message for a device's connections
+	EventAdminMessage    = "admin_message"    // Data is a message for admin dashboards
+	EventDisconnect      = "disconnect"       // Close a device's connections
+	EventPolicyChanged   = "policy_changed"   // Push a device's policy to its connections
+	EventTokenRotated    = "token_rotated"    // Issue the device's connections a new token
+	EventCommandsPending = "commands_pending" // Deliver the device's pending commands
+)
+
+// BrokerEvent is something a hub did that the other instances must repeat
+// for their connections
+type BrokerEvent struct {
+	Kind     string
+	DeviceID int64
+	Data     []byte // Encoded message, for the message kinds
+}
+
+// LocalBroker is the default broker for a single server instance. All
+// connections are in this process, so there is no one to publish to.
+type LocalBroker struct{}
+
+func (LocalBroker) Publish(BrokerEvent) error     { return nil }
+func (LocalBroker) Start(func(BrokerEvent)) error { return nil }
+func (LocalBroker) Close() error                  { return nil }
@@ -1,41 +1,156 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/watchtower/web/logging"
 )
 
 // Client represents a connected WebSocket client
 type Client struct {
-	Hub        *Hub
-	Conn       *websocket.Conn
-	DeviceID   int64
+	Hub         *Hub
+	Conn        *websocket.Conn
+	DeviceID    int64
 	DeviceToken string
-	Send       chan []byte
+	Send        chan []byte
+
+	// Connection details shown in the admin device list
+	ConnectedAt time.Time
+	RemoteAddr  string
+
+	// ID of the request that opened the connection, logged with everything
+	// that happens on it
+	RequestID string
+
+	// Set instead of DeviceID for admin dashboard connections
+	UserID       int64
+	SessionToken string
+
+	// Policy last queued on this connection, maintained by the handlers
+	PolicySent       bool
+	PolicyVersion    int64
+	PolicyRestricted bool
+
+	// Messages dropped because the send buffer was full; the first drop
+	// disconnects the client so it reconnects and resyncs
+	dropped atomic.Int64
+	closing atomic.Bool
+}
+
+// IsAdmin reports whether the client is an admin dashboard connection
+func (c *Client) IsAdmin() bool {
+	return c.UserID != 0
+}
+
+// Context returns a context carrying the connection's request ID, for logging
+// and store calls made on its behalf
+func (c *Client) Context() context.Context {
+	return logging.WithRequestID(context.Background(), c.RequestID)
+}
+
+// logAttrs identifies the client in log lines
+func (c *Client) logAttrs() []any {
+	if c.IsAdmin() {
+		return []any{"user_id", c.UserID}
+	}
+	return []any{"device_id", c.DeviceID}
 }
 
 // Hub manages all WebSocket connections
 type Hub struct {
 	// Clients by device ID for targeted messaging
 	clients map[int64]map[*Client]bool
-	
-	// Register requests from clients
-	register chan *Client
-	
+
+	// Admin dashboard connections, which receive broadcast events
+	admins map[*Client]bool
+
 	// Unregister requests from clients
 	unregister chan *Client
-	
+
 	// Mutex for thread-safe operations
 	mu sync.RWMutex
+
+	// Connection counters since the hub started
+	startedAt        time.Time
+	totalConnections int64
+	totalDisconnects int64
+
+	// Set once Shutdown has closed every send channel
+	shuttingDown bool
+
+	// Carries messages to the devices connected to other instances
+	broker Broker
+
+	// PolicyChanged pushes a device's policy to its connections on this
+	// instance when another instance changed it
+	PolicyChanged func(ctx context.Context, deviceID int64)
+
+	// TokenRotated issues a device's connections on this instance a new
+	// token when another instance regenerated it
+	TokenRotated func(ctx context.Context, deviceID int64)
+
+	// CommandsPending delivers a device's pending commands to its
+	// connections on this instance when another instance queued them
+	CommandsPending func(ctx context.Context, deviceID int64)
+
+	// Slow client counters, updated without the write lock
+	droppedMessages       atomic.Int64
+	slowClientDisconnects atomic.Int64
 }
 
+// DevicePresence is the live connection state of a device
+type DevicePresence struct {
+	Connected      bool       `json:"connected"`
+	Connections    int        `json:"connections"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"` // Oldest open connection
+	RemoteAddrs    []string   `json:"remote_addrs,omitempty"`
+	QueueDepth     int        `json:"queue_depth"`      // Messages waiting to be written, all connections
+	Dropped        int64      `json:"dropped_messages"` // Dropped on open connections
+}
+
+// HubStats summarizes the connections of the whole hub
+type HubStats struct {
+	ConnectedDevices int       `json:"connected_devices"`
+	Connections      int       `json:"connections"`
+	AdminConnections int       `json:"admin_connections"`
+	TotalConnections int64     `json:"total_connections"` // Since the server started
+	TotalDisconnects int64     `json:"total_disconnects"`
+	StartedAt        time.Time `json:"started_at"`
+
+	// Send buffer health
+	QueuedMessages        int   `json:"queued_messages"` // Waiting to be written, all connections
+	MaxQueueDepth         int   `json:"max_queue_depth"` // Fullest connection
+	QueueCapacity         int   `json:"queue_capacity"`
+	DroppedMessages       int64 `json:"dropped_messages"` // Since the server started
+	SlowClientDisconnects int64 `json:"slow_client_disconnects"`
+}
+
+// SendBufferSize is the number of messages queued per connection before the
+// client is considered too slow and disconnected
+const SendBufferSize = 256
+
+// ProtocolVersion is the version of the message protocol spoken by the server
+const ProtocolVersion = 1
+
 // Message represents a WebSocket message
 type Message struct {
-	Type string      `json:"type"`
-	Data interface{} `json:"data,omitempty"`
+	Version int         `json:"v"`
+	Type    string      `json:"type"`
+	ReplyTo string      `json:"reply_to,omitempty"` // ID of the client message this answers
+	Data    interface{} `json:"data,omitempty"`
+	Error   *Error      `json:"error,omitempty"`
+}
+
+// Error describes why a client message was rejected
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 // Global hub instance
@@ -45,8 +160,10 @@ var DefaultHub *Hub
 func NewHub() *Hub {
 	return &Hub{
 		clients:    make(map[int64]map[*Client]bool),
-		register:   make(chan *Client),
+		admins:     make(map[*Client]bool),
 		unregister: make(chan *Client),
+		startedAt:  time.Now().UTC(),
+		broker:     LocalBroker{},
 	}
 }
 
@@ -54,35 +171,59 @@ func NewHub() *Hub {
 func (h *Hub) Run() {
 	for {
 		select {
-		case client := <-h.register:
-			h.mu.Lock()
-			if h.clients[client.DeviceID] == nil {
-				h.clients[client.DeviceID] = make(map[*Client]bool)
-			}
-			h.clients[client.DeviceID][client] = true
-			h.mu.Unlock()
-			log.Printf("WebSocket client registered for device %d", client.DeviceID)
-
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if clients, ok := h.clients[client.DeviceID]; ok {
+			if client.IsAdmin() {
+				if _, ok := h.admins[client]; ok {
+					delete(h.admins, client)
+					h.closeSend(client)
+				}
+			} else if clients, ok := h.clients[client.DeviceID]; ok {
 				if _, ok := clients[client]; ok {
 					delete(clients, client)
-					close(client.Send)
+					h.closeSend(client)
+					h.totalDisconnects++
 					if len(clients) == 0 {
 						delete(h.clients, client.DeviceID)
 					}
 				}
 			}
 			h.mu.Unlock()
-			log.Printf("WebSocket client unregistered for device %d", client.DeviceID)
+			slog.InfoContext(client.Context(), "WebSocket client unregistered", client.logAttrs()...)
 		}
 	}
 }
 
-// Register adds a client to the hub
+// closeSend closes a client's send channel unless Shutdown already did.
+// Callers hold the write lock.
+func (h *Hub) closeSend(client *Client) {
+	if !h.shuttingDown {
+		close(client.Send)
+	}
+}
+
+// Register adds a client to the hub. The client can be sent messages as
+// soon as Register returns. Once the hub is shutting down, the client's send
+// channel is closed instead, so its connection is closed right away.
 func (h *Hub) Register(client *Client) {
-	h.register <- client
+	h.mu.Lock()
+	if h.shuttingDown {
+		close(client.Send)
+		h.mu.Unlock()
+		return
+	}
+	if client.IsAdmin() {
+		h.admins[client] = true
+	} else {
+		if h.clients[client.DeviceID] == nil {
+			h.clients[client.DeviceID] = make(map[*Client]bool)
+		}
+		h.clients[client.DeviceID][client] = true
+		h.totalConnections++
+	}
+	h.mu.Unlock()
+
+	slog.InfoContext(client.Context(), "WebSocket client registered", append(client.logAttrs(), "remote_addr", client.RemoteAddr)...)
 }
 
 // Unregister removes a client from the hub
@@ -90,32 +231,287 @@ func (h *Hub) Unregister(client *Client) {
 	h.unregister <- client
 }
 
-// SendToDevice sends a message to all clients for a specific device
-func (h *Hub) SendToDevice(deviceID int64, message Message) {
+// UseBroker replaces the broker and starts delivering the events it receives
+// from other instances
+func (h *Hub) UseBroker(broker Broker) error {
+	if err := broker.Start(h.deliver); err != nil {
+		return err
+	}
+	h.broker = broker
+	return nil
+}
+
+// publish sends an event to the other instances
+func (h *Hub) publish(event BrokerEvent) {
+	if err := h.broker.Publish(event); err != nil {
+		slog.Error("Failed to publish broker event", "kind", event.Kind, "device_id", event.DeviceID, "err", err)
+	}
+}
+
+// deliver repeats an event from another instance for this hub's connections
+func (h *Hub) deliver(event BrokerEvent) {
+	switch event.Kind {
+	case EventDeviceMessage:
+		h.sendToDevice(event.DeviceID, event.Data)
+	case EventAdminMessage:
+		h.broadcastToAdmins(event.Data)
+	case EventDisconnect:
+		h.disconnectDevice(event.DeviceID)
+	case EventPolicyChanged:
+		h.runHook(h.PolicyChanged, event.DeviceID)
+	case EventTokenRotated:
+		h.runHook(h.TokenRotated, event.DeviceID)
+	case EventCommandsPending:
+		h.runHook(h.CommandsPending, event.DeviceID)
+	default:
+		slog.Warn("Unknown broker event kind", "kind", event.Kind)
+	}
+}
+
+// runHook runs a hook for a signal from another instance if the device is
+// connected here
+func (h *Hub) runHook(hook func(ctx context.Context, deviceID int64), deviceID int64) {
+	if hook != nil && h.IsDeviceConnected(deviceID) {
+		hook(context.Background(), deviceID)
+	}
+}
+
+// SendToDevice sends a message to all clients for a specific device, on
+// this and other instances, and returns how many connections on this
+// instance it was queued on
+func (h *Hub) SendToDevice(deviceID int64, message Message) int {
+	message.Version = ProtocolVersion
 	data, err := json.Marshal(message)
 	if err != nil {
-		log.Printf("Error marshaling WebSocket message: %v", err)
-		return
+		slog.Error("Failed to encode WebSocket message", "type", message.Type, "err", err)
+		return 0
+	}
+
+	h.publish(BrokerEvent{Kind: EventDeviceMessage, DeviceID: deviceID, Data: data})
+	return h.sendToDevice(deviceID, data)
+}
+
+// SendToLocalDevice sends a message to a device's connections on this
+// instance only, and returns how many it was queued on
+func (h *Hub) SendToLocalDevice(deviceID int64, message Message) int {
+	message.Version = ProtocolVersion
+	data, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("Failed to encode WebSocket message", "type", message.Type, "err", err)
+		return 0
 	}
+	return h.sendToDevice(deviceID, data)
+}
 
+// sendToDevice queues an encoded message on a device's connections
+func (h *Hub) sendToDevice(deviceID int64, data []byte) int {
 	h.mu.RLock()
 	clients, ok := h.clients[deviceID]
 	h.mu.RUnlock()
 
 	if !ok {
-		return
+		return 0
 	}
 
+	queued := 0
 	h.mu.RLock()
 	for client := range clients {
-		select {
-		case client.Send <- data:
-		default:
-			// Client buffer full, skip
-			log.Printf("WebSocket client buffer full for device %d", deviceID)
+		if h.enqueue(client, data) {
+			queued++
+		}
+	}
+	h.mu.RUnlock()
+	return queued
+}
+
+// SendToClient sends a message to a single connection, typically a reply to
+// one of its messages. It returns false if the client is gone or its buffer is full.
+func (h *Hub) SendToClient(client *Client, message Message) bool {
+	message.Version = ProtocolVersion
+	data, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("Failed to encode WebSocket message", "type", message.Type, "err", err)
+		return false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	// The send channel is closed once the client is unregistered
+	registered := h.clients[client.DeviceID][client]
+	if client.IsAdmin() {
+		registered = h.admins[client]
+	}
+	if !registered {
+		return false
+	}
+
+	return h.enqueue(client, data)
+}
+
+// BroadcastToAdmins sends a message to every admin dashboard connection, on
+// this and other instances, and returns how many connections on this
+// instance it was queued on
+func (h *Hub) BroadcastToAdmins(message Message) int {
+	message.Version = ProtocolVersion
+	data, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("Failed to encode WebSocket message", "type", message.Type, "err", err)
+		return 0
+	}
+
+	h.publish(BrokerEvent{Kind: EventAdminMessage, Data: data})
+	return h.broadcastToAdmins(data)
+}
+
+// broadcastToAdmins queues an encoded message on every admin connection
+func (h *Hub) broadcastToAdmins(data []byte) int {
+	queued := 0
+	h.mu.RLock()
+	for client := range h.admins {
+		if h.enqueue(client, data) {
+			queued++
 		}
 	}
 	h.mu.RUnlock()
+	return queued
+}
+
+// enqueue queues a message on a registered client. A client whose buffer is
+// full has fallen too far behind to catch up message by message, so the
+// message is dropped and the client disconnected; it gets a full resync when
+// it reconnects. Callers hold the read lock.
+func (h *Hub) enqueue(client *Client, data []byte) bool {
+	if h.shuttingDown {
+		return false
+	}
+	if client.closing.Load() {
+		client.dropped.Add(1)
+		h.droppedMessages.Add(1)
+		return false
+	}
+
+	select {
+	case client.Send <- data:
+		return true
+	default:
+	}
+
+	client.dropped.Add(1)
+	h.droppedMessages.Add(1)
+	if client.closing.CompareAndSwap(false, true) {
+		h.slowClientDisconnects.Add(1)
+		slog.WarnContext(client.Context(), "WebSocket client too slow, disconnecting", client.logAttrs()...)
+		// The read pump notices the closed connection and unregisters the client
+		client.Conn.Close()
+	}
+	return false
+}
+
+// Shutdown sends every device connection a final message, closes all
+// connections once their queued messages are written and waits until they
+// are gone. Connections still open when the context is done are closed
+// without waiting for their writes.
+func (h *Hub) Shutdown(ctx context.Context, message Message) error {
+	message.Version = ProtocolVersion
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	// Messages from other instances are no longer needed
+	if err := h.broker.Close(); err != nil {
+		slog.Error("Failed to close WebSocket broker", "err", err)
+	}
+
+	h.mu.Lock()
+	for _, clients := range h.clients {
+		for client := range clients {
+			h.enqueue(client, data)
+		}
+	}
+	// Closing the send channels makes the write pumps flush what is queued,
+	// send a close frame and close the connections
+	h.shuttingDown = true
+	for _, clients := range h.clients {
+		for client := range clients {
+			close(client.Send)
+		}
+	}
+	for client := range h.admins {
+		close(client.Send)
+	}
+	h.mu.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		h.mu.RLock()
+		remaining := len(h.clients) + len(h.admins)
+		h.mu.RUnlock()
+		if remaining == 0 {
+			slog.Info("WebSocket hub drained")
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			h.mu.RLock()
+			for _, clients := range h.clients {
+				for client := range clients {
+					client.Conn.Close()
+				}
+			}
+			for client := range h.admins {
+				client.Conn.Close()
+			}
+			h.mu.RUnlock()
+			slog.Warn("WebSocket hub shutdown timed out", "open_connections", remaining)
+			return ctx.Err()
+		}
+	}
+}
+
+// Dropped returns how many messages were dropped for the client
+func (c *Client) Dropped() int64 {
+	return c.dropped.Load()
+}
+
+// DisconnectDevice closes all connections for a specific device, on this and
+// other instances
+func (h *Hub) DisconnectDevice(deviceID int64) {
+	h.publish(BrokerEvent{Kind: EventDisconnect, DeviceID: deviceID})
+	h.disconnectDevice(deviceID)
+}
+
+// PublishPolicyChange asks the other instances to push a device's policy to
+// their connections. The caller pushes it to this instance's connections.
+func (h *Hub) PublishPolicyChange(deviceID int64) {
+	h.publish(BrokerEvent{Kind: EventPolicyChanged, DeviceID: deviceID})
+}
+
+// PublishTokenRotation asks the other instances to issue a device's
+// connections a new token. The token itself never goes through the broker.
+func (h *Hub) PublishTokenRotation(deviceID int64) {
+	h.publish(BrokerEvent{Kind: EventTokenRotated, DeviceID: deviceID})
+}
+
+// PublishPendingCommands asks the other instances to deliver a device's
+// pending commands to their connections
+func (h *Hub) PublishPendingCommands(deviceID int64) {
+	h.publish(BrokerEvent{Kind: EventCommandsPending, DeviceID: deviceID})
+}
+
+// disconnectDevice closes a device's connections on this instance.
+// The read pumps notice the closed connections and unregister the clients
+func (h *Hub) disconnectDevice(deviceID int64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for client := range h.clients[deviceID] {
+		client.Conn.Close()
+	}
 }
 
 // GetConnectedDeviceCount returns the number of devices with active connections
@@ -125,6 +521,30 @@ func (h *Hub) GetConnectedDeviceCount() int {
 	return len(h.clients)
 }
 
+// DeviceClients returns the open connections of a device
+func (h *Hub) DeviceClients(deviceID int64) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(h.clients[deviceID]))
+	for client := range h.clients[deviceID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// ConnectedDeviceIDs returns the IDs of all devices with open connections
+func (h *Hub) ConnectedDeviceIDs() []int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ids := make([]int64, 0, len(h.clients))
+	for deviceID := range h.clients {
+		ids = append(ids, deviceID)
+	}
+	return ids
+}
+
 // IsDeviceConnected checks if a device has any active connections
 func (h *Hub) IsDeviceConnected(deviceID int64) bool {
 	h.mu.RLock()
@@ -133,10 +553,64 @@ func (h *Hub) IsDeviceConnected(deviceID int64) bool {
 	return ok
 }
 
+// GetDevicePresence returns the live connection state of a device
+func (h *Hub) GetDevicePresence(deviceID int64) DevicePresence {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	presence := DevicePresence{}
+	for client := range h.clients[deviceID] {
+		presence.Connected = true
+		presence.Connections++
+		if presence.ConnectedSince == nil || client.ConnectedAt.Before(*presence.ConnectedSince) {
+			since := client.ConnectedAt
+			presence.ConnectedSince = &since
+		}
+		presence.RemoteAddrs = append(presence.RemoteAddrs, client.RemoteAddr)
+		presence.QueueDepth += len(client.Send)
+		presence.Dropped += client.Dropped()
+	}
+	return presence
+}
+
+// Stats returns hub-wide connection statistics
+func (h *Hub) Stats() HubStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stats := HubStats{
+		ConnectedDevices: len(h.clients),
+		AdminConnections: len(h.admins),
+		TotalConnections: h.totalConnections,
+		TotalDisconnects: h.totalDisconnects,
+		StartedAt:        h.startedAt,
+
+		QueueCapacity:         SendBufferSize,
+		DroppedMessages:       h.droppedMessages.Load(),
+		SlowClientDisconnects: h.slowClientDisconnects.Load(),
+	}
+	for _, clients := range h.clients {
+		stats.Connections += len(clients)
+		for client := range clients {
+			stats.addQueue(len(client.Send))
+		}
+	}
+	for client := range h.admins {
+		stats.addQueue(len(client.Send))
+	}
+	return stats
+}
+
+func (s *HubStats) addQueue(depth int) {
+	s.QueuedMessages += depth
+	if depth > s.MaxQueueDepth {
+		s.MaxQueueDepth = depth
+	}
+}
+
 // InitHub initializes the global hub and starts it
 func InitHub() {
 	DefaultHub = NewHub()
 	go DefaultHub.Run()
-	log.Println("WebSocket hub initialized")
+	slog.Info("WebSocket hub initialized")
 }
-
@@ -0,0 +1,191 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newConn returns the server end of a real WebSocket connection and the
+// peer's end
+func newConn(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-conns
+	t.Cleanup(func() {
+		peer.Close()
+		conn.Close()
+	})
+	return conn, peer
+}
+
+// pump stands in for the handlers' pumps: it takes messages off the send
+// channel until the hub closes it, then unregisters the client
+func pump(h *Hub, client *Client) {
+	for range client.Send {
+	}
+	h.Unregister(client)
+}
+
+// waitFor polls until cond holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSlowClientDisconnect(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	conn, peer := newConn(t)
+	client := &Client{Hub: h, Conn: conn, DeviceID: 1, Send: make(chan []byte, SendBufferSize)}
+	h.Register(client)
+
+	// Nothing reads the send buffer, so it fills up
+	for i := 0; i < SendBufferSize; i++ {
+		if queued := h.SendToDevice(1, Message{Type: "test"}); queued != 1 {
+			t.Fatalf("message %d queued on %d connections", i, queued)
+		}
+	}
+
+	// The next message is dropped and the client disconnected, once
+	if queued := h.SendToDevice(1, Message{Type: "test"}); queued != 0 {
+		t.Fatalf("message queued on a full buffer")
+	}
+	if h.SendToClient(client, Message{Type: "test"}) {
+		t.Fatal("reply queued on a full buffer")
+	}
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := peer.ReadMessage(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatal("slow client wasn't disconnected")
+			}
+			break
+		}
+	}
+
+	stats := h.Stats()
+	if stats.DroppedMessages != 2 || stats.SlowClientDisconnects != 1 || stats.MaxQueueDepth != SendBufferSize {
+		t.Fatalf("got stats %+v", stats)
+	}
+	if presence := h.GetDevicePresence(1); presence.Dropped != 2 || presence.QueueDepth != SendBufferSize {
+		t.Fatalf("got presence %+v", presence)
+	}
+
+	// The read pump unregisters the client, which closes its send channel
+	// once; later sends don't reach it
+	h.Unregister(client)
+	h.Unregister(client)
+	waitFor(t, "the client to be unregistered", func() bool { return !h.IsDeviceConnected(1) })
+	if _, ok := <-drain(client.Send); ok {
+		t.Fatal("send channel still open")
+	}
+	if h.SendToClient(client, Message{Type: "test"}) || h.SendToDevice(1, Message{Type: "test"}) != 0 {
+		t.Fatal("message queued for an unregistered client")
+	}
+	if stats := h.Stats(); stats.SlowClientDisconnects != 1 || stats.TotalDisconnects != 1 {
+		t.Fatalf("got stats %+v", stats)
+	}
+}
+
+// drain empties a send channel and returns it, so a receive reports
+// whether it is still open
+func drain(send chan []byte) chan []byte {
+	for {
+		select {
+		case _, ok := <-send:
+			if !ok {
+				return send
+			}
+		default:
+			return send
+		}
+	}
+}
+
+func TestShutdownWhileClientsCome(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		workers.Add(1)
+		go func(worker int) {
+			defer workers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				client := &Client{Hub: h, DeviceID: int64(worker%3 + 1), Send: make(chan []byte, SendBufferSize)}
+				if worker%4 == 0 {
+					client.DeviceID, client.UserID = 0, int64(worker)
+				}
+				h.Register(client)
+				go pump(h, client)
+
+				h.SendToDevice(client.DeviceID, Message{Type: "test"})
+				h.BroadcastToAdmins(Message{Type: "test"})
+				h.SendToClient(client, Message{Type: "test"})
+				if i%2 == 0 {
+					h.Unregister(client)
+				}
+			}
+		}(worker)
+	}
+
+	// Let connections come and go for a moment before shutting down
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx, Message{Type: "server_restarting"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients registering after the shutdown are closed right away
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	workers.Wait()
+	waitFor(t, "late clients to be unregistered", func() bool {
+		stats := h.Stats()
+		return stats.Connections == 0 && stats.AdminConnections == 0
+	})
+
+	client := &Client{DeviceID: 1, Send: make(chan []byte, 1)}
+	h.Register(client)
+	if _, ok := <-client.Send; ok {
+		t.Fatal("client registered after shutdown")
+	}
+}
@@ -5,21 +5,36 @@
 // Configuration
 const CONFIG_KEY = 'watchtower_config';
 const PATTERNS_KEY = 'watchtower_patterns';
+const POLICY_KEY = 'watchtower_policy';
 const SYNC_INTERVAL = 2 * 60 * 1000; // 2 minutes (fallback)
 const HEARTBEAT_INTERVAL = 1; // 1 minute
 const WS_RECONNECT_INTERVAL = 1; // 1 minute - check/reconnect WebSocket
+const WS_PROTOCOL = 'watchtower.v1';
+const WS_TOKEN_PROTOCOL_PREFIX = 'watchtower.token.';
+const WS_PROTOCOL_VERSION = 1;
 
 // Default configuration
 const DEFAULT_CONFIG = {
     apiUrl: 'http://localhost:8080',
     token: '',
     lastSync: null,
-    lastHeartbeat: null
+    lastHeartbeat: null,
+    upgradeRequired: null, // minimum version while the server enforces the fallback policy
+    policyKey: null // server key that signs policy bundles: { key_id, public_key }
 };
 
+// Refresh the signed policy when it expires within this time
+const POLICY_REFRESH_MARGIN = 24 * 60 * 60 * 1000;
+
 // WebSocket connection state
 let ws = null;
 let wsConnected = false;
+let wsReconnectTimer = null;
+
+// Replies awaited for messages sent over the WebSocket, by message ID
+const WS_REQUEST_TIMEOUT = 10000;
+const pendingReplies = new Map();
+let nextMessageId = 1;
 
 // ========================================
 // Storage Helpers
@@ -34,20 +49,52 @@ async function setConfig(config) {
     await chrome.storage.local.set({ [CONFIG_KEY]: config });
 }
 
-async function getPatterns() {
-    const result = await chrome.storage.local.get(PATTERNS_KEY);
-    return result[PATTERNS_KEY] || { allow: [], deny: [] };
+// The policy is the server's pattern list at a version, with the signed
+// bundle covering it: { version, etag, patterns, bundle }
+async function getPolicy() {
+    const result = await chrome.storage.local.get(POLICY_KEY);
+    return result[POLICY_KEY] || null;
 }
 
-async function setPatterns(patterns) {
-    await chrome.storage.local.set({ [PATTERNS_KEY]: patterns });
+async function setPolicy(policy) {
+    await chrome.storage.local.set({ [POLICY_KEY]: policy });
+    await chrome.storage.local.remove(PATTERNS_KEY);
+}
+
+// Returns the allow and deny patterns currently in force
+async function getPatterns() {
+    const policy = await getPolicy();
+    if (!policy) {
+        // Patterns stored before policies were versioned
+        const result = await chrome.storage.local.get(PATTERNS_KEY);
+        return result[PATTERNS_KEY] || { allow: [], deny: [] };
+    }
+    
+    // Organize patterns by type, skipping any that expired since the last sync
+    const now = Date.now();
+    const patterns = {
+        allow: [],
+        deny: []
+    };
+    
+    for (const pattern of policy.patterns) {
+        if (pattern.expires_at && Date.parse(pattern.expires_at) <= now) {
+            continue;
+        }
+        if (pattern.type === 'allow') {
+            patterns.allow.push(pattern.pattern);
+        } else if (pattern.type === 'deny') {
+            patterns.deny.push(pattern.pattern);
+        }
+    }
+    return patterns;
 }
 
 // ========================================
 // API Communication
 // ========================================
 
-async function fetchPatterns() {
+async function fetchPatterns(force = false) {
     const config = await getConfig();
     
     if (!config.token || !config.apiUrl) {
@@ -56,39 +103,31 @@ async function fetchPatterns() {
     }
     
     try {
-        const response = await fetch(`${config.apiUrl}/api/patterns`, {
-            headers: {
-                'Authorization': `Bearer ${config.token}`,
-                'Content-Type': 'application/json'
-            }
-        });
-        
-        if (!response.ok) {
-            throw new Error(`HTTP ${response.status}`);
+        // Skip the download if our version is current, unless forced
+        const policy = await getPolicy();
+        const headers = {
+            'Authorization': `Bearer ${config.token}`,
+            'Content-Type': 'application/json'
+        };
+        if (policy && policy.etag && !force) {
+            headers['If-None-Match'] = policy.etag;
         }
         
-        const data = await response.json();
-        
-        // Organize patterns by type
-        // Note: Backend already filters out expired patterns, so we just categorize here
-        const patterns = {
-            allow: [],
-            deny: []
-        };
+        const response = await fetch(`${config.apiUrl}/api/patterns`, { headers });
         
-        for (const pattern of (data.patterns || [])) {
-            if (pattern.type === 'allow') {
-                patterns.allow.push(pattern.pattern);
-            } else if (pattern.type === 'deny') {
-                patterns.deny.push(pattern.pattern);
-            }
+        if (response.status === 304) {
+            config.lastSync = new Date().toISOString();
+            await setConfig(config);
+            return await getPatterns();
         }
         
-        await setPatterns(patterns);
+        if (!response.ok) {
+            throw new Error(`HTTP ${response.status}`);
+        }
         
-        // Update last sync time
-        config.lastSync = new Date().toISOString();
-        await setConfig(config);
+        const data = await response.json();
+        await applyFullPolicy(data, response.headers.get('ETag'));
+        const patterns = await getPatterns();
         
         console.log('Watchtower: Patterns synced', patterns);
         return patterns;
@@ -110,6 +149,15 @@ async function submitRequest(url) {
         // Extract suggested pattern (domain + path prefix)
         const parsed = new URL(url);
         const suggestedPattern = parsed.hostname + '/*';
+        const body = {
+            url: url,
+            suggested_pattern: suggestedPattern
+        };
+        
+        if (await trySendOverWebSocket('access_request', body)) {
+            console.log('Watchtower: Request submitted for', url);
+            return true;
+        }
         
         const response = await fetch(`${config.apiUrl}/api/requests`, {
             method: 'POST',
@@ -117,10 +165,7 @@ async function submitRequest(url) {
                 'Authorization': `Bearer ${config.token}`,
                 'Content-Type': 'application/json'
             },
-            body: JSON.stringify({
-                url: url,
-                suggested_pattern: suggestedPattern
-            })
+            body: JSON.stringify(body)
         });
         
         if (!response.ok) {
@@ -135,30 +180,187 @@ async function submitRequest(url) {
     }
 }
 
+// Exchange a one-time enrollment code for this device's token
+async function enrollDevice(apiUrl, code) {
+    try {
+        const response = await fetch(`${apiUrl}/api/enroll`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ code })
+        });
+        
+        if (!response.ok) {
+            throw new Error(`HTTP ${response.status}`);
+        }
+        
+        const data = await response.json();
+        console.log('Watchtower: Enrolled as device', data.device_name);
+        return data;
+    } catch (error) {
+        console.error('Watchtower: Failed to enroll device', error);
+        return null;
+    }
+}
+
 // ========================================
-// Heartbeat (Canary Check)
+// Tamper & Bypass Event Reporting
 // ========================================
 
-async function sendHeartbeat() {
-    const config = await getConfig();
+const LAST_ALIVE_KEY = 'watchtower_last_alive';
+const INCOGNITO_KEY = 'watchtower_incognito_allowed';
+const REENABLE_GAP = 3 * 60 * 1000; // Worker gaps longer than this count as disabled
+
+let startedNormally = false;
+
+async function reportEvent(type, details = null, config = null) {
+    config = config || await getConfig();
     
     if (!config.token || !config.apiUrl) {
         return false;
     }
     
     try {
-        const response = await fetch(`${config.apiUrl}/api/heartbeat`, {
+        const body = {
+            type,
+            details,
+            occurred_at: new Date().toISOString(),
+            client_time: new Date().toISOString()
+        };
+        
+        if (await trySendOverWebSocket('event', body)) {
+            console.log('Watchtower: Reported event', type);
+            return true;
+        }
+        
+        const response = await fetch(`${config.apiUrl}/api/events`, {
             method: 'POST',
             headers: {
                 'Authorization': `Bearer ${config.token}`,
                 'Content-Type': 'application/json'
-            }
+            },
+            body: JSON.stringify(body)
         });
         
         if (!response.ok) {
             throw new Error(`HTTP ${response.status}`);
         }
         
+        console.log('Watchtower: Reported event', type);
+        return true;
+    } catch (error) {
+        console.error('Watchtower: Failed to report event', type, error);
+        return false;
+    }
+}
+
+async function markAlive() {
+    await chrome.storage.local.set({ [LAST_ALIVE_KEY]: Date.now() });
+}
+
+// The extension can't observe being disabled, but when it is re-enabled the
+// service worker starts without a browser startup or install after a long silence
+async function checkReenabled() {
+    const result = await chrome.storage.local.get(LAST_ALIVE_KEY);
+    const lastAlive = result[LAST_ALIVE_KEY];
+    
+    if (!startedNormally && lastAlive && Date.now() - lastAlive > REENABLE_GAP) {
+        await reportEvent('extension_enabled', {
+            offline_minutes: Math.round((Date.now() - lastAlive) / 60000)
+        });
+    }
+    
+    await markAlive();
+}
+
+async function checkIncognitoAccess() {
+    const allowed = await chrome.extension.isAllowedIncognitoAccess();
+    const result = await chrome.storage.local.get(INCOGNITO_KEY);
+    const previous = result[INCOGNITO_KEY];
+    
+    if (previous !== undefined && previous !== allowed) {
+        await reportEvent(allowed ? 'incognito_access_granted' : 'incognito_access_revoked');
+    }
+    
+    await chrome.storage.local.set({ [INCOGNITO_KEY]: allowed });
+}
+
+// ========================================
+// Heartbeat (Canary Check)
+// ========================================
+
+// Collect browser and environment metadata for the device inventory
+async function getInventory() {
+    const inventory = {
+        extension_version: chrome.runtime.getManifest().version,
+        timezone: Intl.DateTimeFormat().resolvedOptions().timeZone
+    };
+    
+    const brands = navigator.userAgentData?.brands || [];
+    const brand = brands.find(b => !/not.?a.?brand|chromium/i.test(b.brand)) ||
+        brands.find(b => /chromium/i.test(b.brand));
+    if (brand) {
+        inventory.browser_name = brand.brand;
+        inventory.browser_version = brand.version;
+    } else {
+        const match = navigator.userAgent.match(/Chrome\/([\d.]+)/);
+        if (match) {
+            inventory.browser_name = 'Chrome';
+            inventory.browser_version = match[1];
+        }
+    }
+    
+    try {
+        const platform = await chrome.runtime.getPlatformInfo();
+        inventory.os = `${platform.os} ${platform.arch}`;
+    } catch (error) {
+        console.error('Watchtower: Failed to get platform info', error);
+    }
+    
+    try {
+        const profile = await chrome.identity.getProfileUserInfo({ accountStatus: 'ANY' });
+        if (profile.email) {
+            inventory.profile_email = profile.email;
+        }
+    } catch (error) {
+        console.error('Watchtower: Failed to get profile info', error);
+    }
+    
+    return inventory;
+}
+
+async function sendHeartbeat() {
+    const config = await getConfig();
+    
+    if (!config.token || !config.apiUrl) {
+        return false;
+    }
+    
+    try {
+        const body = { inventory: await getInventory() };
+        
+        // Report what we enforce so the server can spot a policy it never issued
+        const policy = await getPolicy();
+        if (policy) {
+            body.policy = { version: policy.version, hash: await policyHash(policy.patterns) };
+        }
+        
+        if (!await trySendOverWebSocket('heartbeat', body)) {
+            const response = await fetch(`${config.apiUrl}/api/heartbeat`, {
+                method: 'POST',
+                headers: {
+                    'Authorization': `Bearer ${config.token}`,
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify(body)
+            });
+            
+            if (!response.ok) {
+                throw new Error(`HTTP ${response.status}`);
+            }
+        }
+        
         // Update last heartbeat time
         config.lastHeartbeat = new Date().toISOString();
         await setConfig(config);
@@ -175,17 +377,387 @@ async function sendHeartbeat() {
 async function setupUninstallUrl() {
     const config = await getConfig();
     
-    if (config.token && config.apiUrl) {
-        const uninstallUrl = `${config.apiUrl}/api/uninstall?token=${encodeURIComponent(config.token)}`;
-        chrome.runtime.setUninstallURL(uninstallUrl);
+    if (!config.token || !config.apiUrl) {
+        return;
+    }
+    
+    // The backend hands out a URL with a single-purpose nonce so the
+    // device token never ends up in a URL
+    try {
+        const response = await fetch(`${config.apiUrl}/api/uninstall-url`, {
+            headers: {
+                'Authorization': `Bearer ${config.token}`
+            }
+        });
+        
+        if (!response.ok) {
+            throw new Error(`HTTP ${response.status}`);
+        }
+        
+        const data = await response.json();
+        chrome.runtime.setUninstallURL(data.url);
         console.log('Watchtower: Uninstall URL configured');
+    } catch (error) {
+        console.error('Watchtower: Failed to configure uninstall URL', error);
     }
 }
 
+// ========================================
+// Policy Sync
+// ========================================
+
+// Policy updates arrive from HTTP and WebSocket at the same time; they are
+// applied one after another so a delta never works on a stale copy
+let policyUpdates = Promise.resolve();
+
+function updatePolicy(update) {
+    const result = policyUpdates.then(update);
+    policyUpdates = result.catch(() => {});
+    return result;
+}
+
+// Replace the policy with a full copy from the server
+function applyFullPolicy(data, etag = null) {
+    return updatePolicy(async () => {
+        await setPolicy({
+            version: data.version || 0,
+            etag,
+            patterns: data.patterns || [],
+            bundle: data.bundle || null
+        });
+        
+        // Update last sync time
+        const config = await getConfig();
+        config.lastSync = new Date().toISOString();
+        applyUpgradeRequired(config, data.upgrade_required, config.upgradeRequired);
+        await setConfig(config);
+    });
+}
+
+// Apply the changes from one policy version to the next. Returns false if
+// changes between our version and the delta's are missing.
+function applyPolicyDelta(delta) {
+    return updatePolicy(async () => {
+        const policy = await getPolicy();
+        if (!policy || policy.version < delta.from_version) {
+            return false;
+        }
+        
+        // Changes we already have are skipped, so deltas can overlap
+        let patterns = policy.patterns;
+        for (const change of (delta.changes || [])) {
+            if (change.version <= policy.version) {
+                continue;
+            }
+            patterns = patterns.filter(pattern => pattern.id !== change.pattern_id);
+            if (change.op !== 'remove') {
+                patterns.push(change.pattern);
+            }
+        }
+        
+        if (delta.version > policy.version) {
+            // The bundle must cover the patterns we ended up with; if it
+            // doesn't, the patterns changed again and we resync
+            if (delta.bundle) {
+                const statement = decodePolicyStatement(delta.bundle);
+                if (!statement || statement.policy_hash !== await policyHash(patterns)) {
+                    return false;
+                }
+            }
+            
+            // The HTTP ETag no longer matches our copy
+            await setPolicy({ version: delta.version, etag: null, patterns, bundle: delta.bundle || null });
+        }
+        
+        const config = await getConfig();
+        config.lastSync = new Date().toISOString();
+        await setConfig(config);
+        return true;
+    });
+}
+
+// Ask the server for the changes we missed, or the full policy if it no
+// longer has them. Falls back to HTTP if the WebSocket is down.
+async function resyncPolicy() {
+    const policy = await getPolicy();
+    try {
+        const data = await wsRequest('sync', { version: policy ? policy.version : 0 });
+        if (data.mode === 'delta' && await applyPolicyDelta(data)) {
+            console.log('Watchtower: Policy caught up to version', data.version);
+            return;
+        }
+        if (data.mode === 'full') {
+            await applyFullPolicy(data);
+            console.log('Watchtower: Policy resynced at version', data.version);
+            return;
+        }
+    } catch (error) {
+        console.log('Watchtower: WebSocket resync failed, using HTTP', error.message);
+    }
+    await fetchPatterns(true);
+}
+
+// ========================================
+// Policy Signatures
+// ========================================
+
+function decodeBase64(value) {
+    return Uint8Array.from(atob(value), c => c.charCodeAt(0));
+}
+
+function decodePolicyStatement(bundle) {
+    try {
+        return JSON.parse(new TextDecoder().decode(decodeBase64(bundle.payload)));
+    } catch {
+        return null;
+    }
+}
+
+// Hash patterns the way the server does: sorted by ID then pattern, one line
+// each with ID, type, pattern and expiry separated by tabs
+async function policyHash(patterns) {
+    const sorted = [...patterns].sort((a, b) => {
+        if (a.id !== b.id) {
+            return a.id - b.id;
+        }
+        return a.pattern < b.pattern ? -1 : a.pattern > b.pattern ? 1 : 0;
+    });
+    const text = sorted
+        .map(p => `${p.id}\t${p.type}\t${p.pattern}\t${p.expires_at || ''}\n`)
+        .join('');
+    
+    const digest = await crypto.subtle.digest('SHA-256', new TextEncoder().encode(text));
+    return Array.from(new Uint8Array(digest), b => b.toString(16).padStart(2, '0')).join('');
+}
+
+// Get the server's signing key, fetching it the first time and when the
+// server starts signing with another key
+async function getPolicyKey(config, keyId) {
+    if (config.policyKey && config.policyKey.key_id === keyId) {
+        return config.policyKey;
+    }
+    
+    const response = await fetch(`${config.apiUrl}/api/policy-key`);
+    if (!response.ok) {
+        throw new Error(`HTTP ${response.status}`);
+    }
+    const key = await response.json();
+    if (key.key_id !== keyId) {
+        throw new Error('unknown signing key');
+    }
+    
+    config.policyKey = { key_id: key.key_id, public_key: key.public_key };
+    await setConfig(config);
+    return config.policyKey;
+}
+
+// Check the cached policy against its signed bundle. Returns 'valid',
+// 'expiring' when it should be refreshed, 'tampered' with a reason, or
+// 'unchecked' when it can't be verified right now.
+async function verifyPolicy(policy, config) {
+    if (!policy.bundle) {
+        // Once the server has signed for us, a missing bundle was removed
+        return config.policyKey ? { status: 'tampered', reason: 'missing_bundle' } : { status: 'unchecked' };
+    }
+    
+    let key;
+    try {
+        key = await getPolicyKey(config, policy.bundle.key_id);
+    } catch (error) {
+        console.log('Watchtower: Policy key unavailable', error.message);
+        return { status: 'unchecked' };
+    }
+    
+    let valid;
+    try {
+        const publicKey = await crypto.subtle.importKey('raw', decodeBase64(key.public_key), { name: 'Ed25519' }, false, ['verify']);
+        valid = await crypto.subtle.verify({ name: 'Ed25519' }, publicKey, decodeBase64(policy.bundle.signature), decodeBase64(policy.bundle.payload));
+    } catch (error) {
+        // Ed25519 is missing from older browsers
+        console.log('Watchtower: Cannot verify policy signature', error.message);
+        return { status: 'unchecked' };
+    }
+    if (!valid) {
+        return { status: 'tampered', reason: 'bad_signature' };
+    }
+    
+    const statement = decodePolicyStatement(policy.bundle);
+    if (!statement || statement.policy_hash !== await policyHash(policy.patterns)) {
+        return { status: 'tampered', reason: 'patterns_modified' };
+    }
+    if (statement.version !== policy.version) {
+        return { status: 'tampered', reason: 'version_modified' };
+    }
+    
+    if (Date.parse(statement.expires_at) - Date.now() < POLICY_REFRESH_MARGIN) {
+        return { status: 'expiring' };
+    }
+    return { status: 'valid' };
+}
+
+// Verify the cached policy and report it if it was modified. Returns false
+// if the policy should be downloaded again.
+async function checkPolicyIntegrity() {
+    const config = await getConfig();
+    const policy = await getPolicy();
+    if (!config.token || !policy) {
+        return true;
+    }
+    
+    const result = await verifyPolicy(policy, config);
+    if (result.status === 'tampered') {
+        console.error('Watchtower: Cached policy failed verification', result.reason);
+        await reportEvent('policy_tampered', { reason: result.reason, version: policy.version });
+        return false;
+    }
+    return result.status !== 'expiring';
+}
+
+// Track whether the server enforces the fallback policy because this
+// extension is older than the required minimum version
+function applyUpgradeRequired(config, required, minVersion) {
+    if (!required) {
+        config.upgradeRequired = null;
+        return;
+    }
+    
+    config.upgradeRequired = minVersion || config.upgradeRequired || true;
+    chrome.runtime.requestUpdateCheck().catch(error => {
+        console.error('Watchtower: Update check failed', error);
+    });
+}
+
 // ========================================
 // WebSocket Connection
 // ========================================
 
+// Send a message over the WebSocket and wait for the server's reply.
+// Rejects with an error carrying the server's error code if the message was
+// rejected, or without a code if the socket failed.
+function wsRequest(type, data) {
+    return new Promise((resolve, reject) => {
+        if (!ws || !wsConnected) {
+            reject(new Error('WebSocket not connected'));
+            return;
+        }
+        
+        const id = String(nextMessageId++);
+        const timer = setTimeout(() => {
+            pendingReplies.delete(id);
+            reject(new Error('WebSocket request timed out'));
+        }, WS_REQUEST_TIMEOUT);
+        
+        pendingReplies.set(id, { resolve, reject, timer });
+        ws.send(JSON.stringify({ v: WS_PROTOCOL_VERSION, id, type, data }));
+    });
+}
+
+// Try to deliver a message over the WebSocket. Returns false if the caller
+// should fall back to HTTP; rethrows errors reported by the server.
+async function trySendOverWebSocket(type, data) {
+    if (!wsConnected) {
+        return false;
+    }
+    
+    try {
+        await wsRequest(type, data);
+        return true;
+    } catch (error) {
+        if (error.code) {
+            throw error;
+        }
+        console.log('Watchtower: WebSocket send failed, using HTTP', type, error.message);
+        return false;
+    }
+}
+
+function resolveReply(message) {
+    const pending = pendingReplies.get(message.reply_to);
+    if (!pending) {
+        return;
+    }
+    
+    pendingReplies.delete(message.reply_to);
+    clearTimeout(pending.timer);
+    
+    if (message.type === 'error') {
+        const error = new Error(message.error?.message || 'Request failed');
+        error.code = message.error?.code || 'unknown';
+        pending.reject(error);
+    } else {
+        pending.resolve(message.data);
+    }
+}
+
+function rejectPendingReplies() {
+    for (const [id, pending] of pendingReplies) {
+        clearTimeout(pending.timer);
+        pending.reject(new Error('WebSocket closed'));
+    }
+    pendingReplies.clear();
+}
+
+async function handleWebSocketMessage(message) {
+    console.log('Watchtower: WebSocket message received', message.type);
+    
+    if (message.type === 'response' || message.type === 'error') {
+        if (message.reply_to) {
+            resolveReply(message);
+        } else {
+            console.error('Watchtower: WebSocket error', message.error);
+        }
+    } else if (message.type === 'patterns_updated') {
+        // Full policy, sent on connect and while an upgrade is required
+        await applyFullPolicy(message.data);
+        console.log('Watchtower: Patterns updated via WebSocket, version', message.data.version);
+    } else if (message.type === 'patterns_delta') {
+        // Changes since the last update; resync if we missed some
+        if (await applyPolicyDelta(message.data)) {
+            console.log('Watchtower: Pattern changes applied, version', message.data.version);
+        } else {
+            console.log('Watchtower: Missed pattern changes, resyncing');
+            await resyncPolicy();
+        }
+    } else if (message.type === 'upgrade_required') {
+        // The server restricts browsing until the extension is updated
+        const cfg = await getConfig();
+        applyUpgradeRequired(cfg, true, message.data.min_version);
+        await setConfig(cfg);
+        
+        console.log('Watchtower: Extension update required, minimum version', message.data.min_version);
+    } else if (message.type === 'command') {
+        // An admin sent a command; it is acknowledged once it ran
+        await handleCommand(message.data);
+    } else if (message.type === 'token_rotated') {
+        // The admin regenerated our token; switch to the new one
+        // before the old one stops working
+        const cfg = await getConfig();
+        cfg.token = message.data.token;
+        await setConfig(cfg);
+        setupUninstallUrl();
+        
+        console.log('Watchtower: Device token rotated via WebSocket');
+    } else if (message.type === 'server_restarting') {
+        // The server is about to close the socket; reconnect once it is back
+        scheduleReconnect(message.data);
+    }
+}
+
+// Reconnect after the delay the server asked for, plus a random share of its
+// jitter so devices don't all reconnect at the same moment. If the server
+// isn't back yet, the wsReconnect alarm keeps trying.
+function scheduleReconnect(hint = {}) {
+    const delay = (hint.reconnect_after_ms || 0) + Math.random() * (hint.reconnect_jitter_ms || 0);
+    
+    clearTimeout(wsReconnectTimer);
+    wsReconnectTimer = setTimeout(() => {
+        wsReconnectTimer = null;
+        ensureWebSocketConnected();
+    }, delay);
+    
+    console.log('Watchtower: Server restarting, reconnecting in', Math.round(delay / 1000), 'seconds');
+}
+
 async function connectWebSocket() {
     const config = await getConfig();
     
@@ -202,55 +774,39 @@ async function connectWebSocket() {
     }
     
     // Convert HTTP URL to WebSocket URL
-    const wsUrl = config.apiUrl.replace(/^http/, 'ws') + '/api/ws?token=' + encodeURIComponent(config.token);
+    const wsUrl = config.apiUrl.replace(/^http/, 'ws') + '/api/ws';
     
     try {
         console.log('Watchtower: Connecting WebSocket...');
-        ws = new WebSocket(wsUrl);
+        // The token travels in Sec-WebSocket-Protocol instead of the URL
+        ws = new WebSocket(wsUrl, [WS_PROTOCOL, WS_TOKEN_PROTOCOL_PREFIX + config.token]);
         
         ws.onopen = () => {
             wsConnected = true;
             console.log('Watchtower: WebSocket connected');
+            
+            // Report the device inventory on every connect
+            sendHeartbeat();
         };
         
         ws.onmessage = async (event) => {
-            try {
-                const message = JSON.parse(event.data);
-                console.log('Watchtower: WebSocket message received', message.type);
-                
-                if (message.type === 'patterns_updated') {
-                    // Update patterns from WebSocket push
-                    const data = message.data;
-                    const patterns = {
-                        allow: [],
-                        deny: []
-                    };
-                    
-                    for (const pattern of (data.patterns || [])) {
-                        if (pattern.type === 'allow') {
-                            patterns.allow.push(pattern.pattern);
-                        } else if (pattern.type === 'deny') {
-                            patterns.deny.push(pattern.pattern);
-                        }
-                    }
-                    
-                    await setPatterns(patterns);
-                    
-                    // Update last sync time
-                    const cfg = await getConfig();
-                    cfg.lastSync = new Date().toISOString();
-                    await setConfig(cfg);
-                    
-                    console.log('Watchtower: Patterns updated via WebSocket', patterns);
+            // The server may batch several messages into one frame, one per line
+            for (const line of event.data.split('\n')) {
+                if (!line.trim()) {
+                    continue;
+                }
+                try {
+                    await handleWebSocketMessage(JSON.parse(line));
+                } catch (error) {
+                    console.error('Watchtower: Failed to parse WebSocket message', error);
                 }
-            } catch (error) {
-                console.error('Watchtower: Failed to parse WebSocket message', error);
             }
         };
         
         ws.onclose = (event) => {
             wsConnected = false;
             ws = null;
+            rejectPendingReplies();
             console.log('Watchtower: WebSocket closed', event.code, event.reason);
         };
         
@@ -281,6 +837,118 @@ async function ensureWebSocketConnected() {
     }
 }
 
+// ========================================
+// Remote Commands
+// ========================================
+
+const LOCK_KEY = 'watchtower_locked_until';
+
+async function getLockedUntil() {
+    const result = await chrome.storage.local.get(LOCK_KEY);
+    const lockedUntil = result[LOCK_KEY];
+    return lockedUntil && new Date(lockedUntil) > new Date() ? lockedUntil : null;
+}
+
+function blockedPageUrl(url, lockedUntil = null) {
+    let pageUrl = chrome.runtime.getURL('blocked.html') + '?url=' + encodeURIComponent(url);
+    if (lockedUntil) {
+        pageUrl += '&locked_until=' + encodeURIComponent(lockedUntil);
+    }
+    return pageUrl;
+}
+
+async function runCommand(command) {
+    const params = command.params || {};
+    
+    switch (command.type) {
+        case 'resync':
+            if (!await fetchPatterns(true)) {
+                throw new Error('pattern sync failed');
+            }
+            break;
+            
+        case 'show_message':
+            await chrome.notifications.create(`watchtower-command-${command.id}`, {
+                type: 'basic',
+                iconUrl: 'icons/icon128.png',
+                title: params.title || 'Message from your administrator',
+                message: params.message,
+                requireInteraction: true
+            });
+            break;
+            
+        case 'close_tabs': {
+            const tabs = await chrome.tabs.query({});
+            const ids = tabs
+                .filter(tab => tab.url && matchesPattern(tab.url, [params.pattern]))
+                .map(tab => tab.id);
+            if (ids.length > 0) {
+                await chrome.tabs.remove(ids);
+            }
+            break;
+        }
+            
+        case 'lock': {
+            const lockedUntil = new Date(Date.now() + params.minutes * 60000).toISOString();
+            await chrome.storage.local.set({ [LOCK_KEY]: lockedUntil });
+            
+            // Move every open page to the blocked page
+            const tabs = await chrome.tabs.query({});
+            for (const tab of tabs) {
+                if (tab.url && (tab.url.startsWith('http://') || tab.url.startsWith('https://'))) {
+                    await chrome.tabs.update(tab.id, { url: blockedPageUrl(tab.url, lockedUntil) });
+                }
+            }
+            break;
+        }
+            
+        default:
+            throw new Error(`unknown command ${command.type}`);
+    }
+}
+
+// Acks of the latest commands run, by command ID. The server sends a command
+// again when it can't tell whether it arrived, e.g. after a reconnect, and
+// the extension only acknowledges it again instead of running it twice.
+const COMMANDS_KEY = 'watchtower_command_acks';
+const MAX_REMEMBERED_COMMANDS = 50;
+
+async function getCommandAcks() {
+    const result = await chrome.storage.local.get(COMMANDS_KEY);
+    return result[COMMANDS_KEY] || [];
+}
+
+async function rememberCommandAck(ack) {
+    const acks = (await getCommandAcks()).filter(a => a.id !== ack.id);
+    acks.push(ack);
+    await chrome.storage.local.set({ [COMMANDS_KEY]: acks.slice(-MAX_REMEMBERED_COMMANDS) });
+}
+
+// Run a command pushed over WebSocket and acknowledge it
+async function handleCommand(command) {
+    let ack = (await getCommandAcks()).find(a => a.id === command.id);
+    if (ack) {
+        console.log('Watchtower: Command already ran, acknowledging again', command.id);
+    } else {
+        ack = { id: command.id, status: 'ok' };
+        try {
+            await runCommand(command);
+            console.log('Watchtower: Command completed', command.type);
+        } catch (error) {
+            console.error('Watchtower: Command failed', command.type, error);
+            ack.status = 'error';
+            ack.error = String(error.message || error);
+        }
+        await rememberCommandAck(ack);
+    }
+    
+    try {
+        await wsRequest('command_ack', ack);
+    } catch (error) {
+        console.error('Watchtower: Failed to acknowledge command', command.id, error);
+    }
+}
+
 // ========================================
 // Pattern Matching
 // ========================================
@@ -346,6 +1014,10 @@ async function shouldBlockUrl(url) {
         return false;
     }
     
+    if (await getLockedUntil()) {
+        return true;
+    }
+    
     const patterns = await getPatterns();
     
     // Check deny list first
@@ -386,10 +1058,7 @@ chrome.webNavigation.onBeforeNavigate.addListener(async (details) => {
         console.log('Watchtower: Blocking', url);
         
         // Redirect to blocked page
-        const blockedPageUrl = chrome.runtime.getURL('blocked.html') + 
-            '?url=' + encodeURIComponent(url);
-        
-        chrome.tabs.update(details.tabId, { url: blockedPageUrl });
+        chrome.tabs.update(details.tabId, { url: blockedPageUrl(url, await getLockedUntil()) });
     }
 });
 
@@ -404,7 +1073,7 @@ chrome.runtime.onMessage.addListener((message, sender, sendResponse) => {
     }
     
     if (message.action === 'setConfig') {
-        setConfig(message.config).then(() => {
+        reportConfigChange(message.config).then(() => setConfig(message.config)).then(() => {
             setupUninstallUrl(); // Update uninstall URL with new config
             connectWebSocket(); // Connect/reconnect WebSocket (handles heartbeat)
             fetchPatterns().then(() => sendResponse({ success: true }));
@@ -412,6 +1081,24 @@ chrome.runtime.onMessage.addListener((message, sender, sendResponse) => {
         return true;
     }
     
+    if (message.action === 'enroll') {
+        enrollDevice(message.apiUrl, message.code).then(async (result) => {
+            if (!result) {
+                sendResponse({ success: false });
+                return;
+            }
+            const config = await getConfig();
+            config.apiUrl = message.apiUrl;
+            config.token = result.token;
+            await setConfig(config);
+            setupUninstallUrl();
+            connectWebSocket();
+            await fetchPatterns();
+            sendResponse({ success: true, deviceName: result.device_name });
+        });
+        return true;
+    }
+    
     if (message.action === 'getPatterns') {
         getPatterns().then(sendResponse);
         return true;
@@ -454,6 +1141,20 @@ chrome.runtime.onMessage.addListener((message, sender, sendResponse) => {
     }
 });
 
+// Tell the currently configured server before its settings are replaced
+async function reportConfigChange(newConfig) {
+    const config = await getConfig();
+    const apiUrlChanged = config.apiUrl !== newConfig.apiUrl;
+    const tokenChanged = config.token !== newConfig.token;
+    
+    if (config.token && (apiUrlChanged || tokenChanged)) {
+        await reportEvent('config_changed', {
+            api_url_changed: apiUrlChanged,
+            token_changed: tokenChanged
+        }, config);
+    }
+}
+
 // ========================================
 // Periodic Sync & Heartbeat
 // ========================================
@@ -461,7 +1162,8 @@ chrome.runtime.onMessage.addListener((message, sender, sendResponse) => {
 async function periodicSync() {
     const config = await getConfig();
     if (config.token) {
-        await fetchPatterns();
+        // A modified or expiring policy is downloaded in full
+        await fetchPatterns(!await checkPolicyIntegrity());
     }
 }
 
@@ -486,6 +1188,8 @@ chrome.alarms.onAlarm.addListener((alarm) => {
     }
     if (alarm.name === 'heartbeat') {
         periodicHeartbeat();
+        markAlive();
+        checkIncognitoAccess();
     }
     if (alarm.name === 'wsReconnect') {
         ensureWebSocketConnected();
@@ -495,6 +1199,7 @@ chrome.alarms.onAlarm.addListener((alarm) => {
 // Initial sync and WebSocket on startup
 chrome.runtime.onStartup.addListener(() => {
     console.log('Watchtower: Extension startup');
+    startedNormally = true;
     setupUninstallUrl();
     connectWebSocket(); // WebSocket handles patterns sync and heartbeat
     periodicSync(); // Fallback sync
@@ -503,8 +1208,12 @@ chrome.runtime.onStartup.addListener(() => {
 // Sync when extension is installed or updated
 chrome.runtime.onInstalled.addListener(() => {
     console.log('Watchtower: Extension installed/updated');
+    startedNormally = true;
     setupUninstallUrl();
     connectWebSocket(); // WebSocket handles patterns sync and heartbeat
     periodicSync(); // Fallback sync
 });
 
+// onStartup and onInstalled are dispatched right after the worker loads, so
+// give them a moment before deciding whether this start was a re-enable
+setTimeout(checkReenabled, 1000);
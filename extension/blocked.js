@@ -13,6 +13,12 @@ function getBlockedUrl() {
     return params.get('url') || '';
 }
 
+// Set when an admin locked the browser; ISO time the lock ends
+function getLockedUntil() {
+    const params = new URLSearchParams(window.location.search);
+    return params.get('locked_until');
+}
+
 function extractDomain(url) {
     try {
         const parsed = new URL(url);
@@ -121,6 +127,14 @@ document.addEventListener('DOMContentLoaded', () => {
     // Suggest pattern
     $('#pattern').value = extractDomain(blockedUrl);
 
+    // A locked browser can't request access
+    const lockedUntil = getLockedUntil();
+    if (lockedUntil) {
+        const until = new Date(lockedUntil).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+        $('#subtitle').textContent = `Browsing is locked by your administrator until ${until}`;
+        $('#request-form').classList.add('hidden');
+    }
+
     // Event listeners
     $('#request-form').addEventListener('submit', submitRequest);
     $('#go-back-btn').addEventListener('click', goBack);
@@ -4,6 +4,8 @@
 
 const $ = (selector) => document.querySelector(selector);
 
+const ENROLLMENT_CODE_RE = /^[A-Za-z0-9]{4}-?[A-Za-z0-9]{4}$/;
+
 // ========================================
 // Message Handling
 // ========================================
@@ -49,6 +51,15 @@ async function updateUI() {
         lastSync.textContent = 'Never';
     }
 
+    // Browsing is restricted until the extension is updated
+    if (config.upgradeRequired) {
+        const minVersion = typeof config.upgradeRequired === 'string' ? ` to ${config.upgradeRequired}+` : '';
+        $('#upgrade-status').textContent = `Update${minVersion}`;
+        $('#upgrade-row').classList.remove('hidden');
+    } else {
+        $('#upgrade-row').classList.add('hidden');
+    }
+
     // Update admin link
     $('#admin-link').href = (config.apiUrl || 'http://localhost:8080') + '/admin/';
 
@@ -106,6 +117,12 @@ async function saveConfig() {
         return;
     }
 
+    // Short codes like "ABCD-EFGH" are enrollment codes, not tokens
+    if (ENROLLMENT_CODE_RE.test(token)) {
+        await enroll(apiUrl, token);
+        return;
+    }
+
     try {
         const result = await sendMessage({
             action: 'setConfig',
@@ -123,6 +140,21 @@ async function saveConfig() {
     }
 }
 
+async function enroll(apiUrl, code) {
+    try {
+        const result = await sendMessage({ action: 'enroll', apiUrl, code });
+
+        if (result.success) {
+            showMessage(`Enrolled as "${result.deviceName}"`);
+            updateUI();
+        } else {
+            showMessage('Invalid or expired enrollment code', 'error');
+        }
+    } catch (error) {
+        showMessage('Error enrolling device', 'error');
+    }
+}
+
 async function syncPatterns() {
     try {
         const result = await sendMessage({ action: 'syncPatterns' });